@@ -3,17 +3,23 @@ package bonito
 import (
 	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"log/slog"
 	"net/url"
 	"os"
-	"os/user"
+	osuser "os/user"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
 	"github.com/diamondburned/nix-bonito/bonito/internal/nixutil"
+	"github.com/diamondburned/nix-bonito/bonito/internal/retry"
+	"github.com/diamondburned/nix-bonito/bonito/internal/trace"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
 )
 
 // WithVerbose enables verbose mode for all invokations that use the returned
@@ -23,6 +29,76 @@ func WithVerbose(ctx context.Context) context.Context {
 	return ctx
 }
 
+// WithRetries makes all network requests using the returned context be
+// retried up to the given number of times if they fail because of network
+// errors, with an exponential backoff starting at one second.
+func WithRetries(ctx context.Context, retries int) context.Context {
+	policy := retry.PolicyFromContext(ctx)
+	policy.Retries = max(retries, 0)
+	return retry.WithPolicy(ctx, policy)
+}
+
+// DefaultParallelism is the number of inputs that are resolved at the same
+// time unless WithParallelism says otherwise.
+const DefaultParallelism = 8
+
+type parallelismCtxKey struct{}
+
+// WithParallelism makes resolving inputs using the returned context resolve at
+// most n inputs at the same time. n is at least 1.
+func WithParallelism(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, parallelismCtxKey{}, max(n, 1))
+}
+
+func parallelism(ctx context.Context) int {
+	n, ok := ctx.Value(parallelismCtxKey{}).(int)
+	if !ok {
+		return DefaultParallelism
+	}
+	return n
+}
+
+// TraceStep is a single step taken to resolve a channel input.
+type TraceStep = trace.Step
+
+// ResolutionTrace describes how a channel input was resolved, step by step.
+type ResolutionTrace struct {
+	Input ChannelInput `json:"input"`
+	Steps []TraceStep  `json:"steps"`
+	// Error is the error that resolving the input failed with, if any.
+	Error string `json:"error,omitempty"`
+}
+
+type resolutionTraceCtxKey struct{}
+
+// WithResolutionTrace makes resolving inputs using the returned context call
+// fn with the trace of every resolved input. fn is never called concurrently.
+func WithResolutionTrace(ctx context.Context, fn func(ResolutionTrace)) context.Context {
+	return context.WithValue(ctx, resolutionTraceCtxKey{}, fn)
+}
+
+func resolutionTraceFunc(ctx context.Context) func(ResolutionTrace) {
+	fn, _ := ctx.Value(resolutionTraceCtxKey{}).(func(ResolutionTrace))
+	return fn
+}
+
+// CommandRunner runs an external command to completion. The command's output
+// streams are already set up by the time it is called.
+type CommandRunner = executil.Runner
+
+// WithCommandRunner makes all external commands invoked using the returned
+// context go through the given runner. It is mostly useful for testing.
+func WithCommandRunner(ctx context.Context, runner CommandRunner) context.Context {
+	return executil.WithRunner(ctx, runner)
+}
+
+// SetStoreDir makes bonito use the given directory as the Nix store instead of
+// asking Nix for it. It returns a function that restores the previous store
+// directory. It is mostly useful for testing.
+func SetStoreDir(dir string) (restore func()) {
+	return nixutil.SetStoreDir(dir)
+}
+
 // ChannelURL is the URL to the source of a channel.
 type ChannelURL string
 
@@ -42,11 +118,30 @@ func (u ChannelURL) Validate() error {
 	}
 
 	// TODO: VCS scheme validation
-	_, err := u.Parse()
+	url, err := u.Parse()
 	if err != nil {
 		return err
 	}
 
+	switch url.Scheme {
+	case "hg+http", "hg+https":
+		if url.Host == "" || strings.Trim(url.Path, "/") == "" {
+			return fmt.Errorf("hg url %q must have a host and a repository path", u)
+		}
+	case "git+ssh":
+		if url.Host == "" || strings.Trim(url.Path, "/") == "" {
+			return fmt.Errorf("git+ssh url %q must have a host and a repository path", u)
+		}
+	case "exec":
+		if _, err := execResolverPath(u); err != nil {
+			return err
+		}
+	case "file":
+		if !filepath.IsAbs(url.Path) {
+			return fmt.Errorf("local path %q must be absolute", url.Path)
+		}
+	}
+
 	return nil
 }
 
@@ -61,21 +156,412 @@ type State struct {
 	Lock   LockFile
 }
 
-// Apply applies the state onto the current system.
+// Apply applies the state onto the current system. With WithLockOnly or
+// Config.Global.SkipUserChannels, only the lock is updated.
 func (s *State) Apply(ctx context.Context) error {
+	ctx = s.withSettings(ctx)
+
 	if err := s.applyGlobal(ctx, noUpdate); err != nil {
 		return errors.Wrap(err, "cannot apply global channels")
 	}
 
+	s.SyncLockNames()
+
+	if isLockOnly(ctx) || s.Config.Global.SkipUserChannels {
+		slog.Debug("not applying channels to users, only locking them")
+		return nil
+	}
+
+	return s.applyUsers(ctx)
+}
+
+// ApplyUsers applies the locked channels onto the configured users without
+// resolving or fetching anything for the lock, which must already have a
+// store hash for every channel. It is the last step of Apply.
+func (s *State) ApplyUsers(ctx context.Context) error {
+	ctx = s.withSettings(ctx)
+
+	for input := range s.Config.ChannelInputs() {
+		if !input.CanResolve() {
+			continue
+		}
+		if lock, ok := s.Lock.Channels[input]; !ok || lock.StoreHash == "" {
+			return fmt.Errorf("input %q is not locked yet, perhaps run bonito lock first", input)
+		}
+	}
+
+	return s.applyUsers(ctx)
+}
+
+func (s *State) applyUsers(ctx context.Context) error {
+	if isTransactional(ctx) && dryRunPlan(ctx) == nil {
+		return s.applyUsersTransactionally(ctx)
+	}
+
+	// Dry runs only list the channels, and the plan isn't safe to add to
+	// concurrently. Password prompts of concurrent sudo commands would
+	// interleave on the terminal.
+	if isSequential(ctx) || dryRunPlan(ctx) != nil || s.mayPromptForSudo() {
+		usernames := make([]string, 0, len(s.Config.Users))
+		for username := range s.Config.Users {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+
+		for _, username := range usernames {
+			if err := s.applyUser(ctx, username, s.Config.Users[username]); err != nil {
+				return errors.Wrapf(err, "cannot apply for user %q", username)
+			}
+		}
+		return nil
+	}
+
+	// Each user has their own channels, and the lock is only read from here
+	// on, so the users are applied concurrently.
+	if confirm := confirmRemovalFunc(ctx); confirm != nil {
+		var mu sync.Mutex
+		ctx = WithRemovalConfirmation(ctx, func(username string, names []string) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return confirm(username, names)
+		})
+	}
+
+	// A failing user must not cancel the others, since a user whose update
+	// is killed halfway cannot be rolled back either. Every failure is
+	// reported.
+	var mu sync.Mutex
+	userErrs := make(map[Username]error)
+
+	var errg errgroup.Group
+	errg.SetLimit(parallelism(ctx))
+
 	for username, usercfg := range s.Config.Users {
-		if err := s.applyUser(ctx, username, usercfg); err != nil {
+		errg.Go(func() error {
+			if err := s.applyUser(ctx, username, usercfg); err != nil {
+				mu.Lock()
+				userErrs[username] = errors.Wrapf(err, "cannot apply for user %q", username)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+
+	errg.Wait()
+
+	usernames := make([]string, 0, len(userErrs))
+	for username := range userErrs {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	errs := make([]error, len(usernames))
+	for i, username := range usernames {
+		errs[i] = userErrs[username]
+	}
+
+	return stderrors.Join(errs...)
+}
+
+// mayPromptForSudo returns true if applying the users may run sudo, which
+// prompts for a password unless bonito runs as root.
+func (s *State) mayPromptForSudo() bool {
+	if executil.CurrentUserIs("root") {
+		return false
+	}
+
+	for username, usercfg := range s.Config.Users {
+		// Commands of the current user never run through sudo.
+		if executil.CurrentUserIs(username) {
+			continue
+		}
+		if usercfg.UseSudo || len(usercfg.Sudo) > 0 || len(s.Config.Global.Sudo) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// appliedUser is a user whose channels were applied, along with the channels
+// they had before.
+type appliedUser struct {
+	username Username
+	usercfg  UserConfig
+	oldList  map[string]string
+}
+
+// applyUsersTransactionally applies the users in the order of their names. If
+// any user fails, every user applied before them has their old channels
+// restored.
+func (s *State) applyUsersTransactionally(ctx context.Context) error {
+	usernames := make([]string, 0, len(s.Config.Users))
+	for username := range s.Config.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var applied []appliedUser
+
+	for _, username := range usernames {
+		usercfg := s.Config.Users[username]
+
+		oldList, err := userChannels(ctx, username, usercfg).list()
+		if err != nil {
+			err = errors.Wrap(err, "cannot get current channels list")
+		} else {
+			err = s.applyUser(ctx, username, usercfg)
+		}
+		if err != nil {
+			// applyUser has already rolled back this user, so only the users
+			// before them are left.
+			for i := len(applied) - 1; i >= 0; i-- {
+				if err := applied[i].restore(ctx); err != nil {
+					slog.Error(
+						"cannot restore channels",
+						"user", applied[i].username,
+						"err", err)
+				}
+			}
 			return errors.Wrapf(err, "cannot apply for user %q", username)
 		}
+
+		applied = append(applied, appliedUser{username, usercfg, oldList})
+	}
+
+	return nil
+}
+
+// restore makes the user's channels match the ones they had before.
+func (u appliedUser) restore(ctx context.Context) error {
+	slog.Info("restoring channels", "user", u.username)
+
+	channels := userChannels(ctx, u.username, u.usercfg)
+
+	list, err := channels.list()
+	if err != nil {
+		return errors.Wrap(err, "cannot get current channels list")
+	}
+
+	for name, url := range list {
+		if oldURL, ok := u.oldList[name]; ok && oldURL == url {
+			continue
+		}
+		if err := channels.remove(name); err != nil {
+			return errors.Wrapf(err, "cannot remove channel %q", name)
+		}
+	}
+
+	names := make([]string, 0, len(u.oldList))
+	for name := range u.oldList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var readded []string
+	for _, name := range names {
+		if list[name] == u.oldList[name] {
+			continue
+		}
+		if _, err := channels.add(name, u.oldList[name]); err != nil {
+			return errors.Wrapf(err, "cannot add channel %q", name)
+		}
+		readded = append(readded, name)
+	}
+
+	if len(readded) == 0 {
+		return nil
+	}
+
+	return channels.update(readded...)
+}
+
+// Resolve resolves the inputs to their latest versions and records them into
+// the lock without fetching them, so inputs whose URLs changed have no store
+// hash until UpdateLocks is called. It returns the inputs whose URLs changed.
+func (s *State) Resolve(ctx context.Context) ([]ChannelChange, error) {
+	ctx = s.withSettings(ctx)
+
+	resolvedInputs, err := s.resolveInputs(ctx, s.Config.ChannelInputs())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot resolve input URLs")
+	}
+
+	if s.Lock.Channels == nil {
+		s.Lock.Channels = make(map[ChannelInput]ChannelLock, len(resolvedInputs))
+	}
+
+	changes := s.lockResolved(resolvedInputs)
+	s.Lock.recordNames(s.Config.ChannelNames())
+
+	return changes, nil
+}
+
+// lockResolved records the resolved inputs whose URLs differ from the lock
+// into the lock. We can't know their store hashes without fetching them, so
+// those are left empty. It returns the recorded changes.
+func (s *State) lockResolved(resolvedInputs map[ChannelInput]ResolvedInput) []ChannelChange {
+	var changes []ChannelChange
+	for input, resolved := range resolvedInputs {
+		oldLock, ok := s.Lock.Channels[input]
+		if ok && oldLock.resolved().URL == resolved.URL {
+			continue
+		}
+
+		changes = append(changes, ChannelChange{
+			Action: ChangeLock,
+			Name:   input.String(),
+			OldURL: oldLock.URL,
+			NewURL: resolved.URL,
+		})
+
+		s.Lock.Channels[input] = newChannelLock(resolved, nixutil.StorePath{}, "")
+	}
+	return changes
+}
+
+// SyncLockNames records the names that each input is configured under into
+// the lock. Inputs that are no longer configured lose their names, so that
+// they aren't applied by ApplyLock anymore.
+func (s *State) SyncLockNames() {
+	names := s.Config.ChannelNames()
+	for input := range s.Lock.Channels {
+		if _, ok := names[input]; !ok {
+			names[input] = nil
+		}
+	}
+	s.Lock.recordNames(names)
+}
+
+// ApplyLock applies the channels in the lock file for the preferred user
+// without resolving anything from the config. The channels are added under the
+// names recorded in the lock, so the lock must have been written by Apply. If
+// the config has no users, the current user is used.
+func (s *State) ApplyLock(ctx context.Context) error {
+	ctx = s.withSettings(ctx)
+
+	channelInputs, err := s.Lock.namedChannels()
+	if err != nil {
+		return errors.Wrap(err, "invalid lock file")
+	}
+
+	if len(channelInputs) == 0 {
+		return errors.New("lock file has no named channels, perhaps run bonito with a config first")
+	}
+
+	var user preferredUser
+	if len(s.Config.Users) > 0 {
+		user, err = s.preferredUser()
+		if err != nil {
+			return errors.Wrap(err, "cannot get preferred user")
+		}
+	} else {
+		u, err := osuser.Current()
+		if err != nil {
+			return errors.Wrap(err, "cannot get current user")
+		}
+		user = preferredUser{Username: u.Username}
+	}
+
+	if isPreflight(ctx) {
+		if err := user.check(ctx); err != nil {
+			return err
+		}
+	}
+
+	usercfg := UserConfig{UseSudo: user.UseSudo}
+	if err := s.applyUserChannels(ctx, user.Username, usercfg, channelInputs); err != nil {
+		return errors.Wrapf(err, "cannot apply for user %q", user.Username)
 	}
 
 	return nil
 }
 
+type preflightCtxKey struct{}
+
+// WithPreflight makes bonito using the returned context check that the
+// preferred user exists on the system and that commands can be run as them
+// before touching any channel.
+func WithPreflight(ctx context.Context) context.Context {
+	return context.WithValue(ctx, preflightCtxKey{}, true)
+}
+
+func isPreflight(ctx context.Context) bool {
+	preflight, _ := ctx.Value(preflightCtxKey{}).(bool)
+	return preflight
+}
+
+type transactionalCtxKey struct{}
+
+// WithTransactional makes Apply using the returned context apply the users'
+// channels all or nothing: if any user fails, every user applied before them
+// has their old channels restored.
+func WithTransactional(ctx context.Context) context.Context {
+	return context.WithValue(ctx, transactionalCtxKey{}, true)
+}
+
+func isTransactional(ctx context.Context) bool {
+	transactional, _ := ctx.Value(transactionalCtxKey{}).(bool)
+	return transactional
+}
+
+type confirmRemovalCtxKey struct{}
+
+// WithRemovalConfirmation makes Apply using the returned context call confirm
+// with the sorted names of the channels that override-channels would remove
+// for the user before removing any of them. If confirm returns false, the
+// channels are kept and only the configured channels are applied.
+func WithRemovalConfirmation(ctx context.Context, confirm func(username string, names []string) bool) context.Context {
+	return context.WithValue(ctx, confirmRemovalCtxKey{}, confirm)
+}
+
+func confirmRemovalFunc(ctx context.Context) func(username string, names []string) bool {
+	fn, _ := ctx.Value(confirmRemovalCtxKey{}).(func(string, []string) bool)
+	return fn
+}
+
+type sequentialCtxKey struct{}
+
+// WithSequential makes Apply using the returned context apply one user at a
+// time instead of all of them concurrently, e.g. so that sudo prompts for
+// different users don't interleave.
+func WithSequential(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sequentialCtxKey{}, true)
+}
+
+func isSequential(ctx context.Context) bool {
+	sequential, _ := ctx.Value(sequentialCtxKey{}).(bool)
+	return sequential
+}
+
+type lockOnlyCtxKey struct{}
+
+// WithLockOnly makes Apply using the returned context only lock the channels
+// without adding them to the users' channels, like
+// Config.Global.SkipUserChannels.
+func WithLockOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lockOnlyCtxKey{}, true)
+}
+
+func isLockOnly(ctx context.Context) bool {
+	lockOnly, _ := ctx.Value(lockOnlyCtxKey{}).(bool)
+	return lockOnly
+}
+
+type strictHashCtxKey struct{}
+
+// WithStrictHash makes Apply using the returned context fail if any channel
+// resolves to a store hash that isn't already in the lock, including channels
+// that weren't locked at all. UpdateLocks and Update are not affected.
+func WithStrictHash(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strictHashCtxKey{}, true)
+}
+
+func isStrictHash(ctx context.Context) bool {
+	strict, _ := ctx.Value(strictHashCtxKey{}).(bool)
+	return strict
+}
+
 type updateFlag int
 
 const (
@@ -95,58 +581,91 @@ func (s *State) applyGlobal(ctx context.Context, update updateFlag) error {
 		s.Lock.Channels = make(map[ChannelInput]ChannelLock, len(channelInputs))
 	}
 
-	user, err := s.preferredUser()
+	groups, err := s.inputUserGroups(ctx, channelInputs)
 	if err != nil {
-		return errors.Wrap(err, "cannot get preferred user")
+		return err
 	}
 
-	ctx = executil.WithOpts(ctx, executil.Opts{
-		Username: user.Username,
-		UseSudo:  user.UseSudo,
-	})
+	resolvedInputs := make(map[ChannelInput]ResolvedInput, len(channelInputs))
+	for _, group := range groups {
+		ctx := group.context(ctx)
 
-	// Remove all existing temporary channels. These aren't used anywhere else,
-	// so we can just remove them before we add the new ones.
-	if err := removeTmpChannels(ctx); err != nil {
-		return errors.Wrap(err, "cannot remove existing temporary channels")
-	}
+		// Fully resolve the inputs if we're updating. Otherwise, we'll just
+		// use the locked ones.
+		if update.is(updateInputs) {
+			newResolvedInputs, err := s.resolveInputs(ctx, group.inputs)
+			if err != nil {
+				return errors.Wrap(err, "cannot resolve input URLs")
+			}
 
-	var inputURLs map[ChannelInput]string
-	// Fully resolve the inputs if we're updating. Otherwise, we'll just use
-	// the locked ones.
-	if update.is(updateInputs) {
-		inputURLs, err = resolveInputs(ctx, channelInputs)
-		if err != nil {
-			return errors.Wrap(err, "cannot resolve input URLs")
+			for input, resolved := range newResolvedInputs {
+				resolvedInputs[input] = resolved
+			}
+			continue
 		}
-	} else {
-		inputURLs = make(map[ChannelInput]string, len(channelInputs))
 
 		// Ensure that channelInputs doesn't have any missing locks.
 		// If it does, we'll need to update them.
-		missingInputs := make(map[ChannelInput]struct{}, len(channelInputs))
-		for input := range channelInputs {
+		missingInputs := make(map[ChannelInput]struct{}, len(group.inputs))
+		for input := range group.inputs {
 			lock, ok := s.Lock.Channels[input]
 			if ok {
-				inputURLs[input] = lock.URL
+				resolvedInputs[input] = lock.resolved()
 			} else {
 				missingInputs[input] = struct{}{}
 			}
 		}
 
-		newInputURLs, err := resolveInputs(ctx, missingInputs)
+		newResolvedInputs, err := s.resolveInputs(ctx, missingInputs)
 		if err != nil {
 			return errors.Wrap(err, "cannot resolve missing input URLs")
 		}
 
-		for input, url := range newInputURLs {
-			inputURLs[input] = url
+		for input, resolved := range newResolvedInputs {
+			resolvedInputs[input] = resolved
 		}
 	}
 
-	locks, err := resolveChannelLocks(ctx, inputURLs)
-	if err != nil {
-		return errors.Wrap(err, "cannot resolve channel locks")
+	if plan := dryRunPlan(ctx); plan != nil {
+		for _, change := range s.lockResolved(resolvedInputs) {
+			plan.add(change)
+		}
+		return nil
+	}
+
+	// Only URLs that were never fetched count towards the download size.
+	var newURLs []string
+	for input, resolved := range resolvedInputs {
+		if lock, ok := s.Lock.Channels[input]; !ok || lock.resolved().URL != resolved.URL || lock.StoreHash == "" {
+			newURLs = append(newURLs, resolved.URL)
+		}
+	}
+
+	if err := s.checkDownloadSize(ctx, newURLs); err != nil {
+		return err
+	}
+
+	locks := make(map[ChannelInput]ChannelLock, len(resolvedInputs))
+	for _, group := range groups {
+		ctx := group.context(ctx)
+
+		groupResolved := make(map[ChannelInput]ResolvedInput, len(group.inputs))
+		for input := range group.inputs {
+			groupResolved[input] = resolvedInputs[input]
+		}
+
+		groupLocks, err := resolveChannelLocks(ctx, groupResolved)
+		if err != nil {
+			return errors.Wrapf(err, "cannot resolve channel locks as user %q", group.user.Username)
+		}
+
+		if err := s.patchLocks(ctx, groupLocks); err != nil {
+			return errors.Wrap(err, "cannot patch channels")
+		}
+
+		for input, lock := range groupLocks {
+			locks[input] = lock
+		}
 	}
 
 	for input, lock := range locks {
@@ -155,99 +674,406 @@ func (s *State) applyGlobal(ctx context.Context, update updateFlag) error {
 		oldLock, ok := s.Lock.Channels[input]
 		if ok && input.CanResolve() && oldLock.HashChanged(lock) {
 			if !update.is(updateLocks) {
-				return fmt.Errorf("channel %q has a different store hash (try --update-locks)", input)
+				return fmt.Errorf("channel %q has different contents than locked (try --update-locks)", input)
 			}
 			slog.Info(
-				"updating channel input with changed hash",
+				"updating channel input with changed contents",
 				"input", input,
+				"old_nar_hash", oldLock.NarHash(),
+				"new_nar_hash", lock.NarHash(),
 				"old", oldLock.StoreHash,
 				"new", lock.StoreHash)
 		}
+		if !update.is(updateLocks) && isStrictHash(ctx) && (!ok || oldLock.StoreHash != lock.StoreHash) {
+			return fmt.Errorf(
+				"channel %q resolved to store hash %q, which is not in the lock (try --update-locks)",
+				input, lock.StoreHash)
+		}
+		if fn := updateReasonFunc(ctx); fn != nil && update.is(updateLocks) {
+			fn(input, classifyUpdate(input, resolvedInputs[input], oldLock, ok, lock))
+		}
+		if ok && !oldLock.FetchedAt.IsZero() && oldLock.URL == lock.URL && !oldLock.HashChanged(lock) {
+			// The contents didn't change, so keep when they were fetched.
+			lock.FetchedAt = oldLock.FetchedAt
+		}
 		s.Lock.Channels[input] = lock
 	}
 
+	s.Lock.recordNames(s.Config.ChannelNames())
 	return nil
 }
 
-func (s *State) applyUser(ctx context.Context, username string, usercfg UserConfig) error {
-	ctx = executil.WithOpts(ctx, executil.Opts{
-		Username: username,
-		UseSudo:  usercfg.UseSudo,
+// inputUserGroup is a group of channel inputs that are fetched as the same
+// user.
+type inputUserGroup struct {
+	user   preferredUser
+	inputs map[ChannelInput]struct{}
+}
+
+// context returns ctx with the options to run commands as the group's user.
+func (g inputUserGroup) context(ctx context.Context) context.Context {
+	return executil.WithOpts(ctx, executil.Opts{
+		Username: g.user.Username,
+		UseSudo:  g.user.UseSudo,
 	})
+}
 
-	channels := newChannelExecer(ctx, false)
+// inputUserGroups groups the given inputs by the users that fetch them: the
+// users in Config.Global.ChannelUsers, or the preferred user otherwise. The
+// groups are sorted by username.
+func (s *State) inputUserGroups(ctx context.Context, inputs map[ChannelInput]struct{}) ([]inputUserGroup, error) {
+	inputUsers, err := s.Config.inputUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultUser *preferredUser
+
+	groups := make(map[string]*inputUserGroup)
+	for input := range inputs {
+		var user preferredUser
+		if username, ok := inputUsers[input]; ok {
+			user = preferredUser{username, s.Config.Users[username].UseSudo}
+		} else {
+			if defaultUser == nil {
+				u, err := s.checkedPreferredUser(ctx)
+				if err != nil {
+					return nil, errors.Wrap(err, "cannot get preferred user")
+				}
+				defaultUser = &u
+			}
+			user = *defaultUser
+		}
+
+		group, ok := groups[user.Username]
+		if !ok {
+			if isPreflight(ctx) && inputUsers[input] != "" {
+				if err := user.check(ctx); err != nil {
+					return nil, err
+				}
+			}
+			group = &inputUserGroup{user: user, inputs: make(map[ChannelInput]struct{})}
+			groups[user.Username] = group
+		}
+		group.inputs[input] = struct{}{}
+	}
+
+	sorted := make([]inputUserGroup, 0, len(groups))
+	for _, group := range groups {
+		sorted = append(sorted, *group)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].user.Username < sorted[j].user.Username
+	})
+
+	return sorted, nil
+}
+
+// resolveInputs resolves the given inputs and rewrites the resolved URLs to
+// use the configured mirrors.
+func (s *State) resolveInputs(ctx context.Context, inputs map[ChannelInput]struct{}) (map[ChannelInput]ResolvedInput, error) {
+	resolvedInputs, err := resolveInputs(ctx, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	for input, resolved := range resolvedInputs {
+		mirrorURL := s.Config.MirrorURL(resolved.URL)
+		if mirrorURL == resolved.URL {
+			continue
+		}
+
+		slog.Debug(
+			"using mirror for input",
+			"input", input,
+			"url", resolved.URL,
+			"mirror", mirrorURL)
+
+		resolved.OriginalURL = resolved.URL
+		resolved.URL = mirrorURL
+		resolvedInputs[input] = resolved
+	}
+
+	return resolvedInputs, nil
+}
+
+func (s *State) applyUser(ctx context.Context, username string, usercfg UserConfig) error {
+	channelInputs, err := s.Config.combineChannelRegistries(
+		s.Config.Global.ChannelRegistry,
+		usercfg.ChannelRegistry,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get channels for user %q", username)
+	}
+
+	return s.applyUserChannels(ctx, username, usercfg, channelInputs)
+}
+
+// applyUserChannels makes the user's channels match the given channels using
+// their locks.
+func (s *State) applyUserChannels(ctx context.Context, username string, usercfg UserConfig, channelInputs map[string]ChannelInput) error {
+	channels := userChannels(ctx, username, usercfg)
+
+	// nix-channel --update downloads the archives again.
+	netrcCtx, cleanup, err := withNetrc(channels.ctx)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	channels = channels.withContext(netrcCtx)
+
+	// plain adds and updates the channels that are not in Sudo. Listing,
+	// removing and reading channels involves the channels in Sudo too, so
+	// those use sudo if any channel needs it.
+	plain := channels
+	sudo := s.Config.sudoChannels(usercfg, channelInputs)
+	if len(sudo) > 0 {
+		channels = channels.withSudo()
+	}
+	ctx = channels.ctx
 
 	oldList, err := channels.list()
 	if err != nil {
 		return errors.Wrap(err, "cannot get current channels list")
 	}
 
+	if plan := dryRunPlan(ctx); plan != nil {
+		return s.planUser(plan, username, usercfg, oldList, channelInputs)
+	}
+
+	// Channels are added in the order of their names, so that the order of
+	// the changes is the same on every run.
+	names := make([]string, 0, len(channelInputs))
+	for name, input := range channelInputs {
+		if _, ok := s.Lock.Channels[input]; !ok && input.CanResolve() {
+			return fmt.Errorf("channel %q has no lock", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var added []string
+
 	rollback := func() {
-		// Undo all our channels.
-		for name := range usercfg.Channels {
-			channels.remove(name)
+		// Undo our channels, newest first.
+		for i := len(added) - 1; i >= 0; i-- {
+			channels.remove(added[i])
 		}
 		// Re-add the old ones.
-		for name, url := range oldList {
-			channels.add(name, url)
+		oldNames := make([]string, 0, len(oldList))
+		for name := range oldList {
+			oldNames = append(oldNames, name)
+		}
+		sort.Strings(oldNames)
+		for _, name := range oldNames {
+			channels.add(name, oldList[name])
 		}
 	}
 
 	if usercfg.OverrideChannels {
 		// Remove old channels first. Nix might add some extra channels, and we
-		// want to keep those.
+		// want to keep those if they're allowed by keep-channels.
+		var removed []string
 		for name := range oldList {
 			_, ok := usercfg.Channels[name]
-			if ok {
+			if ok || usercfg.keepsChannel(name) {
 				continue
 			}
+			removed = append(removed, name)
+		}
+		sort.Strings(removed)
+
+		if confirm := confirmRemovalFunc(ctx); len(removed) > 0 && confirm != nil && !confirm(username, removed) {
+			slog.Warn(
+				"not removing channels without confirmation",
+				"user", username,
+				"channels", removed)
+			removed = nil
+		}
 
+		for _, name := range removed {
 			if err := channels.remove(name); err != nil {
 				rollback()
-				return errors.Wrap(err, "cannot remove channel %q for overriding")
+				return errors.Wrapf(err, "cannot remove channel %q for overriding", name)
 			}
 		}
-	}
+	} else {
+		for _, name := range s.renamedChannels(oldList, channelInputs) {
+			slog.Info(
+				"removing renamed channel",
+				"user", username,
+				"channel", name)
 
-	channelInputs, err := CombineChannelRegistries([]ChannelRegistry{
-		s.Config.Global.ChannelRegistry,
-		usercfg.ChannelRegistry,
-	})
-	if err != nil {
-		return errors.Wrapf(err, "cannot get channels for user %q", username)
+			if err := channels.remove(name); err != nil {
+				rollback()
+				return errors.Wrapf(err, "cannot remove renamed channel %q", name)
+			}
+		}
 	}
 
-	names := make([]string, 0, len(channelInputs))
+	// nix-channel rewrites the whole channels file for every add, so adds
+	// cannot be done in parallel. Updating is done in one batch instead.
+	for _, name := range names {
+		lock := s.Lock.Channels[channelInputs[name]]
 
-	for name, input := range channelInputs {
-		lock, ok := s.Lock.Channels[input]
-		if !ok && input.CanResolve() {
-			return fmt.Errorf("channel %q has no lock", name)
+		execer := plain
+		if sudo[name] {
+			execer = channels
 		}
 
-		_, err := channels.add(name, lock.URL)
+		_, err := execer.add(name, lock.URL)
 		if err != nil {
 			rollback()
 			return errors.Wrapf(err, "cannot add channel %q", name)
 		}
 
-		names = append(names, name)
-		// TODO: validate hash
+		added = append(added, name)
 	}
 
 	if usercfg.OverrideChannels {
 		err = channels.update()
 	} else {
-		err = channels.update(names...)
+		err = updateChannels(plain, channels, names, sudo)
 	}
 	if err != nil {
 		rollback()
 		return errors.Wrap(err, "cannot update")
 	}
 
+	errg, errgctx := errgroup.WithContext(ctx)
+	errg.SetLimit(parallelism(ctx))
+
+	for _, name := range names {
+		lock := s.Lock.Channels[channelInputs[name]]
+		errg.Go(func() error {
+			return verifyChannelHash(errgctx, name, lock)
+		})
+	}
+
+	if err := errg.Wait(); err != nil {
+		rollback()
+		return err
+	}
+
 	return nil
 }
 
+// updateChannels updates the named channels, using the sudo execer for the
+// channels in sudo and the plain one for the rest.
+func updateChannels(plain, sudoer *channelExecer, names []string, sudo map[string]bool) error {
+	if len(names) == 0 {
+		return plain.update()
+	}
+
+	var plainNames, sudoNames []string
+	for _, name := range names {
+		if sudo[name] {
+			sudoNames = append(sudoNames, name)
+		} else {
+			plainNames = append(plainNames, name)
+		}
+	}
+
+	// Updating no names updates every channel, so skip empty batches.
+	if len(plainNames) > 0 {
+		if err := plain.update(plainNames...); err != nil {
+			return err
+		}
+	}
+	if len(sudoNames) > 0 {
+		if err := sudoer.update(sudoNames...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyChannelHash verifies that the sources of the channel with the given
+// name that Nix fetched have the locked NAR hash. The store hash can't be
+// compared, since nix-channel names the store path after the channel, which
+// isn't the name of the temporary channel that locked it. Locks without a NAR
+// hash are not verified.
+func verifyChannelHash(ctx context.Context, name string, lock ChannelLock) error {
+	if lock.NarHash() == "" {
+		return nil
+	}
+
+	src, err := nixutil.ChannelSourcePath(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get source path for channel %q", name)
+	}
+
+	narHash, err := nixutil.NarHash(ctx, src)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get NAR hash of channel %q", name)
+	}
+
+	if narHash != lock.NarHash() {
+		return fmt.Errorf(
+			"channel %q has NAR hash %q instead of the locked %q (try --update-locks)",
+			name, narHash, lock.NarHash())
+	}
+
+	return nil
+}
+
+// planUser records the changes that applyUser would make into the plan.
+func (s *State) planUser(plan *Plan, username string, usercfg UserConfig, oldList map[string]string, channelInputs map[string]ChannelInput) error {
+	for name, input := range channelInputs {
+		lock, ok := s.Lock.Channels[input]
+		if !ok && input.CanResolve() {
+			return fmt.Errorf("channel %q has no lock", name)
+		}
+
+		oldURL, ok := oldList[name]
+		switch {
+		case !ok:
+			plan.add(ChannelChange{Action: ChangeAdd, User: username, Name: name, NewURL: lock.URL})
+		case oldURL != lock.URL:
+			plan.add(ChannelChange{Action: ChangeUpdate, User: username, Name: name, OldURL: oldURL, NewURL: lock.URL})
+		}
+	}
+
+	if usercfg.OverrideChannels {
+		for name, oldURL := range oldList {
+			if _, ok := channelInputs[name]; !ok && !usercfg.keepsChannel(name) {
+				plan.add(ChannelChange{Action: ChangeRemove, User: username, Name: name, OldURL: oldURL})
+			}
+		}
+	} else {
+		for _, name := range s.renamedChannels(oldList, channelInputs) {
+			plan.add(ChannelChange{Action: ChangeRemove, User: username, Name: name, OldURL: oldList[name]})
+		}
+	}
+
+	return nil
+}
+
+// renamedChannels returns the names of channels in oldList that are no longer
+// configured but point to the locked URL of a configured channel. These are
+// channels that bonito added before they were renamed in the config.
+func (s *State) renamedChannels(oldList map[string]string, channelInputs map[string]ChannelInput) []string {
+	lockedURLs := make(map[string]struct{}, len(channelInputs))
+	for _, input := range channelInputs {
+		if lock, ok := s.Lock.Channels[input]; ok && lock.URL != "" {
+			lockedURLs[lock.URL] = struct{}{}
+		}
+	}
+
+	var renamed []string
+	for name, url := range oldList {
+		if _, ok := channelInputs[name]; ok {
+			continue
+		}
+		if _, ok := lockedURLs[url]; ok {
+			renamed = append(renamed, name)
+		}
+	}
+
+	sort.Strings(renamed)
+	return renamed
+}
+
 type preferredUser struct {
 	Username string
 	UseSudo  bool
@@ -268,7 +1094,7 @@ func (s State) preferredUser() (preferredUser, error) {
 		return preferredUser{s.Config.Global.PreferredUser, usercfg.UseSudo}, nil
 	}
 
-	user, _ := user.Current()
+	user, _ := osuser.Current()
 
 	// Prioritize root.
 	if user != nil && user.Username == "root" {
@@ -288,28 +1114,102 @@ func (s State) preferredUser() (preferredUser, error) {
 	return z, errors.New("no suitable user, perhaps run as root or allow use-sudo for root")
 }
 
+// withSettings returns ctx with the binary paths, the Git mirrors, the pinned
+// inputs, the host tokens, the basic auth credentials and the NIX_PATH of
+// evaluations of the config, if any.
+func (s State) withSettings(ctx context.Context) context.Context {
+	if paths := s.Config.BinaryPaths(); len(paths) > 0 {
+		ctx = executil.WithBinaries(ctx, paths)
+	}
+	if mirrors := s.Config.Global.GitMirrors; len(mirrors) > 0 {
+		ctx = withGitMirrors(ctx, mirrors)
+	}
+	if pinned := s.Config.pinnedInputs(); len(pinned) > 0 {
+		ctx = withPinnedInputs(ctx, pinned)
+	}
+	if tokens := s.Config.Global.HostTokens; len(tokens) > 0 {
+		ctx = withHostTokens(ctx, tokens)
+	}
+	if auth := s.Config.Global.BasicAuth; len(auth) > 0 {
+		ctx = withBasicAuth(ctx, auth)
+	}
+	if nixPath := s.Config.Global.EvalNixPath; len(nixPath) > 0 {
+		ctx = nixutil.WithNixPath(ctx, nixPath)
+	}
+	return ctx
+}
+
+// checkedPreferredUser returns the preferred user. If the context has
+// WithPreflight, then the user is also checked.
+func (s State) checkedPreferredUser(ctx context.Context) (preferredUser, error) {
+	user, err := s.preferredUser()
+	if err != nil {
+		return user, err
+	}
+
+	if isPreflight(ctx) {
+		if err := user.check(ctx); err != nil {
+			return user, err
+		}
+	}
+
+	return user, nil
+}
+
+// check checks that the user exists on the system and that commands can be
+// run as them, probing sudo with true(1) if it is needed.
+func (u preferredUser) check(ctx context.Context) error {
+	if _, err := osuser.Lookup(u.Username); err != nil {
+		return errors.Wrapf(err, "preferred user %q does not exist on this system", u.Username)
+	}
+
+	if executil.CurrentUserIs(u.Username) {
+		return nil
+	}
+
+	if !u.UseSudo {
+		return fmt.Errorf("preferred user %q is not the current user and does not have use-sudo", u.Username)
+	}
+
+	ctx = executil.WithOpts(ctx, executil.Opts{
+		Username: u.Username,
+		UseSudo:  true,
+	})
+
+	if err := executil.Exec(ctx, nil, "true"); err != nil {
+		return errors.Wrapf(err, "cannot run commands as preferred user %q using sudo", u.Username)
+	}
+
+	return nil
+}
+
 // UpdateLocks updates just the locks for the current configuration.
 func (s *State) UpdateLocks(ctx context.Context) error {
-	return s.applyGlobal(ctx, updateLocks)
+	return s.applyGlobal(s.withSettings(ctx), updateLocks)
 }
 
 // Update updates the inputs and locks for the current configuration. It is not
 // to be confused with UpdateLocks which only updates the lock hashes,
 // UpdateInputs will also update the input URLs to the latest versions.
 func (s *State) Update(ctx context.Context) error {
-	return s.applyGlobal(ctx, updateInputs)
+	return s.applyGlobal(s.withSettings(ctx), updateInputs)
 }
 
 // GenerateNixRegistry generates the nix.registry attributes as JSON for the
 // current configuration.
 func (s *State) GenerateNixRegistry() (json.RawMessage, error) {
-	registry, err := s.flakesRegistry()
+	registry, err := s.flakesRegistry("")
 	if err != nil {
 		return nil, err
 	}
 
 	var v any
 	switch s.Config.Flakes.Output {
+	case "":
+		// Configs that aren't read by NewConfigFromReader may not have the
+		// default.
+		slog.Warn(`flakes output is unset, using "nix"`)
+		v = registry.convertToNixRegistry()
 	case "nix":
 		v = registry.convertToNixRegistry()
 	case "flakes":
@@ -326,26 +1226,79 @@ func (s *State) GenerateNixRegistry() (json.RawMessage, error) {
 	return registryJSON, nil
 }
 
-func (s *State) flakesRegistry() (*flakesRegistryV2, error) {
-	channelInputs, err := CombineChannelRegistries([]ChannelRegistry{
+// GenerateUserNixRegistry generates the user registry of the given user as
+// JSON, which has the user's channels on top of the global and flakes ones.
+// Since Nix only reads user registries in the flakes format, the output format
+// is always "flakes".
+func (s *State) GenerateUserNixRegistry(username string) (json.RawMessage, error) {
+	if _, ok := s.Config.Users[username]; !ok {
+		return nil, fmt.Errorf("unknown user %q", username)
+	}
+
+	registry, err := s.flakesRegistry(username)
+	if err != nil {
+		return nil, err
+	}
+
+	registryJSON, err := json.MarshalIndent(registry, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal registry JSON file")
+	}
+
+	return registryJSON, nil
+}
+
+// flakesRegistry returns the registry of the global and flakes channels. If
+// username is not empty, then the channels of that user are added on top.
+func (s *State) flakesRegistry(username string) (*flakesRegistryV2, error) {
+	channelInputs, err := s.Config.combineChannelRegistries(
 		s.Config.Global.ChannelRegistry,
 		s.Config.Flakes.ChannelRegistry,
-	})
+	)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot combine channels")
 	}
 
+	if len(s.Config.Flakes.Include) > 0 {
+		included := make(map[string]ChannelInput, len(s.Config.Flakes.Include))
+		for _, name := range s.Config.Flakes.Include {
+			input, ok := channelInputs[name]
+			if !ok {
+				return nil, fmt.Errorf("included flake %q is not a global or flakes channel", name)
+			}
+			included[name] = input
+		}
+		channelInputs = included
+	}
+
+	if username != "" {
+		userInputs, err := s.Config.combineChannelRegistries(s.Config.Users[username].ChannelRegistry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot combine channels of user %q", username)
+		}
+		for name, input := range userInputs {
+			channelInputs[name] = input
+		}
+	}
+
+	names := make([]string, 0, len(channelInputs))
+	for name := range channelInputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	var registry flakesRegistryV2
 
-	for name, input := range channelInputs {
+	for _, name := range names {
+		input := channelInputs[name]
 		lock, ok := s.Lock.Channels[input]
 		if !ok && input.CanResolve() {
 			return nil, fmt.Errorf("channel %q has no lock, perhaps run bonito first", name)
 		}
 
-		storePath, err := nixutil.LocatePath(lock.StoreHash)
+		storePath, err := locateLockedPath(lock)
 		if err != nil {
-			return nil, errors.Wrapf(err, "channel %q cannot find store hash %q", name, lock.StoreHash)
+			return nil, errors.Wrapf(err, "channel %q", name)
 		}
 
 		// flakeRoot hard-codes the structure of the directory that should have
@@ -366,3 +1319,66 @@ func (s *State) flakesRegistry() (*flakesRegistryV2, error) {
 
 	return &registry, nil
 }
+
+// LocateStorePaths returns the store path of every channel of the given user,
+// including the global ones, as found in the store. It fails if a channel has
+// no lock or its locked store path is not in the store.
+func (s State) LocateStorePaths(username string) (map[string]string, error) {
+	channelInputs, err := s.Config.UserChannels(username)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get channels for user %q", username)
+	}
+
+	paths := make(map[string]string, len(channelInputs))
+	for name, input := range channelInputs {
+		lock, ok := s.Lock.Channels[input]
+		if !ok {
+			return nil, fmt.Errorf("channel %q has no lock, perhaps run bonito first", name)
+		}
+
+		storePath, err := locateLockedPath(lock)
+		if err != nil {
+			return nil, errors.Wrapf(err, "channel %q", name)
+		}
+
+		paths[name] = storePath.String()
+	}
+
+	return paths, nil
+}
+
+// locateLockedPath locates the store path of the given lock and verifies that
+// it is the one that was locked.
+func locateLockedPath(lock ChannelLock) (nixutil.StorePath, error) {
+	storePath, err := nixutil.LocatePath(lock.StoreHash)
+	if err != nil {
+		return storePath, errors.Wrapf(err,
+			"cannot find store hash %q, perhaps it was garbage-collected "+
+				"(run bonito to fetch it again)", lock.StoreHash)
+	}
+
+	if lock.StorePath == "" {
+		return storePath, nil
+	}
+
+	lockedPath, err := nixutil.ParseStorePath(lock.StorePath)
+	if err != nil {
+		return storePath, errors.Wrapf(err, "invalid locked store path %q", lock.StorePath)
+	}
+
+	if lockedPath.Hash != lock.StoreHash {
+		return storePath, fmt.Errorf(
+			"locked store path %q does not have the locked hash %q, "+
+				"the lock file may have been edited (try bonito --update-locks)",
+			lock.StorePath, lock.StoreHash)
+	}
+
+	if lockedPath != storePath {
+		return storePath, fmt.Errorf(
+			"store path %q does not match the locked %q, the store may have been "+
+				"tampered with (run nix-store --verify --check-contents --repair)",
+			storePath, lockedPath)
+	}
+
+	return storePath, nil
+}
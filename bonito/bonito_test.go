@@ -0,0 +1,1181 @@
+package bonito
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/nixutil"
+	"github.com/diamondburned/nix-bonito/internal/faketest"
+	"github.com/hexops/autogold"
+)
+
+// makeTestStore creates a fake Nix store with the given store path names and
+// makes it the current store directory.
+func makeTestStore(t *testing.T, names ...string) string {
+	t.Helper()
+
+	storeDir := t.TempDir()
+	t.Cleanup(nixutil.SetStoreDir(storeDir))
+
+	for _, name := range names {
+		if err := os.MkdirAll(filepath.Join(storeDir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return storeDir
+}
+
+// makeTestFlake creates a store path in the fake store that contains a
+// flake.nix.
+func makeTestFlake(t *testing.T, storeDir, name string) {
+	t.Helper()
+
+	_, flakeName, _ := strings.Cut(name, "-")
+
+	flakeRoot := filepath.Join(storeDir, name, flakeName)
+	if err := os.MkdirAll(flakeRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(flakeRoot, "flake.nix"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlakesRegistry(t *testing.T) {
+	const hash = "4ch3bm9bx98jf68ri8jmx00k479mv8g6"
+
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+
+	newState := func(storePath string) *State {
+		var s State
+		s.Config.Flakes.Channels = map[string]ChannelInput{"nixpkgs": input}
+		s.Lock.Channels = map[ChannelInput]ChannelLock{
+			input: {
+				URL:       "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz",
+				StoreHash: hash,
+				StorePath: storePath,
+			},
+		}
+		return &s
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		storeDir := makeTestStore(t)
+		makeTestFlake(t, storeDir, hash+"-source")
+
+		registry, err := newState(filepath.Join(storeDir, hash+"-source")).flakesRegistry("")
+		if err != nil {
+			t.Fatal("cannot generate registry:", err)
+		}
+
+		if len(registry.Flakes) != 1 {
+			t.Fatalf("unexpected registry %+v", registry)
+		}
+	})
+
+	t.Run("empty output", func(t *testing.T) {
+		storeDir := makeTestStore(t)
+		makeTestFlake(t, storeDir, hash+"-source")
+
+		s := newState(filepath.Join(storeDir, hash+"-source"))
+		empty, err := s.GenerateNixRegistry()
+		if err != nil {
+			t.Fatal("cannot generate registry without an output:", err)
+		}
+
+		s.Config.Flakes.Output = "nix"
+		nix, err := s.GenerateNixRegistry()
+		if err != nil {
+			t.Fatal("cannot generate registry:", err)
+		}
+
+		if !bytes.Equal(empty, nix) {
+			t.Errorf("empty output did not default to nix:\n%s\nwant:\n%s", empty, nix)
+		}
+	})
+
+	t.Run("mismatched", func(t *testing.T) {
+		storeDir := makeTestStore(t, hash+"-tampered")
+
+		_, err := newState(filepath.Join(storeDir, hash+"-source")).flakesRegistry("")
+		if err == nil || !strings.Contains(err.Error(), "does not match the locked") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("garbage-collected", func(t *testing.T) {
+		storeDir := makeTestStore(t)
+
+		_, err := newState(filepath.Join(storeDir, hash+"-source")).flakesRegistry("")
+		if err == nil || !strings.Contains(err.Error(), "garbage-collected") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestFlakesRegistryInclude(t *testing.T) {
+	const (
+		nixpkgsHash = "4ch3bm9bx98jf68ri8jmx00k479mv8g6"
+		nurHash     = "5ch3bm9bx98jf68ri8jmx00k479mv8g6"
+	)
+
+	nixpkgs := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	nur := ChannelInput{URL: "github:nix-community/NUR", Version: "master"}
+
+	storeDir := makeTestStore(t, nixpkgsHash+"-nixpkgs")
+	makeTestFlake(t, storeDir, nurHash+"-source")
+
+	var s State
+	s.Config.Global.Channels = map[string]ChannelInput{"nixpkgs": nixpkgs}
+	s.Config.Flakes.Channels = map[string]ChannelInput{"nur": nur}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		nixpkgs: {StoreHash: nixpkgsHash},
+		nur:     {StoreHash: nurHash},
+	}
+
+	// nixpkgs has no flake.nix, so it must be excluded.
+	if _, err := s.flakesRegistry(""); err == nil {
+		t.Fatal("unexpected success generating registry with a non-flake channel")
+	}
+
+	s.Config.Flakes.Include = []string{"nur"}
+
+	registry, err := s.flakesRegistry("")
+	if err != nil {
+		t.Fatal("cannot generate registry:", err)
+	}
+
+	if len(registry.Flakes) != 1 || registry.Flakes[0].From != (flakesRegistryV2FromIndirect{ID: "nur"}) {
+		t.Fatalf("unexpected registry %+v", registry)
+	}
+
+	s.Config.Flakes.Include = []string{"nixos"}
+
+	if _, err := s.flakesRegistry(""); err == nil {
+		t.Fatal("unexpected success including an unknown channel")
+	}
+}
+
+func TestUserFlakesRegistry(t *testing.T) {
+	const (
+		nurHash         = "4ch3bm9bx98jf68ri8jmx00k479mv8g6"
+		homeManagerHash = "5ch3bm9bx98jf68ri8jmx00k479mv8g6"
+		nurForkHash     = "6ch3bm9bx98jf68ri8jmx00k479mv8g6"
+	)
+
+	nur := ChannelInput{URL: "github:nix-community/NUR", Version: "master"}
+	homeManager := ChannelInput{URL: "github:nix-community/home-manager", Version: "master"}
+	nurFork := ChannelInput{URL: "github:alice/NUR", Version: "master"}
+
+	storeDir := makeTestStore(t)
+	makeTestFlake(t, storeDir, nurHash+"-nur")
+	makeTestFlake(t, storeDir, homeManagerHash+"-home-manager")
+	makeTestFlake(t, storeDir, nurForkHash+"-nur")
+
+	var s State
+	s.Config.Flakes.Channels = map[string]ChannelInput{"nur": nur}
+	s.Config.Users = map[Username]UserConfig{
+		"alice": {ChannelRegistry: ChannelRegistry{Channels: map[string]ChannelInput{
+			"home-manager": homeManager,
+			"nur":          nurFork,
+		}}},
+		"bob": {},
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		nur:         {StoreHash: nurHash},
+		homeManager: {StoreHash: homeManagerHash},
+		nurFork:     {StoreHash: nurForkHash},
+	}
+
+	registries := make(map[string]string)
+	for _, username := range []string{"alice", "bob"} {
+		registry, err := s.GenerateUserNixRegistry(username)
+		if err != nil {
+			t.Fatalf("cannot generate registry of %s: %v", username, err)
+		}
+		registries[username] = strings.ReplaceAll(string(registry), storeDir, "/nix/store")
+	}
+
+	autogold.Want("registries", map[string]string{"alice": `{
+  "flakes": [
+    {
+      "from": {
+        "type": "indirect",
+        "id": "home-manager"
+      },
+      "to": {
+        "type": "path",
+        "path": "/nix/store/5ch3bm9bx98jf68ri8jmx00k479mv8g6-home-manager/home-manager"
+      }
+    },
+    {
+      "from": {
+        "type": "indirect",
+        "id": "nur"
+      },
+      "to": {
+        "type": "path",
+        "path": "/nix/store/6ch3bm9bx98jf68ri8jmx00k479mv8g6-nur/nur"
+      }
+    }
+  ],
+  "version": 2
+}`, "bob": `{
+  "flakes": [
+    {
+      "from": {
+        "type": "indirect",
+        "id": "nur"
+      },
+      "to": {
+        "type": "path",
+        "path": "/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-nur/nur"
+      }
+    }
+  ],
+  "version": 2
+}`}).Equal(t, registries)
+
+	if _, err := s.GenerateUserNixRegistry("carol"); err == nil {
+		t.Error("unexpected success generating the registry of an unknown user")
+	}
+}
+
+func TestMirrorURL(t *testing.T) {
+	var cfg Config
+	cfg.Global.Mirrors = map[string]string{
+		"https://github.com/":         "https://mirror.corp/github/",
+		"https://github.com/NixOS/":   "https://nixos-mirror.corp/",
+		"https://releases.nixos.org/": "https://mirror.corp/nixos/",
+	}
+
+	tests := map[string]string{
+		"https://github.com/foo/bar/archive/abc.tar.gz":       "https://mirror.corp/github/foo/bar/archive/abc.tar.gz",
+		"https://github.com/NixOS/nixpkgs/archive/abc.tar.gz": "https://nixos-mirror.corp/nixpkgs/archive/abc.tar.gz",
+		"https://gitlab.com/foo/bar/-/archive/abc.tar.gz":     "https://gitlab.com/foo/bar/-/archive/abc.tar.gz",
+	}
+
+	for url, want := range tests {
+		if got := cfg.MirrorURL(url); got != want {
+			t.Errorf("MirrorURL(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestUpdateMirror(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+
+	const originalURL = "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz"
+	input := ChannelInput{URL: originalURL}
+
+	var s State
+	s.Config.Global.PreferredUser = os.Getenv("USER")
+	s.Config.Global.Mirrors = map[string]string{"https://github.com/": "https://mirror.corp/github/"}
+	s.Config.Global.Channels = map[string]ChannelInput{"nixpkgs": input}
+	s.Config.Users = map[Username]UserConfig{s.Config.Global.PreferredUser: {}}
+
+	if err := s.Update(ctx); err != nil {
+		t.Fatal("cannot update:", err)
+	}
+
+	lock := s.Lock.Channels[input]
+
+	const mirrorURL = "https://mirror.corp/github/NixOS/nixpkgs/archive/abc.tar.gz"
+	if lock.URL != mirrorURL {
+		t.Errorf("lock URL = %q, want %q", lock.URL, mirrorURL)
+	}
+	if lock.StorePath != tempSourcePath(f, input, mirrorURL) {
+		t.Errorf("channel was not fetched from the mirror: %q", lock.StorePath)
+	}
+	if lock.Meta == nil || lock.Meta.OriginalURL != originalURL {
+		t.Errorf("lock meta does not have the original URL: %+v", lock.Meta)
+	}
+}
+
+func TestApplyRenamedChannel(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+
+	const url = "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz"
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "abc"}
+
+	username := os.Getenv("USER")
+
+	var s State
+	s.Config.Global.PreferredUser = username
+	s.Config.Users = map[Username]UserConfig{
+		username: {
+			ChannelRegistry: ChannelRegistry{
+				Channels: map[string]ChannelInput{"nixpkgs-new": input},
+			},
+		},
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		input: fetchedLock(t, f, input, url),
+	}
+
+	f.Channels["nixpkgs-old"] = url
+	f.Channels["manual"] = "https://example.com/manual.tar.gz"
+
+	if err := s.Apply(ctx); err != nil {
+		t.Fatal("cannot apply:", err)
+	}
+
+	if _, ok := f.Channels["nixpkgs-old"]; ok {
+		t.Error("renamed channel was not removed")
+	}
+	if f.Channels["nixpkgs-new"] != url {
+		t.Errorf("new channel was not added: %v", f.Channels)
+	}
+	if _, ok := f.Channels["manual"]; !ok {
+		t.Error("unmanaged channel was removed")
+	}
+}
+
+func TestApplyOverrideKeepChannels(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+
+	const url = "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz"
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "abc"}
+
+	username := os.Getenv("USER")
+
+	var s State
+	s.Config.Global.PreferredUser = username
+	s.Config.Users = map[Username]UserConfig{
+		username: {
+			OverrideChannels: true,
+			KeepChannels:     []string{"nixos", "nixos-*"},
+			ChannelRegistry: ChannelRegistry{
+				Channels: map[string]ChannelInput{"nixpkgs": input},
+			},
+		},
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		input: fetchedLock(t, f, input, url),
+	}
+
+	f.Channels["nixos"] = "https://nixos.org/channels/nixos-unstable"
+	f.Channels["nixos-hardware"] = "https://github.com/NixOS/nixos-hardware/archive/master.tar.gz"
+	f.Channels["manual"] = "https://example.com/manual.tar.gz"
+
+	if err := s.Apply(ctx); err != nil {
+		t.Fatal("cannot apply:", err)
+	}
+
+	for _, name := range []string{"nixos", "nixos-hardware", "nixpkgs"} {
+		if _, ok := f.Channels[name]; !ok {
+			t.Errorf("channel %q was removed", name)
+		}
+	}
+	if _, ok := f.Channels["manual"]; ok {
+		t.Error("unprotected channel was not removed")
+	}
+}
+
+func TestApplyOverrideUnconfirmed(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+
+	const url = "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz"
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "abc"}
+
+	username := os.Getenv("USER")
+
+	var s State
+	s.Config.Global.PreferredUser = username
+	s.Config.Users = map[Username]UserConfig{
+		username: {
+			OverrideChannels: true,
+			ChannelRegistry: ChannelRegistry{
+				Channels: map[string]ChannelInput{"nixpkgs": input},
+			},
+		},
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		input: fetchedLock(t, f, input, url),
+	}
+
+	f.Channels["manual"] = "https://example.com/manual.tar.gz"
+	f.Channels["home-manager"] = "https://example.com/home-manager.tar.gz"
+
+	var asked []string
+	ctx = WithRemovalConfirmation(ctx, func(user string, names []string) bool {
+		if user != username {
+			t.Errorf("confirmation asked for user %q", user)
+		}
+		asked = names
+		return false
+	})
+
+	if err := s.Apply(ctx); err != nil {
+		t.Fatal("cannot apply:", err)
+	}
+
+	autogold.Want("asked", []string{"home-manager", "manual"}).Equal(t, asked)
+
+	for _, name := range []string{"home-manager", "manual", "nixpkgs"} {
+		if _, ok := f.Channels[name]; !ok {
+			t.Errorf("channel %q is missing", name)
+		}
+	}
+}
+
+func TestApplyLockHashMismatch(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+
+	const oldURL = "https://github.com/NixOS/nixpkgs/archive/old.tar.gz"
+	const url = "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz"
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "abc"}
+
+	// Lock the hash of another tarball, as if the one at url was mutated.
+	var s State
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		input: {
+			URL:       url,
+			StoreHash: fetchedLock(t, f, input, oldURL).StoreHash,
+			Meta: &ChannelLockMeta{
+				Names:   []string{"nixpkgs"},
+				NarHash: "sha256:" + faketest.SourceHash(oldURL),
+			},
+		},
+	}
+
+	f.Channels["nixpkgs"] = oldURL
+
+	err := s.ApplyLock(ctx)
+	if err == nil || !strings.Contains(err.Error(), "--update-locks") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if f.Channels["nixpkgs"] != oldURL {
+		t.Errorf("channel was not rolled back: %v", f.Channels)
+	}
+}
+
+func TestApplyLockOtherStorePath(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+
+	const url = "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz"
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "abc"}
+
+	// nix-channel names the store path after the channel, so the channel
+	// has another store path than the temporary channel that locked it.
+	lock := fetchedLock(t, f, input, url)
+	lock.Meta.Names = []string{"nixpkgs"}
+	if lock.StorePath == f.SourcePath(url, "nixpkgs") {
+		t.Fatal("store path doesn't depend on the channel name")
+	}
+
+	var s State
+	s.Lock.Channels = map[ChannelInput]ChannelLock{input: lock}
+
+	if err := s.ApplyLock(ctx); err != nil {
+		t.Fatal("cannot apply:", err)
+	}
+
+	if f.Channels["nixpkgs"] != url {
+		t.Errorf("channel was not applied: %v", f.Channels)
+	}
+
+	var hashed bool
+	for _, call := range f.Calls {
+		hashed = hashed || call[0] == "nix-hash"
+	}
+	if !hashed {
+		t.Error("the sources of the channel were not verified")
+	}
+}
+
+func TestVerifyStore(t *testing.T) {
+	const kept = "0c5lr4kh8rf8h7m1r3bkx2s0pvn5zr3g-source"
+	const collected = "4ch3bm9bx98jf68ri8jmx00k479mv8g6-source"
+
+	storeDir := makeTestStore(t, kept)
+
+	keptInput := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	collectedInput := ChannelInput{URL: "github:nix-community/home-manager", Version: "master"}
+	unfetchedInput := ChannelInput{URL: "github:owner/repo", Version: "master"}
+
+	var s State
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		keptInput: {
+			StoreHash: "0c5lr4kh8rf8h7m1r3bkx2s0pvn5zr3g",
+			StorePath: filepath.Join(storeDir, kept),
+		},
+		collectedInput: {
+			StoreHash: "4ch3bm9bx98jf68ri8jmx00k479mv8g6",
+			StorePath: filepath.Join(storeDir, collected),
+		},
+		unfetchedInput: {URL: "https://example.com/repo.tar.gz"},
+	}
+
+	problems := s.VerifyStore()
+
+	var got []string
+	for _, problem := range problems {
+		got = append(got, problem.Input.String())
+	}
+
+	autogold.Want("problems", []string{
+		"github:nix-community/home-manager master",
+		"github:owner/repo master",
+	}).Equal(t, got)
+}
+
+func TestSelfCheck(t *testing.T) {
+	nixpkgs := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	orphan := ChannelInput{URL: "github:nix-community/home-manager", Version: "master"}
+
+	var s State
+	s.Config.Flakes.Output = "nix"
+	s.Config.Global.Channels = map[string]ChannelInput{
+		"nixpkgs": nixpkgs,
+		"unknown": {URL: "svn://example.com/repo"},
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		nixpkgs: {URL: "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz"},
+		orphan:  {URL: "https://github.com/nix-community/home-manager/archive/abc.tar.gz"},
+	}
+
+	var got []string
+	for _, problem := range s.SelfCheck() {
+		got = append(got, problem.Check+": "+problem.Err.Error())
+	}
+
+	autogold.Want("problems", []string{
+		`lock: locked input "github:nix-community/home-manager master" is not in the config`,
+		`schemes: input "svn://example.com/repo" has no resolver for its scheme`,
+	}).Equal(t, got)
+
+	// A git service without a resolver or an opaque expander.
+	gitSchemes["gitbucket"] = true
+	t.Cleanup(func() { delete(gitSchemes, "gitbucket") })
+
+	got = nil
+	for _, problem := range s.SelfCheck() {
+		if problem.Check == "schemes" {
+			got = append(got, problem.Err.Error())
+		}
+	}
+
+	autogold.Want("git problems", []string{
+		`git scheme "gitbucket" has no resolver`,
+		`git service "gitbucket" has no opaque expander`,
+		`input "svn://example.com/repo" has no resolver for its scheme`,
+	}).Equal(t, got)
+}
+
+func TestApplyUserOrderRollback(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+
+	username := os.Getenv("USER")
+
+	channels := make(map[string]ChannelInput)
+
+	var s State
+	s.Config.Users = map[Username]UserConfig{
+		username: {ChannelRegistry: ChannelRegistry{Channels: channels}},
+	}
+	s.Lock.Channels = make(map[ChannelInput]ChannelLock)
+
+	for _, name := range []string{"delta", "alpha", "charlie", "bravo"} {
+		input := ChannelInput{URL: ChannelURL("github:owner/" + name), Version: "abc"}
+		channels[name] = input
+		s.Lock.Channels[input] = ChannelLock{URL: "https://example.com/" + name + ".tar.gz"}
+	}
+
+	const oldURL = "https://example.com/old-alpha.tar.gz"
+	f.Channels["alpha"] = oldURL
+	f.FailAdds = map[string]bool{"charlie": true}
+
+	err := s.applyUsers(ctx)
+	if err == nil || !strings.Contains(err.Error(), `cannot add channel "charlie"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var changes []string
+	for _, call := range f.Calls {
+		if call[0] == "nix-channel" && (call[1] == "--add" || call[1] == "--remove") {
+			changes = append(changes, call[1]+" "+call[len(call)-1])
+		}
+	}
+
+	autogold.Want("changes", []string{
+		"--add alpha", "--add bravo", "--add charlie",
+		// Rollback.
+		"--remove bravo", "--remove alpha", "--add alpha",
+	}).Equal(t, changes)
+
+	autogold.Want("channels", map[string]string{"alpha": oldURL}).Equal(t, f.Channels)
+}
+
+func TestApplyUsersTransactional(t *testing.T) {
+	_, ctx := newFakeChannels(t)
+
+	// Give each user their own channels, running their sudo'd commands
+	// through their own fake.
+	fakes := map[string]*faketest.System{
+		"alice": {Channels: map[string]string{"nixpkgs": "https://example.com/old.tar.gz"}},
+		"bob":   {Channels: map[string]string{}, FailAdds: map[string]bool{"nixpkgs": true}},
+	}
+	ctx = WithCommandRunner(ctx, func(cmd *exec.Cmd) error {
+		if cmd.Args[0] != "sudo" {
+			return fmt.Errorf("unexpected command %q", cmd.Args)
+		}
+		f := fakes[cmd.Args[2]]
+		cmd.Args = cmd.Args[3:]
+		return f.Run(cmd)
+	})
+	ctx = WithTransactional(ctx)
+
+	nixpkgs := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "abc"}
+
+	var s State
+	s.Config.Global.Channels = map[string]ChannelInput{"nixpkgs": nixpkgs}
+	s.Config.Users = map[Username]UserConfig{
+		"alice": {UseSudo: true},
+		"bob":   {UseSudo: true},
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		nixpkgs: {URL: "https://example.com/nixpkgs.tar.gz"},
+	}
+
+	err := s.applyUsers(ctx)
+	if err == nil || !strings.Contains(err.Error(), `cannot apply for user "bob"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var changes []string
+	for _, call := range fakes["alice"].Calls {
+		if call[0] == "nix-channel" && call[1] != "--list" {
+			changes = append(changes, strings.Join(call[1:], " "))
+		}
+	}
+
+	autogold.Want("alice changes", []string{
+		"--add https://example.com/nixpkgs.tar.gz nixpkgs",
+		"--update nixpkgs",
+		// Rollback.
+		"--remove nixpkgs",
+		"--add https://example.com/old.tar.gz nixpkgs",
+		"--update nixpkgs",
+	}).Equal(t, changes)
+
+	autogold.Want("alice channels", map[string]string{"nixpkgs": "https://example.com/old.tar.gz"}).Equal(t, fakes["alice"].Channels)
+	autogold.Want("bob channels", map[string]string{}).Equal(t, fakes["bob"].Channels)
+}
+
+func TestApplyUsersErrors(t *testing.T) {
+	_, ctx := newFakeChannels(t)
+
+	// sudo never prompts root, so the users are applied concurrently.
+	t.Setenv("USER", "root")
+
+	fakes := map[string]*faketest.System{
+		"alice": {Channels: map[string]string{}, FailAdds: map[string]bool{"nixpkgs": true}},
+		"bob":   {Channels: map[string]string{}, FailAdds: map[string]bool{"nixpkgs": true}},
+		"carol": {Channels: map[string]string{}},
+	}
+	ctx = WithCommandRunner(ctx, func(cmd *exec.Cmd) error {
+		if cmd.Args[0] != "sudo" {
+			return fmt.Errorf("unexpected command %q", cmd.Args)
+		}
+		f := fakes[cmd.Args[2]]
+		cmd.Args = cmd.Args[3:]
+		return f.Run(cmd)
+	})
+
+	nixpkgs := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "abc"}
+
+	var s State
+	s.Config.Global.Channels = map[string]ChannelInput{"nixpkgs": nixpkgs}
+	s.Config.Users = map[Username]UserConfig{
+		"alice": {UseSudo: true},
+		"bob":   {UseSudo: true},
+		"carol": {UseSudo: true},
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		nixpkgs: {URL: "https://example.com/nixpkgs.tar.gz"},
+	}
+
+	err := s.applyUsers(ctx)
+	if err == nil {
+		t.Fatal("applying users with failing channels succeeded")
+	}
+
+	// Both failures are reported, sorted by user.
+	var users []string
+	for _, line := range strings.Split(err.Error(), "\n") {
+		if user, _, ok := strings.Cut(strings.TrimPrefix(line, `cannot apply for user "`), `"`); ok {
+			users = append(users, user)
+		}
+	}
+	autogold.Want("failed users", []string{"alice", "bob"}).Equal(t, users)
+
+	// The other users are still applied.
+	autogold.Want("carol channels", map[string]string{"nixpkgs": "https://example.com/nixpkgs.tar.gz"}).Equal(t, fakes["carol"].Channels)
+}
+
+func TestGenerateNixProfile(t *testing.T) {
+	nixpkgs := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	hm := ChannelInput{URL: "github:nix-community/home-manager", Version: "master"}
+
+	var s State
+	s.Config.Global.Channels = map[string]ChannelInput{"nixpkgs": nixpkgs}
+	s.Config.Users = map[Username]UserConfig{
+		"alice": {ChannelRegistry: ChannelRegistry{
+			Channels: map[string]ChannelInput{"home-manager": hm},
+			Aliases:  map[string]string{"nixos-23.11": "nixpkgs"},
+		}},
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		nixpkgs: {
+			URL:       "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz",
+			StoreHash: "0c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd",
+			StorePath: "/nix/store/0c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd-source",
+			Meta:      &ChannelLockMeta{NarHash: "sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s"},
+		},
+		// home-manager was locked before NAR hashes were recorded.
+		hm: {
+			URL:       "https://github.com/nix-community/home-manager/archive/def.tar.gz",
+			StoreHash: "1c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd",
+			StorePath: "/nix/store/1c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd-source",
+		},
+	}
+
+	t.Run("store-paths", func(t *testing.T) {
+		profile, err := s.GenerateNixProfile("alice")
+		if err != nil {
+			t.Fatal("cannot generate profile:", err)
+		}
+
+		autogold.Want("store-paths", `# Generated by bonito. Do not edit.
+{
+  home-manager = "/nix/store/1c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd-source";
+  "nixos-23.11" = "/nix/store/0c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd-source";
+  nixpkgs = "/nix/store/0c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd-source";
+}
+`).Equal(t, string(profile))
+	})
+
+	t.Run("fetchTarball", func(t *testing.T) {
+		s := s
+		s.Config.Profile.Format = ProfileFetchTarball
+
+		profile, err := s.GenerateNixProfile("alice")
+		if err != nil {
+			t.Fatal("cannot generate profile:", err)
+		}
+
+		autogold.Want("fetchTarball", `# Generated by bonito. Do not edit.
+{
+  home-manager = builtins.fetchTarball { url = "https://github.com/nix-community/home-manager/archive/def.tar.gz"; };
+  "nixos-23.11" = builtins.fetchTarball { url = "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz"; sha256 = "sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s"; };
+  nixpkgs = builtins.fetchTarball { url = "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz"; sha256 = "sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s"; };
+}
+`).Equal(t, string(profile))
+	})
+}
+
+func TestPreflightPreferredUser(t *testing.T) {
+	t.Run("nonexistent", func(t *testing.T) {
+		f, ctx := newFakeChannels(t)
+
+		const username = "bonito-no-such-user"
+
+		var s State
+		s.Config.Global.PreferredUser = username
+		s.Config.Users = map[Username]UserConfig{username: {UseSudo: true}}
+
+		if _, err := s.checkedPreferredUser(ctx); err != nil {
+			t.Fatal("unexpected error without preflight:", err)
+		}
+
+		_, err := s.checkedPreferredUser(WithPreflight(ctx))
+		if err == nil || !strings.Contains(err.Error(), `preferred user "bonito-no-such-user" does not exist on this system`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(f.Calls) > 0 {
+			t.Fatalf("unexpected commands: %q", f.Calls)
+		}
+	})
+
+	t.Run("sudo failure", func(t *testing.T) {
+		_, ctx := newFakeChannels(t)
+		username := os.Getenv("USER")
+
+		// Pretend to be someone else so that sudo is needed.
+		t.Setenv("USER", "bonito-someone-else")
+
+		var calls [][]string
+		ctx = WithCommandRunner(ctx, func(cmd *exec.Cmd) error {
+			calls = append(calls, cmd.Args)
+			if filepath.Base(cmd.Args[0]) == "sudo" {
+				return errors.New("sudo: a password is required")
+			}
+			return nil
+		})
+
+		var s State
+		s.Config.Global.PreferredUser = username
+		s.Config.Users = map[Username]UserConfig{username: {UseSudo: true}}
+
+		_, err := s.checkedPreferredUser(WithPreflight(ctx))
+		if err == nil || !strings.Contains(err.Error(), "cannot run commands as preferred user") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		autogold.Want("probe", [][]string{{"sudo", "-u", username, "true"}}).Equal(t, calls)
+	})
+}
+
+func TestClassifyUpdate(t *testing.T) {
+	const (
+		oldRev = "1b1f50645af2a70dc93eaf1b1f50645af2a70dc9"
+		newRev = "2c2f50645af2a70dc93eaf1b1f50645af2a70dc9"
+	)
+
+	branch := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	pinned := ChannelInput{URL: "github:NixOS/nixpkgs", Version: oldRev[:20]}
+
+	lockAt := func(rev string, hash nixutil.StoreHash) ChannelLock {
+		return ChannelLock{
+			URL:       "https://github.com/NixOS/nixpkgs/archive/" + rev + ".tar.gz",
+			StoreHash: hash,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		input    ChannelInput
+		resolved ResolvedInput
+		oldLock  *ChannelLock
+		lock     ChannelLock
+		want     UpdateReason
+	}{
+		{
+			name:     "branch added",
+			input:    branch,
+			resolved: ResolvedInput{Ref: "refs/heads/nixos-unstable", Rev: newRev},
+			lock:     lockAt(newRev, "a"),
+			want:     UpdateAdded,
+		},
+		{
+			name:     "branch moved",
+			input:    branch,
+			resolved: ResolvedInput{Ref: "refs/heads/nixos-unstable", Rev: newRev},
+			oldLock:  ptrTo(lockAt(oldRev, "a")),
+			lock:     lockAt(newRev, "b"),
+			want:     UpdateRefMoved,
+		},
+		{
+			name:     "branch hash changed",
+			input:    branch,
+			resolved: ResolvedInput{Ref: "refs/heads/nixos-unstable", Rev: oldRev},
+			oldLock:  ptrTo(lockAt(oldRev, "a")),
+			lock:     lockAt(oldRev, "b"),
+			want:     UpdateHashChanged,
+		},
+		{
+			name:     "branch unchanged",
+			input:    branch,
+			resolved: ResolvedInput{Ref: "refs/heads/nixos-unstable", Rev: oldRev},
+			oldLock:  ptrTo(lockAt(oldRev, "a")),
+			lock:     lockAt(oldRev, "a"),
+			want:     UpdateUnchanged,
+		},
+		{
+			name:     "pinned commit",
+			input:    pinned,
+			resolved: ResolvedInput{Rev: oldRev},
+			oldLock:  ptrTo(lockAt(oldRev, "a")),
+			lock:     lockAt(oldRev, "a"),
+			want:     UpdatePinned,
+		},
+		{
+			name:     "pinned tarball",
+			input:    ChannelInput{URL: "https://example.com/a.tar.gz", Version: "sha256:abc"},
+			resolved: ResolvedInput{URL: "https://example.com/a.tar.gz", SHA256: "abc"},
+			oldLock:  &ChannelLock{URL: "https://example.com/a.tar.gz", StoreHash: "a"},
+			lock:     ChannelLock{URL: "https://example.com/a.tar.gz", StoreHash: "a"},
+			want:     UpdatePinned,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oldLock ChannelLock
+			if test.oldLock != nil {
+				oldLock = *test.oldLock
+			}
+
+			reason := classifyUpdate(test.input, test.resolved, oldLock, test.oldLock != nil, test.lock)
+			if reason != test.want {
+				t.Errorf("got %q, want %q", reason, test.want)
+			}
+		})
+	}
+}
+
+func ptrTo[T any](v T) *T { return &v }
+
+func TestBinaryPaths(t *testing.T) {
+	_, ctx := newFakeChannels(t)
+	username := os.Getenv("USER")
+
+	var calls [][]string
+	ctx = WithCommandRunner(ctx, func(cmd *exec.Cmd) error {
+		calls = append(calls, cmd.Args)
+		return nil
+	})
+
+	var s State
+	s.Config.Global.NixChannelPath = "/opt/nix/bin/nix-channel"
+	s.Config.Users = map[Username]UserConfig{username: {}}
+
+	if _, err := s.RemoveTempChannels(ctx); err != nil {
+		t.Fatal("cannot remove temporary channels:", err)
+	}
+
+	autogold.Want("calls", [][]string{{"/opt/nix/bin/nix-channel", "--list"}}).Equal(t, calls)
+}
+
+func TestApplyChannelUsers(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+
+	// Pretend to be someone else, so that the actual current user, which must
+	// exist, is another user.
+	other := os.Getenv("USER")
+	username := "bonito-someone-else"
+	t.Setenv("USER", username)
+
+	// Run sudo'd commands through the fake, recording which user ran which
+	// channel URL.
+	var mu sync.Mutex
+	addedBy := make(map[string]string)
+	ctx = WithCommandRunner(ctx, func(cmd *exec.Cmd) error {
+		user := username
+		if cmd.Args[0] == "sudo" {
+			user = cmd.Args[2]
+			cmd.Args = cmd.Args[3:]
+		}
+		if cmd.Args[0] == "nix-channel" && cmd.Args[1] == "--add" {
+			mu.Lock()
+			addedBy[cmd.Args[2]] = user
+			mu.Unlock()
+		}
+		return f.Run(cmd)
+	})
+
+	nixpkgs := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "abc"}
+	private := ChannelInput{URL: "github:corp/private", Version: "abc"}
+
+	var s State
+	s.Config.Flakes.Output = "nix"
+	s.Config.Global.PreferredUser = username
+	s.Config.Global.ChannelUsers = map[string]string{"private": other}
+	s.Config.Global.Channels = map[string]ChannelInput{
+		"nixpkgs": nixpkgs,
+		"private": private,
+	}
+	s.Config.Users = map[Username]UserConfig{
+		username: {},
+		other:    {UseSudo: true},
+	}
+	if err := s.Config.Validate(); err != nil {
+		t.Fatal("invalid config:", err)
+	}
+
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		nixpkgs: {URL: "https://example.com/nixpkgs.tar.gz"},
+		private: {URL: "https://example.com/private.tar.gz"},
+	}
+
+	if err := s.UpdateLocks(ctx); err != nil {
+		t.Fatal("cannot update locks:", err)
+	}
+
+	autogold.Want("added by", map[string]string{
+		"https://example.com/nixpkgs.tar.gz": username,
+		"https://example.com/private.tar.gz": other,
+	}).Equal(t, addedBy)
+
+	for input, lock := range s.Lock.Channels {
+		if lock.StoreHash == "" {
+			t.Errorf("channel %q was not locked", input)
+		}
+	}
+
+	// The same input can't be fetched by two users.
+	s.Config.Global.Channels["private-again"] = private
+	s.Config.Global.ChannelUsers["private-again"] = username
+	if err := s.Config.Validate(); err == nil || !strings.Contains(err.Error(), "fetched as both") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestApplySudoChannels(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+
+	// Pretend to be someone else, so that managing the channels of the actual
+	// current user needs sudo.
+	other := os.Getenv("USER")
+	t.Setenv("USER", "bonito-someone-else")
+
+	var calls []string
+	ctx = WithCommandRunner(ctx, func(cmd *exec.Cmd) error {
+		calls = append(calls, strings.Join(cmd.Args, " "))
+		if cmd.Args[0] == "sudo" {
+			cmd.Args = cmd.Args[3:]
+		}
+		return f.Run(cmd)
+	})
+
+	private := ChannelInput{URL: "github:corp/private", Version: "abc"}
+
+	var s State
+	s.Config.Flakes.Output = "nix"
+	s.Config.Users = map[Username]UserConfig{
+		other: {ChannelRegistry: ChannelRegistry{
+			Channels: map[string]ChannelInput{"private": private},
+			Sudo:     []string{"private"},
+		}},
+	}
+	if err := s.Config.Validate(); err != nil {
+		t.Fatal("invalid config:", err)
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		private: {URL: "https://example.com/private.tar.gz"},
+	}
+
+	// use-sudo is false, so this only works if the channel uses sudo.
+	if err := s.applyUser(ctx, other, s.Config.Users[other]); err != nil {
+		t.Fatal("cannot apply:", err)
+	}
+
+	for _, call := range calls {
+		if strings.Contains(call, "nix-channel") && !strings.HasPrefix(call, "sudo -u "+other+" ") {
+			t.Errorf("channel command without sudo: %s", call)
+		}
+	}
+	autogold.Want("channels", map[string]string{"private": "https://example.com/private.tar.gz"}).Equal(t, f.Channels)
+
+	usercfg := s.Config.Users[other]
+	usercfg.Sudo = []string{"missing"}
+	s.Config.Users[other] = usercfg
+	if err := s.Config.Validate(); err == nil || !strings.Contains(err.Error(), `sudo channel "missing"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestApplyUsersConcurrently(t *testing.T) {
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+
+	newState := func() *State {
+		var s State
+		s.Config.Global.Channels = map[string]ChannelInput{"nixpkgs": input}
+		s.Config.Users = map[Username]UserConfig{
+			"bonito-alice": {UseSudo: true},
+			"bonito-bob":   {UseSudo: true},
+		}
+		s.Lock.Channels = map[ChannelInput]ChannelLock{
+			input: {URL: "https://example.com/nixpkgs.tar.gz"},
+		}
+		return &s
+	}
+
+	// newRunner returns a runner that records the user of each channel
+	// command. Every user's first command waits for the other users' first
+	// commands, which only works if the users are applied concurrently.
+	newRunner := func(f *faketest.System, wait bool) (func(*exec.Cmd) error, *[]string) {
+		var mu sync.Mutex
+		var users []string
+
+		var started sync.WaitGroup
+		started.Add(2)
+		waited := make(map[string]bool)
+
+		return func(cmd *exec.Cmd) error {
+			if cmd.Args[0] != "sudo" {
+				return f.Run(cmd)
+			}
+			username := cmd.Args[2]
+			cmd.Args = cmd.Args[3:]
+
+			mu.Lock()
+			users = append(users, username)
+			first := !waited[username]
+			waited[username] = true
+			mu.Unlock()
+
+			if wait && first {
+				started.Done()
+				done := make(chan struct{})
+				go func() { started.Wait(); close(done) }()
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					return errors.New("users were not applied concurrently")
+				}
+			}
+
+			return f.Run(cmd)
+		}, &users
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		f, ctx := newFakeChannels(t)
+		run, _ := newRunner(f, true)
+
+		// sudo never prompts root.
+		t.Setenv("USER", "root")
+
+		if err := newState().applyUsers(WithCommandRunner(ctx, run)); err != nil {
+			t.Fatal("cannot apply:", err)
+		}
+	})
+
+	// applySequentially applies the users with the given user as the
+	// current one, and checks that they were applied one at a time.
+	applySequentially := func(t *testing.T, currentUser string, sequential bool) {
+		t.Helper()
+
+		f, ctx := newFakeChannels(t)
+		run, users := newRunner(f, false)
+
+		t.Setenv("USER", currentUser)
+
+		ctx = WithCommandRunner(ctx, run)
+		if sequential {
+			ctx = WithSequential(ctx)
+		}
+		if err := newState().applyUsers(ctx); err != nil {
+			t.Fatal("cannot apply:", err)
+		}
+
+		// Every command of alice comes before the ones of bob.
+		if len(*users) == 0 || !sort.StringsAreSorted(*users) {
+			t.Errorf("users were applied out of order: %q", *users)
+		}
+	}
+
+	t.Run("sequential", func(t *testing.T) {
+		applySequentially(t, "root", true)
+	})
+
+	t.Run("sudo prompts", func(t *testing.T) {
+		// Applying the users as someone other than root may prompt for the
+		// sudo password, so they are applied one at a time anyway.
+		applySequentially(t, "bonito-someone-else", false)
+	})
+}
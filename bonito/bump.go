@@ -0,0 +1,336 @@
+package bonito
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+)
+
+// ErrChannelNotFound is returned by SetChannelVersion if no channels table of
+// the document has the channel.
+var ErrChannelNotFound = errors.New("channel not found")
+
+// channelKey is a channel in a TOML document.
+type channelKey struct {
+	// path is the full key of the channel, e.g. users.alice.channels.nixpkgs.
+	path  []string
+	input string
+}
+
+// SetChannelVersion rewrites the given TOML config document so that every
+// channel named name has its version set to the given one. The rest of the
+// document, including comments and formatting, is kept as-is. An error is
+// returned if no such channel is found, if the channel is an alias or in a
+// group, or if the resulting document is not a valid config.
+func SetChannelVersion(doc []byte, name, version string) ([]byte, error) {
+	if version == "" || strings.ContainsAny(version, "\n\"") {
+		return nil, fmt.Errorf("invalid version %q", version)
+	}
+
+	var tree map[string]any
+	if err := toml.Unmarshal(doc, &tree); err != nil {
+		return nil, errors.Wrap(err, "cannot parse config")
+	}
+
+	var keys []channelKey
+	if err := findChannelKeys(&keys, tree, nil, name); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		if alias, table, ok := findAlias(tree, nil, name); ok {
+			return nil, fmt.Errorf("channel %q is an alias of %q in [%s], bump %q instead", name, alias, table, alias)
+		}
+		return nil, errors.Wrapf(ErrChannelNotFound, "channel %q", name)
+	}
+
+	newInputs := make([]string, len(keys))
+	for i, key := range keys {
+		var input ChannelInput
+		if err := input.UnmarshalText([]byte(key.input)); err != nil {
+			return nil, errors.Wrapf(err, "channel %q in [%s]", name, formatTOMLKey(key.path[:len(key.path)-1]))
+		}
+		input.Version = version
+
+		text, err := input.MarshalText()
+		if err != nil {
+			return nil, errors.Wrapf(err, "channel %q in [%s]", name, formatTOMLKey(key.path[:len(key.path)-1]))
+		}
+		newInputs[i] = string(text)
+	}
+
+	lines := strings.Split(string(doc), "\n")
+	rewritten := make([]bool, len(keys))
+
+	// table is nil while inside a table whose header cannot be parsed, such as
+	// an array of tables, so that none of its keys are mistaken for channels.
+	table := []string{}
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			table = parseTOMLTableHeader(trimmed)
+			continue
+		}
+		if table == nil {
+			continue
+		}
+
+		key, start, end, ok := parseTOMLStringKeyValue(line)
+		if !ok {
+			continue
+		}
+
+		path := append(slices.Clip(table), key...)
+		j := slices.IndexFunc(keys, func(k channelKey) bool { return slices.Equal(k.path, path) })
+		if j == -1 {
+			continue
+		}
+
+		lines[i] = line[:start] + strconv.Quote(newInputs[j]) + line[end:]
+		rewritten[j] = true
+	}
+
+	for i, key := range keys {
+		if !rewritten[i] {
+			return nil, fmt.Errorf(
+				"cannot rewrite channel %q in [%s], only single-line string values can be bumped",
+				name, formatTOMLKey(key.path[:len(key.path)-1]))
+		}
+	}
+
+	newDoc := []byte(strings.Join(lines, "\n"))
+	if _, err := NewConfigFromReader(bytes.NewReader(newDoc)); err != nil {
+		return nil, errors.Wrap(err, "rewritten config is invalid")
+	}
+
+	// Make sure that nothing but the channels changed, in case a line that
+	// looked like a channel was actually part of a multi-line string.
+	var newTree map[string]any
+	if err := toml.Unmarshal(newDoc, &newTree); err != nil {
+		return nil, errors.Wrap(err, "rewritten config is invalid")
+	}
+	for i, key := range keys {
+		setTOMLKey(tree, key.path, newInputs[i])
+	}
+	if !reflect.DeepEqual(tree, newTree) {
+		return nil, fmt.Errorf("cannot rewrite channel %q without changing other parts of the config", name)
+	}
+
+	return newDoc, nil
+}
+
+// findChannelKeys appends the channels named name of every channels table
+// within the given table to keys. A channel that is in a group is an error,
+// since only the group's input can be changed.
+func findChannelKeys(keys *[]channelKey, table map[string]any, path []string, name string) error {
+	if channels, ok := table["channels"].(map[string]any); ok {
+		if v, ok := channels[name]; ok {
+			input, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("channel %q in [%s] is not a string", name, formatTOMLKey(path))
+			}
+			*keys = append(*keys, channelKey{
+				path:  append(slices.Clip(path), "channels", name),
+				input: input,
+			})
+		}
+	}
+
+	if groups, ok := table["groups"].(map[string]any); ok {
+		for _, id := range sortedKeys(groups) {
+			group, _ := groups[id].(map[string]any)
+			channels, _ := group["channels"].([]any)
+			if slices.Contains(channels, any(name)) {
+				return fmt.Errorf(
+					"channel %q is in group %q of [%s], change the input of the group instead",
+					name, id, formatTOMLKey(path))
+			}
+		}
+	}
+
+	for _, k := range sortedKeys(table) {
+		if k == "channels" || k == "groups" {
+			continue
+		}
+		if sub, ok := table[k].(map[string]any); ok {
+			if err := findChannelKeys(keys, sub, append(slices.Clip(path), k), name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// findAlias finds the first aliases table within the given table that has
+// the alias name. It returns the aliased channel and the table's key.
+func findAlias(table map[string]any, path []string, name string) (alias, tableKey string, ok bool) {
+	if aliases, ok := table["aliases"].(map[string]any); ok {
+		if alias, ok := aliases[name].(string); ok {
+			return alias, formatTOMLKey(path), true
+		}
+	}
+
+	for _, k := range sortedKeys(table) {
+		if sub, ok := table[k].(map[string]any); ok {
+			if alias, tableKey, ok := findAlias(sub, append(slices.Clip(path), k), name); ok {
+				return alias, tableKey, true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+func setTOMLKey(table map[string]any, path []string, v any) {
+	for _, k := range path[:len(path)-1] {
+		table = table[k].(map[string]any)
+	}
+	table[path[len(path)-1]] = v
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatTOMLKey formats the given key path as a dotted TOML key, quoting the
+// keys that aren't bare.
+func formatTOMLKey(path []string) string {
+	parts := make([]string, len(path))
+	for i, k := range path {
+		if k != "" && strings.IndexFunc(k, func(r rune) bool { return !isBareKeyRune(r) }) == -1 {
+			parts[i] = k
+		} else {
+			parts[i] = strconv.Quote(k)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// parseTOMLTableHeader parses the trimmed line of a [table] header into its
+// key path. It returns nil if the line isn't a table header that it
+// understands, such as an [[array]] of tables.
+func parseTOMLTableHeader(line string) []string {
+	if strings.HasPrefix(line, "[[") {
+		return nil
+	}
+
+	key, rest, ok := parseTOMLKey(line[1:])
+	if !ok || !strings.HasPrefix(rest, "]") {
+		return nil
+	}
+
+	rest = strings.TrimSpace(rest[1:])
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil
+	}
+
+	return key
+}
+
+// parseTOMLStringKeyValue parses a line of the form `key = "value"`, where
+// the value is a single-line basic or literal string. It returns the key path
+// and the bounds of the value within the line, including its quotes.
+func parseTOMLStringKeyValue(line string) (key []string, start, end int, ok bool) {
+	key, rest, ok := parseTOMLKey(line)
+	if !ok || !strings.HasPrefix(rest, "=") {
+		return nil, 0, 0, false
+	}
+
+	rest = strings.TrimLeft(rest[1:], " \t")
+	start = len(line) - len(rest)
+
+	switch {
+	case strings.HasPrefix(rest, `"""`), strings.HasPrefix(rest, "'''"):
+		return nil, 0, 0, false
+	case strings.HasPrefix(rest, `"`):
+		n, ok := basicStringLen(rest)
+		if !ok {
+			return nil, 0, 0, false
+		}
+		return key, start, start + n, true
+	case strings.HasPrefix(rest, "'"):
+		n := strings.IndexByte(rest[1:], '\'')
+		if n == -1 {
+			return nil, 0, 0, false
+		}
+		return key, start, start + n + 2, true
+	default:
+		return nil, 0, 0, false
+	}
+}
+
+// parseTOMLKey parses the possibly dotted and quoted key at the start of s.
+// It returns the key path and the rest of s after the key and any whitespace.
+func parseTOMLKey(s string) (key []string, rest string, ok bool) {
+	for {
+		s = strings.TrimLeft(s, " \t")
+
+		switch {
+		case strings.HasPrefix(s, `"`):
+			n, ok := basicStringLen(s)
+			if !ok {
+				return nil, "", false
+			}
+			k, err := strconv.Unquote(s[:n])
+			if err != nil {
+				return nil, "", false
+			}
+			key = append(key, k)
+			s = s[n:]
+		case strings.HasPrefix(s, "'"):
+			n := strings.IndexByte(s[1:], '\'')
+			if n == -1 {
+				return nil, "", false
+			}
+			key = append(key, s[1:n+1])
+			s = s[n+2:]
+		default:
+			n := strings.IndexFunc(s, func(r rune) bool { return !isBareKeyRune(r) })
+			if n == -1 {
+				n = len(s)
+			}
+			if n == 0 {
+				return nil, "", false
+			}
+			key = append(key, s[:n])
+			s = s[n:]
+		}
+
+		s = strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(s, ".") {
+			return key, s, true
+		}
+		s = s[1:]
+	}
+}
+
+// basicStringLen returns the length of the basic string at the start of s,
+// including both quotes.
+func basicStringLen(s string) (int, bool) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+func isBareKeyRune(r rune) bool {
+	return r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-'
+}
@@ -0,0 +1,122 @@
+package bonito
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestSetChannelVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "global and user",
+			doc: `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-23.11" # keep me
+home-manager = "github:nix-community/home-manager release-23.11"
+
+[users.alice.channels] # alice's channels
+"nixpkgs" = 'github:NixOS/nixpkgs nixos-unstable'
+`,
+			want: `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-24.05" # keep me
+home-manager = "github:nix-community/home-manager release-23.11"
+
+[users.alice.channels] # alice's channels
+"nixpkgs" = "github:NixOS/nixpkgs nixos-24.05"
+`,
+		},
+		{
+			name: "dotted keys",
+			doc: `
+global.channels.nixpkgs = "github:NixOS/nixpkgs nixos-23.11"
+
+[users."alice"]
+channels.nixpkgs = "github:NixOS/nixpkgs nixos-23.11"
+`,
+			want: `
+global.channels.nixpkgs = "github:NixOS/nixpkgs nixos-24.05"
+
+[users."alice"]
+channels.nixpkgs = "github:NixOS/nixpkgs nixos-24.05"
+`,
+		},
+		{
+			name: "same name outside of channels",
+			doc: `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-23.11"
+
+[global.mirrors]
+nixpkgs = "https://mirror.example.com"
+`,
+			want: `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-24.05"
+
+[global.mirrors]
+nixpkgs = "https://mirror.example.com"
+`,
+		},
+		{
+			name: "inline table",
+			doc: `
+[global]
+channels = { nixpkgs = "github:NixOS/nixpkgs nixos-23.11" }
+`,
+			wantErr: `cannot rewrite channel "nixpkgs" in [global.channels]`,
+		},
+		{
+			name: "group",
+			doc: `
+[global.groups.unstable]
+input = "github:NixOS/nixpkgs nixos-23.11"
+channels = ["nixpkgs", "nixos"]
+`,
+			wantErr: `channel "nixpkgs" is in group "unstable" of [global]`,
+		},
+		{
+			name: "alias",
+			doc: `
+[global.channels]
+nixos = "github:NixOS/nixpkgs nixos-23.11"
+
+[global.aliases]
+nixpkgs = "nixos"
+`,
+			wantErr: `channel "nixpkgs" is an alias of "nixos" in [global]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SetChannelVersion([]byte(test.doc), "nixpkgs", "nixos-24.05")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("unexpected error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("cannot set version:", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("unexpected document:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := SetChannelVersion([]byte("[global.channels]\n"), "nixpkgs", "nixos-24.05")
+		if !errors.Is(err, ErrChannelNotFound) {
+			t.Fatalf("unexpected error %v, want %v", err, ErrChannelNotFound)
+		}
+	})
+}
@@ -5,6 +5,8 @@ import (
 	"encoding"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"path/filepath"
 	"strings"
 
 	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
@@ -19,7 +21,17 @@ type ChannelInput struct {
 	// Version is the respective version string corresponding to the VCS defined
 	// in the channel URL. For example, if the VCS is Git, then the URL's scheme
 	// might be git+https, and the version string would imply a branch name,
-	// tag, or commit hash.
+	// tag, or commit hash. Git versions may also be a semver constraint
+	// prefixed with "semver:", e.g. "semver:>=23.11 <24", in which case the
+	// highest matching tag is used. Git versions of GitHub and GitLab
+	// repositories may also be pinned to a date, e.g. "@2024-01-01" for the
+	// newest commit of the default branch on or before that day (also
+	// written as "date:2024-01-01"), or "nixos-unstable@2024-01-01" for that
+	// of a branch. Several Git versions may be separated by "||", in which
+	// case the first one that exists is used. Mercurial (hg+https) versions
+	// are a branch, tag, bookmark or changeset hash, defaulting to the
+	// default branch. HTTP versions are the expected SHA-256 hash of the
+	// tarball, e.g. "sha256:<hex or base32>" or an SRI hash.
 	//
 	// If the Version string is empty, then it is not included in the marshaled
 	// text at all.
@@ -42,20 +54,31 @@ func (in ChannelInput) CanResolve() bool {
 		return false
 	}
 
-	_, ok := ChannelResolvers[u.Scheme]
+	_, ok := channelResolver(u)
 	return ok
 }
 
+// channelResolver returns the resolver of the URL's scheme. A URL without a
+// scheme is only resolvable if it is an absolute path, since strings like
+// "nixpkgs" are more likely to be a forgotten scheme than a local path.
+func channelResolver(u *url.URL) (ChannelResolver, bool) {
+	if u.Scheme == "" && !filepath.IsAbs(u.Path) {
+		return nil, false
+	}
+	resolve, ok := ChannelResolvers[u.Scheme]
+	return resolve, ok
+}
+
 // Resolve resolves the channel input using one of the ChannelResolvers.
-func (in ChannelInput) Resolve(ctx context.Context) (string, error) {
+func (in ChannelInput) Resolve(ctx context.Context) (ResolvedInput, error) {
 	u, err := in.URL.Parse()
 	if err != nil {
-		return "", err
+		return ResolvedInput{}, err
 	}
 
-	resolve, ok := ChannelResolvers[u.Scheme]
+	resolve, ok := channelResolver(u)
 	if !ok {
-		return "", fmt.Errorf("cannot resolve unknown scheme %q", u.Scheme)
+		return ResolvedInput{}, fmt.Errorf("cannot resolve unknown scheme %q", u.Scheme)
 	}
 
 	return resolve(ctx, in)
@@ -120,19 +143,57 @@ func (in ChannelInput) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return json.Marshal(s)
+	return json.Marshal(string(s))
+}
+
+// ResolvedInput is a channel input that has been resolved by a
+// ChannelResolver.
+type ResolvedInput struct {
+	// URL is the static URL that's actually used for adding into nix-channel.
+	URL string
+	// Ref is the full name of the VCS reference that the input's version
+	// matched, e.g. "refs/tags/v1.0.0". It is empty if the version was already
+	// a revision or if the resolver doesn't know about references.
+	Ref string
+	// Rev is the VCS revision that URL points to. It is empty if the resolver
+	// doesn't know about revisions.
+	Rev string
+	// OriginalURL is the URL before it was rewritten to point to a mirror. It
+	// is empty if no mirror is used.
+	OriginalURL string
+	// Alternative is the alternative of the input's version that resolved if
+	// the version has several, e.g. "nixos-unstable" for
+	// "refs/tags/stable* || nixos-unstable".
+	Alternative string
+	// SHA256 is the verified hash of a pinned tarball, as written in the
+	// input's version.
+	SHA256 string
 }
 
 // ChannelResolver is a function type that resolves a channel URL to the URL that's
 // actually used for adding into nix-channel.
-type ChannelResolver func(context.Context, ChannelInput) (string, error)
+type ChannelResolver func(context.Context, ChannelInput) (ResolvedInput, error)
 
 // ChannelResolvers maps URL schemes to resolvers.
 var ChannelResolvers = map[string]ChannelResolver{
-	"git":     resolveGit,
-	"github":  resolveGit,
-	"gitlab":  resolveGit,
-	"gitsrht": resolveGit,
+	"":          resolveFile, // bare absolute paths
+	"file":      resolveFile,
+	"http":      resolveHTTP,
+	"https":     resolveHTTP,
+	"channel":   resolveChannel,
+	"nixos":     resolveOfficialChannel,
+	"git":       resolveGit,
+	"git+ssh":   resolveGit,
+	"github":    resolveGit,
+	"gitlab":    resolveGit,
+	"gitsrht":   resolveGit,
+	"sourcehut": resolveGit,
+	"gitea":     resolveGit,
+	"codeberg":  resolveGit,
+	"bitbucket": resolveGit,
+	"hg+http":   resolveHg,
+	"hg+https":  resolveHg,
+	"exec":      resolveExec,
 }
 
 type channelExecer struct {
@@ -150,6 +211,15 @@ func newChannelExecer(ctx context.Context, temp bool) *channelExecer {
 	return &execer
 }
 
+// userChannels returns a channelExecer that runs as the given user.
+func userChannels(ctx context.Context, username string, usercfg UserConfig) *channelExecer {
+	ctx = executil.WithOpts(ctx, executil.Opts{
+		Username: username,
+		UseSudo:  usercfg.UseSudo,
+	})
+	return newChannelExecer(ctx, false)
+}
+
 func (e *channelExecer) isTemp() bool { return e.prefix != "" }
 
 func (e *channelExecer) withContext(ctx context.Context) *channelExecer {
@@ -158,6 +228,13 @@ func (e *channelExecer) withContext(ctx context.Context) *channelExecer {
 	return &c
 }
 
+// withSudo returns a copy of e that uses sudo to run as its user.
+func (e *channelExecer) withSudo() *channelExecer {
+	o := executil.OptsFromContext(e.ctx)
+	o.UseSudo = true
+	return e.withContext(executil.WithOpts(e.ctx, o))
+}
+
 func (e *channelExecer) add(name, url string) (string, error) {
 	name = e.prefix + name
 	return name, e.exec("--add", url, name)
@@ -214,27 +291,30 @@ func (e *channelExecer) rollback() error {
 	return e.exec("--rollback")
 }
 
-func (e *channelExecer) removeAll() error {
+// removeAll removes all temporary channels and returns how many were removed.
+func (e *channelExecer) removeAll() (int, error) {
 	if !e.isTemp() {
 		panic("rollbackAll erroneously called on not-temp channelExecer")
 	}
 
 	list, err := e.list()
 	if err != nil {
-		return errors.Wrap(err, "cannot get channels list")
+		return 0, errors.Wrap(err, "cannot get channels list")
 	}
 
+	var removed int
 	for name := range list {
 		if !strings.HasPrefix(name, e.prefix) {
 			continue
 		}
 
 		if err := e.exec("--remove", name); err != nil {
-			return errors.Wrapf(err, "cannot remove channel %q", name)
+			return removed, errors.Wrapf(err, "cannot remove channel %q", name)
 		}
+		removed++
 	}
 
-	return nil
+	return removed, nil
 }
 
 func (e *channelExecer) exec(args ...string) error {
@@ -1,10 +1,22 @@
 package bonito
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/diamondburned/nix-bonito/bonito/internal/nixutil"
 	"github.com/hexops/autogold"
 )
 
@@ -18,10 +30,11 @@ func TestResolveGit(t *testing.T) {
 				t.Fatal("cannot parse channel input:", err)
 			}
 
-			resolvedURL, err := input.Resolve(context.Background())
+			resolved, err := input.Resolve(context.Background())
 			if err != nil {
 				t.Fatalf("cannot resolve %q: %v", input.URL, err)
 			}
+			resolvedURL := resolved.URL
 
 			want.Equal(t, resolvedURL)
 
@@ -52,3 +65,557 @@ func TestResolveGit(t *testing.T) {
 	do("gitlab:diamondburned/dotfiles a9bb5c0",
 		autogold.Want("gitlab-short-rev-2", "https://gitlab.com/diamondburned/dotfiles/-/archive/a9bb5c0/dotfiles-a9bb5c0.tar.gz"))
 }
+
+func TestResolveGitHosts(t *testing.T) {
+	const rev = "a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88"
+
+	// Pretend that every ref points to rev.
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		ref := cmd.Args[len(cmd.Args)-1]
+		fmt.Fprintf(cmd.Stdout, "%s\trefs/heads/%s\n", rev, ref)
+		return nil
+	})
+
+	do := func(inURL string, want autogold.Value) {
+		t.Run(want.Name(), func(t *testing.T) {
+			input, err := ParseChannelInput(inURL)
+			if err != nil {
+				t.Fatal("cannot parse channel input:", err)
+			}
+
+			resolved, err := input.Resolve(ctx)
+			if err != nil {
+				t.Fatalf("cannot resolve %q: %v", input.URL, err)
+			}
+
+			want.Equal(t, resolved.URL)
+		})
+	}
+
+	do("gitlab:diamondburned/dotfiles main",
+		autogold.Want("gitlab", "https://gitlab.com/diamondburned/dotfiles/-/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88/dotfiles-a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+	do("codeberg:forgejo/forgejo main",
+		autogold.Want("codeberg", "https://codeberg.org/forgejo/forgejo/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+	do("codeberg:codeberg.org/forgejo/forgejo main",
+		autogold.Want("codeberg-host", "https://codeberg.org/forgejo/forgejo/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+	do("gitea:gitea/tea main",
+		autogold.Want("gitea", "https://gitea.com/gitea/tea/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+	do("gitea:git.example.com/user/repo main",
+		autogold.Want("gitea-self-hosted", "https://git.example.com/user/repo/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+	do("bitbucket:workspace/repo main",
+		autogold.Want("bitbucket", "https://bitbucket.org/workspace/repo/get/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+	do("git://bitbucket.org/workspace/repo main",
+		autogold.Want("bitbucket-git", "https://bitbucket.org/workspace/repo/get/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+	do("gitsrht:~diamondburned/dotfiles main",
+		autogold.Want("gitsrht-tilde", "https://git.sr.ht/~diamondburned/dotfiles/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+	do("sourcehut:~diamondburned/dotfiles main",
+		autogold.Want("sourcehut-tilde", "https://git.sr.ht/~diamondburned/dotfiles/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+	do("sourcehut:diamondburned/dotfiles main",
+		autogold.Want("sourcehut-no-tilde", "https://git.sr.ht/~diamondburned/dotfiles/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+	do("git://git.sr.ht/~diamondburned/dotfiles main",
+		autogold.Want("sourcehut-git", "https://git.sr.ht/~diamondburned/dotfiles/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz"))
+}
+
+func TestGitSchemesRegistered(t *testing.T) {
+	// Every scheme that gitRemote knows must also be registered, otherwise
+	// its inputs are never resolved.
+	for scheme, service := range gitSchemes {
+		if !service {
+			continue
+		}
+		in := ChannelInput{URL: ChannelURL(scheme + ":git.example.com/user/repo"), Version: "main"}
+		if _, _, err := gitRemote(in); err != nil {
+			t.Errorf("scheme %q is not handled by gitRemote: %v", scheme, err)
+		}
+		if !in.CanResolve() {
+			t.Errorf("scheme %q has no resolver", scheme)
+		}
+		if _, ok := opaqueExpanders[scheme]; !ok {
+			t.Errorf("scheme %q has no opaque expander", scheme)
+		}
+		if err := in.URL.Validate(); err != nil {
+			t.Errorf("scheme %q is rejected: %v", scheme, err)
+		}
+	}
+}
+
+func TestGitSSHRemote(t *testing.T) {
+	tests := []struct {
+		url    string
+		remote string
+		https  string
+		host   string
+	}{
+		{
+			url:    "git+ssh://git@github.com/owner/repo",
+			remote: "ssh://git@github.com/owner/repo",
+			https:  "https://github.com/owner/repo",
+			host:   "github.com",
+		},
+		{
+			url:    "git+ssh://git@git.example.com:2222/user/repo.git",
+			remote: "ssh://git@git.example.com:2222/user/repo.git",
+			https:  "https://git.example.com:2222/user/repo.git",
+			host:   "git.example.com:2222",
+		},
+	}
+
+	for _, test := range tests {
+		in := ChannelInput{URL: ChannelURL(test.url), Version: "main"}
+
+		remote, ok := gitSSHRemote(in)
+		if !ok || remote != test.remote {
+			t.Errorf("gitSSHRemote(%q) = %q, %v, want %q", test.url, remote, ok, test.remote)
+		}
+
+		u, host, err := gitRemote(in)
+		if err != nil {
+			t.Errorf("gitRemote(%q): %v", test.url, err)
+			continue
+		}
+		if u.String() != test.https || host != test.host {
+			t.Errorf("gitRemote(%q) = %q, %q, want %q, %q", test.url, u, host, test.https, test.host)
+		}
+	}
+
+	if _, ok := gitSSHRemote(ChannelInput{URL: "git://github.com/owner/repo"}); ok {
+		t.Error("git:// input has an SSH remote")
+	}
+	if err := ChannelURL("git+ssh://git@github.com").Validate(); err == nil {
+		t.Error("git+ssh URL without a repository is valid")
+	}
+}
+
+func TestResolveGitSSH(t *testing.T) {
+	const rev = "a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88"
+
+	stateDir := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", stateDir)
+
+	var remotes, fetched, roots []string
+	fetchHead := rev
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		switch {
+		case slices.Contains(cmd.Args, "ls-remote"):
+			remotes = append(remotes, cmd.Args[len(cmd.Args)-2])
+			fmt.Fprintf(cmd.Stdout, "%s\trefs/heads/main\n", rev)
+		case slices.Contains(cmd.Args, "fetch"):
+			remotes = append(remotes, cmd.Args[len(cmd.Args)-2])
+			fetched = append(fetched, cmd.Args[len(cmd.Args)-1])
+		case slices.Contains(cmd.Args, "rev-parse"):
+			fmt.Fprintln(cmd.Stdout, fetchHead)
+		case cmd.Args[0] == "nix-store" && cmd.Args[1] == "--realise":
+			roots = append(roots, cmd.Args[4])
+		case cmd.Args[0] == "nix-store":
+			fmt.Fprintf(cmd.Stdout, "/nix/store/aaaa-%s\n", filepath.Base(cmd.Args[len(cmd.Args)-1]))
+		}
+		return nil
+	})
+
+	resolve := func(inURL string) string {
+		t.Helper()
+		input, err := ParseChannelInput(inURL)
+		if err != nil {
+			t.Fatal("cannot parse channel input:", err)
+		}
+		resolved, err := input.Resolve(ctx)
+		if err != nil {
+			t.Fatalf("cannot resolve %q: %v", input.URL, err)
+		}
+		return resolved.URL
+	}
+
+	// Even known hosts are archived locally, since the repository may be
+	// private and so Nix can't fetch their HTTPS archive.
+	if got, want := resolve("git+ssh://git@github.com/owner/repo main"),
+		"file:///nix/store/aaaa-"+rev+".tar.gz"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got, want := resolve("git+ssh://git@git.example.com/user/repo main"),
+		"file:///nix/store/aaaa-"+rev+".tar.gz"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	wantRemotes := []string{
+		"ssh://git@github.com/owner/repo",
+		"ssh://git@github.com/owner/repo",
+		"ssh://git@git.example.com/user/repo",
+		"ssh://git@git.example.com/user/repo",
+	}
+	if !slices.Equal(remotes, wantRemotes) {
+		t.Errorf("remotes = %q, want %q", remotes, wantRemotes)
+	}
+
+	// The archive is kept from being garbage-collected.
+	root := filepath.Join(stateDir, "bonito", "gcroots", "aaaa-"+rev+".tar.gz")
+	if want := []string{root, root}; !slices.Equal(roots, want) {
+		t.Errorf("roots = %q, want %q", roots, want)
+	}
+
+	// The resolved ref is fetched instead of the commit, which most servers
+	// refuse to fetch.
+	if want := []string{"refs/heads/main", "refs/heads/main"}; !slices.Equal(fetched, want) {
+		t.Errorf("fetched %q, want %q", fetched, want)
+	}
+
+	// The ref moved between ls-remote and fetching it.
+	fetchHead = strings.Repeat("b", 40)
+	input, err := ParseChannelInput("git+ssh://git@git.example.com/user/repo main")
+	if err != nil {
+		t.Fatal("cannot parse channel input:", err)
+	}
+	if _, err := input.Resolve(ctx); err == nil || !strings.Contains(err.Error(), "moved") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestArchiveGitCommitOtherUser(t *testing.T) {
+	const commit = "a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88"
+
+	t.Setenv("USER", "bonito-someone-else")
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	tmp := filepath.Join(t.TempDir(), "tmp.alice")
+
+	var calls []string
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		user, args := "self", cmd.Args
+		if args[0] == "sudo" {
+			user, args = args[2], args[3:]
+		}
+		calls = append(calls, user+" "+args[0]+" "+args[1])
+
+		switch {
+		case args[0] == "mktemp":
+			fmt.Fprintln(cmd.Stdout, tmp)
+		case slices.Contains(args, "rev-parse"):
+			fmt.Fprintln(cmd.Stdout, commit)
+		case args[0] == "nix-store" && args[1] == "--add":
+			fmt.Fprintf(cmd.Stdout, "/nix/store/aaaa-%s\n", filepath.Base(args[len(args)-1]))
+		}
+		return nil
+	})
+	ctx = executil.WithOpts(ctx, executil.Opts{Username: "bonito-alice", UseSudo: true})
+
+	if _, err := archiveGitCommit(ctx, "ssh://git@git.example.com/user/repo", "refs/heads/main", commit); err != nil {
+		t.Fatal("cannot archive:", err)
+	}
+
+	// The user makes and removes the temporary directory itself, since the
+	// current user can't give it to them.
+	autogold.Want("calls", []string{
+		"bonito-alice mktemp -d",
+		"bonito-alice git init",
+		"bonito-alice git -C",
+		"bonito-alice git -C",
+		"bonito-alice git -C",
+		"bonito-alice nix-store --add",
+		"self nix-store --realise",
+		"bonito-alice rm -rf",
+	}).Equal(t, calls)
+}
+
+func TestResolveGitMirror(t *testing.T) {
+	// Make a local clone of github.com/owner/repo with a main branch.
+	mirrors := t.TempDir()
+	repo := filepath.Join(mirrors, "owner", "repo")
+
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=bonito", "GIT_AUTHOR_EMAIL=bonito@example.com",
+			"GIT_COMMITTER_NAME=bonito", "GIT_COMMITTER_EMAIL=bonito@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Skipf("cannot run git %q: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	if err := os.MkdirAll(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "--quiet", "--initial-branch=main")
+	git("commit", "--quiet", "--allow-empty", "--message=init")
+	local := git("rev-parse", "HEAD")
+
+	const remote = "a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88"
+
+	// Run git for real on the mirror, but pretend that every ref of the
+	// remote points to remote.
+	var remoteCalls [][]string
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		if slices.Contains(cmd.Args, repo) {
+			return cmd.Run()
+		}
+		remoteCalls = append(remoteCalls, cmd.Args)
+		fmt.Fprintf(cmd.Stdout, "%s\t%s\n", remote, cmd.Args[len(cmd.Args)-1])
+		return nil
+	})
+	ctx = withGitMirrors(ctx, map[string]string{"github.com": mirrors})
+
+	resolve := func(input string) string {
+		t.Helper()
+		in, err := ParseChannelInput(input)
+		if err != nil {
+			t.Fatal("cannot parse channel input:", err)
+		}
+		resolved, err := in.Resolve(ctx)
+		if err != nil {
+			t.Fatalf("cannot resolve %q: %v", input, err)
+		}
+		return resolved.Rev
+	}
+
+	if rev := resolve("github:owner/repo refs/heads/main"); rev != local {
+		t.Errorf("main resolved to %q instead of the mirror's %q", rev, local)
+	}
+	if len(remoteCalls) > 0 {
+		t.Errorf("remote was queried despite the mirror: %q", remoteCalls)
+	}
+
+	// The mirror doesn't have this branch, so the remote is used.
+	if rev := resolve("github:owner/repo refs/heads/unstable"); rev != remote {
+		t.Errorf("unstable resolved to %q instead of the remote's %q", rev, remote)
+	}
+	if len(remoteCalls) != 1 {
+		t.Errorf("remote was not queried exactly once: %q", remoteCalls)
+	}
+
+	// Other repositories have no mirror.
+	remoteCalls = nil
+	if rev := resolve("github:owner/other refs/heads/main"); rev != remote {
+		t.Errorf("other repository resolved to %q instead of the remote's %q", rev, remote)
+	}
+	if len(remoteCalls) != 1 {
+		t.Errorf("remote was not queried exactly once: %q", remoteCalls)
+	}
+}
+
+func TestGitMirror(t *testing.T) {
+	ctx := withGitMirrors(context.Background(), map[string]string{
+		"github.com":                 "/srv/git/github",
+		"github.com/NixOS/nixpkgs":   "/srv/git/nixpkgs.git",
+		"gitlab.example.com/group/":  "/srv/git/group",
+		"github.com/NixOS/nixpkgs-x": "/srv/git/unused",
+	})
+
+	tests := map[string]string{
+		"https://github.com/NixOS/nixpkgs":         "/srv/git/nixpkgs.git",
+		"https://github.com/NixOS/nixpkgs.git":     "/srv/git/github/NixOS/nixpkgs.git",
+		"https://github.com/owner/repo":            "/srv/git/github/owner/repo",
+		"https://gitlab.example.com/group/a/b":     "/srv/git/group/a/b",
+		"https://gitlab.example.com/other/project": "",
+	}
+
+	for remote, want := range tests {
+		u, err := url.Parse(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := gitMirror(ctx, u); got != want {
+			t.Errorf("mirror of %q is %q, want %q", remote, got, want)
+		}
+	}
+}
+
+func TestResolveGitAcknowledgedPin(t *testing.T) {
+	// Short commits are looked up as refs first, which they aren't.
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		return nil
+	})
+
+	cfg, err := NewConfigFromReader(strings.NewReader(`
+[global]
+pinned = ["nixpkgs-old"]
+
+[global.channels]
+nixpkgs-old = "github:NixOS/nixpkgs a9bb5c0f"
+nixpkgs-oops = "github:NixOS/nixpkgs a9bb5c0f2f68"
+`))
+	if err != nil {
+		t.Fatal("cannot parse config:", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("config is invalid:", err)
+	}
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	s := State{Config: cfg}
+	if _, err := s.Resolve(ctx); err != nil {
+		t.Fatal("cannot resolve:", err)
+	}
+
+	warned := logs.String()
+	if !strings.Contains(warned, "nixpkgs a9bb5c0f2f68") {
+		t.Errorf("accidental pin was not warned about, got logs:\n%s", warned)
+	}
+	if strings.Contains(warned, "nixpkgs a9bb5c0f\"") {
+		t.Errorf("acknowledged pin was warned about, got logs:\n%s", warned)
+	}
+
+	cfg.Global.Pinned = []string{"nixpkgs"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), `pinned channel "nixpkgs"`) {
+		t.Errorf("unexpected error for unknown pinned channel: %v", err)
+	}
+}
+
+func TestResolveGitToken(t *testing.T) {
+	const rev = "a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88"
+	t.Setenv("BONITO_TOKEN_GITLAB_EXAMPLE_COM", "hunter2")
+
+	var env []string
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		if strings.Contains(strings.Join(cmd.Args, " "), "hunter2") {
+			t.Errorf("token leaked into args %q", cmd.Args)
+		}
+		env = cmd.Env
+		fmt.Fprintf(cmd.Stdout, "%s\trefs/heads/main\n", rev)
+		return nil
+	})
+
+	input := ChannelInput{URL: "gitlab:gitlab.example.com/group/repo", Version: "main"}
+
+	resolved, err := input.Resolve(ctx)
+	if err != nil {
+		t.Fatal("cannot resolve:", err)
+	}
+
+	autogold.Want("url", "https://gitlab.example.com/group/repo/-/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88/repo-a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz").Equal(t, resolved.URL)
+
+	for _, want := range []string{
+		"GIT_CONFIG_KEY_0=http.https://gitlab.example.com/.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Bearer hunter2",
+	} {
+		if !slices.Contains(env, want) {
+			t.Errorf("git env is missing %q", want)
+		}
+	}
+}
+
+func TestResolveGitWildcardRef(t *testing.T) {
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		fmt.Fprint(cmd.Stdout, ""+
+			"1111111111111111111111111111111111111111\trefs/tags/asahi-6.1\n"+
+			"1111111111111111111111111111111111111112\trefs/tags/asahi-6.1^{}\n"+
+			"2222222222222222222222222222222222222221\trefs/tags/asahi-6.2\n"+
+			"2222222222222222222222222222222222222222\trefs/tags/asahi-6.2^{}\n")
+		return nil
+	})
+
+	input := ChannelInput{URL: "github:AsahiLinux/linux", Version: "refs/tags/asahi-6.*"}
+
+	resolved, err := input.Resolve(ctx)
+	if err != nil {
+		t.Fatal("cannot resolve:", err)
+	}
+
+	lock := newChannelLock(resolved, nixutil.StorePath{}, "")
+	b, err := json.Marshal(lock.Meta)
+	if err != nil {
+		t.Fatal("cannot marshal lock meta:", err)
+	}
+
+	autogold.Want("meta", `{"ref":"refs/tags/asahi-6.2","rev":"2222222222222222222222222222222222222222"}`).Equal(t, string(b))
+}
+
+func TestResolveGitUnpinned(t *testing.T) {
+	// Pretend that the remote has a branch with no commit.
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		fmt.Fprint(cmd.Stdout, "\trefs/heads/master\n")
+		return nil
+	})
+
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "master"}
+
+	_, err := input.Resolve(ctx)
+	if err == nil || !strings.Contains(err.Error(), "did not resolve to a commit") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestResolutionTraceFallback(t *testing.T) {
+	// No ref matches, so the version is used as a commit hash.
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		return nil
+	})
+
+	var traces []ResolutionTrace
+	ctx = WithResolutionTrace(ctx, func(t ResolutionTrace) {
+		traces = append(traces, t)
+	})
+
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "deadbeef"}
+
+	if _, err := resolveInputs(ctx, map[ChannelInput]struct{}{input: {}}); err != nil {
+		t.Fatal("cannot resolve:", err)
+	}
+
+	if len(traces) != 1 {
+		t.Fatalf("got %d traces, want 1", len(traces))
+	}
+
+	var steps []string
+	for _, step := range traces[0].Steps {
+		steps = append(steps, step.Name)
+	}
+
+	autogold.Want("steps", []string{"requested", "ls-remote", "commit-literal-fallback", "resolved"}).Equal(t, steps)
+
+	fallback := traces[0].Steps[2]
+	if fallback.Attrs["commit"] != "deadbeef" {
+		t.Errorf("fallback step has unexpected attrs %v", fallback.Attrs)
+	}
+}
+
+func TestResolveGitAlternatives(t *testing.T) {
+	const commit = "3333333333333333333333333333333333333333"
+
+	// The remote has no stable tags, only the nixos-unstable branch.
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		if cmd.Args[len(cmd.Args)-1] == "nixos-unstable" {
+			fmt.Fprintf(cmd.Stdout, "%s\trefs/heads/nixos-unstable\n", commit)
+		}
+		return nil
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "refs/tags/stable* || nixos-unstable"}
+
+		resolved, err := input.Resolve(ctx)
+		if err != nil {
+			t.Fatal("cannot resolve:", err)
+		}
+
+		lock := newChannelLock(resolved, nixutil.StorePath{}, "")
+		b, err := json.Marshal(lock.Meta)
+		if err != nil {
+			t.Fatal("cannot marshal lock meta:", err)
+		}
+
+		autogold.Want("meta", `{"ref":"refs/heads/nixos-unstable","rev":"3333333333333333333333333333333333333333","alternative":"nixos-unstable"}`).Equal(t, string(b))
+	})
+
+	t.Run("none", func(t *testing.T) {
+		input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "refs/tags/stable* || refs/tags/beta*"}
+
+		_, err := input.Resolve(ctx)
+		if err == nil || !strings.Contains(err.Error(), "refs/tags/beta*") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable ||"}
+
+		_, err := input.Resolve(ctx)
+		if err == nil || !strings.Contains(err.Error(), "empty alternative") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -1,8 +1,18 @@
 package bonito
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
 
 	"github.com/pelletier/go-toml/v2"
 	"github.com/pkg/errors"
@@ -16,6 +26,68 @@ type Config struct {
 		// PreferredUser is the preferred user to use for nix-channel invocations.
 		// If this is empty, then it will be picked automatically.
 		PreferredUser string `toml:"preferred_user,omitempty"`
+		// Mirrors maps URL prefixes to the prefixes of their mirrors. Resolved
+		// channel URLs starting with a key are fetched from the mirror instead,
+		// e.g. "https://github.com/" = "https://mirror.corp/github/".
+		Mirrors map[string]string `toml:"mirrors,omitempty"`
+		// MaxDownloadSize, if not zero, caps the total size in bytes of the
+		// channel URLs that are fetched in one run, as advertised by their
+		// servers. URLs with an unknown size are not counted.
+		MaxDownloadSize int64 `toml:"max_download_size,omitempty"`
+		// MaxDownloadSizeAction is what to do when MaxDownloadSize is exceeded:
+		// "abort" (the default) or "warn".
+		MaxDownloadSizeAction string `toml:"max_download_size_action,omitempty"`
+		// PerUserLocks, if true, splits the lock file into one lock file per
+		// user next to it, so that each user's channels are locked in their
+		// own file. Channels that no user uses stay in the main lock file.
+		PerUserLocks bool `toml:"per_user_locks,omitempty"`
+		// LockBackups is the number of previous versions of each lock file to
+		// keep next to it as <name>.lock.json.1, .2 and so on, the newest
+		// first. It is 0, keeping none, by default.
+		LockBackups int `toml:"lock_backups,omitempty"`
+		// SkipUserChannels, if true, makes Apply only maintain the lock
+		// without adding the channels to the users' channels, e.g. on systems
+		// whose channels are managed by NixOS or that only use Flakes.
+		SkipUserChannels bool `toml:"skip_user_channels,omitempty"`
+		// NixPath is a list of static NIX_PATH entries that are not managed by
+		// bonito, e.g. "nixos-config=/etc/nixos/configuration.nix". They are
+		// appended in order after the channels by include-flags.
+		NixPath []string `toml:"nix_path,omitempty"`
+		// EvalNixPath is a list of NIX_PATH entries that bonito's own Nix
+		// evaluations use before the ambient NIX_PATH, e.g. to pin nixpkgs
+		// with "nixpkgs=/nix/store/...-source", so that they evaluate the
+		// same everywhere.
+		EvalNixPath []string `toml:"eval_nix_path,omitempty"`
+		// ChannelUsers maps channel names to the users that fetch them
+		// instead of PreferredUser, e.g. to fetch system channels as root and
+		// others as a service account. The users must be in Users, and their
+		// UseSudo applies.
+		ChannelUsers map[string]string `toml:"channel_users,omitempty"`
+		// NixChannelPath, NixInstantiatePath, NixStorePath, GitPath and
+		// ReadlinkPath override the paths of the binaries that bonito runs,
+		// which are otherwise looked up in $PATH. They are useful when the
+		// binaries aren't in the $PATH of a user that bonito runs them as.
+		NixChannelPath     string `toml:"nix_channel_path,omitempty"`
+		NixInstantiatePath string `toml:"nix_instantiate_path,omitempty"`
+		NixStorePath       string `toml:"nix_store_path,omitempty"`
+		GitPath            string `toml:"git_path,omitempty"`
+		ReadlinkPath       string `toml:"readlink_path,omitempty"`
+		// GitMirrors maps Git hosts or repositories, e.g. "github.com" or
+		// "github.com/NixOS/nixpkgs", to local clones or directories of
+		// clones that refs are looked up in before the remote. For a host,
+		// the repository's path is appended to the directory.
+		GitMirrors map[string]string `toml:"git_mirrors,omitempty"`
+		// HostTokens maps Git hosts to their tokens, like the
+		// BONITO_TOKEN_<HOST> variables, as secrets that are encrypted at
+		// rest: "sops://<file>#<key>" or "age://<file>?identity=<file>". The
+		// secrets are decrypted when they're first needed. The variables take
+		// precedence.
+		HostTokens map[string]string `toml:"host_tokens,omitempty"`
+		// BasicAuth maps hosts that serve archives behind HTTP basic auth to
+		// their credentials, "<user>:<password>", as secrets like HostTokens.
+		// Nix gets them through a netrc file that only exists while it
+		// fetches, so they're never written to the lock. See netrc.go.
+		BasicAuth map[string]string `toml:"basic_auth,omitempty"`
 		ChannelRegistry
 	} `toml:"global"`
 
@@ -23,20 +95,593 @@ type Config struct {
 	Flakes struct {
 		Enable bool   `toml:"enable"`
 		Output string `toml:"output"` // ("nix") or "flakes"
+		// Include, if not empty, limits the generated registry to only these
+		// channels. Otherwise, all global and flakes channels are included, and
+		// each of them must have a flake.nix.
+		Include []string `toml:"include,omitempty"`
+		// PerUser, if true, also writes a user registry for each user into
+		// their home, which has the user's channels on top of the global and
+		// flakes ones. See GenerateUserNixRegistry.
+		PerUser bool `toml:"per_user,omitempty"`
 		ChannelRegistry
 	} `toml:"flakes"`
 
+	// Profile configures the Nix expression of channels that
+	// GenerateNixProfile generates.
+	Profile struct {
+		// Format is how each channel is written: "store-paths" (the default)
+		// or "fetchTarball". See ProfileStorePaths and ProfileFetchTarball.
+		Format string `toml:"format,omitempty"`
+	} `toml:"profile"`
+
 	// Users maps the usernames to their respective UserConfig.
 	Users map[Username]UserConfig `toml:"users"`
 }
 
+// BinaryPaths returns the configured paths of the binaries that bonito runs,
+// keyed by their names. Binaries without a configured path are not in the
+// map.
+func (cfg Config) BinaryPaths() map[string]string {
+	paths := make(map[string]string)
+	for name, path := range map[string]string{
+		"nix-channel":     cfg.Global.NixChannelPath,
+		"nix-instantiate": cfg.Global.NixInstantiatePath,
+		"nix-store":       cfg.Global.NixStorePath,
+		"git":             cfg.Global.GitPath,
+		"readlink":        cfg.Global.ReadlinkPath,
+	} {
+		if path != "" {
+			paths[name] = path
+		}
+	}
+	return paths
+}
+
 // NewConfigFromReader creates a new Config by decoding the given reader as a
-// TOML file.
+// TOML file. Keys that the Config doesn't have are an error, so that typos
+// such as use_sudo for use-sudo don't go unnoticed.
 func NewConfigFromReader(r io.Reader) (Config, error) {
 	var cfg Config
 	cfg.Flakes.Output = "nix"
-	err := toml.NewDecoder(r).Decode(&cfg)
-	return cfg, err
+
+	dec := toml.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&cfg); err != nil {
+		var strictErr *toml.StrictMissingError
+		if errors.As(err, &strictErr) {
+			return cfg, unknownKeysError(strictErr)
+		}
+		return cfg, err
+	}
+
+	if err := cfg.expandGroups(); err != nil {
+		return cfg, err
+	}
+
+	switch cfg.Flakes.Output {
+	case "nix", "flakes":
+	case "":
+		// An explicit output = "" replaces the default.
+		if cfg.Flakes.Enable {
+			slog.Warn(`flakes output is empty, using "nix"`)
+		}
+		cfg.Flakes.Output = "nix"
+	default:
+		return cfg, fmt.Errorf("unknown flakes output format %q", cfg.Flakes.Output)
+	}
+
+	return cfg, nil
+}
+
+// unknownKeysError turns the given error into one that names each unknown key
+// and its line.
+func unknownKeysError(err *toml.StrictMissingError) error {
+	keys := make([]string, len(err.Errors))
+	for i, keyErr := range err.Errors {
+		row, _ := keyErr.Position()
+		keys[i] = fmt.Sprintf("%q on line %d", strings.Join(keyErr.Key(), "."), row)
+	}
+	return fmt.Errorf("unknown config keys %s", strings.Join(keys, ", "))
+}
+
+// ConfigFragmentExt is the extension of the config fragments that
+// NewConfigFromDir reads.
+const ConfigFragmentExt = ".toml"
+
+// overridableTables are the names of the config tables whose entries may be
+// redefined by later config fragments. All other values must not conflict.
+var overridableTables = map[string]bool{
+	"channels":      true,
+	"aliases":       true,
+	"patches":       true,
+	"mirrors":       true,
+	"channel_users": true,
+	"git_mirrors":   true,
+	"host_tokens":   true,
+	"basic_auth":    true,
+}
+
+// NewConfigFromDir creates a new Config by merging all config fragments, the
+// *.toml files, in the given directory. Fragments are merged in lexical order
+// of their names. Tables are merged recursively, and entries of channels,
+// aliases, patches and mirrors tables in later fragments override those in
+// earlier fragments. Any other value that is set to different values by two
+// fragments, e.g. global.preferred_user, is an error.
+func NewConfigFromDir(dir string) (Config, error) {
+	fragments, err := ReadConfigFragments(dir)
+	if err != nil {
+		return Config{}, err
+	}
+	return NewConfigFromFragments(fragments)
+}
+
+// ReadConfigFragments reads the config fragments in the given directory. The
+// returned map maps the paths of the fragments to their contents.
+func ReadConfigFragments(dir string) (map[string][]byte, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+ConfigFragmentExt))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("config directory %q has no %s files", dir, ConfigFragmentExt)
+	}
+
+	fragments := make(map[string][]byte, len(paths))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fragments[path] = b
+	}
+
+	return fragments, nil
+}
+
+// NewConfigFromFragments creates a new Config by merging the given config
+// fragments, which map names to TOML documents, the way NewConfigFromDir does.
+func NewConfigFromFragments(fragments map[string][]byte) (Config, error) {
+	names := make([]string, 0, len(fragments))
+	for name := range fragments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merged := make(map[string]any)
+	for _, fragment := range names {
+		// Decode the fragment on its own first, so that errors have the
+		// fragment's line numbers.
+		if _, err := NewConfigFromReader(bytes.NewReader(fragments[fragment])); err != nil {
+			return Config{}, errors.Wrapf(err, "cannot parse %q", fragment)
+		}
+
+		var doc map[string]any
+		if err := toml.Unmarshal(fragments[fragment], &doc); err != nil {
+			return Config{}, errors.Wrapf(err, "cannot parse %q", fragment)
+		}
+
+		if err := mergeConfigTables(merged, doc, ""); err != nil {
+			return Config{}, errors.Wrapf(err, "cannot merge %q", fragment)
+		}
+	}
+
+	b, err := toml.Marshal(merged)
+	if err != nil {
+		return Config{}, errors.Wrap(err, "cannot encode merged config")
+	}
+
+	return NewConfigFromReader(bytes.NewReader(b))
+}
+
+// mergeConfigTables merges the src table into the dst table. key is the
+// dotted key of the tables.
+func mergeConfigTables(dst, src map[string]any, key string) error {
+	for name, value := range src {
+		valueKey := name
+		if key != "" {
+			valueKey = key + "." + name
+		}
+
+		old, ok := dst[name]
+		if !ok {
+			dst[name] = value
+			continue
+		}
+
+		oldTable, oldIsTable := old.(map[string]any)
+		table, isTable := value.(map[string]any)
+		if oldIsTable && isTable {
+			if err := mergeConfigTables(oldTable, table, valueKey); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if reflect.DeepEqual(old, value) {
+			continue
+		}
+
+		if overridableTables[key[strings.LastIndexByte(key, '.')+1:]] && !oldIsTable && !isTable {
+			slog.Debug(
+				"config fragment overrides an earlier value",
+				"key", valueKey,
+				"old", old,
+				"new", value)
+			dst[name] = value
+			continue
+		}
+
+		return fmt.Errorf("%s is already set to a different value", valueKey)
+	}
+
+	return nil
+}
+
+// Validate checks that the config is internally consistent: all channel URLs
+// must be valid, all aliases must point to existing channels, and the
+// preferred user must be configured. It does not run any external commands.
+func (cfg Config) Validate() error {
+	switch cfg.Flakes.Output {
+	case "", "nix", "flakes":
+		// GenerateNixRegistry defaults an empty output to "nix".
+	default:
+		return fmt.Errorf("unknown flakes output format %q", cfg.Flakes.Output)
+	}
+
+	switch cfg.Profile.Format {
+	case "", ProfileStorePaths, ProfileFetchTarball:
+	default:
+		return fmt.Errorf("unknown profile format %q, expected %s or %s",
+			cfg.Profile.Format, ProfileStorePaths, ProfileFetchTarball)
+	}
+
+	if cfg.Global.MaxDownloadSize < 0 {
+		return fmt.Errorf("max download size %d is negative", cfg.Global.MaxDownloadSize)
+	}
+
+	if cfg.Global.LockBackups < 0 {
+		return fmt.Errorf("lock backups %d is negative", cfg.Global.LockBackups)
+	}
+
+	switch cfg.Global.MaxDownloadSizeAction {
+	case "", "abort", "warn":
+	default:
+		return fmt.Errorf("unknown max download size action %q, expected abort or warn", cfg.Global.MaxDownloadSizeAction)
+	}
+
+	for _, entry := range cfg.Global.NixPath {
+		if !validNixPathEntry(entry) {
+			return fmt.Errorf("invalid nix_path entry %q, expected name=path or path", entry)
+		}
+	}
+	for _, entry := range cfg.Global.EvalNixPath {
+		if !validNixPathEntry(entry) {
+			return fmt.Errorf("invalid eval_nix_path entry %q, expected name=path or path", entry)
+		}
+	}
+
+	for host, ref := range cfg.Global.HostTokens {
+		if _, err := parseSecretRef(ref); err != nil {
+			return errors.Wrapf(err, "invalid token of host %q", host)
+		}
+	}
+	for host, ref := range cfg.Global.BasicAuth {
+		if !validNetrcHost(host) {
+			return fmt.Errorf("invalid basic_auth host %q", host)
+		}
+		if _, err := parseSecretRef(ref); err != nil {
+			return errors.Wrapf(err, "invalid basic auth of host %q", host)
+		}
+	}
+
+	for repo, dir := range cfg.Global.GitMirrors {
+		if repo == "" || strings.Contains(repo, "://") {
+			return fmt.Errorf("invalid git mirror %q, expected a host or host/path", repo)
+		}
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("git mirror of %q must be an absolute path, got %q", repo, dir)
+		}
+	}
+
+	channelNames := make(map[string]bool)
+	for _, names := range cfg.ChannelNames() {
+		for _, name := range names {
+			channelNames[name] = true
+		}
+	}
+	for name, username := range cfg.Global.ChannelUsers {
+		if !channelNames[name] {
+			return fmt.Errorf("channel_users has unknown channel %q", name)
+		}
+		if _, ok := cfg.Users[username]; !ok {
+			return fmt.Errorf("user %q of channel %q in channel_users is not in [users]", username, name)
+		}
+	}
+	if _, err := cfg.inputUsers(); err != nil {
+		return err
+	}
+
+	if cfg.Global.PreferredUser != "" {
+		if _, ok := cfg.Users[cfg.Global.PreferredUser]; !ok {
+			return fmt.Errorf("preferred user %q is not in [users]", cfg.Global.PreferredUser)
+		}
+	}
+
+	scopes := map[string][]ChannelRegistry{
+		"global": {cfg.Global.ChannelRegistry},
+		"flakes": {cfg.Global.ChannelRegistry, cfg.Flakes.ChannelRegistry},
+	}
+	for username, usercfg := range cfg.Users {
+		scopes["user "+username] = []ChannelRegistry{cfg.Global.ChannelRegistry, usercfg.ChannelRegistry}
+	}
+
+	for scope, registries := range scopes {
+		channels, err := cfg.combineChannelRegistries(registries...)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s channels", scope)
+		}
+
+		if scope == "flakes" {
+			for _, name := range cfg.Flakes.Include {
+				if _, ok := channels[name]; !ok {
+					return fmt.Errorf("included flake %q is not a global or flakes channel", name)
+				}
+			}
+		}
+
+		for name, input := range channels {
+			if err := input.URL.Validate(); err != nil {
+				return errors.Wrapf(err, "invalid %s channel %q", scope, name)
+			}
+			if u, _ := input.URL.Parse(); input.Version != "" && (u.Scheme == "http" || u.Scheme == "https") {
+				if _, err := parseTarballHash(input.Version); err != nil {
+					return errors.Wrapf(err, "invalid %s channel %q", scope, name)
+				}
+			}
+		}
+	}
+
+	for username, usercfg := range cfg.Users {
+		for _, pattern := range usercfg.KeepChannels {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid keep-channels pattern %q of user %q", pattern, username)
+			}
+		}
+	}
+
+	for _, registry := range cfg.registries() {
+		for name := range registry.Patches {
+			if _, ok := registry.Channels[name]; !ok {
+				return fmt.Errorf("patched channel %q is not a channel of the same table", name)
+			}
+		}
+	}
+
+	if _, err := cfg.inputPatches(); err != nil {
+		return err
+	}
+
+	for _, registry := range cfg.registries() {
+		for _, name := range registry.Pinned {
+			if _, ok := registry.Channels[name]; !ok {
+				return fmt.Errorf("pinned channel %q is not a channel of the same table", name)
+			}
+		}
+		for _, name := range registry.Sudo {
+			_, isChannel := registry.Channels[name]
+			_, isAlias := registry.Aliases[name]
+			if !isChannel && !isAlias {
+				return fmt.Errorf("sudo channel %q is not a channel of the same table", name)
+			}
+		}
+	}
+
+	for _, shadow := range cfg.ShadowedChannels() {
+		slog.Warn(
+			"channel overrides the global channel of the same name with a different input",
+			"channel", shadow.Name,
+			"scope", shadow.Scope,
+			"input", shadow.Input,
+			"global_input", shadow.Global)
+	}
+
+	return nil
+}
+
+// VersionConflict is a channel URL that differently-named channels use with
+// different versions.
+type VersionConflict struct {
+	URL ChannelURL
+	// Versions maps each version to the names of the channels that use it.
+	Versions map[string][]string
+}
+
+// ConflictingVersions returns the channel URLs that differently-named
+// channels use with different versions, e.g. "github:NixOS/nixpkgs a" and
+// "github:NixOS/nixpkgs b", sorted by URL. A channel that overrides another
+// channel of the same name with a different version is not a conflict.
+func (cfg Config) ConflictingVersions() []VersionConflict {
+	byURL := make(map[ChannelURL]map[string][]string)
+	for input, names := range cfg.ChannelNames() {
+		if byURL[input.URL] == nil {
+			byURL[input.URL] = make(map[string][]string)
+		}
+		byURL[input.URL][input.Version] = names
+	}
+
+	urls := make([]ChannelURL, 0, len(byURL))
+	for url := range byURL {
+		urls = append(urls, url)
+	}
+	sort.Slice(urls, func(i, j int) bool { return urls[i] < urls[j] })
+
+	var conflicts []VersionConflict
+	for _, url := range urls {
+		versions := byURL[url]
+		if len(versions) < 2 {
+			continue
+		}
+
+		names := make(map[string]struct{})
+		for _, versionNames := range versions {
+			for _, name := range versionNames {
+				names[name] = struct{}{}
+			}
+		}
+
+		if len(names) > 1 {
+			conflicts = append(conflicts, VersionConflict{URL: url, Versions: versions})
+		}
+	}
+
+	return conflicts
+}
+
+// ShadowedChannel is a channel of the flakes or a user that overrides a global
+// channel of the same name with a different input.
+type ShadowedChannel struct {
+	// Name is the name of both channels.
+	Name string
+	// Scope is the scope that overrides the global channel, either "flakes"
+	// or "user <name>".
+	Scope string
+	// Input is the input of the channel in Scope.
+	Input ChannelInput
+	// Global is the input of the global channel that is overridden.
+	Global ChannelInput
+}
+
+// validNixPathEntry returns true if the NIX_PATH entry is either name=path or
+// just a path.
+func validNixPathEntry(entry string) bool {
+	name, path, hasName := strings.Cut(entry, "=")
+	if !hasName {
+		path = name
+	}
+	return path != "" && (!hasName || name != "")
+}
+
+// ShadowedChannels returns the channels and aliases of the flakes and the
+// users that override a global channel of the same name with a different
+// input, sorted by scope and then by name. Overriding with the same input is
+// not shadowing.
+func (cfg Config) ShadowedChannels() []ShadowedChannel {
+	global, err := cfg.combineChannelRegistries(cfg.Global.ChannelRegistry)
+	if err != nil {
+		// Validate reports it.
+		return nil
+	}
+
+	scopes := map[string]ChannelRegistry{"flakes": cfg.Flakes.ChannelRegistry}
+	for username, usercfg := range cfg.Users {
+		scopes["user "+username] = usercfg.ChannelRegistry
+	}
+
+	var shadowed []ShadowedChannel
+	for scope, registry := range scopes {
+		channels, err := cfg.combineChannelRegistries(cfg.Global.ChannelRegistry, registry)
+		if err != nil {
+			continue
+		}
+
+		names := make([]string, 0, len(registry.Channels)+len(registry.Aliases))
+		for name := range registry.Channels {
+			names = append(names, name)
+		}
+		for name := range registry.Aliases {
+			names = append(names, name)
+		}
+
+		for _, name := range names {
+			globalInput, ok := global[name]
+			if !ok || channels[name] == globalInput {
+				continue
+			}
+			shadowed = append(shadowed, ShadowedChannel{
+				Name:   name,
+				Scope:  scope,
+				Input:  channels[name],
+				Global: globalInput,
+			})
+		}
+	}
+
+	sort.Slice(shadowed, func(i, j int) bool {
+		if shadowed[i].Scope != shadowed[j].Scope {
+			return shadowed[i].Scope < shadowed[j].Scope
+		}
+		return shadowed[i].Name < shadowed[j].Name
+	})
+
+	return shadowed
+}
+
+// UnresolvableChannel is a channel whose URL scheme has no resolver in
+// ChannelResolvers, usually because of a typo such as "gihub:".
+type UnresolvableChannel struct {
+	// Name is the name of the channel.
+	Name string
+	// Scope is the table of the channel: "global", "flakes" or
+	// "user <name>".
+	Scope string
+	// Scheme is the unknown scheme of the channel's URL.
+	Scheme string
+}
+
+// UnresolvableChannels returns the channels whose schemes have no resolver,
+// sorted by scope and then by name. Channels whose URLs cannot be parsed at
+// all are left to Validate.
+func (cfg Config) UnresolvableChannels() []UnresolvableChannel {
+	scopes := map[string]ChannelRegistry{
+		"global": cfg.Global.ChannelRegistry,
+		"flakes": cfg.Flakes.ChannelRegistry,
+	}
+	for username, usercfg := range cfg.Users {
+		scopes["user "+username] = usercfg.ChannelRegistry
+	}
+
+	var unresolvable []UnresolvableChannel
+	for scope, registry := range scopes {
+		for name, input := range registry.Channels {
+			if input.CanResolve() {
+				continue
+			}
+			u, err := input.URL.Parse()
+			if err != nil {
+				continue
+			}
+			unresolvable = append(unresolvable, UnresolvableChannel{
+				Name:   name,
+				Scope:  scope,
+				Scheme: u.Scheme,
+			})
+		}
+	}
+
+	sort.Slice(unresolvable, func(i, j int) bool {
+		if unresolvable[i].Scope != unresolvable[j].Scope {
+			return unresolvable[i].Scope < unresolvable[j].Scope
+		}
+		return unresolvable[i].Name < unresolvable[j].Name
+	})
+
+	return unresolvable
+}
+
+// MirrorURL rewrites the given URL using the longest matching prefix in
+// Mirrors. The URL is returned as-is if no prefix matches.
+func (cfg Config) MirrorURL(url string) string {
+	var prefix string
+	for p := range cfg.Global.Mirrors {
+		if strings.HasPrefix(url, p) && len(p) > len(prefix) {
+			prefix = p
+		}
+	}
+	if prefix == "" {
+		return url
+	}
+	return cfg.Global.Mirrors[prefix] + strings.TrimPrefix(url, prefix)
 }
 
 // ChannelInputs returns all channel inputs within the current config.
@@ -64,9 +709,67 @@ func (cfg Config) ChannelInputs() map[ChannelInput]struct{} {
 	return inputsSet
 }
 
+// ChannelNames returns the names that each channel input is defined as across
+// all scopes. Aliases are not included. The names are sorted.
+func (cfg Config) ChannelNames() map[ChannelInput][]string {
+	names := make(map[ChannelInput][]string)
+	add := func(registry ChannelRegistry) {
+		for name, input := range registry.Channels {
+			if !slices.Contains(names[input], name) {
+				names[input] = append(names[input], name)
+			}
+		}
+	}
+
+	add(cfg.Global.ChannelRegistry)
+	add(cfg.Flakes.ChannelRegistry)
+	for _, usercfg := range cfg.Users {
+		add(usercfg.ChannelRegistry)
+	}
+
+	for _, n := range names {
+		sort.Strings(n)
+	}
+
+	return names
+}
+
+// inputUsers returns the users in Global.ChannelUsers that fetch each channel
+// input. Inputs without one are not in the map. An input must not be fetched
+// by different users under different names.
+func (cfg Config) inputUsers() (map[ChannelInput]string, error) {
+	users := make(map[ChannelInput]string)
+	for input, names := range cfg.ChannelNames() {
+		for _, name := range names {
+			username, ok := cfg.Global.ChannelUsers[name]
+			if !ok {
+				continue
+			}
+			if other, ok := users[input]; ok && other != username {
+				return nil, fmt.Errorf(
+					"channel %q is fetched as both user %q and %q under different names",
+					input, other, username)
+			}
+			users[input] = username
+		}
+	}
+	return users, nil
+}
+
 // FilterChannels returns a new Config with only the channels that are
 // present in the given names.
 func (cfg Config) FilterChannels(names []string) Config {
+	// Keep the targets of the kept aliases, since they may be in another
+	// scope.
+	names = slices.Clone(names)
+	for _, registry := range cfg.registries() {
+		for _, name := range names {
+			if alias, ok := registry.Aliases[name]; ok && !slices.Contains(names, alias) {
+				names = append(names, alias)
+			}
+		}
+	}
+
 	cfg.Global.ChannelRegistry = cfg.Global.ChannelRegistry.FilterChannels(names)
 	cfg.Flakes.ChannelRegistry = cfg.Flakes.ChannelRegistry.FilterChannels(names)
 
@@ -80,6 +783,101 @@ func (cfg Config) FilterChannels(names []string) Config {
 	return cfg
 }
 
+// inputPatches returns the patch files of every patched channel input. An
+// input that is configured under several names must have the same patches
+// under all of them, since it is only locked once.
+func (cfg Config) inputPatches() (map[ChannelInput][]string, error) {
+	patches := make(map[ChannelInput][]string)
+	for _, registry := range cfg.registries() {
+		for name, files := range registry.Patches {
+			input, ok := registry.Channels[name]
+			if !ok || len(files) == 0 {
+				continue
+			}
+			if other, ok := patches[input]; ok && !slices.Equal(other, files) {
+				return nil, fmt.Errorf("input %q has different patches under different names", input)
+			}
+			patches[input] = files
+		}
+	}
+	return patches, nil
+}
+
+// ResolveSecretPaths makes the relative paths of the secrets in
+// Global.HostTokens and Global.BasicAuth relative to the given directory,
+// which is usually the directory of the config file.
+func (cfg *Config) ResolveSecretPaths(dir string) {
+	for _, refs := range []map[string]string{cfg.Global.HostTokens, cfg.Global.BasicAuth} {
+		for host, ref := range refs {
+			secret, err := parseSecretRef(ref)
+			if err != nil {
+				// Validate reports it.
+				continue
+			}
+			refs[host] = secret.relativeTo(dir).String()
+		}
+	}
+}
+
+// pinnedInputs returns the inputs of the channels that are listed in Pinned.
+func (cfg Config) pinnedInputs() map[ChannelInput]bool {
+	pinned := make(map[ChannelInput]bool)
+	for _, registry := range cfg.registries() {
+		for _, name := range registry.Pinned {
+			if input, ok := registry.Channels[name]; ok {
+				pinned[input] = true
+			}
+		}
+	}
+	return pinned
+}
+
+// sudoChannels returns the names of the given channels of the user that are
+// listed in Sudo of the global table or of the user's table.
+func (cfg Config) sudoChannels(usercfg UserConfig, channelInputs map[string]ChannelInput) map[string]bool {
+	sudo := make(map[string]bool)
+	for _, registry := range []ChannelRegistry{cfg.Global.ChannelRegistry, usercfg.ChannelRegistry} {
+		for _, name := range registry.Sudo {
+			if _, ok := channelInputs[name]; ok {
+				sudo[name] = true
+			}
+		}
+	}
+	return sudo
+}
+
+// ResolvePatchPaths makes the relative paths of the patch files relative to
+// the given directory, which is usually the directory of the config file.
+func (cfg *Config) ResolvePatchPaths(dir string) {
+	resolve := func(registry *ChannelRegistry) {
+		for name, files := range registry.Patches {
+			resolved := make([]string, len(files))
+			for i, file := range files {
+				if !filepath.IsAbs(file) {
+					file = filepath.Join(dir, file)
+				}
+				resolved[i] = file
+			}
+			registry.Patches[name] = resolved
+		}
+	}
+
+	resolve(&cfg.Global.ChannelRegistry)
+	resolve(&cfg.Flakes.ChannelRegistry)
+	for _, usercfg := range cfg.Users {
+		resolve(&usercfg.ChannelRegistry)
+	}
+}
+
+// registries returns the ChannelRegistry of every scope.
+func (cfg Config) registries() []ChannelRegistry {
+	registries := []ChannelRegistry{cfg.Global.ChannelRegistry, cfg.Flakes.ChannelRegistry}
+	for _, usercfg := range cfg.Users {
+		registries = append(registries, usercfg.ChannelRegistry)
+	}
+	return registries
+}
+
 // UserChannels returns the ChannelRegistry for the given user combined with the
 // global channels.
 func (cfg Config) UserChannels(user string) (map[string]ChannelInput, error) {
@@ -89,7 +887,7 @@ func (cfg Config) UserChannels(user string) (map[string]ChannelInput, error) {
 	if ok {
 		rs = append(rs, u.ChannelRegistry)
 	}
-	res, err := CombineChannelRegistries(rs)
+	res, err := cfg.combineChannelRegistries(rs...)
 	if err != nil {
 		return nil, err
 	}
@@ -108,9 +906,24 @@ type UserConfig struct {
 	// OverrideChannels, if true, will cause all channels not defined in the
 	// configuration file to be deleted.
 	OverrideChannels bool `toml:"override-channels"`
+	// KeepChannels is a list of glob patterns, as in path.Match, of channel
+	// names that OverrideChannels keeps even if they are not configured, e.g.
+	// channels that NixOS adds by itself such as "nixos".
+	KeepChannels []string `toml:"keep-channels,omitempty"`
 	ChannelRegistry
 }
 
+// keepsChannel returns true if the name of a channel that isn't configured
+// matches one of the KeepChannels patterns.
+func (u UserConfig) keepsChannel(name string) bool {
+	for _, pattern := range u.KeepChannels {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // ChannelRegistry is a common structure holding configured channels and its
 // aliases.
 type ChannelRegistry struct {
@@ -119,30 +932,193 @@ type ChannelRegistry struct {
 	// Aliases maps a channel name to another channel name as aliases. The
 	// aliasing channel will have the same channel input as the aliased.
 	Aliases map[string]string `toml:"aliases"`
+	// Patches maps a channel name to the patch files that are applied to the
+	// channel's source after it is fetched, in order. See patch.go.
+	Patches map[string][]string `toml:"patches,omitempty"`
+	// Pinned lists the names of the channels whose version is intentionally
+	// a commit hash, which silences the warning that they are never updated.
+	Pinned []string `toml:"pinned,omitempty"`
+	// Sudo lists the names of the channels that are added and updated using
+	// sudo even if use-sudo of the user is false. The user's use-sudo is the
+	// default for all other channels.
+	Sudo []string `toml:"sudo,omitempty"`
+	// Groups maps ids to groups of channels that share one channel input.
+	// Their channels are added to Channels when the config is read.
+	Groups map[string]ChannelGroup `toml:"groups,omitempty"`
+}
+
+// ChannelGroup is a set of channels that share a single channel input. The
+// input is resolved and locked once, and all channels of the group always get
+// the same lock.
+type ChannelGroup struct {
+	// Input is the channel input that is shared by the channels.
+	Input ChannelInput `toml:"input"`
+	// Channels lists the names of the channels that use Input.
+	Channels []string `toml:"channels"`
+}
+
+// expandGroups adds the channels of the groups to the channels of their
+// registries. A channel must not be in a group and also be defined on its own
+// or in another group of the same table.
+func (cfg *Config) expandGroups() error {
+	if err := cfg.Global.ChannelRegistry.expandGroups(); err != nil {
+		return errors.Wrap(err, "invalid global groups")
+	}
+	if err := cfg.Flakes.ChannelRegistry.expandGroups(); err != nil {
+		return errors.Wrap(err, "invalid flakes groups")
+	}
+	for username, usercfg := range cfg.Users {
+		if err := usercfg.ChannelRegistry.expandGroups(); err != nil {
+			return errors.Wrapf(err, "invalid groups of user %q", username)
+		}
+		cfg.Users[username] = usercfg
+	}
+	return nil
+}
+
+func (r *ChannelRegistry) expandGroups() error {
+	ids := make([]string, 0, len(r.Groups))
+	for id := range r.Groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	grouped := make(map[string]string)
+	for _, id := range ids {
+		group := r.Groups[id]
+		if len(group.Channels) == 0 {
+			return fmt.Errorf("group %q has no channels", id)
+		}
+
+		for _, name := range group.Channels {
+			if other, ok := grouped[name]; ok {
+				return fmt.Errorf("channel %q is in both group %q and %q", name, other, id)
+			}
+			if _, ok := r.Channels[name]; ok {
+				return fmt.Errorf("channel %q of group %q is also defined in channels", name, id)
+			}
+			if _, ok := r.Aliases[name]; ok {
+				return fmt.Errorf("channel %q of group %q is also defined in aliases", name, id)
+			}
+			grouped[name] = id
+		}
+	}
+
+	if len(grouped) > 0 && r.Channels == nil {
+		r.Channels = make(map[string]ChannelInput, len(grouped))
+	}
+	for name, id := range grouped {
+		r.Channels[name] = r.Groups[id].Input
+	}
+
+	return nil
 }
 
 // CombineChannelRegistries combines the given ChannelRegistries into a single
 // channel input map. It also resolves the aliases. Channels defined later in
-// the list will override the ones defined earlier.
+// the list will override the ones defined earlier. Aliases are resolved after
+// all registries are merged, so they may point to channels or other aliases
+// defined in any of them, including later ones.
 func CombineChannelRegistries(registries []ChannelRegistry) (map[string]ChannelInput, error) {
+	return combineChannelRegistries(registries, nil)
+}
+
+// combineChannelRegistries is CombineChannelRegistries, except aliases to
+// channels that aren't in the given registries are looked up in fallback.
+func combineChannelRegistries(registries []ChannelRegistry, fallback map[string]ChannelInput) (map[string]ChannelInput, error) {
 	channelInputs := make(map[string]ChannelInput)
+	aliases := make(map[string]string)
+
 	for _, registry := range registries {
 		for name, input := range registry.Channels {
 			channelInputs[name] = input
+			delete(aliases, name)
 		}
-
 		for name, alias := range registry.Aliases {
-			input, ok := channelInputs[alias]
-			if !ok {
-				return nil, errors.Errorf("unknown channel alias %q", alias)
-			}
-			channelInputs[name] = input
+			aliases[name] = alias
+			delete(channelInputs, name)
+		}
+	}
+
+	// Resolve in the order of the names, so that errors are the same on
+	// every run.
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resolved := make(map[string]ChannelInput, len(aliases))
+	for _, name := range names {
+		input, err := resolveAlias(name, aliases, channelInputs, fallback)
+		if err != nil {
+			return nil, err
 		}
+		resolved[name] = input
 	}
 
+	maps.Copy(channelInputs, resolved)
 	return channelInputs, nil
 }
 
+// resolveAlias follows the alias of the given name through other aliases
+// until it reaches a channel.
+func resolveAlias(name string, aliases map[string]string, channelInputs, fallback map[string]ChannelInput) (ChannelInput, error) {
+	seen := map[string]bool{name: true}
+	alias := aliases[name]
+
+	for {
+		if input, ok := channelInputs[alias]; ok {
+			return input, nil
+		}
+
+		next, ok := aliases[alias]
+		if !ok {
+			break
+		}
+		if seen[alias] {
+			return ChannelInput{}, errors.Errorf("alias %q points to itself through %q", name, alias)
+		}
+		seen[alias] = true
+		alias = next
+	}
+
+	input, ok := fallback[alias]
+	if !ok {
+		return ChannelInput{}, errors.Errorf("alias %q points to unknown channel %q", name, alias)
+	}
+	return input, nil
+}
+
+// combineChannelRegistries combines the given registries like
+// CombineChannelRegistries, except aliases may also point to channels defined
+// in any other scope of the config. If multiple scopes define the channel,
+// then the global channels take precedence, then the flakes channels, then
+// the channels of the users sorted by name.
+func (cfg Config) combineChannelRegistries(registries ...ChannelRegistry) (map[string]ChannelInput, error) {
+	return combineChannelRegistries(registries, cfg.allChannels())
+}
+
+// allChannels returns the channels of all scopes. See combineChannelRegistries
+// for the precedence.
+func (cfg Config) allChannels() map[string]ChannelInput {
+	usernames := make([]string, 0, len(cfg.Users))
+	for username := range cfg.Users {
+		usernames = append(usernames, username)
+	}
+	// Add in reverse order, so that earlier scopes override later ones.
+	sort.Sort(sort.Reverse(sort.StringSlice(usernames)))
+
+	channels := make(map[string]ChannelInput)
+	for _, username := range usernames {
+		maps.Copy(channels, cfg.Users[username].Channels)
+	}
+	maps.Copy(channels, cfg.Flakes.Channels)
+	maps.Copy(channels, cfg.Global.Channels)
+
+	return channels
+}
+
 // FilterChannels returns a new ChannelRegistry with only the channels that are
 // present in the given names.
 func (r ChannelRegistry) FilterChannels(names []string) ChannelRegistry {
@@ -158,15 +1134,24 @@ func (r ChannelRegistry) FilterChannels(names []string) ChannelRegistry {
 	for _, name := range names {
 		if alias, ok := r.Aliases[name]; ok {
 			filteredAliases[name] = alias
-			// Also include the channel that the alias points to.
-			if _, ok := filteredChannels[alias]; !ok {
-				filteredChannels[alias] = r.Channels[alias]
+			// Also include the channel that the alias points to if it's in
+			// this registry.
+			if ch, ok := r.Channels[alias]; ok {
+				filteredChannels[alias] = ch
 			}
 		}
 	}
 
+	var filteredPinned []string
+	for _, name := range r.Pinned {
+		if _, ok := filteredChannels[name]; ok {
+			filteredPinned = append(filteredPinned, name)
+		}
+	}
+
 	newer := r
 	newer.Channels = filteredChannels
 	newer.Aliases = filteredAliases
+	newer.Pinned = filteredPinned
 	return newer
 }
@@ -0,0 +1,463 @@
+package bonito
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hexops/autogold"
+)
+
+const crossScopeConfig = `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[flakes.channels]
+nur = "github:nix-community/NUR master"
+
+[users.alice.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-24.05"
+home-manager = "github:nix-community/home-manager master"
+
+[users.alice.aliases]
+nur-alias = "nur"
+
+[users.bob.aliases]
+hm = "home-manager"
+nixos = "nixpkgs"
+`
+
+func TestCrossScopeAliases(t *testing.T) {
+	cfg, err := NewConfigFromReader(strings.NewReader(crossScopeConfig))
+	if err != nil {
+		t.Fatal("cannot parse config:", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("config is invalid:", err)
+	}
+
+	alice, err := cfg.UserChannels("alice")
+	if err != nil {
+		t.Fatal("cannot get channels for alice:", err)
+	}
+	if alice["nur-alias"] != cfg.Flakes.Channels["nur"] {
+		t.Errorf("alice's nur-alias points to %q", alice["nur-alias"])
+	}
+
+	bob, err := cfg.UserChannels("bob")
+	if err != nil {
+		t.Fatal("cannot get channels for bob:", err)
+	}
+	if bob["hm"] != cfg.Users["alice"].Channels["home-manager"] {
+		t.Errorf("bob's hm points to %q", bob["hm"])
+	}
+	// bob's own scope only has the global nixpkgs, which takes precedence
+	// over alice's anyway.
+	if bob["nixos"] != cfg.Global.Channels["nixpkgs"] {
+		t.Errorf("bob's nixos points to %q", bob["nixos"])
+	}
+
+	filtered := cfg.FilterChannels([]string{"nur-alias"})
+	if _, ok := filtered.Flakes.Channels["nur"]; !ok {
+		t.Error("filtering by an alias dropped its cross-scope target")
+	}
+	if err := filtered.Validate(); err != nil {
+		t.Error("filtered config is invalid:", err)
+	}
+}
+
+func TestCrossScopeAliasUnknown(t *testing.T) {
+	cfg, err := NewConfigFromReader(strings.NewReader(crossScopeConfig + `
+[users.carol.aliases]
+foo = "bar"
+`))
+	if err != nil {
+		t.Fatal("cannot parse config:", err)
+	}
+
+	err = cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), `alias "foo" points to unknown channel "bar"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAliasBeforeTarget(t *testing.T) {
+	nixpkgs := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	hm := ChannelInput{URL: "github:nix-community/home-manager", Version: "master"}
+
+	channels, err := CombineChannelRegistries([]ChannelRegistry{
+		{Aliases: map[string]string{"nixos": "nixpkgs", "unstable": "nixos"}},
+		{Channels: map[string]ChannelInput{"nixpkgs": nixpkgs}},
+		{Channels: map[string]ChannelInput{"home-manager": hm}},
+	})
+	if err != nil {
+		t.Fatal("cannot combine registries:", err)
+	}
+
+	autogold.Want("channels", map[string]ChannelInput{
+		"home-manager": {URL: "github:nix-community/home-manager", Version: "master"},
+		"nixos":        {URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"},
+		"nixpkgs":      {URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"},
+		"unstable":     {URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"},
+	}).Equal(t, channels)
+
+	_, err = CombineChannelRegistries([]ChannelRegistry{
+		{Aliases: map[string]string{"a": "b"}},
+		{Aliases: map[string]string{"b": "a"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "points to itself") {
+		t.Errorf("unexpected error for alias cycle: %v", err)
+	}
+}
+
+func TestGlobalAliasToUserChannel(t *testing.T) {
+	cfg, err := NewConfigFromReader(strings.NewReader(`
+[global.aliases]
+hm = "home-manager"
+
+[users.alice.channels]
+home-manager = "github:nix-community/home-manager master"
+`))
+	if err != nil {
+		t.Fatal("cannot parse config:", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("config is invalid:", err)
+	}
+
+	alice, err := cfg.UserChannels("alice")
+	if err != nil {
+		t.Fatal("cannot get channels for alice:", err)
+	}
+	if alice["hm"] != cfg.Users["alice"].Channels["home-manager"] {
+		t.Errorf("alice's hm points to %q", alice["hm"])
+	}
+}
+
+func TestFlakesOutput(t *testing.T) {
+	for _, output := range []string{`""`, `"nix"`} {
+		cfg, err := NewConfigFromReader(strings.NewReader("[flakes]\nenable = true\noutput = " + output))
+		if err != nil {
+			t.Fatalf("cannot parse config with output %s: %v", output, err)
+		}
+		if cfg.Flakes.Output != "nix" {
+			t.Errorf("output %s became %q, want nix", output, cfg.Flakes.Output)
+		}
+	}
+
+	_, err := NewConfigFromReader(strings.NewReader("[flakes]\nenable = true\noutput = \"flake\""))
+	if err == nil || !strings.Contains(err.Error(), `unknown flakes output format "flake"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUnresolvableChannels(t *testing.T) {
+	cfg, err := NewConfigFromReader(strings.NewReader(`
+[global.channels]
+nixpkgs = "gihub:NixOS/nixpkgs nixos-unstable"
+local = "/home/alice/nixpkgs"
+relative = "NixOS/nixpkgs"
+
+[users.alice.channels]
+home-manager = "github:nix-community/home-manager master"
+private = "git+sssh://git@git.example.com/user/repo main"
+`))
+	if err != nil {
+		t.Fatal("cannot parse config:", err)
+	}
+
+	autogold.Want("unresolvable", []UnresolvableChannel{
+		{
+			Name:   "nixpkgs",
+			Scope:  "global",
+			Scheme: "gihub",
+		},
+		{
+			Name:  "relative",
+			Scope: "global",
+		},
+		{
+			Name:   "private",
+			Scope:  "user alice",
+			Scheme: "git+sssh",
+		},
+	}).Equal(t, cfg.UnresolvableChannels())
+}
+
+func TestShadowedChannels(t *testing.T) {
+	cfg, err := NewConfigFromReader(strings.NewReader(`
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+home-manager = "github:nix-community/home-manager master"
+
+[flakes.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[users.alice.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-24.05"
+
+[users.bob.channels]
+stable = "github:NixOS/nixpkgs nixos-24.05"
+
+[users.bob.aliases]
+home-manager = "stable"
+`))
+	if err != nil {
+		t.Fatal("cannot parse config:", err)
+	}
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("config is invalid:", err)
+	}
+
+	// The flakes' nixpkgs is the same input, so it doesn't shadow anything.
+	autogold.Want("shadowed", []ShadowedChannel{
+		{
+			Name:  "nixpkgs",
+			Scope: "user alice",
+			Input: ChannelInput{
+				URL:     ChannelURL("github:NixOS/nixpkgs"),
+				Version: "nixos-24.05",
+			},
+			Global: ChannelInput{
+				URL:     ChannelURL("github:NixOS/nixpkgs"),
+				Version: "nixos-unstable",
+			},
+		},
+		{
+			Name:  "home-manager",
+			Scope: "user bob",
+			Input: ChannelInput{
+				URL:     ChannelURL("github:NixOS/nixpkgs"),
+				Version: "nixos-24.05",
+			},
+			Global: ChannelInput{
+				URL:     ChannelURL("github:nix-community/home-manager"),
+				Version: "master",
+			},
+		},
+	}).Equal(t, cfg.ShadowedChannels())
+
+	if !strings.Contains(logs.String(), "overrides the global channel") {
+		t.Errorf("validating did not warn about shadowing, got logs:\n%s", logs.String())
+	}
+}
+
+func TestConflictingVersions(t *testing.T) {
+	cfg, err := NewConfigFromReader(strings.NewReader(`
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+nixpkgs2 = "github:NixOS/nixpkgs nixos-24.05"
+home-manager = "github:nix-community/home-manager master"
+hm2 = "github:nix-community/home-manager release-24.05"
+nur = "github:nix-community/NUR master"
+
+[users.alice.channels]
+nur = "github:nix-community/NUR main"
+`))
+	if err != nil {
+		t.Fatal("cannot parse config:", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("config is invalid:", err)
+	}
+
+	autogold.Want("conflicts", []VersionConflict{
+		{
+			URL: "github:NixOS/nixpkgs",
+			Versions: map[string][]string{
+				"nixos-24.05":    {"nixpkgs2"},
+				"nixos-unstable": {"nixpkgs"},
+			},
+		},
+		{
+			URL: "github:nix-community/home-manager",
+			Versions: map[string][]string{
+				"master":        {"home-manager"},
+				"release-24.05": {"hm2"},
+			},
+		},
+	}).Equal(t, cfg.ConflictingVersions())
+}
+
+func TestNewConfigFromDir(t *testing.T) {
+	writeFragments := func(t *testing.T, fragments map[string]string) string {
+		dir := t.TempDir()
+		for name, body := range fragments {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		dir := writeFragments(t, map[string]string{
+			"00-global.toml": `
+[global]
+preferred_user = "alice"
+
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-23.11"
+`,
+			"10-alice.toml": `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-24.05"
+
+[users.alice]
+use-sudo = true
+
+[users.alice.channels]
+home-manager = "github:nix-community/home-manager master"
+`,
+			"20-bob.toml": `
+[global]
+preferred_user = "alice"
+
+[users.bob.aliases]
+nixos = "nixpkgs"
+`,
+			"README.md": `not a fragment`,
+		})
+
+		cfg, err := NewConfigFromDir(dir)
+		if err != nil {
+			t.Fatal("cannot read config directory:", err)
+		}
+
+		autogold.Want("preferred-user", "alice").Equal(t, cfg.Global.PreferredUser)
+		autogold.Want("output", "nix").Equal(t, cfg.Flakes.Output)
+		autogold.Want("nixpkgs", "github:NixOS/nixpkgs nixos-24.05").Equal(t, cfg.Global.Channels["nixpkgs"].String())
+		autogold.Want("users", []string{"alice", "bob"}).Equal(t, sortedKeys(cfg.Users))
+		if !cfg.Users["alice"].UseSudo {
+			t.Error("alice lost use-sudo")
+		}
+
+		if err := cfg.Validate(); err != nil {
+			t.Error("merged config is invalid:", err)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		dir := writeFragments(t, map[string]string{
+			"a.toml": "[global]\npreferred_user = \"alice\"\n",
+			"b.toml": "[global]\npreferred_user = \"bob\"\n",
+		})
+
+		_, err := NewConfigFromDir(dir)
+		if err == nil || !strings.Contains(err.Error(), "global.preferred_user is already set") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if _, err := NewConfigFromDir(t.TempDir()); err == nil {
+			t.Fatal("reading an empty config directory succeeded")
+		}
+	})
+}
+
+func TestConfigUnknownKeys(t *testing.T) {
+	const config = `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[users.alice]
+use_sudo = true
+
+[flake]
+enable = true
+`
+
+	_, err := NewConfigFromReader(strings.NewReader(config))
+	if err == nil {
+		t.Fatal("misspelled keys were accepted")
+	}
+
+	autogold.Want("error", `unknown config keys "users.alice.use_sudo" on line 6, "flake" on line 8`).Equal(t, err.Error())
+}
+
+func TestChannelGroups(t *testing.T) {
+	_, ctx := newFakeChannels(t)
+
+	config, err := NewConfigFromReader(strings.NewReader(`
+[global]
+preferred_user = "` + os.Getenv("USER") + `"
+
+[global.channels]
+nixos-24_05 = "https://example.com/nixos-24.05.tar.gz"
+
+[global.groups.unstable]
+input = "https://example.com/nixos-unstable.tar.gz"
+channels = ["nixpkgs", "nixos", "unstable"]
+
+[users."` + os.Getenv("USER") + `".groups.stable]
+input = "https://example.com/nixos-24.05.tar.gz"
+channels = ["stable"]
+`))
+	if err != nil {
+		t.Fatal("cannot parse config:", err)
+	}
+
+	s := State{Config: config}
+	if err := s.Config.Validate(); err != nil {
+		t.Fatal("invalid config:", err)
+	}
+
+	if err := s.UpdateLocks(ctx); err != nil {
+		t.Fatal("cannot update locks:", err)
+	}
+
+	// Every channel of a group has the same input, so they share one lock.
+	names := make(map[string][]string)
+	for input, n := range s.Config.ChannelNames() {
+		names[input.String()] = n
+	}
+	autogold.Want("names", map[string][]string{
+		"https://example.com/nixos-24.05.tar.gz":    {"nixos-24_05", "stable"},
+		"https://example.com/nixos-unstable.tar.gz": {"nixos", "nixpkgs", "unstable"},
+	}).Equal(t, names)
+
+	if len(s.Lock.Channels) != 2 {
+		t.Errorf("expected 2 locks, got %d", len(s.Lock.Channels))
+	}
+	for input, lock := range s.Lock.Channels {
+		if lock.StoreHash == "" {
+			t.Errorf("input %q was not locked", input)
+		}
+	}
+
+	for _, config := range []string{`
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[global.groups.unstable]
+input = "github:NixOS/nixpkgs nixos-unstable"
+channels = ["nixpkgs"]
+`, `
+[global.groups.a]
+input = "github:NixOS/nixpkgs nixos-unstable"
+channels = ["nixpkgs"]
+
+[global.groups.b]
+input = "github:NixOS/nixpkgs nixos-24.05"
+channels = ["nixpkgs"]
+`, `
+[global.groups.empty]
+input = "github:NixOS/nixpkgs nixos-unstable"
+`} {
+		if _, err := NewConfigFromReader(strings.NewReader(config)); err == nil {
+			t.Errorf("invalid groups were accepted:%s", config)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package bonito
+
+import (
+	"context"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LockDiff describes how the lock of a single input differs between two lock
+// files.
+type LockDiff struct {
+	Input ChannelInput `json:"input"`
+	// Action is ChangeAdd, ChangeRemove or ChangeUpdate.
+	Action ChangeAction `json:"action"`
+	// Old is the old lock. It is nil for ChangeAdd.
+	Old *ChannelLock `json:"old,omitempty"`
+	// New is the new lock. It is nil for ChangeRemove.
+	New *ChannelLock `json:"new,omitempty"`
+	// Fields are the JSON names of the fields that changed for ChangeUpdate,
+	// out of "url", "store_hash", "store_path" and "meta".
+	Fields []string `json:"fields,omitempty"`
+}
+
+// DiffLocks returns the differences from the old lock file to the newer one,
+// sorted by input.
+func DiffLocks(old, newer LockFile) []LockDiff {
+	var diffs []LockDiff
+
+	for input, oldLock := range old.Channels {
+		newLock, ok := newer.Channels[input]
+		if !ok {
+			diffs = append(diffs, LockDiff{Input: input, Action: ChangeRemove, Old: &oldLock})
+			continue
+		}
+
+		var fields []string
+		if oldLock.URL != newLock.URL {
+			fields = append(fields, "url")
+		}
+		if oldLock.StoreHash != newLock.StoreHash {
+			fields = append(fields, "store_hash")
+		}
+		if oldLock.StorePath != newLock.StorePath {
+			fields = append(fields, "store_path")
+		}
+		if !oldLock.metaEq(newLock) {
+			fields = append(fields, "meta")
+		}
+
+		if len(fields) > 0 {
+			diffs = append(diffs, LockDiff{
+				Input:  input,
+				Action: ChangeUpdate,
+				Old:    &oldLock,
+				New:    &newLock,
+				Fields: fields,
+			})
+		}
+	}
+
+	for input, newLock := range newer.Channels {
+		if _, ok := old.Channels[input]; !ok {
+			diffs = append(diffs, LockDiff{Input: input, Action: ChangeAdd, New: &newLock})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Input.String() < diffs[j].Input.String()
+	})
+
+	return diffs
+}
+
+// FreshLock returns the lock file that UpdateLocks would produce for the
+// current configuration without changing the state's lock. Locked inputs that
+// are no longer configured are left out.
+func (s State) FreshLock(ctx context.Context) (LockFile, error) {
+	s.Lock.Channels = maps.Clone(s.Lock.Channels)
+
+	if err := s.UpdateLocks(ctx); err != nil {
+		return LockFile{}, err
+	}
+
+	inputs := s.Config.ChannelInputs()
+	for input := range s.Lock.Channels {
+		if _, ok := inputs[input]; !ok {
+			delete(s.Lock.Channels, input)
+		}
+	}
+
+	return s.Lock, nil
+}
+
+// FetchLockFile reads the lock file at the given http:// or https:// URL, such
+// as the reference lock of a fleet of machines. Any other location is read as
+// a local path. Requests are retried like the ones that resolve inputs.
+func FetchLockFile(ctx context.Context, location string) (LockFile, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		f, err := os.Open(strings.TrimPrefix(location, "file://"))
+		if err != nil {
+			return LockFile{}, err
+		}
+		defer f.Close()
+
+		return NewLockFileFromReader(f)
+	}
+
+	var lock LockFile
+	if err := getJSON(ctx, location, nil, &lock); err != nil {
+		return LockFile{}, errors.Wrapf(err, "cannot fetch lock file %q", location)
+	}
+	if err := lock.migrate(); err != nil {
+		return LockFile{}, errors.Wrapf(err, "invalid lock file %q", location)
+	}
+
+	return lock, nil
+}
+
+// DiffAgainst returns the differences from the given reference lock file to
+// the state's lock, sorted by input. Inputs that the config doesn't have are
+// left out of the reference, so that a reference lock may cover more channels
+// than any single machine.
+func (s State) DiffAgainst(ref LockFile) []LockDiff {
+	inputs := s.Config.ChannelInputs()
+
+	configured := LockFile{Channels: make(map[ChannelInput]ChannelLock, len(inputs))}
+	for input, lock := range ref.Channels {
+		if _, ok := inputs[input]; ok {
+			configured.Channels[input] = lock
+		}
+	}
+
+	return DiffLocks(configured, s.Lock)
+}
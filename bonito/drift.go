@@ -0,0 +1,112 @@
+package bonito
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/gitutil"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// RefDrift describes a locked Git channel whose ref no longer points to the
+// locked revision upstream.
+type RefDrift struct {
+	Input ChannelInput
+	// Ref is the full name of the locked ref, e.g. "refs/tags/v1.0.0".
+	Ref string
+	// Locked is the locked revision.
+	Locked string
+	// Upstream is the revision that the ref points to upstream. It is empty
+	// if the ref no longer exists.
+	Upstream string
+}
+
+// Advanced returns true if the ref is a branch that still exists upstream.
+// Branches normally gain new commits, and git ls-remote can't tell those apart
+// from a force-push, so such a drift is expected rather than a sign that the
+// lock was tampered with. Moved tags and deleted refs are never advanced.
+func (d RefDrift) Advanced() bool {
+	return d.Upstream != "" && strings.HasPrefix(d.Ref, "refs/heads/")
+}
+
+// CheckLockedRefs asks the remotes of the locked Git channels which revisions
+// their locked refs point to now, and returns the channels whose refs no
+// longer point to their locked revisions. A moved tag or a force-pushed branch
+// shows up this way, but so does a branch that simply has new commits, which
+// RefDrift.Advanced tells apart. Only locks that have both a ref and a
+// revision are checked.
+func (s *State) CheckLockedRefs(ctx context.Context) ([]RefDrift, error) {
+	ctx = s.withSettings(ctx)
+
+	var mu sync.Mutex
+	var drifts []RefDrift
+
+	errg, ctx := errgroup.WithContext(ctx)
+	errg.SetLimit(parallelism(ctx))
+
+	for input, lock := range s.Lock.Channels {
+		if lock.Meta == nil || lock.Meta.Ref == "" || lock.Meta.Rev == "" {
+			continue
+		}
+
+		u, _, err := gitRemote(input)
+		if err != nil {
+			// Not a Git input.
+			continue
+		}
+
+		remote, ssh := gitSSHRemote(input)
+		if !ssh {
+			remote = u.String()
+		}
+
+		input := input
+		meta := *lock.Meta
+
+		errg.Go(func() error {
+			ctx, err := withHostToken(ctx, u)
+			if err != nil {
+				return err
+			}
+
+			var upstream string
+			ref, err := gitutil.RefCommit(ctx, remote, meta.Ref)
+			switch {
+			case err == nil:
+				upstream = ref.Commit
+			case gitutil.IsRefNotFound(err):
+				// The ref was deleted.
+			default:
+				return errors.Wrapf(err, "cannot get commit of %s of %q", meta.Ref, input)
+			}
+
+			if upstream == meta.Rev {
+				return nil
+			}
+
+			mu.Lock()
+			drifts = append(drifts, RefDrift{
+				Input:    input,
+				Ref:      meta.Ref,
+				Locked:   meta.Rev,
+				Upstream: upstream,
+			})
+			mu.Unlock()
+
+			return nil
+		})
+	}
+
+	if err := errg.Wait(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(drifts, func(i, j int) bool {
+		return drifts[i].Input.String() < drifts[j].Input.String()
+	})
+
+	return drifts, nil
+}
@@ -0,0 +1,99 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/hexops/autogold"
+)
+
+func TestCheckLockedRefs(t *testing.T) {
+	var (
+		oldTag = strings.Repeat("a", 40)
+		newTag = strings.Repeat("b", 40)
+		tagObj = strings.Repeat("c", 40)
+		main   = strings.Repeat("d", 40)
+	)
+
+	// The v1.0 tag was moved to newTag, the v0.9 tag was deleted, and the dev
+	// branch gained new commits.
+	upstream := map[string]string{
+		"refs/tags/v1.0":    tagObj,
+		"refs/tags/v1.0^{}": newTag,
+		"refs/heads/main":   main,
+		"refs/heads/dev":    main,
+	}
+
+	ctx := WithCommandRunner(context.Background(), func(cmd *exec.Cmd) error {
+		if cmd.Args[0] != "git" {
+			return fmt.Errorf("unexpected command %q", cmd.Args)
+		}
+		// The patterns come after the remote.
+		args := cmd.Args
+		for i, arg := range args {
+			if strings.HasPrefix(arg, "https://") {
+				args = args[i+1:]
+				break
+			}
+		}
+		for _, pattern := range args {
+			if commit, ok := upstream[pattern]; ok {
+				fmt.Fprintf(cmd.Stdout, "%s\t%s\n", commit, pattern)
+			}
+		}
+		return nil
+	})
+
+	lockAt := func(ref, rev string) ChannelLock {
+		return ChannelLock{
+			URL:  "https://github.com/owner/repo/archive/" + rev + ".tar.gz",
+			Meta: &ChannelLockMeta{Ref: ref, Rev: rev},
+		}
+	}
+
+	var s State
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		{URL: "github:owner/repo", Version: "v1.0"}: lockAt("refs/tags/v1.0", oldTag),
+		{URL: "github:owner/repo", Version: "v0.9"}: lockAt("refs/tags/v0.9", oldTag),
+		{URL: "github:owner/repo", Version: "main"}: lockAt("refs/heads/main", main),
+		{URL: "github:owner/repo", Version: "dev"}:  lockAt("refs/heads/dev", oldTag),
+		{URL: "github:owner/repo", Version: oldTag}: lockAt("", oldTag),
+		{URL: "https://example.com/nixpkgs.tar.gz"}: lockAt("refs/tags/v1.0", oldTag),
+	}
+
+	drifts, err := s.CheckLockedRefs(ctx)
+	if err != nil {
+		t.Fatal("cannot check locked refs:", err)
+	}
+
+	autogold.Want("drifts", []RefDrift{
+		{
+			Input:    ChannelInput{URL: "github:owner/repo", Version: "dev"},
+			Ref:      "refs/heads/dev",
+			Locked:   oldTag,
+			Upstream: main,
+		},
+		{
+			Input:  ChannelInput{URL: "github:owner/repo", Version: "v0.9"},
+			Ref:    "refs/tags/v0.9",
+			Locked: oldTag,
+		},
+		{
+			Input:    ChannelInput{URL: "github:owner/repo", Version: "v1.0"},
+			Ref:      "refs/tags/v1.0",
+			Locked:   oldTag,
+			Upstream: newTag,
+		},
+	}).Equal(t, drifts)
+
+	var advanced []string
+	for _, drift := range drifts {
+		if drift.Advanced() {
+			advanced = append(advanced, drift.Ref)
+		}
+	}
+	autogold.Want("advanced", []string{"refs/heads/dev"}).Equal(t, advanced)
+}
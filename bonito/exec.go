@@ -0,0 +1,97 @@
+package bonito
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/pkg/errors"
+)
+
+// execResolution is the JSON object that an external resolver prints.
+type execResolution struct {
+	// URL is the static URL of the channel tarball. It is required.
+	URL string `json:"url"`
+	// Rev is the VCS revision that URL points to, if any.
+	Rev string `json:"rev,omitempty"`
+	// Ref is the full name of the reference that the version matched, if any.
+	Ref string `json:"ref,omitempty"`
+	// SHA256 is the hash of the tarball at URL, if known. It is verified like
+	// the hash of a pinned tarball.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// resolveExec resolves "exec:/path/to/resolver version" inputs by running the
+// resolver with the version as its only argument, or no argument if there is
+// no version. "exec:resolver" looks the resolver up in $PATH instead. The
+// whole input is also passed in $BONITO_INPUT, so that one resolver can serve
+// several channels, e.g. using "exec:/path/to/resolver?repo=foo".
+//
+// The resolver must print a JSON object with the static "url" of the channel
+// tarball, and optionally its VCS "rev", the full "ref" name that the version
+// matched and the "sha256" hash of the tarball, in any form that a pinned
+// tarball accepts. A non-zero exit status fails the resolution.
+func resolveExec(ctx context.Context, in ChannelInput) (ResolvedInput, error) {
+	resolver, err := execResolverPath(in.URL)
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	var args []string
+	if in.Version != "" {
+		args = append(args, in.Version)
+	}
+
+	ctx = executil.WithEnv(ctx, "BONITO_INPUT="+in.String())
+
+	var out string
+	if err := executil.Exec(ctx, &out, resolver, args...); err != nil {
+		return ResolvedInput{}, errors.Wrapf(err, "resolver %q failed", resolver)
+	}
+
+	var resolution execResolution
+	if err := json.Unmarshal([]byte(out), &resolution); err != nil {
+		return ResolvedInput{}, errors.Wrapf(err, "resolver %q printed invalid JSON", resolver)
+	}
+
+	u, err := url.Parse(resolution.URL)
+	if err != nil || !u.IsAbs() {
+		return ResolvedInput{}, fmt.Errorf("resolver %q printed invalid url %q", resolver, resolution.URL)
+	}
+
+	resolved := ResolvedInput{URL: resolution.URL}
+	if resolution.SHA256 != "" {
+		resolved, err = resolvePinnedTarball(ctx, ChannelInput{
+			URL:     ChannelURL(resolution.URL),
+			Version: resolution.SHA256,
+		})
+		if err != nil {
+			return ResolvedInput{}, err
+		}
+	}
+
+	resolved.Rev = resolution.Rev
+	resolved.Ref = resolution.Ref
+	return resolved, nil
+}
+
+// execResolverPath returns the resolver command of an exec URL.
+func execResolverPath(channelURL ChannelURL) (string, error) {
+	u, err := channelURL.Parse()
+	if err != nil {
+		return "", err
+	}
+
+	resolver := u.Opaque
+	if resolver == "" {
+		resolver = u.Path
+	}
+	if resolver == "" || strings.HasPrefix(resolver, "//") || u.Host != "" {
+		return "", fmt.Errorf("exec url %q must be exec:/path/to/resolver or exec:resolver", channelURL)
+	}
+
+	return resolver, nil
+}
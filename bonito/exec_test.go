@@ -0,0 +1,86 @@
+package bonito
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hexops/autogold"
+)
+
+func TestResolveExec(t *testing.T) {
+	dir := t.TempDir()
+
+	resolver := filepath.Join(dir, "resolver")
+	writeResolver := func(script string) {
+		t.Helper()
+		if err := os.WriteFile(resolver, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolve := func(input string) (ResolvedInput, error) {
+		t.Helper()
+		in, err := ParseChannelInput(input)
+		if err != nil {
+			t.Fatalf("cannot parse channel input %q: %v", input, err)
+		}
+		return in.Resolve(context.Background())
+	}
+
+	writeResolver(`
+case "$BONITO_INPUT" in
+*repo=foo*) ;;
+*) echo "unexpected input $BONITO_INPUT" >&2; exit 1 ;;
+esac
+echo '{"url": "https://example.com/foo/'"${1:-tip}"'.tar.gz", "rev": "'"${1:-tip}"'", "ref": "refs/heads/main"}'
+`)
+
+	resolved, err := resolve("exec:" + resolver + "?repo=foo abc123")
+	if err != nil {
+		t.Fatal("cannot resolve:", err)
+	}
+	autogold.Want("resolved", ResolvedInput{
+		URL: "https://example.com/foo/abc123.tar.gz", Ref: "refs/heads/main",
+		Rev: "abc123",
+	}).Equal(t, resolved)
+
+	resolved, err = resolve("exec:" + resolver + "?repo=foo")
+	if err != nil {
+		t.Fatal("cannot resolve without version:", err)
+	}
+	autogold.Want("no version", "https://example.com/foo/tip.tar.gz").Equal(t, resolved.URL)
+
+	_, err = resolve("exec:" + resolver + "?repo=bar")
+	if err == nil || !strings.Contains(err.Error(), "resolver") {
+		t.Errorf("unexpected error for failing resolver: %v", err)
+	}
+
+	writeResolver(`echo '{"rev": "abc123"}'`)
+	_, err = resolve("exec:" + resolver)
+	if err == nil || !strings.Contains(err.Error(), "invalid url") {
+		t.Errorf("unexpected error for missing url: %v", err)
+	}
+
+	writeResolver(`echo 'https://example.com/foo.tar.gz'`)
+	_, err = resolve("exec:" + resolver)
+	if err == nil || !strings.Contains(err.Error(), "invalid JSON") {
+		t.Errorf("unexpected error for invalid JSON: %v", err)
+	}
+}
+
+func TestExecURLValidate(t *testing.T) {
+	for _, url := range []ChannelURL{"exec:", "exec://host/resolver"} {
+		if err := url.Validate(); err == nil {
+			t.Errorf("invalid exec url %q was accepted", url)
+		}
+	}
+
+	for _, url := range []ChannelURL{"exec:/path/to/resolver", "exec:resolver?repo=foo"} {
+		if err := url.Validate(); err != nil {
+			t.Errorf("valid exec url %q was rejected: %v", url, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package bonito
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ExportVersion is the version of the Export format. It is only bumped for
+// changes that older readers cannot ignore.
+const ExportVersion = 1
+
+// Export is the locked state of every configured channel in a format that is
+// meant for other tooling, e.g. to reconstruct flake inputs in CI. Unlike the
+// lock file, its shape is stable.
+type Export struct {
+	Version  int               `json:"version"`
+	Channels []ExportedChannel `json:"channels"`
+}
+
+// ExportedChannel is a single locked channel of an Export. A channel input
+// that is configured under several names is exported once per name.
+type ExportedChannel struct {
+	// Name is the name of the channel.
+	Name string `json:"name"`
+	// Input is the channel input as written in the config.
+	Input string `json:"input"`
+	// URL is the locked URL of the channel tarball.
+	URL string `json:"url"`
+	// Rev is the locked VCS revision, if the channel has one.
+	Rev string `json:"rev,omitempty"`
+	// NarHash is the NAR hash of the channel's sources, if it is known.
+	NarHash string `json:"narHash,omitempty"`
+	// StoreHash is the hash part of the channel's store path.
+	StoreHash string `json:"storeHash"`
+}
+
+// Export exports the locks of all configured channels, sorted by name and
+// then by input. Every channel that bonito can resolve must already be
+// locked.
+func (s State) Export() (Export, error) {
+	export := Export{
+		Version:  ExportVersion,
+		Channels: []ExportedChannel{},
+	}
+
+	for input, names := range s.Config.ChannelNames() {
+		if !input.CanResolve() {
+			// Inputs that bonito can't resolve are never locked.
+			continue
+		}
+
+		lock, ok := s.Lock.Channels[input]
+		if !ok || lock.StoreHash == "" {
+			return Export{}, fmt.Errorf("input %q is not locked yet, perhaps run bonito lock first", input)
+		}
+
+		for _, name := range names {
+			export.Channels = append(export.Channels, ExportedChannel{
+				Name:      name,
+				Input:     input.String(),
+				URL:       lock.URL,
+				Rev:       lock.Rev(),
+				NarHash:   lock.NarHash(),
+				StoreHash: string(lock.StoreHash),
+			})
+		}
+	}
+
+	sort.Slice(export.Channels, func(i, j int) bool {
+		a, b := export.Channels[i], export.Channels[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Input < b.Input
+	})
+
+	return export, nil
+}
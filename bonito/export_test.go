@@ -0,0 +1,85 @@
+package bonito
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hexops/autogold"
+)
+
+func TestExport(t *testing.T) {
+	nixpkgs := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	hm := ChannelInput{URL: "https://example.com/home-manager.tar.gz"}
+
+	var s State
+	s.Config.Global.Channels = map[string]ChannelInput{
+		"nixpkgs": nixpkgs,
+		"nixos":   nixpkgs,
+	}
+	s.Config.Users = map[Username]UserConfig{
+		"alice": {ChannelRegistry: ChannelRegistry{
+			Channels: map[string]ChannelInput{"home-manager": hm},
+		}},
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		nixpkgs: {
+			URL:       "https://github.com/NixOS/nixpkgs/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz",
+			StoreHash: "0c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd",
+			StorePath: "/nix/store/0c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd-source",
+			Meta: &ChannelLockMeta{
+				Ref:     "refs/heads/nixos-unstable",
+				Rev:     "a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88",
+				NarHash: "sha256:1ph3lmnlzjxw1cc6d5gsb6d7iac9ylxmsvcvq6bsgqh4aw9ljrdl",
+			},
+		},
+		hm: {
+			URL:       "https://example.com/home-manager.tar.gz",
+			StoreHash: "4ch3bm9bx98jf68ri8jmx00k479mv8g6",
+			StorePath: "/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source",
+		},
+	}
+
+	export, err := s.Export()
+	if err != nil {
+		t.Fatal("cannot export:", err)
+	}
+
+	b, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		t.Fatal("cannot marshal export:", err)
+	}
+
+	autogold.Want("export", `{
+  "version": 1,
+  "channels": [
+    {
+      "name": "home-manager",
+      "input": "https://example.com/home-manager.tar.gz",
+      "url": "https://example.com/home-manager.tar.gz",
+      "storeHash": "4ch3bm9bx98jf68ri8jmx00k479mv8g6"
+    },
+    {
+      "name": "nixos",
+      "input": "github:NixOS/nixpkgs nixos-unstable",
+      "url": "https://github.com/NixOS/nixpkgs/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz",
+      "rev": "a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88",
+      "narHash": "sha256:1ph3lmnlzjxw1cc6d5gsb6d7iac9ylxmsvcvq6bsgqh4aw9ljrdl",
+      "storeHash": "0c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd"
+    },
+    {
+      "name": "nixpkgs",
+      "input": "github:NixOS/nixpkgs nixos-unstable",
+      "url": "https://github.com/NixOS/nixpkgs/archive/a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88.tar.gz",
+      "rev": "a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88",
+      "narHash": "sha256:1ph3lmnlzjxw1cc6d5gsb6d7iac9ylxmsvcvq6bsgqh4aw9ljrdl",
+      "storeHash": "0c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd"
+    }
+  ]
+}`).Equal(t, string(b))
+
+	delete(s.Lock.Channels, hm)
+	if _, err := s.Export(); err == nil || !strings.Contains(err.Error(), "is not locked yet") {
+		t.Errorf("unexpected error for an unlocked channel: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/pkg/errors"
+)
+
+// resolveFile resolves local "file:///path" and bare "/path" inputs to a file
+// URL of that path. The path must exist. A directory, such as a nixpkgs
+// checkout, is packed into a tarball in the Nix store first, since
+// nix-channel would look for a nixexprs.tar.xz in it.
+func resolveFile(ctx context.Context, in ChannelInput) (ResolvedInput, error) {
+	u, err := in.URL.Parse()
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	if u.Host != "" && u.Host != "localhost" {
+		return ResolvedInput{}, fmt.Errorf("file URL %q must not have a remote host", in.URL)
+	}
+
+	path := u.Path
+	if !filepath.IsAbs(path) {
+		return ResolvedInput{}, fmt.Errorf("local path %q must be absolute", path)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ResolvedInput{}, fmt.Errorf("local path %q does not exist", path)
+		}
+		return ResolvedInput{}, errors.Wrapf(err, "cannot access local path %q", path)
+	}
+
+	path = filepath.Clean(path)
+	if stat.IsDir() {
+		path, err = packDirectory(ctx, path)
+		if err != nil {
+			return ResolvedInput{}, errors.Wrapf(err, "cannot pack local directory %q", in.URL)
+		}
+	}
+
+	fileURL := url.URL{Scheme: "file", Path: path}
+	return ResolvedInput{URL: fileURL.String()}, nil
+}
+
+// packDirectory packs the directory into a tarball and adds it to the Nix
+// store like patchSource does. The tarball is deterministic, so the store
+// path only changes when the contents of the directory do. It returns the
+// store path of the tarball.
+func packDirectory(ctx context.Context, dir string) (string, error) {
+	// The tarball is ours, so don't add it as the preferred user.
+	ctx = executil.WithOpts(ctx, executil.Opts{})
+
+	tmp, err := os.MkdirTemp("", "bonito-local-*")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot make temporary directory")
+	}
+	defer os.RemoveAll(tmp)
+
+	tarball := filepath.Join(tmp, filepath.Base(dir)+".tar.gz")
+	if err := writeTarball(tarball, dir); err != nil {
+		return "", err
+	}
+
+	storePath, err := addToStore(ctx, tarball)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot add the tarball to the store")
+	}
+
+	return storePath, nil
+}
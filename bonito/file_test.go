@@ -0,0 +1,96 @@
+package bonito
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveFile(t *testing.T) {
+	tarball := filepath.Join(t.TempDir(), "nixexprs.tar.xz")
+	if err := os.WriteFile(tarball, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := "file://" + tarball
+
+	for _, in := range []string{"file://" + tarball, tarball} {
+		input, err := ParseChannelInput(in)
+		if err != nil {
+			t.Fatal("cannot parse channel input:", err)
+		}
+
+		resolved, err := input.Resolve(context.Background())
+		if err != nil {
+			t.Fatalf("cannot resolve %q: %v", in, err)
+		}
+
+		if resolved.URL != want {
+			t.Errorf("%q resolved to %q, want %q", in, resolved.URL, want)
+		}
+	}
+}
+
+func TestResolveFileDirectory(t *testing.T) {
+	_, ctx := newFakeChannels(t)
+
+	dir := filepath.Join(t.TempDir(), "nixpkgs")
+	if err := os.MkdirAll(filepath.Join(dir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "default.nix"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(in string) string {
+		t.Helper()
+		resolved, err := ChannelInput{URL: ChannelURL(in)}.Resolve(ctx)
+		if err != nil {
+			t.Fatalf("cannot resolve %q: %v", in, err)
+		}
+		return resolved.URL
+	}
+
+	// The directory is packed into a tarball in the store, which is the same
+	// for the same contents.
+	url := resolve(dir)
+	if !strings.HasPrefix(url, "file:///nix/store/") {
+		t.Errorf("directory resolved to %q, want a store path", url)
+	}
+	if again := resolve("file://" + dir + "/"); again != url {
+		t.Errorf("directory resolved to %q, then %q", url, again)
+	}
+
+	// Changes in .git don't change the tarball, but other changes do.
+	if err := os.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("ref"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolve(dir); got != url {
+		t.Errorf("changing .git changed the tarball from %q to %q", url, got)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "default.nix"), []byte("{ x = 1; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolve(dir); got == url {
+		t.Errorf("changing the directory did not change the tarball %q", url)
+	}
+}
+
+func TestResolveFileMissing(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "nixpkgs")
+
+	for _, in := range []string{"file://" + missing, missing} {
+		input := ChannelInput{URL: ChannelURL(in)}
+
+		_, err := input.Resolve(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "does not exist") {
+			t.Errorf("unexpected error resolving %q: %v", in, err)
+		}
+	}
+
+	input := ChannelInput{URL: "nixpkgs"}
+	if _, err := input.Resolve(context.Background()); err == nil {
+		t.Error("unexpected success resolving a relative path")
+	}
+}
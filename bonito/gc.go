@@ -0,0 +1,142 @@
+package bonito
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/pkg/errors"
+)
+
+// RemoveTempChannels removes the temporary channels that bonito adds to fetch
+// inputs from the channel lists of every configured user. They are normally
+// removed by the next run, but they linger if a run is interrupted. It returns
+// how many channels were removed.
+func (s *State) RemoveTempChannels(ctx context.Context) (int, error) {
+	ctx = s.withSettings(ctx)
+
+	usernames := make([]string, 0, len(s.Config.Users))
+	for username := range s.Config.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var removed int
+	for _, username := range usernames {
+		ctx := executil.WithOpts(ctx, executil.Opts{
+			Username: username,
+			UseSudo:  s.Config.Users[username].UseSudo,
+		})
+
+		n, err := newChannelExecer(ctx, true).removeAll()
+		removed += n
+		if err != nil {
+			return removed, errors.Wrapf(err, "cannot remove temporary channels of user %q", username)
+		}
+	}
+
+	return removed, nil
+}
+
+// RemoveStaleGCRoots removes the GC roots of the tarballs that bonito added to
+// the Nix store, such as patched sources, that the lock no longer points to,
+// so that Nix can garbage-collect them. It returns how many roots were
+// removed.
+func (s *State) RemoveStaleGCRoots() (int, error) {
+	dir, err := gcRootsDir()
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "cannot read GC roots")
+	}
+
+	locked := s.Lock.localStorePaths()
+
+	var removed int
+	for _, entry := range entries {
+		root := filepath.Join(dir, entry.Name())
+
+		target, err := os.Readlink(root)
+		if err != nil || locked[target] {
+			// Not a root that we made, or one that is still needed.
+			continue
+		}
+
+		if err := os.Remove(root); err != nil {
+			return removed, errors.Wrap(err, "cannot remove stale GC root")
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// localStorePaths returns the store paths that the lock points to using
+// file:// URLs, including the unpatched sources of patched channels.
+func (l LockFile) localStorePaths() map[string]bool {
+	paths := make(map[string]bool)
+	for _, lock := range l.Channels {
+		urls := []string{lock.URL}
+		if lock.Meta != nil && lock.Meta.PatchedFrom != "" {
+			urls = append(urls, lock.Meta.PatchedFrom)
+		}
+		for _, u := range urls {
+			if path, ok := strings.CutPrefix(u, "file://"); ok {
+				paths[path] = true
+			}
+		}
+	}
+	return paths
+}
+
+// addToStore adds the given file to the Nix store and registers an indirect
+// GC root for it, since nothing else refers to the store path but the lock.
+// Without the root, the lock would stop working after the next garbage
+// collection. It returns the store path.
+func addToStore(ctx context.Context, file string) (string, error) {
+	storePath, err := executil.ExecOutput(ctx, "nix-store", "--add", file)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := gcRootsDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "cannot make GC roots directory")
+	}
+
+	// The root is in our own state directory, so register it as ourselves.
+	ctx = executil.WithOpts(ctx, executil.Opts{})
+
+	root := filepath.Join(dir, filepath.Base(storePath))
+	if err := executil.Exec(ctx, nil, "nix-store", "--realise", storePath, "--add-root", root, "--indirect"); err != nil {
+		return "", errors.Wrapf(err, "cannot add GC root for %s", storePath)
+	}
+
+	return storePath, nil
+}
+
+// gcRootsDir returns the directory of the GC roots of the tarballs that bonito
+// adds to the Nix store, which is in $XDG_STATE_HOME.
+func gcRootsDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", errors.Wrap(err, "cannot get home directory")
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "bonito", "gcroots"), nil
+}
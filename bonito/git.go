@@ -5,18 +5,43 @@ import (
 	"fmt"
 	"log/slog"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
 	"github.com/diamondburned/nix-bonito/bonito/internal/gitutil"
+	"github.com/diamondburned/nix-bonito/bonito/internal/trace"
 	"github.com/pkg/errors"
 )
 
 // TODO: figure out a better name.
 var opaqueExpanders = map[string]func(*url.URL) error{
-	"github":  commonOpaqueExpander("github.com"),
-	"gitlab":  commonOpaqueExpander("gitlab.com"),
-	"gitsrht": commonOpaqueExpander("git.sr.ht"),
+	"github":    commonOpaqueExpander("github.com"),
+	"gitlab":    commonOpaqueExpander("gitlab.com"),
+	"gitsrht":   sourcehutOpaqueExpander,
+	"sourcehut": sourcehutOpaqueExpander,
+	"gitea":     commonOpaqueExpander("gitea.com"),
+	"codeberg":  commonOpaqueExpander("codeberg.org"),
+	"bitbucket": commonOpaqueExpander("bitbucket.org"),
+}
+
+// gitSchemes are the schemes of the inputs that resolveGit resolves. The
+// schemes of Git services, whose inputs are like "github:owner/repo", are true
+// and have an opaque expander. Those of plain Git URLs are false.
+var gitSchemes = map[string]bool{
+	"git":       false,
+	"git+ssh":   false,
+	"github":    true,
+	"gitlab":    true,
+	"gitsrht":   true,
+	"sourcehut": true,
+	"gitea":     true,
+	"codeberg":  true,
+	"bitbucket": true,
 }
 
 // commonOpaqueExpander handles "x:user/repo" and "x:service.com/user/repo".
@@ -37,27 +62,223 @@ func commonOpaqueExpander(host string) func(*url.URL) error {
 	}
 }
 
-func resolveGit(ctx context.Context, in ChannelInput) (string, error) {
+// sourcehutOpaqueExpander is commonOpaqueExpander for SourceHut, whose
+// repositories are under "~user".
+func sourcehutOpaqueExpander(u *url.URL) error {
+	if err := commonOpaqueExpander("git.sr.ht")(u); err != nil {
+		return err
+	}
+	u.Path = sourcehutPath(u.Path)
+	return nil
+}
+
+// sourcehutPath returns the repository path with a "~" before the owner,
+// which SourceHut requires, e.g. "/~user/repo" for "user/repo".
+func sourcehutPath(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if !strings.HasPrefix(path, "~") {
+		path = "~" + path
+	}
+	return "/" + path
+}
+
+func resolveGit(ctx context.Context, in ChannelInput) (ResolvedInput, error) {
+	u, host, err := gitRemote(in)
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	ctx, err = withHostToken(ctx, u)
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	// remote is what Git talks to, which is the SSH URL for git+ssh inputs.
+	// u stays the HTTPS URL that the archive URL of the service is made from.
+	remote, ssh := gitSSHRemote(in)
+	if !ssh {
+		remote = u.String()
+	}
+
+	alts := gitutil.SplitAlternatives(in.Version)
+	ref, chosen, err := resolveGitAlternatives(ctx, in, host, u, remote)
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	version := chosen
+	if commit := ref.Commit; commit != "" {
+		if strings.HasPrefix(commit, version) && !isAcknowledgedPin(ctx, in) {
+			// If the version is part of the resolved commit hash, then we're
+			// not updating anything. Warn about this.
+			slog.Warn(
+				"not updating git input as a commit is being used",
+				"input", in)
+		}
+
+		// Found a commit associated to a ref. Use that as the version for our
+		// URL.
+		version = commit
+	}
+
+	// Record the alternative that won if there was a choice.
+	var alternative string
+	if len(alts) > 1 {
+		alternative = chosen
+	}
+
+	in.Version = version
+	switch {
+	case ssh:
+		// The repository may only be reachable over SSH, e.g. a private one,
+		// in which case Nix can't fetch the archive URL of the service. Archive
+		// the commit ourselves over SSH.
+		tarball, err := archiveGitCommit(ctx, remote, ref.Ref, in.Version)
+		if err != nil {
+			return ResolvedInput{}, errors.Wrapf(err, "cannot archive %q", in)
+		}
+		u = &url.URL{Scheme: "file", Path: tarball}
+	case host == "github.com":
+		u.Path += "/archive/" + in.Version + ".tar.gz"
+	case host == "gitlab.com":
+		u.Path += fmt.Sprintf("/-/archive/%[1]s/%[2]s-%[1]s.tar.gz", in.Version, path.Base(u.Path))
+	case host == "git.sr.ht":
+		u.Path += "/archive/" + in.Version + ".tar.gz"
+	case host == "gitea.com", host == "codeberg.org":
+		u.Path += "/archive/" + in.Version + ".tar.gz"
+	case host == "bitbucket.org":
+		// Bitbucket serves archives of any revision under /get/ rather than
+		// /archive/.
+		u.Path += "/get/" + in.Version + ".tar.gz"
+	default:
+		return ResolvedInput{}, fmt.Errorf("unknown git service %q, consider using https://", host)
+	}
+
+	resolved := ResolvedInput{
+		URL:         u.String(),
+		Ref:         ref.Ref,
+		Rev:         in.Version,
+		Alternative: alternative,
+	}
+
+	if err := checkPinned(resolved); err != nil {
+		return ResolvedInput{}, errors.Wrapf(err, "cannot pin %q", in)
+	}
+
+	return resolved, nil
+}
+
+// resolveGitAlternatives resolves the first alternative of the input's version
+// that exists to a commit. It returns the reference and the alternative.
+func resolveGitAlternatives(ctx context.Context, in ChannelInput, host string, u *url.URL, remote string) (gitutil.GitReference, string, error) {
+	alts := gitutil.SplitAlternatives(in.Version)
+	if len(alts) > 1 && slices.Contains(alts, "") {
+		return gitutil.GitReference{}, "", fmt.Errorf("version %q has an empty alternative", in.Version)
+	}
+
+	var ref gitutil.GitReference
+	var chosen string
+	var err error
+
+	for _, alt := range alts {
+		chosen = alt
+		ref, err = resolveGitRef(ctx, host, u, remote, alt)
+		if err == nil || !gitutil.IsRefNotFound(err) {
+			break
+		}
+
+		trace.Record(ctx, "alternative-failed", "version", alt, "err", err.Error())
+		slog.Debug(
+			"version alternative not found, trying the next one",
+			"input", in,
+			"alternative", alt,
+			"err", err)
+	}
+	if err != nil {
+		return gitutil.GitReference{}, "", errors.Wrap(err, "cannot get version")
+	}
+
+	return ref, chosen, nil
+}
+
+// isGitInput returns true if the input is resolved by resolveGit.
+func isGitInput(in ChannelInput) bool {
 	u, err := in.URL.Parse()
 	if err != nil {
-		return "", err
+		return false
 	}
+	_, ok := gitSchemes[u.Scheme]
+	return ok
+}
 
+// latestGitRev returns the commit that the version of the Git input points to
+// upstream using only git ls-remote, unlike resolveGit, which may also
+// archive the commit. It returns false for dated versions, which can't be
+// looked up using ls-remote.
+func latestGitRev(ctx context.Context, in ChannelInput) (string, bool, error) {
+	for _, alt := range gitutil.SplitAlternatives(in.Version) {
+		if _, _, dated, _ := parseDatedVersion(alt); dated {
+			return "", false, nil
+		}
+	}
+
+	u, host, err := gitRemote(in)
+	if err != nil {
+		return "", false, err
+	}
+
+	ctx, err = withHostToken(ctx, u)
+	if err != nil {
+		return "", false, err
+	}
+
+	remote, ssh := gitSSHRemote(in)
+	if !ssh {
+		remote = u.String()
+	}
+
+	ref, chosen, err := resolveGitAlternatives(ctx, in, host, u, remote)
+	if err != nil {
+		return "", false, err
+	}
+
+	if ref.Commit != "" {
+		return ref.Commit, true, nil
+	}
+	return chosen, true, nil
+}
+
+// gitRemote returns the HTTPS URL of the Git repository of the input and the
+// default host of its service, which decides the layout of its archive URLs.
+func gitRemote(in ChannelInput) (*url.URL, string, error) {
+	u, err := in.URL.Parse()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// host is the default host of the service, which also decides the layout
+	// of the archive URLs.
 	var host string
 
 	switch u.Scheme {
-	case "git":
+	case "git", "git+ssh":
 		host = u.Host
 	case "github":
 		host = "github.com"
 	case "gitlab":
 		host = "gitlab.com"
-	case "gitsrht":
+	case "gitsrht", "sourcehut":
 		host = "git.sr.ht"
 	case "gitea":
+		// Most Gitea and Forgejo instances are self-hosted, e.g.
+		// gitea:git.example.com/user/repo, so gitea.com is only the default.
 		host = "gitea.com"
+	case "codeberg":
+		host = "codeberg.org"
+	case "bitbucket":
+		host = "bitbucket.org"
 	default:
-		return "", fmt.Errorf("unknown git service %q, consider using https://", u.Host)
+		return nil, "", fmt.Errorf("unknown git service %q, consider using https://", u.Host)
 	}
 
 	if u.Opaque != "" {
@@ -66,52 +287,214 @@ func resolveGit(ctx context.Context, in ChannelInput) (string, error) {
 		case 2:
 			u.Host = host
 		case 3:
+			// Self-hosted instances of the service, e.g.
+			// gitlab:gitlab.example.com/user/repo.
 			u.Host = parts[0]
 			parts = parts[1:]
 		default:
-			return "", fmt.Errorf("invalid opaque %q", u.Opaque)
+			return nil, "", fmt.Errorf("invalid opaque %q", u.Opaque)
 		}
 
 		u.Path = strings.Join(parts, "/")
-		u.Host = host
 		u.Opaque = ""
 	}
 
+	if host == "git.sr.ht" {
+		u.Path = sourcehutPath(u.Path)
+	}
+
 	u.Scheme = "https"
+	// The user of git+ssh URLs, usually "git", is only for SSH.
+	u.User = nil
+
+	return u, host, nil
+}
+
+// gitSSHRemote returns the SSH URL of the Git repository of a git+ssh input,
+// e.g. ssh://git@host/user/repo for git+ssh://git@host/user/repo. It returns
+// false if the input is not a git+ssh input.
+func gitSSHRemote(in ChannelInput) (string, bool) {
+	u, err := in.URL.Parse()
+	if err != nil || u.Scheme != "git+ssh" {
+		return "", false
+	}
+	u.Scheme = "ssh"
+	return u.String(), true
+}
 
-	commit, err := gitutil.RefCommit(ctx, u.String(), in.Version)
+// withHostToken returns ctx with the token for the host of the Git remote u,
+// if there is one.
+func withHostToken(ctx context.Context, u *url.URL) (context.Context, error) {
+	token, err := hostToken(ctx, u.Host)
 	if err != nil {
-		return "", errors.Wrap(err, "cannot get version")
+		return ctx, err
 	}
 
-	if commit != "" {
-		if strings.HasPrefix(commit, in.Version) {
-			// If the version is part of the resolved commit hash, then we're
-			// not updating anything. Warn about this.
-			slog.Warn(
-				"not updating git input as a commit is being used",
-				"input", in)
+	if token != "" {
+		slog.Debug(
+			"using token for git host",
+			"host", u.Host,
+			"env", hostTokenEnv(u.Host))
+		ctx = executil.WithEnv(ctx, gitutil.AuthEnv(u.Scheme+"://"+u.Host+"/", token)...)
+	}
+
+	return ctx, nil
+}
+
+// resolveGitRef resolves a single version of the repository at u to a
+// commit. host is the default host of the service, and remote is the URL that
+// Git fetches the refs from.
+func resolveGitRef(ctx context.Context, host string, u *url.URL, remote, version string) (gitutil.GitReference, error) {
+	branch, date, dated, err := parseDatedVersion(version)
+	if err != nil {
+		return gitutil.GitReference{}, err
+	}
+
+	if dated {
+		return datedCommit(ctx, host, u, branch, date)
+	}
+
+	if mirror := gitMirror(ctx, u); mirror != "" {
+		ref, err := gitutil.RefCommit(ctx, mirror, version)
+		if err == nil {
+			trace.Record(ctx, "mirror", "path", mirror)
+			return ref, nil
 		}
 
-		// Found a commit associated to a ref. Use that as the version for our
-		// URL.
-		in.Version = commit
+		slog.Debug(
+			"cannot resolve version using the local git mirror, using the remote",
+			"remote", u,
+			"mirror", mirror,
+			"version", version,
+			"err", err)
 	}
 
-	switch host {
-	case "github.com":
-		u.Path += "/archive/" + in.Version + ".tar.gz"
-	case "gitlab.com":
-		u.Path += fmt.Sprintf("/-/archive/%[1]s/%[2]s-%[1]s.tar.gz", in.Version, path.Base(u.Path))
-	case "git.sr.ht":
-		u.Path += "/archive/" + in.Version + ".tar.gz"
-	case "gitea.com":
-		u.Path += "/archive/" + in.Version + ".tar.gz"
-	default:
-		return "", fmt.Errorf("unknown git service %q, consider using https://", u.Host)
+	return gitutil.RefCommit(ctx, remote, version)
+}
+
+// archiveGitCommit fetches the given ref from the Git remote, checks that it
+// is still at the resolved commit and adds an archive of it to the Nix store.
+// It returns the store path of the archive, whose name contains the commit.
+// Like patched sources, the archive only exists in the local Nix store.
+//
+// The ref is fetched rather than the commit, since most servers don't allow
+// fetching commits by their hash. Only pinned commits without a ref are
+// fetched by their hash.
+func archiveGitCommit(ctx context.Context, remote, ref, commit string) (string, error) {
+	// Everything runs as the same user as git ls-remote did, so that the
+	// same SSH keys are used.
+	tmp, cleanup, err := mkdirTempAsUser(ctx, "bonito-git-*")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot make temporary directory")
 	}
+	defer cleanup()
+
+	repo := filepath.Join(tmp, "repo")
+	tarball := filepath.Join(tmp, commit+".tar.gz")
 
-	return u.String(), nil
+	want := ref
+	if want == "" {
+		want = commit
+	}
+
+	cmds := [][]string{
+		{"git", "init", "--quiet", "--bare", repo},
+		{"git", "-C", repo, "fetch", "--quiet", "--depth=1", remote, want},
+	}
+	for _, args := range cmds {
+		if err := executil.Exec(ctx, nil, args[0], args[1:]...); err != nil {
+			return "", err
+		}
+	}
+
+	fetched, err := executil.ExecOutput(ctx, "git", "-C", repo, "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return "", err
+	}
+	if fetched != commit {
+		return "", fmt.Errorf("%s moved from %s to %s while fetching it, try again", want, commit, fetched)
+	}
+
+	err = executil.Exec(ctx, nil,
+		"git", "-C", repo, "archive", "--format=tar.gz",
+		"--prefix="+patchedSourceName+"/", "--output="+tarball, "FETCH_HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	storePath, err := addToStore(ctx, tarball)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot add archive to the store")
+	}
+
+	return storePath, nil
+}
+
+type gitMirrorsCtxKey struct{}
+
+// withGitMirrors returns ctx with the given Config.Global.GitMirrors.
+func withGitMirrors(ctx context.Context, mirrors map[string]string) context.Context {
+	return context.WithValue(ctx, gitMirrorsCtxKey{}, mirrors)
+}
+
+// gitMirror returns the path of the local clone of the Git remote u, or an
+// empty string if it has no mirror. The longest host or repository in the
+// mirrors that u is in wins.
+func gitMirror(ctx context.Context, u *url.URL) string {
+	mirrors, _ := ctx.Value(gitMirrorsCtxKey{}).(map[string]string)
+
+	repo := u.Host + "/" + strings.Trim(u.Path, "/")
+
+	var match string
+	for prefix := range mirrors {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if repo != prefix && !strings.HasPrefix(repo, prefix+"/") {
+			continue
+		}
+		if len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+
+	if match == "" {
+		return ""
+	}
+
+	dir, ok := mirrors[match]
+	if !ok {
+		dir = mirrors[match+"/"]
+	}
+	return filepath.Join(dir, strings.TrimPrefix(repo, match))
+}
+
+// hostTokenEnv returns the name of the environment variable that holds the
+// token for the given host, e.g. BONITO_TOKEN_GITLAB_EXAMPLE_COM.
+func hostTokenEnv(host string) string {
+	return "BONITO_TOKEN_" + strings.ToUpper(hostTokenEnvRe.ReplaceAllString(host, "_"))
+}
+
+var hostTokenEnvRe = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// hostToken returns the token for the given host from the environment, or
+// from Config.Global.HostTokens if the environment has none. It returns an
+// empty string if there is none.
+func hostToken(ctx context.Context, host string) (string, error) {
+	if token := os.Getenv(hostTokenEnv(host)); token != "" {
+		return token, nil
+	}
+	return configHostToken(ctx, host)
+}
+
+// checkPinned checks that the resolved URL points to an immutable commit, so
+// that it always points to the same file.
+func checkPinned(resolved ResolvedInput) error {
+	if !gitutil.IsCommitHash(resolved.Rev) {
+		return fmt.Errorf("version %q did not resolve to a commit", resolved.Rev)
+	}
+	if !strings.Contains(resolved.URL, resolved.Rev) {
+		return fmt.Errorf("url %q does not contain commit %q", resolved.URL, resolved.Rev)
+	}
+	return nil
 }
 
 func popHost(opaque string) (string, string) {
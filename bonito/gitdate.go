@@ -0,0 +1,126 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/gitutil"
+	"github.com/diamondburned/nix-bonito/bonito/internal/trace"
+	"github.com/pkg/errors"
+)
+
+// githubAPIURL is the base URL of the GitHub API.
+var githubAPIURL = "https://api.github.com"
+
+// datedVersionRe matches versions pinned to a date, e.g. "@2024-01-01" or
+// "date:2024-01-01" for the default branch, or "nixos-unstable@2024-01-01" for
+// a branch.
+var datedVersionRe = regexp.MustCompile(`^(?:date:|([^@]*)@)(\d{4}-\d{2}-\d{2})$`)
+
+// parseDatedVersion parses a version pinned to a date into the branch and the
+// date. The branch is empty for the default branch. ok is false if the version
+// is not pinned to a date.
+func parseDatedVersion(version string) (branch string, date time.Time, ok bool, err error) {
+	m := datedVersionRe.FindStringSubmatch(version)
+	if m == nil {
+		return "", time.Time{}, false, nil
+	}
+
+	date, err = time.Parse(time.DateOnly, m[2])
+	if err != nil {
+		return "", time.Time{}, true, fmt.Errorf("invalid date %q", m[2])
+	}
+
+	return m[1], date, true, nil
+}
+
+// datedCommit resolves the newest commit on the branch of the repository at u
+// that was made on or before the given date using the API of the forge. host
+// is the default host of the service, as in resolveGit.
+func datedCommit(ctx context.Context, host string, u *url.URL, branch string, date time.Time) (gitutil.GitReference, error) {
+	// Include the whole day.
+	until := date.Add(24*time.Hour - time.Second).Format(time.RFC3339)
+	repo := strings.Trim(u.Path, "/")
+
+	token, err := hostToken(ctx, u.Host)
+	if err != nil {
+		return gitutil.GitReference{}, err
+	}
+
+	header := make(http.Header)
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	var commit string
+
+	switch host {
+	case "github.com":
+		q := url.Values{"until": {until}, "per_page": {"1"}}
+		if branch != "" {
+			q.Set("sha", branch)
+		}
+
+		apiURL := githubAPIURL
+		if u.Host != host {
+			// GitHub Enterprise serves its API under /api/v3.
+			apiURL = "https://" + u.Host + "/api/v3"
+		}
+
+		var commits []struct {
+			SHA string `json:"sha"`
+		}
+		if err := getJSON(ctx, apiURL+"/repos/"+repo+"/commits?"+q.Encode(), header, &commits); err != nil {
+			return gitutil.GitReference{}, errors.Wrap(err, "cannot list commits")
+		}
+		if len(commits) > 0 {
+			commit = commits[0].SHA
+		}
+
+	case "gitlab.com":
+		q := url.Values{"until": {until}, "per_page": {"1"}}
+		if branch != "" {
+			q.Set("ref_name", branch)
+		}
+
+		apiURL := "https://" + u.Host + "/api/v4/projects/" + url.PathEscape(repo) + "/repository/commits?" + q.Encode()
+
+		var commits []struct {
+			ID string `json:"id"`
+		}
+		if err := getJSON(ctx, apiURL, header, &commits); err != nil {
+			return gitutil.GitReference{}, errors.Wrap(err, "cannot list commits")
+		}
+		if len(commits) > 0 {
+			commit = commits[0].ID
+		}
+
+	default:
+		return gitutil.GitReference{}, fmt.Errorf(
+			"git service %q does not support pinning to a date, only GitHub and GitLab do", host)
+	}
+
+	if commit == "" {
+		return gitutil.GitReference{}, &gitutil.RefNotFoundError{
+			Ref:    branch + "@" + date.Format(time.DateOnly),
+			Reason: fmt.Sprintf("no commit on or before %s", date.Format(time.DateOnly)),
+		}
+	}
+
+	trace.Record(ctx, "dated-commit",
+		"branch", branch,
+		"until", until,
+		"commit", commit)
+
+	ref := gitutil.GitReference{Commit: commit}
+	if branch != "" {
+		ref.Ref = "refs/heads/" + branch
+	}
+
+	return ref, nil
+}
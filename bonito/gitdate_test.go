@@ -0,0 +1,183 @@
+package bonito
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/nixutil"
+	"github.com/hexops/autogold"
+)
+
+type testDatedCommit struct {
+	sha    string
+	branch string
+	date   time.Time
+}
+
+// newTestForgeAPI serves a fake GitHub and GitLab commits API that lists the
+// given commits, newest first.
+func newTestForgeAPI(t *testing.T, commits []testDatedCommit) *httptest.Server {
+	list := func(r *http.Request, branchParam string) []testDatedCommit {
+		until, err := time.Parse(time.RFC3339, r.URL.Query().Get("until"))
+		if err != nil {
+			t.Errorf("invalid until %q", r.URL.Query().Get("until"))
+		}
+
+		branch := r.URL.Query().Get(branchParam)
+		if branch == "" {
+			branch = "main"
+		}
+
+		var matched []testDatedCommit
+		for _, commit := range commits {
+			if commit.branch == branch && !commit.date.After(until) {
+				matched = append(matched, commit)
+			}
+		}
+		return matched[:min(len(matched), 1)]
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /repos/owner/repo/commits", func(w http.ResponseWriter, r *http.Request) {
+		var resp []map[string]string
+		for _, commit := range list(r, "sha") {
+			resp = append(resp, map[string]string{"sha": commit.sha})
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("GET /api/v4/projects/{project}/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("project") != "group/repo" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer hunter2" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var resp []map[string]string
+		for _, commit := range list(r, "ref_name") {
+			resp = append(resp, map[string]string{"id": commit.sha})
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	oldClient, oldAPIURL := httpClient, githubAPIURL
+	t.Cleanup(func() { httpClient, githubAPIURL = oldClient, oldAPIURL })
+
+	httpClient = srv.Client()
+	githubAPIURL = srv.URL
+
+	return srv
+}
+
+func TestResolveGitDate(t *testing.T) {
+	day := func(date string, hour int) time.Time {
+		t, _ := time.Parse(time.DateOnly, date)
+		return t.Add(time.Duration(hour) * time.Hour)
+	}
+
+	srv := newTestForgeAPI(t, []testDatedCommit{
+		{"3333333333333333333333333333333333333333", "main", day("2024-01-02", 1)},
+		{"2222222222222222222222222222222222222222", "main", day("2024-01-01", 23)},
+		{"1111111111111111111111111111111111111111", "main", day("2023-12-31", 12)},
+		{"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "stable", day("2023-12-01", 12)},
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "stable", day("2023-11-01", 12)},
+	})
+
+	srvURL, _ := url.Parse(srv.URL)
+	t.Setenv(hostTokenEnv(srvURL.Host), "hunter2")
+
+	tests := []struct {
+		input ChannelInput
+		want  autogold.Value
+	}{
+		{
+			ChannelInput{URL: "github:owner/repo", Version: "@2024-01-01"},
+			autogold.Want("github-default", ResolvedInput{
+				URL: "https://github.com/owner/repo/archive/2222222222222222222222222222222222222222.tar.gz",
+				Rev: "2222222222222222222222222222222222222222",
+			}),
+		},
+		{
+			ChannelInput{URL: "github:owner/repo", Version: "stable@2023-11-30"},
+			autogold.Want("github-branch", ResolvedInput{
+				URL: "https://github.com/owner/repo/archive/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.tar.gz",
+				Ref: "refs/heads/stable",
+				Rev: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			}),
+		},
+		{
+			ChannelInput{URL: "github:owner/repo", Version: "date:2024-01-02"},
+			autogold.Want("github-date-prefix", ResolvedInput{
+				URL: "https://github.com/owner/repo/archive/3333333333333333333333333333333333333333.tar.gz",
+				Rev: "3333333333333333333333333333333333333333",
+			}),
+		},
+		{
+			ChannelInput{URL: ChannelURL("gitlab:" + srvURL.Host + "/group/repo"), Version: "@2023-12-31"},
+			autogold.Want("gitlab-default", ResolvedInput{
+				URL: "https://127.0.0.1/group/repo/-/archive/1111111111111111111111111111111111111111/repo-1111111111111111111111111111111111111111.tar.gz",
+				Rev: "1111111111111111111111111111111111111111",
+			}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input.String(), func(t *testing.T) {
+			resolved, err := test.input.Resolve(context.Background())
+			if err != nil {
+				t.Fatal("cannot resolve:", err)
+			}
+			// The test server's port changes on every run.
+			resolved.URL = strings.Replace(resolved.URL, srvURL.Host, srvURL.Hostname(), 1)
+			test.want.Equal(t, resolved)
+		})
+	}
+}
+
+func TestResolveGitDateErrors(t *testing.T) {
+	newTestForgeAPI(t, []testDatedCommit{
+		{"1111111111111111111111111111111111111111", "main", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	})
+
+	tests := map[ChannelInput]string{
+		{URL: "github:owner/repo", Version: "@2023-12-31"}:     "no commit on or before 2023-12-31",
+		{URL: "codeberg:owner/repo", Version: "@2024-01-01"}:   "does not support pinning to a date",
+		{URL: "github:owner/repo", Version: "date:2024-13-01"}: `invalid date "2024-13-01"`,
+	}
+
+	for input, want := range tests {
+		_, err := input.Resolve(context.Background())
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("resolving %q: unexpected error %v, want %q", input, err, want)
+		}
+	}
+}
+
+func TestResolveGitDateMeta(t *testing.T) {
+	const rev = "1111111111111111111111111111111111111111"
+	newTestForgeAPI(t, []testDatedCommit{
+		{rev, "main", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	})
+
+	input := ChannelInput{URL: "github:owner/repo", Version: "date:2024-01-01"}
+
+	resolved, err := input.Resolve(context.Background())
+	if err != nil {
+		t.Fatal("cannot resolve:", err)
+	}
+
+	lock := newChannelLock(resolved, nixutil.StorePath{}, "")
+	if lock.Rev() != rev {
+		t.Errorf("lock rev = %q, want %q", lock.Rev(), rev)
+	}
+}
@@ -0,0 +1,77 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/pkg/errors"
+)
+
+// hgDefaultRev is the revision used for Mercurial inputs without a version.
+const hgDefaultRev = "default"
+
+// resolveHg resolves "hg+https://host/repo rev" inputs. The revision can be
+// anything that hg accepts, such as a branch, tag, bookmark or changeset
+// hash. It is resolved to a changeset hash, which is then pinned using the
+// hgweb archive URL of the repository.
+func resolveHg(ctx context.Context, in ChannelInput) (ResolvedInput, error) {
+	u, err := in.URL.Parse()
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	u.Scheme = strings.TrimPrefix(u.Scheme, "hg+")
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	remote := u.String()
+
+	rev := in.Version
+	if rev == "" {
+		rev = hgDefaultRev
+	}
+
+	node, err := hgRevNode(ctx, remote, rev)
+	if err != nil {
+		return ResolvedInput{}, errors.Wrap(err, "cannot get version")
+	}
+
+	if strings.HasPrefix(node, rev) && !isAcknowledgedPin(ctx, in) {
+		slog.Warn(
+			"not updating hg input as a changeset is being used",
+			"input", in)
+	}
+
+	u.Path += "/archive/" + node + ".tar.gz"
+
+	return ResolvedInput{
+		URL: u.String(),
+		Rev: node,
+	}, nil
+}
+
+// hgRevNode resolves the given revision in the remote repository to its full
+// changeset hash.
+func hgRevNode(ctx context.Context, remote, rev string) (string, error) {
+	if len(rev) == 40 && isHex(rev) {
+		// Like with git, a full changeset hash is used as-is.
+		return rev, nil
+	}
+
+	// --debug makes hg print the full changeset hash.
+	node, err := executil.ExecOutput(ctx, "hg", "identify", "--debug", "--id", "--rev", rev, remote)
+	if err != nil {
+		return "", err
+	}
+
+	if len(node) != 40 || !isHex(node) {
+		return "", fmt.Errorf("hg returned invalid changeset %q for %q", node, rev)
+	}
+
+	return node, nil
+}
+
+func isHex(s string) bool {
+	return strings.Trim(s, "0123456789abcdef") == ""
+}
@@ -0,0 +1,67 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/hexops/autogold"
+)
+
+func TestResolveHg(t *testing.T) {
+	const node = "0123456789abcdef0123456789abcdef01234567"
+
+	var calls [][]string
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		calls = append(calls, cmd.Args)
+		fmt.Fprintln(cmd.Stdout, node)
+		return nil
+	})
+
+	do := func(inURL string, want autogold.Value) {
+		t.Run(want.Name(), func(t *testing.T) {
+			input, err := ParseChannelInput(inURL)
+			if err != nil {
+				t.Fatal("cannot parse channel input:", err)
+			}
+
+			resolved, err := input.Resolve(ctx)
+			if err != nil {
+				t.Fatalf("cannot resolve %q: %v", input, err)
+			}
+
+			want.Equal(t, resolved.URL)
+		})
+	}
+
+	do("hg+https://hg.example.com/repo stable",
+		autogold.Want("branch", "https://hg.example.com/repo/archive/0123456789abcdef0123456789abcdef01234567.tar.gz"))
+	do("hg+https://hg.example.com/repo/",
+		autogold.Want("default", "https://hg.example.com/repo/archive/0123456789abcdef0123456789abcdef01234567.tar.gz"))
+
+	autogold.Want("calls", [][]string{
+		{"hg", "identify", "--debug", "--id", "--rev", "stable", "https://hg.example.com/repo"},
+		{"hg", "identify", "--debug", "--id", "--rev", "default", "https://hg.example.com/repo"},
+	}).Equal(t, calls)
+
+	calls = nil
+	do("hg+http://hg.example.com/repo "+node,
+		autogold.Want("node", "http://hg.example.com/repo/archive/0123456789abcdef0123456789abcdef01234567.tar.gz"))
+	if len(calls) > 0 {
+		t.Errorf("full changeset hash was resolved using %q", calls)
+	}
+}
+
+func TestHgURLValidate(t *testing.T) {
+	for _, url := range []ChannelURL{"hg+https://hg.example.com", "hg+https:///repo"} {
+		if err := url.Validate(); err == nil {
+			t.Errorf("invalid hg url %q was accepted", url)
+		}
+	}
+
+	if err := ChannelURL("hg+https://hg.example.com/repo").Validate(); err != nil {
+		t.Error("valid hg url was rejected:", err)
+	}
+}
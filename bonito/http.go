@@ -0,0 +1,300 @@
+package bonito
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/retry"
+	"github.com/pkg/errors"
+)
+
+// httpClient is the HTTP client used by resolvers that need to talk to a web
+// server directly.
+var httpClient = http.DefaultClient
+
+// channelsBaseURL is the base URL that "channel:" inputs are resolved against.
+var channelsBaseURL = "https://nixos.org/channels/"
+
+// officialChannelsBaseURL is the base URL that "nixos:" inputs are resolved
+// against.
+var officialChannelsBaseURL = "https://channels.nixos.org/"
+
+// officialChannelForm describes the names that officialChannelRe accepts.
+const officialChannelForm = "nixos-<YY.MM|unstable> or nixpkgs-<YY.MM|unstable>, " +
+	"optionally suffixed with -small or -darwin"
+
+// officialChannelRe matches the names of the official NixOS channels, e.g.
+// nixos-24.05, nixos-unstable-small or nixpkgs-24.05-darwin.
+var officialChannelRe = regexp.MustCompile(`^(nixos|nixpkgs)-(unstable|\d{2}\.\d{2})(-small|-darwin)?$`)
+
+// osReleasePath is the path of the os-release file that "nixos:system" reads
+// the running NixOS version from.
+var osReleasePath = "/etc/os-release"
+
+// officialSystemChannel is the name of "nixos:" inputs that follow the NixOS
+// release of the running system.
+const officialSystemChannel = "system"
+
+// channelRedirectHosts are the hosts that serve Nix channels as redirects to
+// immutable snapshots of them.
+var channelRedirectHosts = map[string]bool{
+	"nixos.org":          true,
+	"channels.nixos.org": true,
+}
+
+// resolveHTTP resolves plain HTTP URLs. URLs with a version are tarballs
+// pinned to that hash, see resolvePinnedTarball. Official Nix channel URLs are
+// resolved to the snapshot that they currently redirect to; all other URLs are
+// assumed to already be static and are used as-is.
+func resolveHTTP(ctx context.Context, in ChannelInput) (ResolvedInput, error) {
+	if in.Version != "" {
+		return resolvePinnedTarball(ctx, in)
+	}
+
+	u, err := in.URL.Parse()
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	if !channelRedirectHosts[u.Host] {
+		return ResolvedInput{URL: u.String()}, nil
+	}
+
+	return resolveRedirect(ctx, u.String())
+}
+
+// resolveChannel resolves "channel:name" inputs using the official Nix
+// channels, e.g. "channel:nixpkgs-unstable".
+func resolveChannel(ctx context.Context, in ChannelInput) (ResolvedInput, error) {
+	u, err := in.URL.Parse()
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	name := u.Opaque
+	if name == "" || strings.Contains(name, "/") {
+		return ResolvedInput{}, fmt.Errorf("invalid channel name %q, expected channel:<name>", name)
+	}
+
+	return resolveRedirect(ctx, channelsBaseURL+url.PathEscape(name))
+}
+
+// resolveOfficialChannel resolves "nixos:name" inputs to the dated snapshot of
+// the official channel's tarball. The name can be a full channel name, such as
+// "nixos:nixpkgs-unstable", or just a version, such as "nixos:24.05" or
+// "nixos:unstable", which is short for "nixos-<version>". "nixos:system" is
+// the version of the running NixOS, and "nixos:system-small" its small
+// channel.
+func resolveOfficialChannel(ctx context.Context, in ChannelInput) (ResolvedInput, error) {
+	u, err := in.URL.Parse()
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	name := u.Opaque
+	if suffix, ok := strings.CutPrefix(name, officialSystemChannel); ok && (suffix == "" || suffix == "-small") {
+		version, err := systemNixOSVersion()
+		if err != nil {
+			return ResolvedInput{}, errors.Wrap(err, "cannot get the NixOS version of the system")
+		}
+
+		slog.Debug(
+			"following the NixOS version of the system",
+			"input", in,
+			"version", version)
+
+		name = version + suffix
+	}
+
+	name, err = officialChannelName(name)
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	resolved, err := resolveRedirect(ctx, officialChannelsBaseURL+name+"/nixexprs.tar.xz")
+	if err != nil {
+		var statusErr *httpStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return ResolvedInput{}, fmt.Errorf(
+				"official channel %q does not exist, expected %s of a released version",
+				name, officialChannelForm)
+		}
+		return ResolvedInput{}, err
+	}
+
+	return resolved, nil
+}
+
+// systemNixOSVersion returns the release of the running NixOS, e.g. "24.05",
+// from osReleasePath.
+func systemNixOSVersion() (string, error) {
+	b, err := os.ReadFile(osReleasePath)
+	if err != nil {
+		return "", err
+	}
+
+	release := make(map[string]string)
+	for _, line := range strings.Split(string(b), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, "'")
+		}
+		release[key] = value
+	}
+
+	if release["ID"] != "nixos" {
+		return "", fmt.Errorf("%s is not NixOS but %q", osReleasePath, release["ID"])
+	}
+
+	version := release["VERSION_ID"]
+	if !nixosVersionRe.MatchString(version) {
+		return "", fmt.Errorf("%s has invalid NixOS version %q, expected YY.MM", osReleasePath, version)
+	}
+
+	return version, nil
+}
+
+// nixosVersionRe matches NixOS release versions, e.g. 24.05.
+var nixosVersionRe = regexp.MustCompile(`^\d{2}\.\d{2}$`)
+
+func officialChannelName(name string) (string, error) {
+	if !strings.HasPrefix(name, "nixos-") && !strings.HasPrefix(name, "nixpkgs-") {
+		name = "nixos-" + name
+	}
+
+	if !officialChannelRe.MatchString(name) {
+		return "", fmt.Errorf("unknown official channel %q, expected %s", name, officialChannelForm)
+	}
+
+	return name, nil
+}
+
+// resolveRedirect follows the redirect chain of the given URL and resolves to
+// the final URL.
+func resolveRedirect(ctx context.Context, rawURL string) (ResolvedInput, error) {
+	resp, err := head(ctx, rawURL)
+	if err != nil {
+		return ResolvedInput{}, errors.Wrapf(err, "cannot follow redirects of %q", rawURL)
+	}
+
+	finalURL := resp.Request.URL.String()
+	if finalURL == rawURL {
+		slog.Warn(
+			"channel URL did not redirect, so it may not be immutable",
+			"url", rawURL)
+	}
+
+	slog.Debug(
+		"followed channel redirects",
+		"url", rawURL,
+		"final", finalURL)
+
+	return ResolvedInput{URL: finalURL}, nil
+}
+
+// contentLength returns the size of the file at the given URL as advertised
+// by the server, or -1 if the server doesn't say.
+func contentLength(ctx context.Context, rawURL string) (int64, error) {
+	resp, err := head(ctx, rawURL)
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot get size of %q", rawURL)
+	}
+
+	return resp.ContentLength, nil
+}
+
+// head sends a HEAD request to the given URL, following redirects. Requests
+// that fail because of network errors or gateway errors are retried. A non-2xx
+// response is returned as an *httpStatusError.
+func head(ctx context.Context, rawURL string) (*http.Response, error) {
+	return doRequest(ctx, http.MethodHead, rawURL, nil, nil)
+}
+
+// getJSON sends a GET request to the given URL and decodes the JSON response
+// into v. It retries the same way head does.
+func getJSON(ctx context.Context, rawURL string, header http.Header, v any) error {
+	_, err := doRequest(ctx, http.MethodGet, rawURL, header, v)
+	return err
+}
+
+// doRequest sends a request with the given method and header. If v is not
+// nil, then the response body is decoded into it as JSON.
+func doRequest(ctx context.Context, method, rawURL string, header http.Header, v any) (*http.Response, error) {
+	var resp *http.Response
+
+	err := retry.Do(ctx, isTransientHTTPError, func() error {
+		req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+		if err != nil {
+			return errors.Wrap(err, "cannot create request")
+		}
+		for k, vs := range header {
+			req.Header[k] = vs
+		}
+
+		resp, err = httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return &httpStatusError{
+				URL:        rawURL,
+				Status:     resp.Status,
+				StatusCode: resp.StatusCode,
+			}
+		}
+
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				return errors.Wrap(err, "cannot decode response")
+			}
+		}
+
+		return nil
+	})
+
+	return resp, err
+}
+
+// isTransientHTTPError returns true if the request failed because of a
+// network error or a gateway error, which may go away when retried.
+func isTransientHTTPError(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// httpStatusError is returned when a web server responds with a non-2xx
+// status.
+type httpStatusError struct {
+	URL        string
+	Status     string
+	StatusCode int
+}
+
+func (err *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %q while following %q", err.Status, err.URL)
+}
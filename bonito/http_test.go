@@ -0,0 +1,273 @@
+package bonito
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/hexops/autogold"
+)
+
+func newTestChannelServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/channels/nixpkgs-25.05", http.RedirectHandler("/nixpkgs-25.05", http.StatusFound))
+	mux.Handle("/nixpkgs-25.05", http.RedirectHandler("/nixpkgs/25.05/nixpkgs-25.05.123.abcdef", http.StatusMovedPermanently))
+	mux.HandleFunc("/nixpkgs/25.05/nixpkgs-25.05.123.abcdef", func(w http.ResponseWriter, r *http.Request) {})
+	mux.Handle("/nixos-25.05/nixexprs.tar.xz", http.RedirectHandler("/nixos/25.05/nixos-25.05.456.fedcba/nixexprs.tar.xz", http.StatusFound))
+	mux.HandleFunc("/nixos/25.05/nixos-25.05.456.fedcba/nixexprs.tar.xz", func(w http.ResponseWriter, r *http.Request) {})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	oldClient, oldBaseURL, oldOfficialURL := httpClient, channelsBaseURL, officialChannelsBaseURL
+	t.Cleanup(func() {
+		httpClient, channelsBaseURL, officialChannelsBaseURL = oldClient, oldBaseURL, oldOfficialURL
+	})
+
+	httpClient = srv.Client()
+	channelsBaseURL = srv.URL + "/channels/"
+	officialChannelsBaseURL = srv.URL + "/"
+
+	return srv
+}
+
+func TestResolveChannelRedirect(t *testing.T) {
+	srv := newTestChannelServer(t)
+
+	srvURL, _ := url.Parse(srv.URL)
+	channelRedirectHosts[srvURL.Host] = true
+	t.Cleanup(func() { delete(channelRedirectHosts, srvURL.Host) })
+
+	want := srv.URL + "/nixpkgs/25.05/nixpkgs-25.05.123.abcdef"
+
+	for _, in := range []string{
+		"channel:nixpkgs-25.05",
+		srv.URL + "/channels/nixpkgs-25.05",
+	} {
+		input, err := ParseChannelInput(in)
+		if err != nil {
+			t.Fatal("cannot parse channel input:", err)
+		}
+
+		resolved, err := input.Resolve(context.Background())
+		if err != nil {
+			t.Fatalf("cannot resolve %q: %v", in, err)
+		}
+
+		if resolved.URL != want {
+			t.Errorf("%q resolved to %q, want %q", in, resolved.URL, want)
+		}
+	}
+}
+
+func TestResolveChannelNotFound(t *testing.T) {
+	newTestChannelServer(t)
+
+	input := ChannelInput{URL: "channel:nixpkgs-99.99"}
+	if _, err := input.Resolve(context.Background()); err == nil {
+		t.Fatal("unexpected success resolving missing channel")
+	}
+}
+
+func TestResolveOfficialChannel(t *testing.T) {
+	srv := newTestChannelServer(t)
+
+	want := srv.URL + "/nixos/25.05/nixos-25.05.456.fedcba/nixexprs.tar.xz"
+
+	for _, in := range []string{"nixos:25.05", "nixos:nixos-25.05"} {
+		input := ChannelInput{URL: ChannelURL(in)}
+
+		resolved, err := input.Resolve(context.Background())
+		if err != nil {
+			t.Fatalf("cannot resolve %q: %v", in, err)
+		}
+
+		if resolved.URL != want {
+			t.Errorf("%q resolved to %q, want %q", in, resolved.URL, want)
+		}
+	}
+}
+
+func TestResolveOfficialSystemChannel(t *testing.T) {
+	srv := newTestChannelServer(t)
+
+	oldPath := osReleasePath
+	t.Cleanup(func() { osReleasePath = oldPath })
+	osReleasePath = filepath.Join(t.TempDir(), "os-release")
+
+	resolve := func(osRelease, in string) (ResolvedInput, error) {
+		t.Helper()
+		if err := os.WriteFile(osReleasePath, []byte(osRelease), 0644); err != nil {
+			t.Fatal(err)
+		}
+		input := ChannelInput{URL: ChannelURL(in)}
+		return input.Resolve(context.Background())
+	}
+
+	const nixos2505 = `ANSI_COLOR="1;34"
+BUILD_ID="25.05.20250601.abcdef"
+ID=nixos
+NAME=NixOS
+VERSION="25.05 (Warbler)"
+VERSION_ID="25.05"
+`
+
+	resolved, err := resolve(nixos2505, "nixos:system")
+	if err != nil {
+		t.Fatal("cannot resolve nixos:system:", err)
+	}
+	if want := srv.URL + "/nixos/25.05/nixos-25.05.456.fedcba/nixexprs.tar.xz"; resolved.URL != want {
+		t.Errorf("nixos:system resolved to %q, want %q", resolved.URL, want)
+	}
+
+	// The test server has no small channel.
+	_, err = resolve(nixos2505, "nixos:system-small")
+	if err == nil || !strings.Contains(err.Error(), `official channel "nixos-25.05-small" does not exist`) {
+		t.Errorf("unexpected error for nixos:system-small: %v", err)
+	}
+
+	_, err = resolve(strings.ReplaceAll(nixos2505, "25.05", "99.99"), "nixos:system")
+	if err == nil || !strings.Contains(err.Error(), `official channel "nixos-99.99" does not exist`) {
+		t.Errorf("unexpected error for an unreleased version: %v", err)
+	}
+
+	_, err = resolve("ID=debian\nVERSION_ID=\"12\"\n", "nixos:system")
+	if err == nil || !strings.Contains(err.Error(), `is not NixOS but "debian"`) {
+		t.Errorf("unexpected error for another distribution: %v", err)
+	}
+
+	_, err = resolve("ID=nixos\nVERSION_ID=latest\n", "nixos:system")
+	if err == nil || !strings.Contains(err.Error(), `invalid NixOS version "latest"`) {
+		t.Errorf("unexpected error for an invalid version: %v", err)
+	}
+}
+
+func TestResolveOfficialChannelInvalid(t *testing.T) {
+	newTestChannelServer(t)
+
+	for _, in := range []string{"nixos:latest", "nixos:nixpkgs-24", "nixos:nixos-24.05-large"} {
+		input := ChannelInput{URL: ChannelURL(in)}
+
+		_, err := input.Resolve(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "unknown official channel") {
+			t.Errorf("unexpected error resolving %q: %v", in, err)
+		}
+	}
+}
+
+func TestResolveOfficialChannelNotFound(t *testing.T) {
+	newTestChannelServer(t)
+
+	input := ChannelInput{URL: "nixos:nixpkgs-99.99"}
+
+	_, err := input.Resolve(context.Background())
+	if err == nil || !strings.Contains(err.Error(), `official channel "nixpkgs-99.99" does not exist`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckDownloadSize(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/huge.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10000000000")
+	})
+	mux.HandleFunc("/small.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	oldClient := httpClient
+	t.Cleanup(func() { httpClient = oldClient })
+	httpClient = srv.Client()
+
+	var s State
+	s.Config.Global.MaxDownloadSize = 1 << 30
+
+	if err := s.checkDownloadSize(context.Background(), []string{srv.URL + "/small.tar.gz"}); err != nil {
+		t.Error("small download was rejected:", err)
+	}
+
+	urls := []string{srv.URL + "/small.tar.gz", srv.URL + "/huge.tar.gz"}
+
+	err := s.checkDownloadSize(context.Background(), urls)
+	if err == nil || !strings.Contains(err.Error(), "max download size") {
+		t.Errorf("unexpected error for huge download: %v", err)
+	}
+
+	s.Config.Global.MaxDownloadSizeAction = "warn"
+	if err := s.checkDownloadSize(context.Background(), urls); err != nil {
+		t.Error("huge download was rejected despite warn:", err)
+	}
+}
+
+func TestResolvePinnedTarball(t *testing.T) {
+	const (
+		tarballURL = "https://example.com/release-1.0.tar.gz"
+		hash       = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	)
+
+	var prefetched [][]string
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		prefetched = append(prefetched, cmd.Args)
+		if cmd.Args[len(cmd.Args)-2] != tarballURL || cmd.Args[len(cmd.Args)-1] != strings.TrimPrefix(hash, "sha256:") {
+			return errors.New("hash mismatch")
+		}
+		fmt.Fprintln(cmd.Stdout, "0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73")
+		return nil
+	})
+
+	input := ChannelInput{URL: tarballURL, Version: hash}
+
+	resolved, err := input.Resolve(ctx)
+	if err != nil {
+		t.Fatal("cannot resolve:", err)
+	}
+
+	autogold.Want("resolved", ResolvedInput{URL: tarballURL, SHA256: hash}).Equal(t, resolved)
+
+	if len(prefetched) != 1 || prefetched[0][0] != "nix-prefetch-url" {
+		t.Errorf("unexpected commands %q", prefetched)
+	}
+
+	input.URL = "https://example.com/release-2.0.tar.gz"
+	if _, err := input.Resolve(ctx); err == nil || !strings.Contains(err.Error(), "cannot verify the hash") {
+		t.Errorf("unexpected error for mismatching hash: %v", err)
+	}
+}
+
+func TestParseTarballHash(t *testing.T) {
+	valid := []string{
+		"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+		"sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+	}
+	for _, version := range valid {
+		if _, err := parseTarballHash(version); err != nil {
+			t.Errorf("%q is invalid: %v", version, err)
+		}
+	}
+
+	invalid := []string{
+		"master",
+		"sha256:abc",
+		"sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9cee",
+		"sha256-abc=",
+		"sha512:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}
+	for _, version := range invalid {
+		if _, err := parseTarballHash(version); err == nil {
+			t.Errorf("%q is valid", version)
+		}
+	}
+}
@@ -19,6 +19,9 @@ const (
 	_ ctxKey = iota
 	optsCtxKey
 	verboseCtxKey
+	runnerCtxKey
+	envCtxKey
+	binariesCtxKey
 )
 
 func isVerbose(ctx context.Context) bool {
@@ -50,15 +53,79 @@ func OptsFromContext(ctx context.Context) Opts {
 	return o
 }
 
+// Runner runs the given command to completion. The command's Stdout and Stderr
+// are already set up by Exec. It is mainly useful for replacing the actual
+// command invocations in tests.
+type Runner func(cmd *exec.Cmd) error
+
+// WithRunner makes all Exec calls using the returned context use the given
+// Runner instead of running the command directly.
+func WithRunner(ctx context.Context, runner Runner) context.Context {
+	return context.WithValue(ctx, runnerCtxKey, runner)
+}
+
+// WithEnv makes all Exec calls using the returned context run with the given
+// extra environment variables in the form of key=value. The variables are
+// never logged, so they may contain secrets. If the command is run using sudo,
+// the variables are kept using --preserve-env, which the sudoers policy must
+// allow.
+func WithEnv(ctx context.Context, env ...string) context.Context {
+	env = append(envFromContext(ctx), env...)
+	return context.WithValue(ctx, envCtxKey, env)
+}
+
+// WithBinaries makes all Exec calls using the returned context run the
+// binaries at the given paths instead of looking up their names in $PATH. The
+// map maps names, e.g. "nix-channel", to paths. Names that aren't in the map
+// are run as they are.
+func WithBinaries(ctx context.Context, paths map[string]string) context.Context {
+	return context.WithValue(ctx, binariesCtxKey, paths)
+}
+
+func binaryPath(ctx context.Context, name string) string {
+	paths, _ := ctx.Value(binariesCtxKey).(map[string]string)
+	if path, ok := paths[name]; ok && path != "" {
+		return path
+	}
+	return name
+}
+
+func envFromContext(ctx context.Context) []string {
+	env, _ := ctx.Value(envCtxKey).([]string)
+	return env[:len(env):len(env)]
+}
+
+func runnerFromContext(ctx context.Context) Runner {
+	r, _ := ctx.Value(runnerCtxKey).(Runner)
+	if r == nil {
+		r = (*exec.Cmd).Run
+	}
+	return r
+}
+
 // Exec executes a command.
 func Exec(ctx context.Context, out *string, arg0 string, argv ...string) error {
+	return execCmd(ctx, nil, out, arg0, argv)
+}
+
+// ExecInput executes a command like Exec with the given input as its stdin.
+// Unlike arguments, the input isn't visible to other users, so it can be a
+// secret. sudo still prompts for a password on the terminal.
+func ExecInput(ctx context.Context, input string, arg0 string, argv ...string) error {
+	return execCmd(ctx, strings.NewReader(input), nil, arg0, argv)
+}
+
+func execCmd(ctx context.Context, stdin io.Reader, out *string, arg0 string, argv []string) error {
 	o := OptsFromContext(ctx)
+	arg0 = binaryPath(ctx, arg0)
 
 	currentUser := CurrentUser()
 	if o.Username == "" {
 		o.Username = currentUser
 	}
 
+	env := envFromContext(ctx)
+
 	var cmd *exec.Cmd
 	if o.Username == currentUser {
 		cmd = exec.CommandContext(ctx, arg0, argv...)
@@ -67,13 +134,25 @@ func Exec(ctx context.Context, out *string, arg0 string, argv ...string) error {
 			return fmt.Errorf("cannot run as user %q", o.Username)
 		}
 
-		sudoArgs := []string{"-u", o.Username, arg0}
+		sudoArgs := []string{"-u", o.Username}
+		if keys := envKeys(env); len(keys) > 0 {
+			sudoArgs = append(sudoArgs, "--preserve-env="+strings.Join(keys, ","))
+		}
+		sudoArgs = append(sudoArgs, arg0)
 		sudoArgs = append(sudoArgs, argv...)
 
 		cmd = exec.CommandContext(ctx, "sudo", sudoArgs...)
 		cmd.Stdin = os.Stdin // for the prompt
 	}
 
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
 	if out != nil {
 		var outbuf strings.Builder
 		cmd.Stdout = &outbuf
@@ -91,7 +170,7 @@ func Exec(ctx context.Context, out *string, arg0 string, argv ...string) error {
 		cmd.Stderr = &stderr
 	}
 
-	if err := cmd.Run(); err != nil {
+	if err := runnerFromContext(ctx)(cmd); err != nil {
 		if stderr.Len() > 0 {
 			slog.Warn(
 				"command failed with non-zero exit status",
@@ -99,7 +178,7 @@ func Exec(ctx context.Context, out *string, arg0 string, argv ...string) error {
 				"args", args(arg0, argv),
 				"status", cmd.ProcessState.ExitCode(),
 				"stderr", stderr.String())
-			return fmt.Errorf("%s failed", arg0)
+			return &ExitError{Name: arg0, Stderr: stderr.String()}
 		}
 
 		slog.Warn(
@@ -113,6 +192,36 @@ func Exec(ctx context.Context, out *string, arg0 string, argv ...string) error {
 	return nil
 }
 
+// ExecOutput executes a command like Exec and returns its output without
+// leading and trailing whitespace, such as the newline that ends the output of
+// most commands. It is meant for commands that print a single value, such as
+// a path.
+func ExecOutput(ctx context.Context, arg0 string, argv ...string) (string, error) {
+	var out string
+	err := Exec(ctx, &out, arg0, argv...)
+	return strings.TrimSpace(out), err
+}
+
+// ExitError is returned by Exec when the command fails and writes to stderr.
+type ExitError struct {
+	// Name is the name of the command.
+	Name string
+	// Stderr is what the command wrote to stderr.
+	Stderr string
+}
+
+func (err *ExitError) Error() string {
+	return fmt.Sprintf("%s failed", err.Name)
+}
+
+func envKeys(env []string) []string {
+	keys := make([]string, len(env))
+	for i, kv := range env {
+		keys[i], _, _ = strings.Cut(kv, "=")
+	}
+	return keys
+}
+
 func args(arg0 string, argv []string) []string {
 	return append([]string{arg0}, argv...)
 }
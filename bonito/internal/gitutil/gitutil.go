@@ -1,25 +1,42 @@
 package gitutil
 
 import (
+	"cmp"
 	"context"
 	"encoding/hex"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/diamondburned/nix-bonito/bonito/internal/retry"
+	"github.com/diamondburned/nix-bonito/bonito/internal/trace"
+	"github.com/pkg/errors"
 )
 
 // RefCommit fetches the latest commit of the reference in the given remote.
 // If the reference is a commit hash, it will be returned as is, otherwise it
 // will try to fetch a latest reference matching the given ref. If the ref ends
 // with a *, it will be treated as a glob, and the latest reference matching
-// the glob will be returned.
-func RefCommit(ctx context.Context, remote, ref string) (string, error) {
-	if len(ref) == 40 && isValidCommitHash(ref) {
+// the glob will be returned. If the ref starts with SemverPrefix, the rest of
+// it is treated as a version constraint, and the commit of the highest tag
+// satisfying it will be returned.
+//
+// The returned GitReference contains the full name of the reference that was
+// matched, which is empty if ref was already a commit hash.
+func RefCommit(ctx context.Context, remote, ref string) (GitReference, error) {
+	trace.Record(ctx, "requested", "remote", remote, "ref", ref)
+
+	if constraint, ok := strings.CutPrefix(ref, SemverPrefix); ok {
+		return semverRefCommit(ctx, remote, constraint)
+	}
+
+	if len(ref) == 40 && IsCommitHash(ref) {
 		// Immediately consider it a commit hash.
 		// A branch name of 40 characters of hex is very unlikely.
 		// If it happens, the user should use refs/heads/branch instead.
-		return ref, nil
+		trace.Record(ctx, "commit-literal", "commit", ref)
+		return GitReference{Commit: ref}, nil
 	}
 
 	args := []string{
@@ -29,74 +46,278 @@ func RefCommit(ctx context.Context, remote, ref string) (string, error) {
 	}
 
 	if !strings.HasSuffix(ref, "*") {
-		if strings.HasPrefix(ref, "refs/") {
-			ref += "^{}"
-		}
 		// Require an exact match.
 		args = append(args, ref)
+		if strings.HasPrefix(ref, "refs/") {
+			// Also ask for the dereferenced annotated tag, which points to
+			// the commit. Lightweight tags already do.
+			args = append(args, ref+"^{}")
+		}
 	}
 
 	var out string
-	err := executil.Exec(ctx, &out, args[0], args[1:]...)
-	if err != nil {
-		return "", err
+	if err := runGit(ctx, &out, args...); err != nil {
+		return GitReference{}, err
 	}
 
 	refs := splitLsRemote(out)
+	trace.Record(ctx, "ls-remote", "matches", formatRefs(refs))
 
 	if strings.HasSuffix(ref, "*") {
 		// Filter lines that match our glob, then take the last one, which is
 		// the latest one.
-		filtered := refs[:0]
-		matchRef := ref[:len(ref)-1]
-		for _, ref := range refs {
-			if strings.HasPrefix(ref.ref, matchRef) {
+		refs = filterGlobRefs(refs, ref)
+		trace.Record(ctx, "glob", "prefix", ref[:len(ref)-1], "matches", formatRefs(refs))
+	}
+
+	if len(refs) == 0 {
+		// This could still be a commit hash.
+		if IsCommitHash(ref) {
+			trace.Record(ctx, "commit-literal-fallback",
+				"commit", ref,
+				"reason", "no ref matched, but the ref looks like a commit hash")
+			return GitReference{Commit: ref}, nil
+		}
+		return GitReference{}, &RefNotFoundError{Ref: ref}
+	}
+
+	// ls-remote sorted the refs by version, so the last one is the latest.
+	matched := refs[len(refs)-1]
+	matched.Ref = strings.TrimSuffix(matched.Ref, "^{}")
+	trace.Record(ctx, "chosen",
+		"sorted", formatRefs(refs),
+		"ref", matched.Ref,
+		"commit", matched.Commit)
+	return matched, nil
+}
+
+// filterGlobRefs returns the refs that match the given glob, which ends in
+// "*", sorted by version. A glob that doesn't start with "refs/", e.g.
+// "release-*", matches both branches and tags.
+func filterGlobRefs(refs []GitReference, glob string) []GitReference {
+	prefixes := []string{strings.TrimSuffix(glob, "*")}
+	if !strings.HasPrefix(glob, "refs/") {
+		prefixes = []string{"refs/heads/" + prefixes[0], "refs/tags/" + prefixes[0]}
+	}
+
+	var filtered []GitReference
+	for _, ref := range refs {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(ref.Ref, prefix) {
 				filtered = append(filtered, ref)
+				break
 			}
 		}
-		refs = filtered
 	}
 
-	if len(refs) == 0 {
-		// This could still be a commit hash.
-		if isValidCommitHash(ref) {
-			return ref, nil
+	if len(prefixes) > 1 {
+		// ls-remote sorts by the full refname, which puts every tag after
+		// every branch, so sort by the names after refs/heads/ and refs/tags/
+		// instead. The sort is stable, so a peeled tag stays after its tag.
+		sort.SliceStable(filtered, func(i, j int) bool {
+			return compareVersions(shortRefName(filtered[i].Ref), shortRefName(filtered[j].Ref)) < 0
+		})
+	}
+
+	return filtered
+}
+
+// shortRefName returns the name of the branch or tag, e.g. "v1.0" for
+// "refs/tags/v1.0^{}".
+func shortRefName(ref string) string {
+	ref = strings.TrimSuffix(ref, "^{}")
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		if name, ok := strings.CutPrefix(ref, prefix); ok {
+			return name
 		}
-		return "", fmt.Errorf("ref %q not found", ref)
 	}
+	return ref
+}
 
-	return refs[len(refs)-1].commit, nil
+// compareVersions compares the names like git's version sort does, where runs
+// of digits are compared as numbers, e.g. "release-9" < "release-10". Like
+// versionsort.suffix=-, a name with a "-" suffix sorts before the name
+// itself, e.g. "v1.0-rc1" < "v1.0".
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			na, ra := cutDigits(a)
+			nb, rb := cutDigits(b)
+			na = strings.TrimLeft(na, "0")
+			nb = strings.TrimLeft(nb, "0")
+			if len(na) != len(nb) {
+				return cmp.Compare(len(na), len(nb))
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			a, b = ra, rb
+			continue
+		}
+		if a[0] != b[0] {
+			return cmp.Compare(a[0], b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	switch {
+	case strings.HasPrefix(a, "-"):
+		return -1
+	case strings.HasPrefix(b, "-"):
+		return 1
+	}
+	return cmp.Compare(len(a), len(b))
 }
 
-type gitReference struct {
-	commit string
-	ref    string
+func cutDigits(s string) (digits, rest string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+// formatRefs formats the given refs as "commit ref" strings for tracing.
+func formatRefs(refs []GitReference) []string {
+	strs := make([]string, len(refs))
+	for i, ref := range refs {
+		strs[i] = ref.Commit + " " + ref.Ref
+	}
+	return strs
 }
 
-func splitLsRemote(out string) []gitReference {
+// RefNotFoundError is returned when the remote has nothing that matches the
+// requested ref.
+type RefNotFoundError struct {
+	Ref string
+	// Reason replaces the default error message if it is not empty.
+	Reason string
+}
+
+func (err *RefNotFoundError) Error() string {
+	if err.Reason != "" {
+		return err.Reason
+	}
+	return fmt.Sprintf("ref %q not found", err.Ref)
+}
+
+// IsRefNotFound returns true if err is or wraps a *RefNotFoundError.
+func IsRefNotFound(err error) bool {
+	var notFound *RefNotFoundError
+	return errors.As(err, &notFound)
+}
+
+// AlternativeSeparator separates the alternative refs of a version, e.g.
+// "refs/tags/stable* || nixos-unstable".
+const AlternativeSeparator = "||"
+
+// SplitAlternatives splits the version into its alternative refs, which are
+// to be tried in order. Since semver constraints use the same separator, an
+// alternative that follows a semver constraint and is itself a valid
+// constraint continues that constraint instead.
+func SplitAlternatives(version string) []string {
+	parts := strings.Split(version, AlternativeSeparator)
+	alts := make([]string, 0, len(parts))
+
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+
+		if n := len(alts); n > 0 && strings.HasPrefix(alts[n-1], SemverPrefix) {
+			if _, err := ParseConstraint(part); err == nil {
+				alts[n-1] += " " + AlternativeSeparator + " " + part
+				continue
+			}
+		}
+
+		alts = append(alts, part)
+	}
+
+	return alts
+}
+
+// runGit runs the given git command, retrying it if it fails because of a
+// network error.
+func runGit(ctx context.Context, out *string, args ...string) error {
+	return retry.Do(ctx, isTransientError, func() error {
+		return executil.Exec(ctx, out, args[0], args[1:]...)
+	})
+}
+
+// transientErrors are parts of the messages that git prints for errors that
+// may go away when retried.
+var transientErrors = []string{
+	"Could not resolve host",
+	"Failed to connect",
+	"Connection refused",
+	"Connection reset",
+	"timed out",
+	"early EOF",
+	"remote end hung up",
+	"The requested URL returned error: 5",
+}
+
+// isTransientError returns true if git failed because of a network error.
+// Other errors, such as a missing ref, are never transient.
+func isTransientError(err error) bool {
+	var exitErr *executil.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	for _, msg := range transientErrors {
+		if strings.Contains(exitErr.Stderr, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// GitReference is a reference in a remote git repository.
+type GitReference struct {
+	// Commit is the commit hash that the reference points to.
+	Commit string
+	// Ref is the full name of the reference, e.g. "refs/tags/v1.0.0".
+	Ref string
+}
+
+func splitLsRemote(out string) []GitReference {
 	lines := strings.Split(out, "\n")
-	refs := make([]gitReference, 0, len(lines))
+	refs := make([]GitReference, 0, len(lines))
+
+	// Annotated tags are listed twice: once pointing to the tag object and
+	// once dereferenced with a ^{} suffix pointing to the commit.
+	peeled := make(map[string]bool)
+	for _, line := range lines {
+		if _, ref, ok := strings.Cut(line, "\t"); ok {
+			if tag, ok := strings.CutSuffix(ref, "^{}"); ok {
+				peeled[tag] = true
+			}
+		}
+	}
 
 	for _, line := range lines {
 		commit, ref, ok := strings.Cut(line, "\t")
 		if !ok {
 			continue
 		}
-		if strings.HasPrefix(ref, "refs/tags/") && !strings.HasSuffix(ref, "^{}") {
-			// Skip the tags that aren't dereferenced.
+		if peeled[ref] {
+			// Skip the tags that aren't dereferenced, keeping lightweight
+			// tags, which already point to the commit.
 			// See https://stackoverflow.com/q/15472107.
 			continue
 		}
-		refs = append(refs, gitReference{
-			commit: commit,
-			ref:    ref,
+		refs = append(refs, GitReference{
+			Commit: commit,
+			Ref:    ref,
 		})
 	}
 
 	return refs
 }
 
-func isValidCommitHash(hash string) bool {
+// IsCommitHash returns true if the given string looks like a full or
+// abbreviated commit hash.
+func IsCommitHash(hash string) bool {
 	if len(hash) < 4 || len(hash) > 40 {
 		// Require at least 4 characters.
 		// Require at most 40 characters.
@@ -107,3 +328,14 @@ func isValidCommitHash(hash string) bool {
 	_, err := hex.DecodeString(hash[:l])
 	return err == nil
 }
+
+// AuthEnv returns the environment variables that make git send the given
+// token as a bearer token to the given remote and nothing else. Passing the
+// token through the environment keeps it out of the command's arguments.
+func AuthEnv(remote, token string) []string {
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http." + remote + ".extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Bearer " + token,
+	}
+}
@@ -0,0 +1,206 @@
+package gitutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/diamondburned/nix-bonito/bonito/internal/retry"
+)
+
+func TestRefCommitRetry(t *testing.T) {
+	const commit = "1111111111111111111111111111111111111111"
+
+	// failingRemote fails the first n ls-remote calls with the given stderr.
+	failingRemote := func(n int, stderr string) (context.Context, *int) {
+		var calls int
+		ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+			calls++
+			if calls <= n {
+				fmt.Fprint(cmd.Stderr, stderr)
+				return errors.New("exit status 128")
+			}
+			fmt.Fprintf(cmd.Stdout, "%s\trefs/heads/master\n", commit)
+			return nil
+		})
+		ctx = retry.WithPolicy(ctx, retry.Policy{Retries: 2, Delay: time.Millisecond})
+		return ctx, &calls
+	}
+
+	t.Run("transient", func(t *testing.T) {
+		ctx, calls := failingRemote(2, "fatal: unable to access 'https://example.com/': Could not resolve host: example.com\n")
+
+		ref, err := RefCommit(ctx, "https://example.com/repo", "master")
+		if err != nil {
+			t.Fatal("transient error was not retried:", err)
+		}
+		if ref.Commit != commit || *calls != 3 {
+			t.Errorf("got commit %q after %d calls", ref.Commit, *calls)
+		}
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		ctx, calls := failingRemote(5, "fatal: the remote end hung up unexpectedly\n")
+
+		if _, err := RefCommit(ctx, "https://example.com/repo", "master"); err == nil {
+			t.Fatal("unexpected success")
+		}
+		if *calls != 3 {
+			t.Errorf("got %d calls, want 3", *calls)
+		}
+	})
+
+	t.Run("permanent", func(t *testing.T) {
+		ctx, calls := failingRemote(5, "fatal: repository 'https://example.com/repo/' not found\n")
+
+		_, err := RefCommit(ctx, "https://example.com/repo", "master")
+		if err == nil || !strings.Contains(err.Error(), "git failed") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if *calls != 1 {
+			t.Errorf("permanent error was retried %d times", *calls-1)
+		}
+	})
+}
+
+func TestRefCommitGlob(t *testing.T) {
+	// As sorted by git ls-remote --sort=v:refname.
+	const lsRemote = "" +
+		"1111111111111111111111111111111111111111\trefs/heads/master\n" +
+		"2222222222222222222222222222222222222222\trefs/heads/release-24.05\n" +
+		"3333333333333333333333333333333333333333\trefs/heads/release-24.11\n" +
+		"4444444444444444444444444444444444444444\trefs/tags/v1.0\n" +
+		"5555555555555555555555555555555555555555\trefs/tags/v1.0^{}\n" +
+		"6666666666666666666666666666666666666666\trefs/tags/v1.1\n"
+
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		fmt.Fprint(cmd.Stdout, lsRemote)
+		return nil
+	})
+
+	tests := []struct {
+		glob string
+		want GitReference
+	}{
+		{
+			glob: "refs/heads/release-*",
+			want: GitReference{Commit: "3333333333333333333333333333333333333333", Ref: "refs/heads/release-24.11"},
+		},
+		{
+			glob: "release-*",
+			want: GitReference{Commit: "3333333333333333333333333333333333333333", Ref: "refs/heads/release-24.11"},
+		},
+		{
+			// v1.1 is a lightweight tag.
+			glob: "refs/tags/v*",
+			want: GitReference{Commit: "6666666666666666666666666666666666666666", Ref: "refs/tags/v1.1"},
+		},
+		{
+			// v1.0 is an annotated tag, which resolves to its commit.
+			glob: "refs/tags/v1.0*",
+			want: GitReference{Commit: "5555555555555555555555555555555555555555", Ref: "refs/tags/v1.0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.glob, func(t *testing.T) {
+			ref, err := RefCommit(ctx, "https://example.com/repo", test.glob)
+			if err != nil {
+				t.Fatal("cannot resolve glob:", err)
+			}
+			if ref != test.want {
+				t.Errorf("got %+v, want %+v", ref, test.want)
+			}
+		})
+	}
+}
+
+func TestRefCommitGlobBranchesAndTags(t *testing.T) {
+	// ls-remote puts every tag after every branch.
+	lsRemote := func(tags ...string) string {
+		out := "" +
+			"1111111111111111111111111111111111111111\trefs/heads/release-24.05\n" +
+			"2222222222222222222222222222222222222222\trefs/heads/release-25.05\n"
+		for _, tag := range tags {
+			out += tag + "\n"
+		}
+		return out
+	}
+
+	tests := map[string]struct {
+		lsRemote string
+		want     GitReference
+	}{
+		"newer branch": {
+			lsRemote: lsRemote("3333333333333333333333333333333333333333\trefs/tags/release-24.11"),
+			want:     GitReference{Commit: "2222222222222222222222222222222222222222", Ref: "refs/heads/release-25.05"},
+		},
+		"newer annotated tag": {
+			lsRemote: lsRemote(
+				"3333333333333333333333333333333333333333\trefs/tags/release-25.11",
+				"4444444444444444444444444444444444444444\trefs/tags/release-25.11^{}"),
+			want: GitReference{Commit: "4444444444444444444444444444444444444444", Ref: "refs/tags/release-25.11"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+				fmt.Fprint(cmd.Stdout, test.lsRemote)
+				return nil
+			})
+
+			ref, err := RefCommit(ctx, "https://example.com/repo", "release-*")
+			if err != nil {
+				t.Fatal("cannot resolve glob:", err)
+			}
+			if ref != test.want {
+				t.Errorf("got %+v, want %+v", ref, test.want)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	// Each name sorts before the next one.
+	names := []string{
+		"release-9.0",
+		"release-10.0-rc1",
+		"release-10.0",
+		"release-10.1",
+		"release-24.05",
+		"release-24.11",
+	}
+
+	for i := 1; i < len(names); i++ {
+		if c := compareVersions(names[i-1], names[i]); c >= 0 {
+			t.Errorf("compareVersions(%q, %q) = %d, want < 0", names[i-1], names[i], c)
+		}
+		if c := compareVersions(names[i], names[i-1]); c <= 0 {
+			t.Errorf("compareVersions(%q, %q) = %d, want > 0", names[i], names[i-1], c)
+		}
+	}
+}
+
+func TestSplitAlternatives(t *testing.T) {
+	tests := map[string][]string{
+		"nixos-unstable":                         {"nixos-unstable"},
+		"refs/tags/stable* || nixos-unstable":    {"refs/tags/stable*", "nixos-unstable"},
+		"semver:<2 || >=3":                       {"semver:<2 || >=3"},
+		"semver:<2 || >=3 || master":             {"semver:<2 || >=3", "master"},
+		"master || semver:<2 || >=3 || nixos-22": {"master", "semver:<2 || >=3", "nixos-22"},
+	}
+
+	for version, want := range tests {
+		got := SplitAlternatives(version)
+		if !slices.Equal(got, want) {
+			t.Errorf("SplitAlternatives(%q) = %q, want %q", version, got, want)
+		}
+	}
+}
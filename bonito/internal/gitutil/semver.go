@@ -0,0 +1,260 @@
+package gitutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/trace"
+	"github.com/pkg/errors"
+)
+
+// SemverPrefix is the prefix of a ref that should be treated as a semver
+// constraint instead of a ref name, e.g. "semver:>=23.11 <24".
+const SemverPrefix = "semver:"
+
+// Version is a parsed version number. Missing components are zero, so "23.11"
+// is equivalent to "23.11.0".
+type Version struct {
+	Major, Minor, Patch int
+	// Pre is the pre-release part of the version, if any.
+	Pre string
+}
+
+// ParseVersion parses a version string like "v1.2.3", "23.11" or "2-rc1". A
+// leading "v" is allowed.
+func ParseVersion(str string) (Version, error) {
+	var v Version
+
+	s := strings.TrimPrefix(str, "v")
+	s, v.Pre, _ = strings.Cut(s, "-")
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("version %q has too many components", str)
+	}
+
+	nums := [3]*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("version %q has invalid component %q", str, part)
+		}
+		*nums[i] = n
+	}
+
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1 if v is less than, equal to or greater than other.
+// A pre-release version is less than the same version without one.
+func (v Version) Compare(other Version) int {
+	for _, c := range [][2]int{
+		{v.Major, other.Major},
+		{v.Minor, other.Minor},
+		{v.Patch, other.Patch},
+	} {
+		switch {
+		case c[0] < c[1]:
+			return -1
+		case c[0] > c[1]:
+			return 1
+		}
+	}
+
+	switch {
+	case v.Pre == other.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case other.Pre == "":
+		return -1
+	case v.Pre < other.Pre:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// Constraint is a parsed version constraint. It is a list of alternatives
+// separated by "||", each of which is a list of space-separated comparisons
+// that must all hold, e.g. ">=23.05 <24 || 24.05".
+type Constraint struct {
+	alternatives [][]comparison
+}
+
+type comparison struct {
+	op string
+	v  Version
+}
+
+var constraintOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// ParseConstraint parses a version constraint string.
+func ParseConstraint(str string) (Constraint, error) {
+	var c Constraint
+
+	for _, alt := range strings.Split(str, "||") {
+		fields := strings.Fields(alt)
+		if len(fields) == 0 {
+			return c, fmt.Errorf("constraint %q has an empty alternative", str)
+		}
+
+		comparisons := make([]comparison, 0, len(fields))
+		for _, field := range fields {
+			op := "="
+			for _, o := range constraintOps {
+				if strings.HasPrefix(field, o) {
+					op = o
+					field = field[len(o):]
+					break
+				}
+			}
+
+			v, err := ParseVersion(field)
+			if err != nil {
+				return c, errors.Wrapf(err, "invalid constraint %q", str)
+			}
+
+			comparisons = append(comparisons, comparison{op, v})
+		}
+
+		c.alternatives = append(c.alternatives, comparisons)
+	}
+
+	return c, nil
+}
+
+// Match returns true if the given version satisfies the constraint.
+// Pre-release versions never match.
+func (c Constraint) Match(v Version) bool {
+	if v.Pre != "" {
+		return false
+	}
+
+	for _, comparisons := range c.alternatives {
+		if matchAll(comparisons, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAll(comparisons []comparison, v Version) bool {
+	for _, cmp := range comparisons {
+		n := v.Compare(cmp.v)
+
+		var ok bool
+		switch cmp.op {
+		case ">=":
+			ok = n >= 0
+		case "<=":
+			ok = n <= 0
+		case ">":
+			ok = n > 0
+		case "<":
+			ok = n < 0
+		case "!=":
+			ok = n != 0
+		case "=":
+			ok = n == 0
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// semverRefCommit fetches the highest tag in the given remote that satisfies
+// the given constraint.
+func semverRefCommit(ctx context.Context, remote, constraint string) (GitReference, error) {
+	c, err := ParseConstraint(constraint)
+	if err != nil {
+		return GitReference{}, err
+	}
+
+	var out string
+	if err := runGit(ctx, &out, "git", "ls-remote", "--tags", remote); err != nil {
+		return GitReference{}, err
+	}
+
+	tag, ok := highestMatchingTag(out, c)
+	if !ok {
+		return GitReference{}, &RefNotFoundError{
+			Ref:    SemverPrefix + constraint,
+			Reason: fmt.Sprintf("no tag matches constraint %q", constraint),
+		}
+	}
+
+	trace.Record(ctx, "chosen",
+		"constraint", constraint,
+		"ref", tag.Ref,
+		"commit", tag.Commit)
+
+	slog.Debug(
+		"resolved semver constraint to tag",
+		"remote", remote,
+		"constraint", constraint,
+		"tag", tag.Ref)
+
+	return tag, nil
+}
+
+// highestMatchingTag picks the highest version tag from the given ls-remote
+// output that matches c. Annotated tags are resolved to the commit that they
+// point to.
+func highestMatchingTag(lsRemoteOut string, c Constraint) (GitReference, bool) {
+	var best GitReference
+	var bestVersion Version
+	var found bool
+
+	commits := make(map[string]string)
+	var names []string
+
+	for _, line := range strings.Split(lsRemoteOut, "\n") {
+		commit, ref, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+
+		name, ok := strings.CutPrefix(ref, "refs/tags/")
+		if !ok {
+			continue
+		}
+
+		peeled, isPeeled := strings.CutSuffix(name, "^{}")
+		if isPeeled {
+			name = peeled
+		}
+
+		if _, ok := commits[name]; !ok {
+			names = append(names, name)
+		} else if !isPeeled {
+			// The dereferenced commit of an annotated tag always wins.
+			continue
+		}
+
+		commits[name] = commit
+	}
+
+	for _, name := range names {
+		v, err := ParseVersion(name)
+		if err != nil || !c.Match(v) {
+			continue
+		}
+
+		if !found || v.Compare(bestVersion) > 0 {
+			best = GitReference{Commit: commits[name], Ref: "refs/tags/" + name}
+			bestVersion = v
+			found = true
+		}
+	}
+
+	return best, found
+}
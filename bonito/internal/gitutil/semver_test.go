@@ -0,0 +1,58 @@
+package gitutil
+
+import (
+	"testing"
+
+	"github.com/hexops/autogold"
+)
+
+const testTagsLsRemote = "" +
+	"1111111111111111111111111111111111111111\trefs/tags/22.11\n" +
+	"1111111111111111111111111111111111111112\trefs/tags/22.11^{}\n" +
+	"2222222222222222222222222222222222222221\trefs/tags/23.05\n" +
+	"2222222222222222222222222222222222222222\trefs/tags/23.05^{}\n" +
+	"3333333333333333333333333333333333333331\trefs/tags/23.11\n" +
+	"3333333333333333333333333333333333333332\trefs/tags/23.11^{}\n" +
+	"4444444444444444444444444444444444444444\trefs/tags/24.05-beta\n" +
+	"5555555555555555555555555555555555555555\trefs/tags/v24.05.1\n" +
+	"6666666666666666666666666666666666666666\trefs/tags/not-a-version\n" +
+	"7777777777777777777777777777777777777777\trefs/heads/master\n"
+
+func TestHighestMatchingTag(t *testing.T) {
+	tests := []struct {
+		constraint string
+		want       autogold.Value
+	}{
+		{">=23.11 <24", autogold.Want("range", "refs/tags/23.11 3333333333333333333333333333333333333332")},
+		{"<23.11", autogold.Want("upper-bound", "refs/tags/23.05 2222222222222222222222222222222222222222")},
+		{">=23", autogold.Want("lower-bound", "refs/tags/v24.05.1 5555555555555555555555555555555555555555")},
+		{"22.11", autogold.Want("exact", "refs/tags/22.11 1111111111111111111111111111111111111112")},
+		{"<23 || 23.11", autogold.Want("alternatives", "refs/tags/23.11 3333333333333333333333333333333333333332")},
+		{"<24.05.1 !=23.11", autogold.Want("not-equal", "refs/tags/23.05 2222222222222222222222222222222222222222")},
+		{">=25", autogold.Want("no-match", "")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.want.Name(), func(t *testing.T) {
+			c, err := ParseConstraint(test.constraint)
+			if err != nil {
+				t.Fatalf("cannot parse constraint %q: %v", test.constraint, err)
+			}
+
+			var got string
+			if tag, ok := highestMatchingTag(testTagsLsRemote, c); ok {
+				got = tag.Ref + " " + tag.Commit
+			}
+
+			test.want.Equal(t, got)
+		})
+	}
+}
+
+func TestParseConstraintError(t *testing.T) {
+	for _, constraint := range []string{"", ">=abc", "1.2.3.4", ">=23 ||"} {
+		if _, err := ParseConstraint(constraint); err == nil {
+			t.Errorf("constraint %q unexpectedly parsed", constraint)
+		}
+	}
+}
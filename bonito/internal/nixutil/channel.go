@@ -5,7 +5,6 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
-	"strings"
 	"sync/atomic"
 	"time"
 
@@ -14,15 +13,13 @@ import (
 )
 
 // ChannelSourcePath resolves the /nix/store path of the channel with the given
-// name.
+// name. It returns an error naming the expected symlink if the channel has no
+// source path, e.g. because nix-channel --update did not create it.
 func ChannelSourcePath(ctx context.Context, channelName string) (string, error) {
 	o := executil.OptsFromContext(ctx)
 
-	var homeDir string
-	var err error
-
 	if o.Username == "" || executil.CurrentUserIs(o.Username) {
-		homeDir, err = os.UserHomeDir()
+		homeDir, err := os.UserHomeDir()
 		if err != nil {
 			u, err := user.Current()
 			if err != nil {
@@ -30,20 +27,53 @@ func ChannelSourcePath(ctx context.Context, channelName string) (string, error)
 			}
 			homeDir = u.HomeDir
 		}
-	} else {
-		u, err := user.Lookup(o.Username)
-		if err != nil {
-			return "", errors.Wrapf(err, "cannot lookup user %q", o.Username)
-		}
-		homeDir = u.HomeDir
+
+		// We can read our own channels without running anything.
+		link := defexprChannel(homeDir, channelName)
+		src, err := os.Readlink(link)
+		return checkSourcePath(channelName, link, src, err)
 	}
 
-	defexpr := filepath.Join(homeDir, ".nix-defexpr", "channels", channelName)
+	u, err := user.Lookup(o.Username)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot lookup user %q", o.Username)
+	}
 
-	var out string
 	// Use Exec so sudo works.
-	err = executil.Exec(ctx, &out, "readlink", defexpr)
-	return strings.TrimSpace(out), err
+	link := defexprChannel(u.HomeDir, channelName)
+	src, err := executil.ExecOutput(ctx, "readlink", link)
+	return checkSourcePath(channelName, link, src, err)
+}
+
+// checkSourcePath returns the source path src that was read from the symlink
+// link of the channel, or a clear error if reading it failed or gave nothing.
+func checkSourcePath(channelName, link, src string, err error) (string, error) {
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot read symlink %s of channel %q", link, channelName)
+	}
+	if src == "" {
+		return "", errors.Errorf("channel %q has no source path, expected a symlink at %s", channelName, link)
+	}
+	return src, nil
+}
+
+// defexprChannel returns the path of the symlink to the channel with the given
+// name in the given home directory.
+func defexprChannel(homeDir, channelName string) string {
+	return filepath.Join(homeDir, ".nix-defexpr", "channels", channelName)
+}
+
+// NarHash returns the hash of the NAR serialization of the given path, e.g.
+// "sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s". The path may
+// be within a store path, such as a channel's source path: nix-channel unpacks
+// a channel into a directory named after it, so only that directory has the
+// hash that builtins.fetchTarball expects for the channel's tarball.
+func NarHash(ctx context.Context, path string) (string, error) {
+	hash, err := executil.ExecOutput(ctx, "nix-hash", "--type", "sha256", "--base32", path)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hash, nil
 }
 
 var storeDir atomic.Pointer[string]
@@ -68,6 +98,14 @@ func StoreDir() (string, error) {
 	return d, nil
 }
 
+// SetStoreDir overrides the cached Nix store directory returned by StoreDir.
+// It returns a function that restores the previous value. Tests use it to
+// point bonito at a fake store without needing Nix.
+func SetStoreDir(dir string) (restore func()) {
+	old := storeDir.Swap(&dir)
+	return func() { storeDir.Store(old) }
+}
+
 // StoreDirUncached retrieves the Nix store directory without using the
 // cache.
 func StoreDirUncached(ctx context.Context) (string, error) {
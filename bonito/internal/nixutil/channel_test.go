@@ -0,0 +1,138 @@
+package nixutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+)
+
+func TestChannelSourcePath(t *testing.T) {
+	const storePath = "/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-nixpkgs"
+
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("cannot get current user:", err)
+	}
+
+	t.Run("current user", func(t *testing.T) {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+		t.Setenv("USER", u.Username)
+
+		dir := filepath.Join(home, ".nix-defexpr", "channels")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(storePath, filepath.Join(dir, "nixpkgs")); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+			t.Errorf("unexpected command %q", cmd.Args)
+			return fmt.Errorf("unexpected command")
+		})
+
+		path, err := ChannelSourcePath(ctx, "nixpkgs")
+		if err != nil {
+			t.Fatal("cannot get source path:", err)
+		}
+		if path != storePath {
+			t.Errorf("got %q, want %q", path, storePath)
+		}
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		// Pretend to be someone else, so that the actual current user is
+		// another user.
+		t.Setenv("USER", "bonito-someone-else")
+
+		var args []string
+		ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+			args = cmd.Args
+			fmt.Fprintln(cmd.Stdout, storePath)
+			return nil
+		})
+		ctx = executil.WithOpts(ctx, executil.Opts{Username: u.Username, UseSudo: true})
+
+		path, err := ChannelSourcePath(ctx, "nixpkgs")
+		if err != nil {
+			t.Fatal("cannot get source path:", err)
+		}
+		if path != storePath {
+			t.Errorf("got %q, want %q", path, storePath)
+		}
+
+		want := []string{"sudo", "-u", u.Username, "readlink", filepath.Join(u.HomeDir, ".nix-defexpr", "channels", "nixpkgs")}
+		if !slices.Equal(args, want) {
+			t.Errorf("got args %q, want %q", args, want)
+		}
+	})
+
+	t.Run("trailing newline", func(t *testing.T) {
+		t.Setenv("USER", "bonito-someone-else")
+		t.Cleanup(SetStoreDir("/nix/store"))
+
+		ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+			fmt.Fprint(cmd.Stdout, storePath+"\n")
+			return nil
+		})
+		ctx = executil.WithOpts(ctx, executil.Opts{Username: u.Username, UseSudo: true})
+
+		src, err := ChannelSourcePath(ctx, "nixpkgs")
+		if err != nil {
+			t.Fatal("cannot get source path:", err)
+		}
+
+		path, err := ParseStorePath(src)
+		if err != nil {
+			t.Fatalf("cannot parse source path %q: %v", src, err)
+		}
+		if path.Name != "nixpkgs" {
+			t.Errorf("got name %q, want %q", path.Name, "nixpkgs")
+		}
+	})
+
+	t.Run("missing link", func(t *testing.T) {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+		t.Setenv("USER", u.Username)
+
+		_, err := ChannelSourcePath(context.Background(), "nixpkgs")
+		if err == nil {
+			t.Fatal("missing link has a source path")
+		}
+
+		link := filepath.Join(home, ".nix-defexpr", "channels", "nixpkgs")
+		if !strings.Contains(err.Error(), link) || !strings.Contains(err.Error(), `"nixpkgs"`) {
+			t.Errorf("error does not name the channel and its link: %v", err)
+		}
+	})
+
+	t.Run("other user missing link", func(t *testing.T) {
+		t.Setenv("USER", "bonito-someone-else")
+
+		// Simulate a readlink that succeeds without printing anything.
+		ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+			return nil
+		})
+		ctx = executil.WithOpts(ctx, executil.Opts{Username: u.Username, UseSudo: true})
+
+		_, err := ChannelSourcePath(ctx, "nixpkgs")
+		if err == nil {
+			t.Fatal("empty readlink output is a source path")
+		}
+
+		link := filepath.Join(u.HomeDir, ".nix-defexpr", "channels", "nixpkgs")
+		if !strings.Contains(err.Error(), link) {
+			t.Errorf("error does not name the link: %v", err)
+		}
+	})
+}
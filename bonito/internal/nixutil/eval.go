@@ -8,11 +8,32 @@ import (
 	"github.com/pkg/errors"
 )
 
+type nixPathCtxKey struct{}
+
+// WithNixPath makes Eval using the returned context look up <name> paths in
+// the given NIX_PATH entries, e.g. "nixpkgs=/nix/store/...-source", before the
+// ambient NIX_PATH. It pins what evaluations see regardless of the
+// environment that they run in.
+func WithNixPath(ctx context.Context, entries []string) context.Context {
+	return context.WithValue(ctx, nixPathCtxKey{}, entries)
+}
+
+func nixPathFromContext(ctx context.Context) []string {
+	entries, _ := ctx.Value(nixPathCtxKey{}).([]string)
+	return entries
+}
+
 // Eval uses nix-instantiate to evaluate a Nix expression.
 func Eval(ctx context.Context, out interface{}, expr string) error {
+	var args []string
+	for _, entry := range nixPathFromContext(ctx) {
+		args = append(args, "-I", entry)
+	}
+	args = append(args, "--json", "--eval", "-E", expr)
+
 	var stdout string
 
-	err := executil.Exec(ctx, &stdout, "nix-instantiate", "--json", "--eval", "-E", expr)
+	err := executil.Exec(ctx, &stdout, "nix-instantiate", args...)
 	if err != nil {
 		return err
 	}
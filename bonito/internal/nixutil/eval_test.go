@@ -0,0 +1,40 @@
+package nixutil
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"slices"
+	"testing"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+)
+
+func TestEvalNixPath(t *testing.T) {
+	var args []string
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		args = cmd.Args
+		fmt.Fprint(cmd.Stdout, `"/nix/store"`)
+		return nil
+	})
+
+	var out string
+	if err := Eval(ctx, &out, "builtins.storeDir"); err != nil {
+		t.Fatal("cannot eval:", err)
+	}
+	if slices.Contains(args, "-I") {
+		t.Errorf("unpinned eval has -I: %q", args)
+	}
+
+	const pinned = "nixpkgs=/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source"
+	ctx = WithNixPath(ctx, []string{pinned})
+
+	if err := Eval(ctx, &out, "(import <nixpkgs> {}).lib.version"); err != nil {
+		t.Fatal("cannot eval:", err)
+	}
+
+	want := []string{"nix-instantiate", "-I", pinned, "--json", "--eval", "-E", "(import <nixpkgs> {}).lib.version"}
+	if !slices.Equal(args, want) {
+		t.Errorf("pinned eval ran %q, want %q", args, want)
+	}
+}
@@ -0,0 +1,75 @@
+// Package retry retries operations that fail because of transient errors,
+// such as network timeouts.
+package retry
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Policy describes how often and how quickly an operation is retried.
+type Policy struct {
+	// Retries is the number of times that an operation is retried after its
+	// first attempt.
+	Retries int
+	// Delay is the delay before the first retry. It doubles after every
+	// retry.
+	Delay time.Duration
+}
+
+// DefaultPolicy is the Policy used if the context has none.
+var DefaultPolicy = Policy{
+	Retries: 3,
+	Delay:   time.Second,
+}
+
+type policyCtxKey struct{}
+
+// WithPolicy makes all Do calls using the returned context use the given
+// Policy.
+func WithPolicy(ctx context.Context, policy Policy) context.Context {
+	return context.WithValue(ctx, policyCtxKey{}, policy)
+}
+
+// PolicyFromContext returns the Policy from the given context, or
+// DefaultPolicy if there is none.
+func PolicyFromContext(ctx context.Context) Policy {
+	policy, ok := ctx.Value(policyCtxKey{}).(Policy)
+	if !ok {
+		return DefaultPolicy
+	}
+	return policy
+}
+
+// Do calls fn until it succeeds, fails with an error that isTransient rejects
+// or runs out of retries, with an exponential backoff between attempts. The
+// last error is returned. A cancelled context stops the retries immediately.
+func Do(ctx context.Context, isTransient func(error) bool, fn func() error) error {
+	policy := PolicyFromContext(ctx)
+	delay := policy.Delay
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > policy.Retries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+
+		slog.Warn(
+			"retrying after transient error",
+			"attempt", attempt,
+			"retries", policy.Retries,
+			"delay", delay,
+			"err", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		delay *= 2
+	}
+}
@@ -0,0 +1,76 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var (
+	errTransient = errors.New("transient")
+	errPermanent = errors.New("ref not found")
+)
+
+func isTransient(err error) bool { return errors.Is(err, errTransient) }
+
+func TestDo(t *testing.T) {
+	ctx := WithPolicy(context.Background(), Policy{Retries: 3, Delay: time.Millisecond})
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"recovers", []error{errTransient, errTransient, nil}, 3, nil},
+		{"exhausted", []error{errTransient, errTransient, errTransient, errTransient, nil}, 4, errTransient},
+		{"permanent", []error{errPermanent, nil}, 1, errPermanent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+			err := Do(ctx, isTransient, func() error {
+				err := test.errs[calls]
+				calls++
+				return err
+			})
+
+			if calls != test.wantCalls {
+				t.Errorf("got %d calls, want %d", calls, test.wantCalls)
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDoCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = WithPolicy(ctx, Policy{Retries: 3, Delay: time.Hour})
+
+	var calls int
+	done := make(chan error)
+	go func() {
+		done <- Do(ctx, isTransient, func() error {
+			calls++
+			return errTransient
+		})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling did not stop the retries")
+	}
+
+	if calls != 1 {
+		t.Errorf("got %d calls after cancelling, want 1", calls)
+	}
+}
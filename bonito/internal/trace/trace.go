@@ -0,0 +1,66 @@
+// Package trace records the steps taken to resolve a channel input, so that
+// surprising resolutions can be explained.
+package trace
+
+import (
+	"context"
+	"sync"
+)
+
+// Step is a single step taken during resolution.
+type Step struct {
+	// Name is the name of the step, e.g. "ls-remote".
+	Name string `json:"step"`
+	// Attrs describes the step, e.g. the refs that were considered.
+	Attrs map[string]any `json:"attrs,omitempty"`
+}
+
+// Recorder records the steps of a single resolution.
+type Recorder struct {
+	mu    sync.Mutex
+	steps []Step
+}
+
+// Steps returns the steps recorded so far.
+func (r *Recorder) Steps() []Step {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Step(nil), r.steps...)
+}
+
+type recorderCtxKey struct{}
+
+// WithRecorder makes all Record calls using the returned context record into
+// the given Recorder.
+func WithRecorder(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, recorderCtxKey{}, r)
+}
+
+// Enabled returns true if the context has a Recorder. It is useful to skip
+// preparing expensive attributes.
+func Enabled(ctx context.Context) bool {
+	_, ok := ctx.Value(recorderCtxKey{}).(*Recorder)
+	return ok
+}
+
+// Record records a step into the context's Recorder, if any. attrs are pairs
+// of keys and values, like in log/slog.
+func Record(ctx context.Context, name string, attrs ...any) {
+	r, ok := ctx.Value(recorderCtxKey{}).(*Recorder)
+	if !ok {
+		return
+	}
+
+	step := Step{Name: name}
+	if len(attrs) > 0 {
+		step.Attrs = make(map[string]any, len(attrs)/2)
+		for i := 0; i+1 < len(attrs); i += 2 {
+			key, _ := attrs[i].(string)
+			step.Attrs[key] = attrs[i+1]
+		}
+	}
+
+	r.mu.Lock()
+	r.steps = append(r.steps, step)
+	r.mu.Unlock()
+}
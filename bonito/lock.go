@@ -5,30 +5,172 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
+	"os"
 	"path"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/diamondburned/nix-bonito/bonito/internal/nixutil"
+	"github.com/diamondburned/nix-bonito/bonito/internal/trace"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 )
 
+// LockFileVersion is the version of the lock file format that is written.
+// Lock files of older versions are migrated when they are read.
+const LockFileVersion = 2
+
 // LockFile describes a file containing hashes (or checksums) of the channels
 // fetched.
 type LockFile struct {
+	// Version is the version of the lock file format. It is always
+	// LockFileVersion when written. Lock files written before it was added
+	// have version 0.
+	Version int `json:"version"`
 	// Channels maps channel URLs to its lock.
 	Channels map[ChannelInput]ChannelLock `json:"channels"`
 }
 
+// lockFileMigrations are the steps that migrate a lock file from the version
+// of the index to the next one.
+var lockFileMigrations = [LockFileVersion]func(*LockFile){
+	// 0 to 1: the version was added. Nothing else changed, since the fields
+	// added before then are all optional.
+	func(l *LockFile) {},
+	// 1 to 2: the NAR hash was of the whole store path that nix-channel
+	// unpacked the channel into, which isn't what builtins.fetchTarball
+	// expects. Drop it, so that the hash of the sources is recorded instead
+	// the next time the channel is fetched.
+	func(l *LockFile) {
+		for input, lock := range l.Channels {
+			if lock.NarHash() == "" {
+				continue
+			}
+			meta := *lock.Meta
+			meta.NarHash = ""
+			lock.Meta = &meta
+			if meta.isZero() {
+				lock.Meta = nil
+			}
+			l.Channels[input] = lock
+		}
+	},
+}
+
+// migrate migrates the lock file to LockFileVersion.
+func (l *LockFile) migrate() error {
+	if l.Version > LockFileVersion {
+		return fmt.Errorf(
+			"lock file version %d is newer than the supported version %d, perhaps upgrade bonito",
+			l.Version, LockFileVersion)
+	}
+	if l.Version < 0 {
+		return fmt.Errorf("invalid lock file version %d", l.Version)
+	}
+
+	for l.Version < LockFileVersion {
+		lockFileMigrations[l.Version](l)
+		l.Version++
+	}
+
+	return nil
+}
+
 // Update updates the lock file to have hashes from the given LockFile.
 func (l *LockFile) Update(newer LockFile) {
+	if l.Channels == nil {
+		l.Channels = make(map[ChannelInput]ChannelLock, len(newer.Channels))
+	}
 	for channel, lock := range newer.Channels {
 		l.Channels[channel] = lock
 	}
 }
 
+// SplitUsers splits the lock by the users whose channels, including the global
+// ones, use each input. An input used by several users is in the lock of each
+// of them. The inputs that no user uses, such as flakes-only channels, are
+// returned in rest.
+func (l LockFile) SplitUsers(cfg Config) (rest LockFile, users map[Username]LockFile, err error) {
+	rest = LockFile{Channels: make(map[ChannelInput]ChannelLock)}
+	users = make(map[Username]LockFile, len(cfg.Users))
+
+	used := make(map[ChannelInput]bool, len(l.Channels))
+
+	for username := range cfg.Users {
+		channels, err := cfg.UserChannels(username)
+		if err != nil {
+			return LockFile{}, nil, errors.Wrapf(err, "cannot get channels of user %q", username)
+		}
+
+		userLock := LockFile{Channels: make(map[ChannelInput]ChannelLock)}
+		for _, input := range channels {
+			if lock, ok := l.Channels[input]; ok {
+				userLock.Channels[input] = lock
+				used[input] = true
+			}
+		}
+
+		users[username] = userLock
+	}
+
+	for input, lock := range l.Channels {
+		if !used[input] {
+			rest.Channels[input] = lock
+		}
+	}
+
+	return rest, users, nil
+}
+
+// Merge adds the channels of the other lock file into the lock, e.g. to
+// combine the locks returned by SplitUsers. If both lock the same input
+// differently, then the lock of l is kept and a warning is logged.
+func (l *LockFile) Merge(other LockFile) {
+	if l.Channels == nil {
+		l.Channels = make(map[ChannelInput]ChannelLock, len(other.Channels))
+	}
+
+	for input, lock := range other.Channels {
+		if existing, ok := l.Channels[input]; ok {
+			if !existing.Eq(lock) {
+				slog.Warn(
+					"input is locked differently in separate lock files, keeping the first",
+					"input", input,
+					"kept", existing.URL,
+					"ignored", lock.URL)
+			}
+			continue
+		}
+		l.Channels[input] = lock
+	}
+}
+
+// Overlay returns the locks of the inputs configured in cfg that the base
+// lock file doesn't have or locks differently, so that updating base with the
+// overlay gives back the configured part of l. The recorded channel names are
+// not compared, since they depend on the config of whoever wrote each lock.
+func (l LockFile) Overlay(base LockFile, cfg Config) LockFile {
+	inputs := cfg.ChannelInputs()
+
+	overlay := LockFile{Channels: make(map[ChannelInput]ChannelLock)}
+	for input, lock := range l.Channels {
+		if _, ok := inputs[input]; !ok {
+			continue
+		}
+		if baseLock, ok := base.Channels[input]; ok && baseLock.withoutNames().Eq(lock.withoutNames()) {
+			continue
+		}
+		overlay.Channels[input] = lock
+	}
+	return overlay
+}
+
 // ChannelLock describes the locking checksums for a single channel.
 type ChannelLock struct {
 	// URL is the resolved channel URL that's used for Nix. This URL must always
@@ -38,24 +180,264 @@ type ChannelLock struct {
 	StoreHash nixutil.StoreHash `json:"store_hash"`
 	// StorePath is the path of the /nix/store output path of the channel.
 	StorePath string `json:"store_path,omitempty"`
+	// Meta contains extra information about how the channel was resolved. It
+	// is nil if the resolver had nothing to add.
+	Meta *ChannelLockMeta `json:"meta,omitempty"`
+	// FetchedAt is when the channel was fetched with its current contents. It
+	// is kept as long as the contents don't change, and is zero for locks
+	// written before it was added.
+	FetchedAt time.Time `json:"fetched_at,omitempty"`
+}
+
+// MarshalJSON marshals the lock like encoding/json would, except FetchedAt is
+// written in RFC 3339 in UTC and left out if it is zero.
+func (l ChannelLock) MarshalJSON() ([]byte, error) {
+	type rawLock ChannelLock
+
+	var fetchedAt string
+	if !l.FetchedAt.IsZero() {
+		fetchedAt = l.FetchedAt.UTC().Format(time.RFC3339)
+	}
+
+	return json.Marshal(struct {
+		rawLock
+		FetchedAt string `json:"fetched_at,omitempty"`
+	}{rawLock(l), fetchedAt})
 }
 
-// HashChanged returns true if the channel URL is the same, but the store hash
-// is different.
+// ChannelLockMeta contains extra information about a locked channel.
+type ChannelLockMeta struct {
+	// Ref is the full name of the VCS reference that the channel version
+	// matched, e.g. "refs/tags/v1.0.0".
+	Ref string `json:"ref,omitempty"`
+	// Rev is the VCS revision that the channel URL points to.
+	Rev string `json:"rev,omitempty"`
+	// OriginalURL is the channel URL before it was rewritten to use a mirror.
+	OriginalURL string `json:"original_url,omitempty"`
+	// Names are the channel names that the channel is configured under. They
+	// allow applying the lock without the config.
+	Names []string `json:"names,omitempty"`
+	// PatchedFrom is the URL of the unpatched source if patches were applied
+	// to the channel. The channel URL then points to the patched source.
+	PatchedFrom string `json:"patched_from,omitempty"`
+	// Patches are the SHA-256 hashes of the applied patch files, in order.
+	Patches []string `json:"patches,omitempty"`
+	// Alternative is the alternative of the channel version that was used if
+	// the version has several.
+	Alternative string `json:"alternative,omitempty"`
+	// SHA256 is the verified hash of the tarball of a pinned tarball channel.
+	SHA256 string `json:"sha256,omitempty"`
+	// NarHash is the hash of the NAR serialization of the channel's sources,
+	// e.g. "sha256:<base32>". It allows fetching the channel with
+	// builtins.fetchTarball without the local store.
+	NarHash string `json:"nar_hash,omitempty"`
+}
+
+func (m ChannelLockMeta) eq(other ChannelLockMeta) bool {
+	return m.Ref == other.Ref &&
+		m.Rev == other.Rev &&
+		m.OriginalURL == other.OriginalURL &&
+		slices.Equal(m.Names, other.Names) &&
+		m.PatchedFrom == other.PatchedFrom &&
+		slices.Equal(m.Patches, other.Patches) &&
+		m.Alternative == other.Alternative &&
+		m.SHA256 == other.SHA256 &&
+		m.NarHash == other.NarHash
+}
+
+func (m ChannelLockMeta) isZero() bool {
+	return m.eq(ChannelLockMeta{})
+}
+
+func newChannelLock(resolved ResolvedInput, storePath nixutil.StorePath, src string) ChannelLock {
+	lock := ChannelLock{
+		URL:       resolved.URL,
+		StoreHash: storePath.Hash,
+		StorePath: src,
+	}
+	if storePath.Hash != "" {
+		lock.FetchedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	meta := ChannelLockMeta{
+		Ref:         resolved.Ref,
+		Rev:         resolved.Rev,
+		OriginalURL: resolved.OriginalURL,
+		Alternative: resolved.Alternative,
+		SHA256:      resolved.SHA256,
+	}
+	if !meta.isZero() {
+		lock.Meta = &meta
+	}
+	return lock
+}
+
+// Rev returns the locked VCS revision of the channel, or an empty string if
+// it is not known.
+func (l ChannelLock) Rev() string {
+	if l.Meta == nil {
+		return ""
+	}
+	return l.Meta.Rev
+}
+
+// withoutNames returns the lock without the recorded channel names.
+func (l ChannelLock) withoutNames() ChannelLock {
+	if l.Meta == nil {
+		return l
+	}
+	meta := *l.Meta
+	meta.Names = nil
+	if meta.isZero() {
+		l.Meta = nil
+	} else {
+		l.Meta = &meta
+	}
+	return l
+}
+
+// resolved returns the ResolvedInput that the lock was created from. For
+// patched channels, this is the unpatched source.
+func (l ChannelLock) resolved() ResolvedInput {
+	resolved := ResolvedInput{URL: l.URL}
+	if l.Meta != nil {
+		resolved.Ref = l.Meta.Ref
+		resolved.Rev = l.Meta.Rev
+		resolved.OriginalURL = l.Meta.OriginalURL
+		resolved.Alternative = l.Meta.Alternative
+		resolved.SHA256 = l.Meta.SHA256
+		if l.Meta.PatchedFrom != "" {
+			resolved.URL = l.Meta.PatchedFrom
+		}
+	}
+	return resolved
+}
+
+// Eq returns true if l == other. FetchedAt is not compared, since it doesn't
+// change what the lock points to.
+func (l ChannelLock) Eq(other ChannelLock) bool {
+	if !l.metaEq(other) {
+		return false
+	}
+	l.Meta = nil
+	other.Meta = nil
+	l.FetchedAt = time.Time{}
+	other.FetchedAt = time.Time{}
+	return l == other
+}
+
+func (l ChannelLock) metaEq(other ChannelLock) bool {
+	if (l.Meta == nil) != (other.Meta == nil) {
+		return false
+	}
+	return l.Meta == nil || l.Meta.eq(*other.Meta)
+}
+
+// HashChanged returns true if the channel URL is the same, but the contents
+// are different. If both locks have the NAR hash of the channel's sources,
+// then the contents are compared using it, since the store hash may change
+// across Nix versions even if the sources don't. Otherwise, the store hashes
+// of the temporary channels that fetched them are compared. A lock without a
+// store hash was never fetched, so its hash never changes.
 func (l ChannelLock) HashChanged(newer ChannelLock) bool {
-	return l.URL == newer.URL && l.StoreHash != newer.StoreHash
+	if l.URL != newer.URL || l.StoreHash == "" {
+		return false
+	}
+	if l.NarHash() != "" && newer.NarHash() != "" {
+		return l.NarHash() != newer.NarHash()
+	}
+	return l.StoreHash != newer.StoreHash
+}
+
+// NarHash returns the locked NAR hash of the channel's sources, or an empty
+// string if it is not known.
+func (l ChannelLock) NarHash() string {
+	if l.Meta == nil {
+		return ""
+	}
+	return l.Meta.NarHash
 }
 
 // NewLockFileFromReader creates a new LockFile containing data from the given
-// reader parsed as JSON.
+// reader parsed as JSON. Lock files of older versions are migrated to
+// LockFileVersion.
 func NewLockFileFromReader(r io.Reader) (LockFile, error) {
 	var l LockFile
 	if err := json.NewDecoder(r).Decode(&l); err != nil {
 		return l, err
 	}
+	if err := l.migrate(); err != nil {
+		return l, err
+	}
 	return l, nil
 }
 
+// recordNames records the channel names that each input is configured under
+// into the input's lock. Inputs that aren't in the lock are ignored.
+func (l *LockFile) recordNames(names map[ChannelInput][]string) {
+	for input, inputNames := range names {
+		lock, ok := l.Channels[input]
+		if !ok {
+			continue
+		}
+
+		var meta ChannelLockMeta
+		if lock.Meta != nil {
+			meta = *lock.Meta
+		}
+		meta.Names = inputNames
+
+		if meta.isZero() {
+			lock.Meta = nil
+		} else {
+			lock.Meta = &meta
+		}
+
+		l.Channels[input] = lock
+	}
+}
+
+// removeName removes the given channel name from the locks that record it.
+// Locks that are left without any name are deleted. It returns true if any
+// lock recorded the name.
+func (l *LockFile) removeName(name string) bool {
+	var found bool
+	for input, lock := range l.Channels {
+		if lock.Meta == nil || !slices.Contains(lock.Meta.Names, name) {
+			continue
+		}
+		found = true
+
+		meta := *lock.Meta
+		meta.Names = slices.DeleteFunc(slices.Clone(meta.Names), func(n string) bool { return n == name })
+		if len(meta.Names) == 0 {
+			delete(l.Channels, input)
+			continue
+		}
+
+		lock.Meta = &meta
+		l.Channels[input] = lock
+	}
+	return found
+}
+
+// namedChannels returns the channels in the lock file by the names recorded
+// in them. It errors if a name is recorded for more than one input.
+func (l LockFile) namedChannels() (map[string]ChannelInput, error) {
+	channels := make(map[string]ChannelInput, len(l.Channels))
+	for input, lock := range l.Channels {
+		if lock.Meta == nil {
+			continue
+		}
+		for _, name := range lock.Meta.Names {
+			if other, ok := channels[name]; ok {
+				return nil, fmt.Errorf("channel %q is locked for both %q and %q", name, other, input)
+			}
+			channels[name] = input
+		}
+	}
+	return channels, nil
+}
+
 // Eq returns true if l == old.
 func (l LockFile) Eq(old LockFile) bool {
 	if len(l.Channels) != len(old.Channels) {
@@ -68,7 +450,7 @@ func (l LockFile) Eq(old LockFile) bool {
 			return false
 		}
 
-		if oldLock != lock {
+		if !oldLock.Eq(lock) {
 			return false
 		}
 	}
@@ -78,6 +460,7 @@ func (l LockFile) Eq(old LockFile) bool {
 
 // String formats the LockFile as a pretty JSON string.
 func (l LockFile) String() string {
+	l.Version = LockFileVersion
 	b, err := json.MarshalIndent(l, "", "  ")
 	if err != nil {
 		panic(err)
@@ -101,8 +484,8 @@ func (u *locksUpdater) add(channelInputs map[string]ChannelInput) (err error) {
 	channels := newChannelExecer(u.ctx, true)
 
 	type addedCh struct {
-		name string
-		url  string
+		name     string
+		resolved ResolvedInput
 	}
 
 	added := make(map[ChannelInput]addedCh, len(channelInputs))
@@ -120,20 +503,20 @@ func (u *locksUpdater) add(channelInputs map[string]ChannelInput) (err error) {
 			continue
 		}
 
-		url, err := input.Resolve(u.ctx)
+		resolved, err := input.Resolve(u.ctx)
 		if err != nil {
 			return errors.Wrapf(err, "cannot resolve %q", input)
 		}
 
-		n, err := channels.add(name, url)
+		n, err := channels.add(name, resolved.URL)
 		if err != nil {
 			return errors.Wrapf(err, "cannot add channel %q", input)
 		}
 
 		names = append(names, n)
 		added[input] = addedCh{
-			name: n,
-			url:  url,
+			name:     n,
+			resolved: resolved,
 		}
 	}
 
@@ -152,21 +535,20 @@ func (u *locksUpdater) add(channelInputs map[string]ChannelInput) (err error) {
 			return errors.Wrapf(err, "invalid store path for channel %q", input)
 		}
 
-		u.locks[input] = ChannelLock{
-			URL:       add.url,
-			StoreHash: path.Hash,
-			StorePath: src,
-		}
+		u.locks[input] = newChannelLock(add.resolved, path, src)
 	}
 
 	return nil
 }
 
-func resolveInputs(ctx context.Context, inputs map[ChannelInput]struct{}) (map[ChannelInput]string, error) {
-	urls := make(map[ChannelInput]string, len(inputs))
+func resolveInputs(ctx context.Context, inputs map[ChannelInput]struct{}) (map[ChannelInput]ResolvedInput, error) {
+	resolvedInputs := make(map[ChannelInput]ResolvedInput, len(inputs))
 
 	var mu sync.Mutex
 	errg, ctx := errgroup.WithContext(ctx)
+	errg.SetLimit(parallelism(ctx))
+
+	traceFn := resolutionTraceFunc(ctx)
 
 	for input := range inputs {
 		input := input
@@ -179,7 +561,33 @@ func resolveInputs(ctx context.Context, inputs map[ChannelInput]struct{}) (map[C
 		}
 
 		errg.Go(func() error {
-			url, err := input.Resolve(ctx)
+			ctx := ctx
+
+			var recorder *trace.Recorder
+			if traceFn != nil {
+				recorder = &trace.Recorder{}
+				ctx = trace.WithRecorder(ctx, recorder)
+			}
+
+			resolved, err := input.Resolve(ctx)
+
+			if traceFn != nil {
+				t := ResolutionTrace{Input: input}
+				if err != nil {
+					t.Error = err.Error()
+				} else {
+					trace.Record(ctx, "resolved",
+						"url", resolved.URL,
+						"ref", resolved.Ref,
+						"rev", resolved.Rev)
+				}
+				t.Steps = recorder.Steps()
+
+				mu.Lock()
+				traceFn(t)
+				mu.Unlock()
+			}
+
 			if err != nil {
 				return errors.Wrapf(err, "cannot resolve %q", input)
 			}
@@ -187,10 +595,12 @@ func resolveInputs(ctx context.Context, inputs map[ChannelInput]struct{}) (map[C
 			slog.Debug(
 				"resolved input to static URL for Nix",
 				"input", input,
-				"url", url)
+				"url", resolved.URL,
+				"ref", resolved.Ref,
+				"rev", resolved.Rev)
 
 			mu.Lock()
-			urls[input] = url
+			resolvedInputs[input] = resolved
 			mu.Unlock()
 
 			return nil
@@ -201,62 +611,198 @@ func resolveInputs(ctx context.Context, inputs map[ChannelInput]struct{}) (map[C
 		return nil, err
 	}
 
-	return urls, nil
+	return resolvedInputs, nil
 }
 
-func resolveChannelLocks(ctx context.Context, inputURLs map[ChannelInput]string) (map[ChannelInput]ChannelLock, error) {
-	if len(inputURLs) == 0 {
-		return nil, nil
-	}
+func resolveChannelLocks(ctx context.Context, resolvedInputs map[ChannelInput]ResolvedInput) (map[ChannelInput]ChannelLock, error) {
+	return fetchChannelLocks(ctx, resolvedInputs, true)
+}
 
-	locks := make(map[ChannelInput]ChannelLock, len(inputURLs))
+// fetchChannelLocks fetches the resolved inputs using temporary channels and
+// locks them. If removeStale is true, then temporary channels that aren't
+// needed for the given inputs are removed.
+func fetchChannelLocks(ctx context.Context, resolvedInputs map[ChannelInput]ResolvedInput, removeStale bool) (map[ChannelInput]ChannelLock, error) {
+	ctx, cleanup, err := withNetrc(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
 
 	channels := newChannelExecer(ctx, true)
-	channelNames := make([]string, 0, len(inputURLs))
-	channelInputs := make(map[string]ChannelInput, len(inputURLs))
 
-	for input, url := range inputURLs {
-		tempName := shortHash(url) + "-" + path.Base(string(input.URL))
+	existing, err := channels.list()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list temporary channels")
+	}
 
-		chName, err := channels.add(tempName, url)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot add channel")
-		}
+	channelNames := make([]string, 0, len(resolvedInputs))
+	channelInputs := make(map[string]ChannelInput, len(resolvedInputs))
 
+	for input, resolved := range resolvedInputs {
+		chName := channelPrefix + tempChannelName(input, resolved.URL)
 		channelInputs[chName] = input
 		channelNames = append(channelNames, chName)
 	}
 
-	if err := channels.update(channelNames...); err != nil {
-		return nil, errors.Wrap(err, "cannot update channels")
+	// Remove temporary channels left over from previous runs that we don't
+	// need anymore.
+	for name := range existing {
+		if _, ok := channelInputs[name]; ok || !removeStale {
+			continue
+		}
+		if err := channels.exec("--remove", name); err != nil {
+			return nil, errors.Wrapf(err, "cannot remove stale temporary channel %q", name)
+		}
+	}
+
+	if len(resolvedInputs) == 0 {
+		return nil, nil
 	}
 
 	for name, input := range channelInputs {
-		src, err := nixutil.ChannelSourcePath(ctx, name)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot get source path for channel")
+		url := resolvedInputs[input].URL
+		if existing[name] == url {
+			continue
 		}
 
-		path, err := nixutil.ParseStorePath(src)
-		if err != nil {
-			return nil, errors.Wrap(err, "invalid store path for channel")
+		if _, err := channels.add(strings.TrimPrefix(name, channelPrefix), url); err != nil {
+			return nil, errors.Wrap(err, "cannot add channel")
 		}
+	}
+
+	srcs := reusableChannelSources(ctx, existing, channelInputs, resolvedInputs)
 
-		locks[input] = ChannelLock{
-			URL:       inputURLs[input],
-			StoreHash: path.Hash,
-			StorePath: src,
+	var updateNames []string
+	for _, name := range channelNames {
+		if _, ok := srcs[name]; !ok {
+			updateNames = append(updateNames, name)
 		}
 	}
 
+	// Updating no names updates every channel, so only update if needed.
+	if len(updateNames) > 0 {
+		if err := channels.update(updateNames...); err != nil {
+			return nil, errors.Wrap(err, "cannot update channels")
+		}
+	}
+
+	locks := make(map[ChannelInput]ChannelLock, len(resolvedInputs))
+
+	var mu sync.Mutex
+	errg, ctx := errgroup.WithContext(ctx)
+	errg.SetLimit(maxSourcePathLookups)
+
+	for name, input := range channelInputs {
+		name := name
+		input := input
+
+		errg.Go(func() error {
+			src, ok := srcs[name]
+			if !ok {
+				var err error
+				src, err = nixutil.ChannelSourcePath(ctx, name)
+				if err != nil {
+					return errors.Wrapf(err, "cannot get source path for channel %q", input)
+				}
+			}
+
+			path, err := nixutil.ParseStorePath(src)
+			if err != nil {
+				return errors.Wrapf(err, "invalid store path for channel %q", input)
+			}
+
+			narHash, err := nixutil.NarHash(ctx, src)
+			if err != nil {
+				return errors.Wrapf(err, "cannot get NAR hash of channel %q", input)
+			}
+
+			lock := newChannelLock(resolvedInputs[input], path, src)
+			meta := ChannelLockMeta{}
+			if lock.Meta != nil {
+				meta = *lock.Meta
+			}
+			meta.NarHash = narHash
+			lock.Meta = &meta
+
+			mu.Lock()
+			locks[input] = lock
+			mu.Unlock()
+
+			return nil
+		})
+	}
+
+	if err := errg.Wait(); err != nil {
+		return nil, err
+	}
+
 	return locks, nil
 }
 
-func removeTmpChannels(ctx context.Context) error {
-	channels := newChannelExecer(ctx, true)
-	return channels.removeAll()
+// maxSourcePathLookups is the maximum number of channel source paths that are
+// looked up at the same time.
+const maxSourcePathLookups = 8
+
+// reusableChannelSources returns the source paths of the temporary channels
+// that were already fetched from their resolved URLs in an earlier run and
+// whose sources are still in the store, so that they don't need to be fetched
+// again. Channels whose sources can't be found are fetched as usual.
+func reusableChannelSources(ctx context.Context, existing map[string]string, channelInputs map[string]ChannelInput, resolvedInputs map[ChannelInput]ResolvedInput) map[string]string {
+	var mu sync.Mutex
+	srcs := make(map[string]string)
+
+	var errg errgroup.Group
+	errg.SetLimit(maxSourcePathLookups)
+
+	for name, input := range channelInputs {
+		name := name
+		url := resolvedInputs[input].URL
+		if existing[name] != url {
+			continue
+		}
+
+		errg.Go(func() error {
+			src, err := nixutil.ChannelSourcePath(ctx, name)
+			if err == nil {
+				_, err = os.Stat(src)
+			}
+			if err != nil {
+				slog.Debug(
+					"fetching existing temporary channel again",
+					"channel", name,
+					"url", url,
+					"err", err)
+				return nil
+			}
+
+			slog.Debug(
+				"reusing existing temporary channel",
+				"channel", name,
+				"url", url)
+
+			mu.Lock()
+			srcs[name] = src
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	// The lookups never fail, since the channels are fetched again instead.
+	errg.Wait()
+	return srcs
 }
 
+// tempChannelName returns the name of the temporary channel used to fetch the
+// given input resolved to the given URL. The name is deterministic, so the
+// channel can be reused across runs, and it is unique for each pair of input
+// and URL.
+func tempChannelName(input ChannelInput, url string) string {
+	base := tempChannelNameRe.ReplaceAllString(path.Base(string(input.URL)), "_")
+	return shortHash(input.String()+"\x00"+url) + "-" + base
+}
+
+var tempChannelNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
 func shortHash(str string) string {
 	h := sha256.New()
 	h.Write([]byte(str))
@@ -0,0 +1,535 @@
+package bonito
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/diamondburned/nix-bonito/bonito/internal/nixutil"
+	"github.com/diamondburned/nix-bonito/internal/faketest"
+	"github.com/hexops/autogold"
+)
+
+// newFakeChannels creates a new fake system without Git refs and returns a
+// context that runs all commands through it.
+func newFakeChannels(t *testing.T) (*faketest.System, context.Context) {
+	t.Helper()
+
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("cannot get current user:", err)
+	}
+
+	t.Setenv("USER", u.Username)
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Cleanup(nixutil.SetStoreDir(faketest.DefaultStoreDir))
+
+	f := faketest.New(nil)
+	ctx := executil.WithRunner(context.Background(), f.Run)
+	return f, ctx
+}
+
+// tempSourcePath returns the source path that the fake fetches the given input
+// resolved to the given URL into.
+func tempSourcePath(f *faketest.System, input ChannelInput, url string) string {
+	return f.SourcePath(url, channelPrefix+tempChannelName(input, url))
+}
+
+// fetchedLock returns the lock of the given input resolved to the given URL as
+// the fake fetches it.
+func fetchedLock(t *testing.T, f *faketest.System, input ChannelInput, url string) ChannelLock {
+	t.Helper()
+
+	src := tempSourcePath(f, input, url)
+	path, err := nixutil.ParseStorePath(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ChannelLock{
+		URL:       url,
+		StoreHash: path.Hash,
+		StorePath: src,
+		Meta:      &ChannelLockMeta{NarHash: "sha256:" + faketest.SourceHash(url)},
+	}
+}
+
+func TestResolveChannelLocks(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+
+	resolvedInputs := make(map[ChannelInput]ResolvedInput)
+	for i := 0; i < 4*maxSourcePathLookups; i++ {
+		input := ChannelInput{URL: ChannelURL(fmt.Sprintf("github:owner/repo%d", i)), Version: "master"}
+		resolvedInputs[input] = ResolvedInput{
+			URL: fmt.Sprintf("https://github.com/owner/repo%d/archive/abcdef.tar.gz", i),
+			Rev: "abcdef",
+		}
+	}
+
+	locks, err := resolveChannelLocks(ctx, resolvedInputs)
+	if err != nil {
+		t.Fatal("cannot resolve channel locks:", err)
+	}
+
+	if len(locks) != len(resolvedInputs) {
+		t.Fatalf("got %d locks, want %d", len(locks), len(resolvedInputs))
+	}
+
+	for input, resolved := range resolvedInputs {
+		lock := locks[input]
+		if lock.URL != resolved.URL {
+			t.Errorf("input %q has lock URL %q, want %q", input, lock.URL, resolved.URL)
+		}
+		if want := tempSourcePath(f, input, resolved.URL); lock.StorePath != want {
+			t.Errorf("input %q has store path %q, want %q", input, lock.StorePath, want)
+		}
+		if lock.Rev() != resolved.Rev {
+			t.Errorf("input %q has rev %q, want %q", input, lock.Rev(), resolved.Rev)
+		}
+		if want := "sha256:" + faketest.SourceHash(resolved.URL); lock.Meta.NarHash != want {
+			t.Errorf("input %q has NAR hash %q, want %q", input, lock.Meta.NarHash, want)
+		}
+	}
+}
+
+func TestResolveChannelLocksReuse(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+	f.StoreDir = makeTestStore(t)
+
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	resolved := ResolvedInput{URL: "https://github.com/NixOS/nixpkgs/archive/abcdef.tar.gz"}
+
+	collectedInput := ChannelInput{URL: "github:nix-community/home-manager", Version: "master"}
+	collectedResolved := ResolvedInput{URL: "https://github.com/nix-community/home-manager/archive/abcdef.tar.gz"}
+
+	reused := channelPrefix + tempChannelName(input, resolved.URL)
+	collected := channelPrefix + tempChannelName(collectedInput, collectedResolved.URL)
+	stale := channelPrefix + "stale-nixpkgs"
+
+	f.Channels[reused] = resolved.URL
+	f.Channels[collected] = collectedResolved.URL
+	f.Channels[stale] = "https://example.com/old.tar.gz"
+	f.Channels["nixos"] = "https://nixos.org/channels/nixos-unstable"
+
+	// Fetch the channels in an earlier run, after which the sources of one
+	// of them were garbage-collected.
+	if err := f.Link(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(tempSourcePath(f, input, resolved.URL), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	locks, err := resolveChannelLocks(ctx, map[ChannelInput]ResolvedInput{
+		input:          resolved,
+		collectedInput: collectedResolved,
+	})
+	if err != nil {
+		t.Fatal("cannot resolve channel locks:", err)
+	}
+
+	if lock := locks[input]; lock.StorePath != tempSourcePath(f, input, resolved.URL) {
+		t.Errorf("unexpected lock %+v", lock)
+	}
+	if lock := locks[collectedInput]; lock.StorePath != tempSourcePath(f, collectedInput, collectedResolved.URL) {
+		t.Errorf("unexpected lock %+v", lock)
+	}
+
+	var updated []string
+	for _, call := range f.Calls {
+		if call[0] != "nix-channel" {
+			continue
+		}
+		switch call[1] {
+		case "--add":
+			t.Errorf("unexpected channel add %q", call)
+		case "--update":
+			updated = append(updated, call[2:]...)
+		}
+	}
+
+	// Only the channel whose sources are gone is fetched again.
+	autogold.Want("updated", []string{collected}).Equal(t, updated)
+
+	if _, ok := f.Channels[stale]; ok {
+		t.Error("stale temporary channel was not removed")
+	}
+	if _, ok := f.Channels["nixos"]; !ok {
+		t.Error("non-temporary channel was removed")
+	}
+}
+
+func TestLockFetchedAt(t *testing.T) {
+	_, ctx := newFakeChannels(t)
+
+	input := ChannelInput{URL: "https://example.com/nixpkgs.tar.gz"}
+
+	var s State
+	s.Config.Global.PreferredUser = os.Getenv("USER")
+	s.Config.Global.Channels = map[string]ChannelInput{"nixpkgs": input}
+	s.Config.Users = map[Username]UserConfig{s.Config.Global.PreferredUser: {}}
+
+	before := time.Now().Add(-time.Second)
+	if err := s.UpdateLocks(ctx); err != nil {
+		t.Fatal("cannot update locks:", err)
+	}
+	if fetchedAt := s.Lock.Channels[input].FetchedAt; fetchedAt.Before(before) {
+		t.Fatalf("new lock has fetched_at %v", fetchedAt)
+	}
+
+	// Unchanged contents keep their original time.
+	original := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	lock := s.Lock.Channels[input]
+	lock.FetchedAt = original
+	s.Lock.Channels[input] = lock
+
+	if err := s.UpdateLocks(ctx); err != nil {
+		t.Fatal("cannot update locks:", err)
+	}
+	if fetchedAt := s.Lock.Channels[input].FetchedAt; !fetchedAt.Equal(original) {
+		t.Errorf("unchanged lock has fetched_at %v, want %v", fetchedAt, original)
+	}
+
+	b, err := json.Marshal(s.Lock.Channels[input])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"fetched_at":"2024-01-02T03:04:05Z"`) {
+		t.Errorf("fetched_at is not RFC 3339: %s", b)
+	}
+
+	var decoded ChannelLock
+	if err := json.Unmarshal(b, &decoded); err != nil || !decoded.FetchedAt.Equal(original) {
+		t.Errorf("fetched_at did not round-trip: %v, %v", decoded.FetchedAt, err)
+	}
+
+	// Changed contents get a new time.
+	lock = s.Lock.Channels[input]
+	lock.StoreHash = "0000000000000000000000000000000a"
+	lock.Meta.NarHash = "sha256:old"
+	s.Lock.Channels[input] = lock
+
+	if err := s.UpdateLocks(ctx); err != nil {
+		t.Fatal("cannot update locks:", err)
+	}
+	if fetchedAt := s.Lock.Channels[input].FetchedAt; !fetchedAt.After(original) {
+		t.Errorf("changed lock kept fetched_at %v", fetchedAt)
+	}
+
+	b, err = json.Marshal(ChannelLock{URL: "https://example.com/unfetched.tar.gz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "fetched_at") {
+		t.Errorf("zero fetched_at was marshaled: %s", b)
+	}
+}
+
+func TestLockNamesRoundTrip(t *testing.T) {
+	nixpkgs := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	hm := ChannelInput{URL: "github:nix-community/home-manager", Version: "master"}
+	gone := ChannelInput{URL: "github:owner/gone", Version: "master"}
+
+	var s State
+	s.Config.Global.Channels = map[string]ChannelInput{"nixpkgs": nixpkgs}
+	s.Config.Flakes.Channels = map[string]ChannelInput{"nixpkgs-flake": nixpkgs}
+	s.Config.Users = map[Username]UserConfig{
+		"alice": {ChannelRegistry: ChannelRegistry{
+			Channels: map[string]ChannelInput{"home-manager": hm},
+		}},
+	}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		nixpkgs: {URL: "https://example.com/nixpkgs.tar.gz", Meta: &ChannelLockMeta{Rev: "abc"}},
+		hm:      {URL: "https://example.com/hm.tar.gz"},
+		gone:    {URL: "https://example.com/gone.tar.gz", Meta: &ChannelLockMeta{Names: []string{"gone"}}},
+	}
+
+	s.SyncLockNames()
+
+	lock, err := NewLockFileFromReader(strings.NewReader(s.Lock.String()))
+	if err != nil {
+		t.Fatal("cannot read lock:", err)
+	}
+
+	if !lock.Eq(s.Lock) {
+		t.Errorf("lock did not round-trip:\n%s", s.Lock)
+	}
+
+	autogold.Want("names", map[string][]string{
+		"github:NixOS/nixpkgs nixos-unstable":      {"nixpkgs", "nixpkgs-flake"},
+		"github:nix-community/home-manager master": {"home-manager"},
+		"github:owner/gone master":                 {},
+	}).Equal(t, lockNames(lock))
+
+	if lock.Channels[nixpkgs].Rev() != "abc" {
+		t.Error("recording names lost the rev")
+	}
+	if lock.Channels[gone].Meta != nil {
+		t.Errorf("unconfigured input kept its meta: %+v", lock.Channels[gone].Meta)
+	}
+}
+
+func lockNames(lock LockFile) map[string][]string {
+	names := make(map[string][]string, len(lock.Channels))
+	for input, l := range lock.Channels {
+		names[input.String()] = []string{}
+		if l.Meta != nil && l.Meta.Names != nil {
+			names[input.String()] = l.Meta.Names
+		}
+	}
+	return names
+}
+
+func TestDiffLocks(t *testing.T) {
+	kept := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	changed := ChannelInput{URL: "github:nix-community/home-manager", Version: "master"}
+	removed := ChannelInput{URL: "github:nix-community/NUR", Version: "master"}
+	added := ChannelInput{URL: "github:nix-community/emacs-overlay", Version: "master"}
+	// Only the store path of repathed differs.
+	repathed := ChannelInput{URL: "github:nix-community/nixGL", Version: "main"}
+
+	old := LockFile{Channels: map[ChannelInput]ChannelLock{
+		kept:     {URL: "https://example.com/nixpkgs.tar.gz", StoreHash: "a"},
+		changed:  {URL: "https://example.com/hm-old.tar.gz", StoreHash: "b"},
+		removed:  {URL: "https://example.com/nur.tar.gz", StoreHash: "c"},
+		repathed: {URL: "https://example.com/nixgl.tar.gz", StoreHash: "f", StorePath: "/nix/store/f-old"},
+	}}
+	newer := LockFile{Channels: map[ChannelInput]ChannelLock{
+		kept: {URL: "https://example.com/nixpkgs.tar.gz", StoreHash: "a"},
+		changed: {
+			URL:       "https://example.com/hm-new.tar.gz",
+			StoreHash: "d",
+			Meta:      &ChannelLockMeta{Rev: "new"},
+		},
+		added:    {URL: "https://example.com/emacs.tar.gz", StoreHash: "e"},
+		repathed: {URL: "https://example.com/nixgl.tar.gz", StoreHash: "f", StorePath: "/nix/store/f-source"},
+	}}
+
+	var got []string
+	for _, diff := range DiffLocks(old, newer) {
+		got = append(got, fmt.Sprintf("%s %s %v", diff.Action, diff.Input, diff.Fields))
+	}
+
+	autogold.Want("diffs", []string{
+		"remove github:nix-community/NUR master []",
+		"add github:nix-community/emacs-overlay master []",
+		"update github:nix-community/home-manager master [url store_hash meta]",
+		"update github:nix-community/nixGL main [store_path]",
+	}).Equal(t, got)
+}
+
+func TestDiffAgainst(t *testing.T) {
+	nixpkgs := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	hm := ChannelInput{URL: "github:nix-community/home-manager", Version: "master"}
+	nur := ChannelInput{URL: "github:nix-community/NUR", Version: "master"}
+	other := ChannelInput{URL: "github:nix-community/emacs-overlay", Version: "master"}
+
+	ref := LockFile{Channels: map[ChannelInput]ChannelLock{
+		nixpkgs: {URL: "https://example.com/nixpkgs.tar.gz", StoreHash: "a"},
+		hm:      {URL: "https://example.com/hm-new.tar.gz", StoreHash: "b"},
+		nur:     {URL: "https://example.com/nur.tar.gz", StoreHash: "c"},
+		other:   {URL: "https://example.com/emacs.tar.gz", StoreHash: "d"},
+	}}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/fleet.lock.json" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, ref.String())
+	}))
+	defer srv.Close()
+
+	fetched, err := FetchLockFile(context.Background(), srv.URL+"/fleet.lock.json")
+	if err != nil {
+		t.Fatal("cannot fetch reference lock:", err)
+	}
+	if !fetched.Eq(ref) {
+		t.Errorf("fetched lock differs from the served one:\n%s", fetched)
+	}
+
+	var s State
+	s.Config.Global.Channels = map[string]ChannelInput{"nixpkgs": nixpkgs, "home-manager": hm, "nur": nur}
+	s.Lock.Channels = map[ChannelInput]ChannelLock{
+		nixpkgs: {URL: "https://example.com/nixpkgs.tar.gz", StoreHash: "a"},
+		hm:      {URL: "https://example.com/hm-old.tar.gz", StoreHash: "e"},
+	}
+
+	var got []string
+	for _, diff := range s.DiffAgainst(fetched) {
+		got = append(got, fmt.Sprintf("%s %s %v", diff.Action, diff.Input, diff.Fields))
+	}
+
+	// The reference's emacs-overlay isn't configured here, so it's not a
+	// divergence.
+	autogold.Want("diffs", []string{
+		"remove github:nix-community/NUR master []",
+		"update github:nix-community/home-manager master [url store_hash]",
+	}).Equal(t, got)
+
+	if _, err := FetchLockFile(context.Background(), srv.URL+"/missing"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("unexpected error for missing lock: %v", err)
+	}
+}
+
+func TestResolveInputsParallelism(t *testing.T) {
+	const limit = 3
+
+	var running, maxRunning atomic.Int32
+	ChannelResolvers["test"] = func(ctx context.Context, in ChannelInput) (ResolvedInput, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+
+		for {
+			old := maxRunning.Load()
+			if n <= old || maxRunning.CompareAndSwap(old, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		return ResolvedInput{URL: "https://example.com/" + string(in.URL)}, nil
+	}
+	t.Cleanup(func() { delete(ChannelResolvers, "test") })
+
+	inputs := make(map[ChannelInput]struct{})
+	for i := 0; i < 12; i++ {
+		inputs[ChannelInput{URL: ChannelURL(fmt.Sprintf("test:%d", i))}] = struct{}{}
+	}
+
+	ctx := WithParallelism(context.Background(), limit)
+
+	resolved, err := resolveInputs(ctx, inputs)
+	if err != nil {
+		t.Fatal("cannot resolve inputs:", err)
+	}
+
+	if len(resolved) != len(inputs) {
+		t.Errorf("resolved %d inputs, want %d", len(resolved), len(inputs))
+	}
+	if got := maxRunning.Load(); got > limit {
+		t.Errorf("%d inputs were resolved at the same time, want at most %d", got, limit)
+	}
+}
+
+func TestHashChanged(t *testing.T) {
+	const url = "https://example.com/nixpkgs.tar.gz"
+
+	lock := func(storeHash nixutil.StoreHash, narHash string) ChannelLock {
+		l := ChannelLock{URL: url, StoreHash: storeHash}
+		if narHash != "" {
+			l.Meta = &ChannelLockMeta{NarHash: narHash}
+		}
+		return l
+	}
+
+	tests := []struct {
+		name  string
+		old   ChannelLock
+		newer ChannelLock
+		want  bool
+	}{
+		{"same", lock("a", "sha256:x"), lock("a", "sha256:x"), false},
+		{"store hash changed, same contents", lock("a", "sha256:x"), lock("b", "sha256:x"), false},
+		{"contents changed, same store hash", lock("a", "sha256:x"), lock("a", "sha256:y"), true},
+		{"both changed", lock("a", "sha256:x"), lock("b", "sha256:y"), true},
+		{"old without NAR hash", lock("a", ""), lock("b", "sha256:x"), true},
+		{"new without NAR hash", lock("a", "sha256:x"), lock("a", ""), false},
+		{"never fetched", lock("", ""), lock("b", "sha256:x"), false},
+		{"different URL", ChannelLock{URL: "https://example.com/other.tar.gz", StoreHash: "a"}, lock("b", ""), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.old.HashChanged(test.newer); got != test.want {
+				t.Errorf("HashChanged = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLockFileVersion(t *testing.T) {
+	input := ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+
+	t.Run("unversioned", func(t *testing.T) {
+		const old = `{
+  "channels": {
+    "github:NixOS/nixpkgs nixos-unstable": {
+      "url": "https://github.com/NixOS/nixpkgs/archive/abcdef.tar.gz",
+      "store_hash": "4ch3bm9bx98jf68ri8jmx00k479mv8g6"
+    }
+  }
+}`
+
+		lock, err := NewLockFileFromReader(strings.NewReader(old))
+		if err != nil {
+			t.Fatal("cannot read unversioned lock file:", err)
+		}
+
+		if lock.Version != LockFileVersion {
+			t.Errorf("got version %d, want %d", lock.Version, LockFileVersion)
+		}
+		if lock.Channels[input].StoreHash != "4ch3bm9bx98jf68ri8jmx00k479mv8g6" {
+			t.Errorf("channel was lost while migrating: %v", lock.Channels)
+		}
+	})
+
+	t.Run("wrapper NAR hash", func(t *testing.T) {
+		const old = `{
+  "version": 1,
+  "channels": {
+    "github:NixOS/nixpkgs nixos-unstable": {
+      "url": "https://github.com/NixOS/nixpkgs/archive/abcdef.tar.gz",
+      "store_hash": "4ch3bm9bx98jf68ri8jmx00k479mv8g6",
+      "meta": {
+        "rev": "abcdef",
+        "nar_hash": "sha256:1ph3lmnlzjxw1cc6d5gsb6d7iac9ylxmsvcvq6bsgqh4aw9ljrdl"
+      }
+    }
+  }
+}`
+
+		lock, err := NewLockFileFromReader(strings.NewReader(old))
+		if err != nil {
+			t.Fatal("cannot read lock file:", err)
+		}
+
+		got := lock.Channels[input]
+		if got.NarHash() != "" {
+			t.Errorf("NAR hash of the whole store path was kept: %q", got.NarHash())
+		}
+		if got.Rev() != "abcdef" {
+			t.Errorf("rest of the meta was lost while migrating: %+v", got.Meta)
+		}
+	})
+
+	t.Run("written", func(t *testing.T) {
+		lock := LockFile{Channels: map[ChannelInput]ChannelLock{
+			input: {URL: "https://github.com/NixOS/nixpkgs/archive/abcdef.tar.gz"},
+		}}
+
+		if !strings.Contains(lock.String(), fmt.Sprintf(`"version": %d`, LockFileVersion)) {
+			t.Errorf("lock file has no version:\n%s", lock)
+		}
+	})
+
+	t.Run("newer", func(t *testing.T) {
+		newer := fmt.Sprintf(`{"version": %d, "channels": {}}`, LockFileVersion+1)
+
+		_, err := NewLockFileFromReader(strings.NewReader(newer))
+		if err == nil || !strings.Contains(err.Error(), "newer than the supported version") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/pkg/errors"
+)
+
+// Archives behind HTTP basic auth are fetched using a netrc file with the
+// credentials of Config.Global.BasicAuth. The file is written to a temporary
+// directory right before Nix fetches the archives and removed right after, and
+// Nix is pointed at it using $NIX_CONFIG. The config only has references to
+// the encrypted credentials, and the lock only has the plain archive URLs.
+
+type basicAuthCtxKey struct{}
+
+// withBasicAuth returns ctx with the given Config.Global.BasicAuth.
+func withBasicAuth(ctx context.Context, refs map[string]string) context.Context {
+	return context.WithValue(ctx, basicAuthCtxKey{}, newHostTokens(refs))
+}
+
+// withNetrc writes the credentials of Config.Global.BasicAuth into a netrc file
+// and returns ctx with Nix configured to use it, along with a function that
+// removes the file. ctx is returned as is if there are no credentials. The
+// file is readable by the user that the commands of ctx run as.
+func withNetrc(ctx context.Context) (context.Context, func(), error) {
+	auth, _ := ctx.Value(basicAuthCtxKey{}).(*hostTokens)
+	if auth == nil || len(auth.refs) == 0 {
+		return ctx, func() {}, nil
+	}
+
+	hosts := make([]string, 0, len(auth.refs))
+	for host := range auth.refs {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var netrc strings.Builder
+	for _, host := range hosts {
+		credentials, err := auth.get(ctx, host)
+		if err != nil {
+			return ctx, nil, errors.Wrapf(err, "cannot get basic auth of host %q", host)
+		}
+
+		login, password, ok := strings.Cut(credentials, ":")
+		if !ok || login == "" || strings.ContainsAny(credentials, " \t\n") {
+			return ctx, nil, fmt.Errorf("basic auth of host %q must be <user>:<password> without spaces", host)
+		}
+
+		fmt.Fprintf(&netrc, "machine %s login %s password %s\n", host, login, password)
+	}
+
+	dir, cleanup, err := mkdirTempAsUser(ctx, "bonito-netrc-*")
+	if err != nil {
+		return ctx, nil, errors.Wrap(err, "cannot make temporary directory")
+	}
+
+	path := filepath.Join(dir, "netrc")
+	if err := writeFileAsUser(ctx, path, netrc.String()); err != nil {
+		cleanup()
+		return ctx, nil, errors.Wrap(err, "cannot write netrc file")
+	}
+
+	nixConfig := "netrc-file = " + path
+	if config := os.Getenv("NIX_CONFIG"); config != "" {
+		nixConfig = config + "\n" + nixConfig
+	}
+
+	return executil.WithEnv(ctx, "NIX_CONFIG="+nixConfig), cleanup, nil
+}
+
+// ownsFiles returns true if the user that the commands of ctx run as can use
+// the files of the current user: it is the current user, or root.
+func ownsFiles(ctx context.Context) bool {
+	o := executil.OptsFromContext(ctx)
+	return o.Username == "" || o.Username == "root" || executil.CurrentUserIs(o.Username)
+}
+
+// mkdirTempAsUser makes a new temporary directory like os.MkdirTemp that only
+// the user that the commands of ctx run as can use, and returns a function
+// that removes it. Other users make and remove it themselves, since giving
+// them a directory needs privileges that the current user may not have.
+func mkdirTempAsUser(ctx context.Context, pattern string) (string, func(), error) {
+	if ownsFiles(ctx) {
+		dir, err := os.MkdirTemp("", pattern)
+		if err != nil {
+			return "", nil, err
+		}
+		return dir, func() { os.RemoveAll(dir) }, nil
+	}
+
+	dir, err := executil.ExecOutput(ctx, "mktemp", "-d")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		// Remove it even if ctx was canceled.
+		executil.Exec(context.WithoutCancel(ctx), nil, "rm", "-rf", dir)
+	}
+	return dir, cleanup, nil
+}
+
+// writeFileAsUser writes the given data into a file at path that only the user
+// that the commands of ctx run as can read. The data is given to other users
+// on stdin, so it can be a secret.
+func writeFileAsUser(ctx context.Context, path, data string) error {
+	if ownsFiles(ctx) {
+		return os.WriteFile(path, []byte(data), 0600)
+	}
+	return executil.ExecInput(ctx, data, "sh", "-c", `umask 077 && cat > "$1"`, "sh", path)
+}
+
+// validNetrcHost returns true if the host can be written into a netrc file.
+func validNetrcHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, " \t\n/")
+}
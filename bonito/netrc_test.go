@@ -0,0 +1,171 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/hexops/autogold"
+)
+
+func TestFetchBasicAuth(t *testing.T) {
+	f, _ := newFakeChannels(t)
+	t.Setenv("NIX_CONFIG", "")
+
+	var netrcPath, netrc string
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		switch {
+		case cmd.Args[0] == "sops":
+			fmt.Fprintln(cmd.Stdout, "alice:hunter2")
+			return nil
+		case cmd.Args[0] == "nix-channel" && cmd.Args[1] == "--update":
+			for _, env := range cmd.Env {
+				if config, ok := strings.CutPrefix(env, "NIX_CONFIG="); ok {
+					netrcPath = strings.TrimPrefix(config, "netrc-file = ")
+				}
+			}
+			b, err := os.ReadFile(netrcPath)
+			if err != nil {
+				t.Errorf("cannot read netrc file %q: %v", netrcPath, err)
+			}
+			netrc = string(b)
+		}
+		if strings.Contains(strings.Join(cmd.Args, " "), "hunter2") {
+			t.Errorf("password leaked into args %q", cmd.Args)
+		}
+		return f.Run(cmd)
+	})
+
+	var cfg Config
+	cfg.Global.BasicAuth = map[string]string{
+		"forge.example.com": "sops://secrets.yaml#forge",
+	}
+	ctx = withBasicAuth(ctx, cfg.Global.BasicAuth)
+
+	input := ChannelInput{URL: "https://forge.example.com/archive/main.tar.gz"}
+	resolved := map[ChannelInput]ResolvedInput{
+		input: {URL: "https://forge.example.com/archive/main.tar.gz"},
+	}
+
+	locks, err := fetchChannelLocks(ctx, resolved, false)
+	if err != nil {
+		t.Fatal("cannot fetch:", err)
+	}
+
+	autogold.Want("netrc", "machine forge.example.com login alice password hunter2\n").Equal(t, netrc)
+
+	if _, err := os.Stat(netrcPath); !os.IsNotExist(err) {
+		t.Errorf("netrc file %q was not removed: %v", netrcPath, err)
+	}
+
+	// Only the plain URL is locked.
+	if url := locks[input].URL; url != "https://forge.example.com/archive/main.tar.gz" {
+		t.Errorf("unexpected locked URL %q", url)
+	}
+}
+
+func TestNetrcInvalidCredentials(t *testing.T) {
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		fmt.Fprintln(cmd.Stdout, "no-password")
+		return nil
+	})
+	ctx = withBasicAuth(ctx, map[string]string{"forge.example.com": "sops://secrets.yaml#forge"})
+
+	_, _, err := withNetrc(ctx)
+	if err == nil || !strings.Contains(err.Error(), "<user>:<password>") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNetrcOtherUser(t *testing.T) {
+	t.Setenv("USER", "bonito-someone-else")
+	t.Setenv("NIX_CONFIG", "")
+	t.Setenv("TMPDIR", t.TempDir())
+
+	// testNetrc writes the netrc file for the given user, running the sudo'd
+	// commands for real as the current user. It returns the contents of the
+	// file and the commands that the user ran.
+	testNetrc := func(t *testing.T, username string) (string, []string) {
+		var netrcPath string
+		var sudoed []string
+
+		ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+			if strings.Contains(strings.Join(cmd.Args, " "), "hunter2") {
+				t.Errorf("password leaked into args %q", cmd.Args)
+			}
+			for _, env := range cmd.Env {
+				if config, ok := strings.CutPrefix(env, "NIX_CONFIG="); ok {
+					netrcPath = strings.TrimPrefix(config, "netrc-file = ")
+				}
+			}
+
+			switch {
+			case cmd.Args[0] == "sops":
+				fmt.Fprintln(cmd.Stdout, "alice:hunter2")
+				return nil
+			case cmd.Args[0] == "nix-channel":
+				return nil
+			case cmd.Args[0] != "sudo" || cmd.Args[2] != username:
+				return fmt.Errorf("unexpected command %q", cmd.Args)
+			}
+
+			args := cmd.Args[3:]
+			sudoed = append(sudoed, args[0])
+
+			real := exec.Command(args[0], args[1:]...)
+			real.Stdin = cmd.Stdin
+			real.Stdout = cmd.Stdout
+			real.Stderr = cmd.Stderr
+			return real.Run()
+		})
+		ctx = executil.WithOpts(ctx, executil.Opts{Username: username, UseSudo: true})
+		ctx = withBasicAuth(ctx, map[string]string{"forge.example.com": "sops://secrets.yaml#forge"})
+
+		ctx, cleanup, err := withNetrc(ctx)
+		if err != nil {
+			t.Fatal("cannot write netrc:", err)
+		}
+
+		// Run a command as the current user to see where the file is.
+		if err := executil.Exec(executil.WithOpts(ctx, executil.Opts{}), nil, "nix-channel", "--update"); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(netrcPath)
+		if err != nil {
+			t.Fatalf("cannot read netrc file %q: %v", netrcPath, err)
+		}
+
+		cleanup()
+
+		if _, err := os.Stat(filepath.Dir(netrcPath)); !os.IsNotExist(err) {
+			t.Errorf("netrc directory of %q was not removed: %v", netrcPath, err)
+		}
+
+		return string(b), sudoed
+	}
+
+	t.Run("non-root", func(t *testing.T) {
+		netrc, sudoed := testNetrc(t, "bonito-alice")
+		autogold.Want("netrc", "machine forge.example.com login alice password hunter2\n").Equal(t, netrc)
+
+		// The user makes, writes and removes the file itself, since the
+		// current user can't give it to them.
+		autogold.Want("sudoed", []string{"mktemp", "sh", "rm"}).Equal(t, sudoed)
+	})
+
+	t.Run("root", func(t *testing.T) {
+		netrc, sudoed := testNetrc(t, "root")
+		autogold.Want("root netrc", "machine forge.example.com login alice password hunter2\n").Equal(t, netrc)
+
+		// root can read the file of the current user as it is.
+		if len(sudoed) > 0 {
+			t.Errorf("unexpected commands as root: %q", sudoed)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package bonito
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// ChannelRevision describes the locked and the latest upstream revisions of a
+// channel input.
+type ChannelRevision struct {
+	Input ChannelInput
+	// Locked is the revision in the lock file. It is empty if the input is not
+	// locked or if its lock has no revision.
+	Locked string
+	// Latest is the latest revision available upstream.
+	Latest string
+}
+
+// Outdated returns true if the upstream revision differs from the locked one.
+func (r ChannelRevision) Outdated() bool {
+	return r.Locked != r.Latest
+}
+
+// CheckRevisions looks up the latest revisions of the Git channel inputs in
+// the config using git ls-remote and compares them against the lock. Nothing
+// else is run, so nothing is fetched into the Nix store. Inputs of other
+// schemes and Git inputs with dated versions are skipped.
+func (s *State) CheckRevisions(ctx context.Context) ([]ChannelRevision, error) {
+	ctx = s.withSettings(ctx)
+
+	var mu sync.Mutex
+	var revisions []ChannelRevision
+
+	errg, ctx := errgroup.WithContext(ctx)
+	errg.SetLimit(parallelism(ctx))
+
+	for input := range s.Config.ChannelInputs() {
+		if !isGitInput(input) {
+			continue
+		}
+
+		errg.Go(func() error {
+			latest, ok, err := latestGitRev(ctx, input)
+			if err != nil {
+				return errors.Wrapf(err, "cannot resolve %q", input)
+			}
+			if !ok {
+				return nil
+			}
+
+			mu.Lock()
+			revisions = append(revisions, ChannelRevision{
+				Input:  input,
+				Locked: s.Lock.Channels[input].Rev(),
+				Latest: latest,
+			})
+			mu.Unlock()
+
+			return nil
+		})
+	}
+
+	if err := errg.Wait(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Input.String() < revisions[j].Input.String()
+	})
+
+	return revisions, nil
+}
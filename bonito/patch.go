@@ -0,0 +1,298 @@
+package bonito
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/pkg/errors"
+)
+
+// Patching works by copying the fetched source out of the Nix store, applying
+// the patches to the copy using patch(1), packing the copy into a tarball and
+// adding the tarball to the Nix store. The channel is then fetched again from
+// the tarball's file:// URL, and that store hash is locked.
+//
+// The tarball is packed deterministically, so the same source and patches
+// always give the same store paths. However, the tarball only exists in the
+// local Nix store, so the lock of a patched channel can only be applied on
+// machines that have run bonito with the same patches themselves. The tarball
+// has a GC root until bonito gc finds that the lock no longer points to it.
+
+// patchedSourceName is the name of the patched source inside the tarball.
+const patchedSourceName = "source"
+
+// patchLocks applies the configured patches to the sources of the given
+// locks and replaces them with the locks of the patched sources.
+func (s *State) patchLocks(ctx context.Context, locks map[ChannelInput]ChannelLock) error {
+	inputPatches, err := s.Config.inputPatches()
+	if err != nil {
+		return err
+	}
+
+	patchedInputs := make(map[ChannelInput]ResolvedInput)
+	patchesDigests := make(map[ChannelInput][]string)
+
+	for input, lock := range locks {
+		patches, ok := inputPatches[input]
+		if !ok {
+			continue
+		}
+
+		digests, err := patchDigests(patches)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read patches of %q", input)
+		}
+
+		tarball, err := patchSource(ctx, lock.StorePath, patches)
+		if err != nil {
+			return errors.Wrapf(err, "cannot patch %q", input)
+		}
+
+		slog.Debug(
+			"patched channel source",
+			"input", input,
+			"source", lock.StorePath,
+			"tarball", tarball)
+
+		resolved := lock.resolved()
+		resolved.URL = "file://" + tarball
+		patchedInputs[input] = resolved
+		patchesDigests[input] = digests
+	}
+
+	if len(patchedInputs) == 0 {
+		return nil
+	}
+
+	// Keep the temporary channels of the unpatched sources around, so that
+	// they don't have to be fetched again next time.
+	patchedLocks, err := fetchChannelLocks(ctx, patchedInputs, false)
+	if err != nil {
+		return errors.Wrap(err, "cannot fetch patched sources")
+	}
+
+	for input, lock := range patchedLocks {
+		meta := ChannelLockMeta{}
+		if lock.Meta != nil {
+			meta = *lock.Meta
+		}
+		meta.PatchedFrom = locks[input].URL
+		meta.Patches = patchesDigests[input]
+		lock.Meta = &meta
+
+		locks[input] = lock
+	}
+
+	return nil
+}
+
+// patchDigests returns the SHA-256 hashes of the given patch files.
+func patchDigests(patches []string) ([]string, error) {
+	digests := make([]string, len(patches))
+	for i, patch := range patches {
+		b, err := os.ReadFile(patch)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		digests[i] = hex.EncodeToString(sum[:])
+	}
+	return digests, nil
+}
+
+// patchSource applies the patches to a copy of the given source directory and
+// adds the patched copy to the Nix store as a tarball. It returns the store
+// path of the tarball.
+func patchSource(ctx context.Context, src string, patches []string) (string, error) {
+	if src == "" {
+		return "", errors.New("channel has no source path")
+	}
+
+	// The copy is ours, so don't patch it as the preferred user.
+	ctx = executil.WithOpts(ctx, executil.Opts{})
+
+	tmp, err := os.MkdirTemp("", "bonito-patch-*")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot make temporary directory")
+	}
+	defer os.RemoveAll(tmp)
+
+	root := filepath.Join(tmp, patchedSourceName)
+	if err := copyTree(src, root); err != nil {
+		return "", errors.Wrap(err, "cannot copy source")
+	}
+
+	for _, patch := range patches {
+		if err := executil.Exec(ctx, nil, "patch", "--batch", "--forward", "-p1", "-d", root, "-i", patch); err != nil {
+			return "", errors.Wrapf(err, "cannot apply patch %q", patch)
+		}
+	}
+
+	tarball := filepath.Join(tmp, "patched-source.tar.gz")
+	if err := writeTarball(tarball, root); err != nil {
+		return "", errors.Wrap(err, "cannot pack patched source")
+	}
+
+	storePath, err := addToStore(ctx, tarball)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot add patched source to the store")
+	}
+
+	return storePath, nil
+}
+
+// copyTree copies the directory at src to dst. Files are made writable, since
+// files in the Nix store are not.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, info.Mode().Perm()|0200)
+		}
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// writeTarball packs the directory at root into a gzipped tarball at dst. The
+// tarball only depends on the names, contents, types and executable bits of
+// the files, so packing the same tree always gives the same bytes. .git
+// directories of local checkouts are left out.
+func writeTarball(dst, root string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	base := filepath.Base(root)
+
+	// WalkDir walks in lexical order, which keeps the tarball deterministic.
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Join(base, rel))
+
+		if d.IsDir() && d.Name() == ".git" && path != root {
+			return filepath.SkipDir
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{Name: name}
+
+		switch {
+		case d.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0755
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = link
+			hdr.Mode = 0777
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = info.Size()
+			hdr.Mode = 0644
+			if info.Mode()&0111 != 0 {
+				hdr.Mode = 0755
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			if _, err := io.Copy(tw, file); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,70 @@
+package bonito
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatchedChannel(t *testing.T) {
+	f, ctx := newFakeChannels(t)
+	f.StoreDir = makeTestStore(t)
+
+	const url = "https://example.com/source.tar.gz"
+	input := ChannelInput{URL: url}
+
+	// Fake the fetched source of the channel.
+	src := tempSourcePath(f, input, url)
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "default.nix"), []byte("{}\n"), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := filepath.Join(t.TempDir(), "fix.patch")
+	if err := os.WriteFile(patch, []byte("fix\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var s State
+	s.Config.Global.PreferredUser = os.Getenv("USER")
+	s.Config.Global.Channels = map[string]ChannelInput{"src": input}
+	s.Config.Global.Patches = map[string][]string{"src": {patch}}
+	s.Config.Users = map[Username]UserConfig{s.Config.Global.PreferredUser: {}}
+
+	if err := s.UpdateLocks(ctx); err != nil {
+		t.Fatal("cannot update locks:", err)
+	}
+
+	lock := s.Lock.Channels[input]
+	if !strings.HasPrefix(lock.URL, "file://") {
+		t.Fatalf("lock URL %q is not the patched tarball", lock.URL)
+	}
+	if lock.StorePath != tempSourcePath(f, input, lock.URL) {
+		t.Errorf("lock store path %q is not fetched from the patched tarball", lock.StorePath)
+	}
+	if lock.Meta == nil || lock.Meta.PatchedFrom != url || len(lock.Meta.Patches) != 1 {
+		t.Fatalf("unexpected lock meta %+v", lock.Meta)
+	}
+
+	// Patching again must give the same tarball, and so the same hash.
+	if err := s.UpdateLocks(ctx); err != nil {
+		t.Fatal("cannot update locks again:", err)
+	}
+	if again := s.Lock.Channels[input]; !again.Eq(lock) {
+		t.Errorf("patching again changed the lock from %+v to %+v", lock, again)
+	}
+
+	// Changing the patch must change the hash.
+	if err := os.WriteFile(patch, []byte("another fix\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateLocks(ctx); err != nil {
+		t.Fatal("cannot update locks with a changed patch:", err)
+	}
+	if changed := s.Lock.Channels[input]; changed.StoreHash == lock.StoreHash {
+		t.Error("changing the patch did not change the store hash")
+	}
+}
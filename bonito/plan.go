@@ -0,0 +1,88 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChangeAction is the kind of change that applying a State makes.
+type ChangeAction string
+
+const (
+	// ChangeLock means that an input would be locked to a new URL.
+	ChangeLock ChangeAction = "lock"
+	// ChangeAdd means that a channel would be added for a user.
+	ChangeAdd ChangeAction = "add"
+	// ChangeUpdate means that a user's channel would point to a new URL.
+	ChangeUpdate ChangeAction = "update"
+	// ChangeRemove means that a channel would be removed from a user.
+	ChangeRemove ChangeAction = "remove"
+)
+
+// ChannelChange describes a single change that applying a State makes.
+type ChannelChange struct {
+	Action ChangeAction
+	// User is the user whose channel changes. It is empty for ChangeLock.
+	User string
+	// Name is the channel name, or the input string for ChangeLock.
+	Name   string
+	OldURL string
+	NewURL string
+}
+
+// String formats the change as a human-readable line.
+func (c ChannelChange) String() string {
+	name := c.Name
+	if c.User != "" {
+		name = c.User + "/" + c.Name
+	}
+
+	switch c.Action {
+	case ChangeAdd:
+		return fmt.Sprintf("+ %s %s", name, c.NewURL)
+	case ChangeRemove:
+		return fmt.Sprintf("- %s %s", name, c.OldURL)
+	default:
+		oldURL := c.OldURL
+		if oldURL == "" {
+			oldURL = "(none)"
+		}
+		return fmt.Sprintf("~ %s %s -> %s", name, oldURL, c.NewURL)
+	}
+}
+
+// Plan collects the changes that a dry run would have made.
+type Plan struct {
+	Changes []ChannelChange
+}
+
+func (p *Plan) add(change ChannelChange) {
+	p.Changes = append(p.Changes, change)
+}
+
+// String formats the plan as one change per line, sorted.
+func (p *Plan) String() string {
+	lines := make([]string, len(p.Changes))
+	for i, change := range p.Changes {
+		lines[i] = change.String()
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+type dryRunCtxKey struct{}
+
+// WithDryRun makes Apply, Update and UpdateLocks using the returned context
+// not change any channels. The changes that would have been made are recorded
+// into the given Plan instead. Inputs are still resolved, but nothing is
+// fetched into the Nix store, so new locks will have no store hash.
+func WithDryRun(ctx context.Context, plan *Plan) context.Context {
+	return context.WithValue(ctx, dryRunCtxKey{}, plan)
+}
+
+func dryRunPlan(ctx context.Context) *Plan {
+	plan, _ := ctx.Value(dryRunCtxKey{}).(*Plan)
+	return plan
+}
@@ -0,0 +1,102 @@
+package bonito
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Formats of the Nix profile expression, as in Config.Profile.Format.
+const (
+	// ProfileStorePaths maps each channel to its locked store path. It is
+	// the default.
+	ProfileStorePaths = "store-paths"
+	// ProfileFetchTarball maps each channel to a builtins.fetchTarball call
+	// of its locked URL and NAR hash, so that it doesn't need the local
+	// store.
+	ProfileFetchTarball = "fetchTarball"
+)
+
+// GenerateNixProfile generates a Nix expression of an attribute set that maps
+// the names of the user's channels to their locked sources. It can be
+// imported instead of using NIX_PATH, e.g.
+//
+//	let channels = import ./channels.nix; in import channels.nixpkgs { }
+func (s *State) GenerateNixProfile(username string) ([]byte, error) {
+	channelInputs, err := s.Config.UserChannels(username)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(channelInputs))
+	for name := range channelInputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by bonito. Do not edit.\n{\n")
+
+	for _, name := range names {
+		lock, ok := s.Lock.Channels[channelInputs[name]]
+		if !ok {
+			return nil, fmt.Errorf("channel %q has no lock, perhaps run bonito first", name)
+		}
+
+		var value string
+		switch s.Config.Profile.Format {
+		case "", ProfileStorePaths:
+			if lock.StorePath == "" {
+				return nil, fmt.Errorf("channel %q has no locked store path, perhaps run bonito first", name)
+			}
+			value = nixString(lock.StorePath)
+		case ProfileFetchTarball:
+			var narHash string
+			if lock.Meta != nil {
+				narHash = lock.Meta.NarHash
+			}
+			if narHash == "" {
+				slog.Warn(
+					"channel has no NAR hash in the lock, so it is fetched without a sha256",
+					"channel", name,
+					"hint", "run bonito again to record it")
+				value = fmt.Sprintf("builtins.fetchTarball { url = %s; }", nixString(lock.URL))
+				break
+			}
+			value = fmt.Sprintf("builtins.fetchTarball { url = %s; sha256 = %s; }",
+				nixString(lock.URL), nixString(narHash))
+		default:
+			return nil, fmt.Errorf("unknown profile format %q", s.Config.Profile.Format)
+		}
+
+		fmt.Fprintf(&buf, "  %s = %s;\n", nixAttrName(name), value)
+	}
+
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+var nixStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `${`, `\${`, "\n", `\n`)
+
+// nixString quotes s as a Nix string.
+func nixString(s string) string {
+	return `"` + nixStringEscaper.Replace(s) + `"`
+}
+
+var nixIdentRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_'-]*$`)
+
+var nixKeywords = map[string]bool{
+	"assert": true, "else": true, "if": true, "in": true, "inherit": true,
+	"let": true, "or": true, "rec": true, "then": true, "with": true,
+}
+
+// nixAttrName returns name as a Nix attribute name, quoting it if needed.
+func nixAttrName(name string) string {
+	if nixIdentRe.MatchString(name) && !nixKeywords[name] {
+		return name
+	}
+	return nixString(name)
+}
@@ -0,0 +1,64 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/pkg/errors"
+)
+
+// RemoveChannel removes the channel with the given name from the preferred
+// user's channels and forgets it in the lock. This is useful for cleaning up
+// channels that were removed from the config when OverrideChannels is off.
+// The lock entry of the channel's input is only deleted if no other channel
+// uses it.
+func (s *State) RemoveChannel(ctx context.Context, name string) error {
+	ctx = s.withSettings(ctx)
+
+	user, err := s.checkedPreferredUser(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot get preferred user")
+	}
+
+	ctx = executil.WithOpts(ctx, executil.Opts{
+		Username: user.Username,
+		UseSudo:  user.UseSudo,
+	})
+
+	channels := newChannelExecer(ctx, false)
+
+	list, err := channels.list()
+	if err != nil {
+		return errors.Wrap(err, "cannot get current channels list")
+	}
+
+	_, listed := list[name]
+	locked := s.Lock.removeName(name)
+
+	if !listed && !locked {
+		return fmt.Errorf(
+			"channel %q is neither in the channels of user %q nor in the lock",
+			name, user.Username)
+	}
+
+	if listed {
+		if err := channels.remove(name); err != nil {
+			return errors.Wrapf(err, "cannot remove channel %q", name)
+		}
+	}
+
+	for _, registry := range s.Config.registries() {
+		_, isChannel := registry.Channels[name]
+		_, isAlias := registry.Aliases[name]
+		if isChannel || isAlias {
+			slog.Warn(
+				"removed channel is still configured and will be added back on the next run",
+				"channel", name)
+			break
+		}
+	}
+
+	return nil
+}
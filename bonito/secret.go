@@ -0,0 +1,174 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/pkg/errors"
+)
+
+// secretRef is a reference to a secret that is encrypted at rest, as written
+// in Config.Global.HostTokens. It is either "sops://<file>#<key>", where key
+// may be a dotted path into the document, e.g. "github.token", or
+// "age://<file>?identity=<identity file>", e.g. an agenix secret.
+type secretRef struct {
+	// Tool is the tool that decrypts the secret, either "sops" or "age".
+	Tool string
+	// File is the path of the encrypted file.
+	File string
+	// Key is the key of the secret in a sops file.
+	Key string
+	// Identity is the path of the age identity that decrypts an age file.
+	Identity string
+}
+
+func parseSecretRef(ref string) (secretRef, error) {
+	tool, rest, ok := strings.Cut(ref, "://")
+	if !ok {
+		return secretRef{}, fmt.Errorf("invalid secret %q, expected sops://<file>#<key> or age://<file>?identity=<file>", ref)
+	}
+
+	switch tool {
+	case "sops":
+		file, key, _ := strings.Cut(rest, "#")
+		if file == "" || key == "" {
+			return secretRef{}, fmt.Errorf("invalid sops secret %q, expected sops://<file>#<key>", ref)
+		}
+		return secretRef{Tool: tool, File: file, Key: key}, nil
+	case "age":
+		file, identity, _ := strings.Cut(rest, "?identity=")
+		if file == "" || identity == "" {
+			return secretRef{}, fmt.Errorf("invalid age secret %q, expected age://<file>?identity=<file>", ref)
+		}
+		return secretRef{Tool: tool, File: file, Identity: identity}, nil
+	default:
+		return secretRef{}, fmt.Errorf("unknown secret tool %q, expected sops or age", tool)
+	}
+}
+
+// String formats the reference back into its config form.
+func (r secretRef) String() string {
+	switch r.Tool {
+	case "sops":
+		return "sops://" + r.File + "#" + r.Key
+	default:
+		return "age://" + r.File + "?identity=" + r.Identity
+	}
+}
+
+// relativeTo makes the relative paths of the reference relative to dir.
+func (r secretRef) relativeTo(dir string) secretRef {
+	if r.File != "" && !filepath.IsAbs(r.File) {
+		r.File = filepath.Join(dir, r.File)
+	}
+	if r.Identity != "" && !filepath.IsAbs(r.Identity) {
+		r.Identity = filepath.Join(dir, r.Identity)
+	}
+	return r
+}
+
+// decrypt decrypts the secret by running sops or age as the current user,
+// whose keys they use. The plaintext is only ever kept in memory.
+func (r secretRef) decrypt(ctx context.Context) (string, error) {
+	ctx = executil.WithOpts(ctx, executil.Opts{})
+
+	var out string
+	var err error
+
+	switch r.Tool {
+	case "sops":
+		// sops wants the key as a path of JSON strings, e.g. ["a"]["b"].
+		var extract strings.Builder
+		for _, part := range strings.Split(r.Key, ".") {
+			extract.WriteString("[" + strconv.Quote(part) + "]")
+		}
+		err = executil.Exec(ctx, &out, "sops", "--decrypt", "--extract", extract.String(), r.File)
+	case "age":
+		err = executil.Exec(ctx, &out, "age", "--decrypt", "--identity", r.Identity, r.File)
+	default:
+		return "", fmt.Errorf("unknown secret tool %q", r.Tool)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot decrypt %s", r)
+	}
+
+	secret := strings.TrimSpace(out)
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", r)
+	}
+
+	return secret, nil
+}
+
+// hostTokens decrypts the secrets of hosts, such as the tokens of
+// Config.Global.HostTokens, once per run, when they're first needed.
+type hostTokens struct {
+	refs   map[string]string
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func newHostTokens(refs map[string]string) *hostTokens {
+	return &hostTokens{
+		refs:   refs,
+		tokens: make(map[string]string),
+	}
+}
+
+// get returns the decrypted secret of the given host, or an empty string if it
+// has none.
+func (t *hostTokens) get(ctx context.Context, host string) (string, error) {
+	ref, ok := t.refs[host]
+	if !ok {
+		return "", nil
+	}
+
+	// Only decrypt once even if many inputs of the host are resolved at the
+	// same time, since decrypting may prompt for a passphrase.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if token, ok := t.tokens[host]; ok {
+		return token, nil
+	}
+
+	secret, err := parseSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := secret.decrypt(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	t.tokens[host] = token
+	return token, nil
+}
+
+type hostTokensCtxKey struct{}
+
+// withHostTokens returns ctx with the given Config.Global.HostTokens.
+func withHostTokens(ctx context.Context, refs map[string]string) context.Context {
+	return context.WithValue(ctx, hostTokensCtxKey{}, newHostTokens(refs))
+}
+
+// configHostToken returns the decrypted token of the given host in
+// Config.Global.HostTokens, or an empty string if it has none.
+func configHostToken(ctx context.Context, host string) (string, error) {
+	t, _ := ctx.Value(hostTokensCtxKey{}).(*hostTokens)
+	if t == nil {
+		return "", nil
+	}
+
+	token, err := t.get(ctx, host)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get token for host %q", host)
+	}
+	return token, nil
+}
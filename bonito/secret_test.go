@@ -0,0 +1,103 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/hexops/autogold"
+)
+
+func TestResolveGitSopsToken(t *testing.T) {
+	const rev = "a9bb5c0f2f683063c2b14c9f4d12c55ad5f4ed88"
+
+	var sopsCalls [][]string
+	var gitEnv [][]string
+	ctx := executil.WithRunner(context.Background(), func(cmd *exec.Cmd) error {
+		switch cmd.Args[0] {
+		case "sops":
+			// Fake sops decrypting the token.
+			sopsCalls = append(sopsCalls, cmd.Args)
+			fmt.Fprintln(cmd.Stdout, "hunter2")
+		case "git":
+			if strings.Contains(strings.Join(cmd.Args, " "), "hunter2") {
+				t.Errorf("token leaked into args %q", cmd.Args)
+			}
+			gitEnv = append(gitEnv, cmd.Env)
+			fmt.Fprintf(cmd.Stdout, "%s\trefs/heads/main\n", rev)
+		default:
+			return fmt.Errorf("unexpected command %q", cmd.Args)
+		}
+		return nil
+	})
+
+	var cfg Config
+	cfg.Global.HostTokens = map[string]string{
+		"gitlab.example.com": "sops://secrets.yaml#gitlab.token",
+	}
+	cfg.ResolveSecretPaths("/etc/bonito")
+	ctx = withHostTokens(ctx, cfg.Global.HostTokens)
+
+	for _, url := range []ChannelURL{
+		"gitlab:gitlab.example.com/group/repo",
+		"gitlab:gitlab.example.com/group/other",
+	} {
+		input := ChannelInput{URL: url, Version: "main"}
+		if _, err := input.Resolve(ctx); err != nil {
+			t.Fatalf("cannot resolve %q: %v", input, err)
+		}
+	}
+
+	// The token is only decrypted once.
+	autogold.Want("sops calls", [][]string{{
+		"sops",
+		"--decrypt",
+		"--extract",
+		`["gitlab"]["token"]`,
+		"/etc/bonito/secrets.yaml",
+	}}).Equal(t, sopsCalls)
+
+	for _, env := range gitEnv {
+		if !slices.Contains(env, "GIT_CONFIG_VALUE_0=Authorization: Bearer hunter2") {
+			t.Errorf("git env is missing the decrypted token: %q", env)
+		}
+	}
+
+	// The environment takes precedence.
+	t.Setenv("BONITO_TOKEN_GITLAB_EXAMPLE_COM", "from-env")
+	sopsCalls = nil
+	ctx = withHostTokens(ctx, cfg.Global.HostTokens)
+	input := ChannelInput{URL: "gitlab:gitlab.example.com/group/repo", Version: "main"}
+	if _, err := input.Resolve(ctx); err != nil {
+		t.Fatal("cannot resolve:", err)
+	}
+	if len(sopsCalls) > 0 {
+		t.Errorf("sops was called despite the environment variable: %q", sopsCalls)
+	}
+}
+
+func TestParseSecretRef(t *testing.T) {
+	for _, ref := range []string{
+		"secrets.yaml#token",
+		"sops://secrets.yaml",
+		"age://token.age",
+		"vault://secret/token",
+	} {
+		if _, err := parseSecretRef(ref); err == nil {
+			t.Errorf("invalid secret %q was accepted", ref)
+		}
+	}
+
+	secret, err := parseSecretRef("age://token.age?identity=/etc/ssh/ssh_host_ed25519_key")
+	if err != nil {
+		t.Fatal("cannot parse age secret:", err)
+	}
+	autogold.Want("age", secretRef{
+		Tool: "age", File: "/etc/bonito/token.age",
+		Identity: "/etc/ssh/ssh_host_ed25519_key",
+	}).Equal(t, secret.relativeTo("/etc/bonito"))
+}
@@ -0,0 +1,68 @@
+package bonito
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SelfCheckProblem describes an internal invariant that does not hold.
+type SelfCheckProblem struct {
+	// Check is the name of the check that failed.
+	Check string
+	Err   error
+}
+
+// SelfCheck checks the internal invariants of the state: the config must be
+// valid, every locked input must be in the config, every configured channel
+// must have a known scheme, and the git services must be both resolvable and
+// expandable. Nothing is run or fetched. It returns the problems found,
+// sorted by check.
+func (s *State) SelfCheck() []SelfCheckProblem {
+	var problems []SelfCheckProblem
+	add := func(check string, err error) {
+		problems = append(problems, SelfCheckProblem{Check: check, Err: err})
+	}
+
+	// This also checks that the aliases resolve.
+	if err := s.Config.Validate(); err != nil {
+		add("config", err)
+	}
+
+	inputs := s.Config.ChannelInputs()
+
+	for input := range s.Lock.Channels {
+		if _, ok := inputs[input]; !ok {
+			add("lock", fmt.Errorf("locked input %q is not in the config", input))
+		}
+	}
+
+	for input := range inputs {
+		if !input.CanResolve() {
+			add("schemes", fmt.Errorf("input %q has no resolver for its scheme", input))
+		}
+	}
+
+	for scheme := range opaqueExpanders {
+		if !gitSchemes[scheme] {
+			add("schemes", fmt.Errorf("opaque expander %q is not of a git service", scheme))
+		}
+	}
+
+	for scheme, service := range gitSchemes {
+		if _, ok := ChannelResolvers[scheme]; !ok {
+			add("schemes", fmt.Errorf("git scheme %q has no resolver", scheme))
+		}
+		if _, ok := opaqueExpanders[scheme]; service && !ok {
+			add("schemes", fmt.Errorf("git service %q has no opaque expander", scheme))
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Check != problems[j].Check {
+			return problems[i].Check < problems[j].Check
+		}
+		return problems[i].Err.Error() < problems[j].Err.Error()
+	})
+
+	return problems
+}
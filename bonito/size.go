@@ -0,0 +1,65 @@
+package bonito
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+)
+
+// checkDownloadSize checks the total size of the given URLs that are about to
+// be fetched against Global.MaxDownloadSize. Only HTTP URLs are counted, and
+// URLs whose size cannot be determined are skipped with a warning.
+func (s *State) checkDownloadSize(ctx context.Context, urls []string) error {
+	max := s.Config.Global.MaxDownloadSize
+	if max == 0 {
+		return nil
+	}
+
+	var total int64
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+
+		size, err := contentLength(ctx, rawURL)
+		if err != nil {
+			slog.Warn(
+				"cannot get download size of channel, not counting it",
+				"url", rawURL,
+				"err", err)
+			continue
+		}
+
+		if size < 0 {
+			slog.Debug(
+				"server did not advertise download size of channel",
+				"url", rawURL)
+			continue
+		}
+
+		total += size
+	}
+
+	slog.Debug(
+		"measured download size of channels",
+		"total", total,
+		"max", max)
+
+	if total <= max {
+		return nil
+	}
+
+	if s.Config.Global.MaxDownloadSizeAction == "warn" {
+		slog.Warn(
+			"channels exceed the max download size",
+			"total", total,
+			"max", max)
+		return nil
+	}
+
+	return fmt.Errorf(
+		"channels would download %d bytes, more than the max download size of %d bytes",
+		total, max)
+}
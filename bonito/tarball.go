@@ -0,0 +1,84 @@
+package bonito
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/diamondburned/nix-bonito/bonito/internal/executil"
+	"github.com/pkg/errors"
+)
+
+// nixBase32Alphabet is the alphabet of Nix's base32 encoding.
+const nixBase32Alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// parseTarballHash parses the version of a pinned tarball input, which is the
+// expected SHA-256 hash of the tarball. The hash is written either as
+// "sha256:" followed by its hexadecimal or Nix base32 form, or as an SRI hash,
+// e.g. "sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=". The hash is
+// returned in the form that nix-prefetch-url accepts.
+func parseTarballHash(version string) (string, error) {
+	if sri, ok := strings.CutPrefix(version, "sha256-"); ok {
+		b, err := base64.StdEncoding.DecodeString(sri)
+		if err != nil || len(b) != 32 {
+			return "", fmt.Errorf("invalid SRI hash %q", version)
+		}
+		return version, nil
+	}
+
+	hash, ok := strings.CutPrefix(version, "sha256:")
+	if !ok {
+		return "", fmt.Errorf("version %q of a tarball must be its sha256 hash, e.g. sha256:<hash>", version)
+	}
+
+	switch len(hash) {
+	case 64:
+		if _, err := hex.DecodeString(hash); err == nil {
+			return hash, nil
+		}
+	case 52:
+		if strings.Trim(hash, nixBase32Alphabet) == "" {
+			return hash, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid sha256 hash %q", hash)
+}
+
+// resolvePinnedTarball resolves an HTTP input whose version is the expected
+// hash of the tarball at its URL. The tarball is downloaded once to verify the
+// hash, which is then recorded in the lock.
+func resolvePinnedTarball(ctx context.Context, in ChannelInput) (ResolvedInput, error) {
+	hash, err := parseTarballHash(in.Version)
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	u, err := in.URL.Parse()
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+
+	ctx, cleanup, err := withNetrc(ctx)
+	if err != nil {
+		return ResolvedInput{}, err
+	}
+	defer cleanup()
+
+	// nix-prefetch-url fails if the downloaded file has a different hash.
+	var out string
+	if err := executil.Exec(ctx, &out, "nix-prefetch-url", "--type", "sha256", u.String(), hash); err != nil {
+		return ResolvedInput{}, errors.Wrapf(err, "cannot verify the hash of %q", u)
+	}
+
+	slog.Debug(
+		"verified pinned tarball",
+		"url", u,
+		"hash", in.Version,
+		"prefetched", strings.TrimSpace(out))
+
+	return ResolvedInput{URL: u.String(), SHA256: in.Version}, nil
+}
@@ -0,0 +1,96 @@
+package bonito
+
+import (
+	"context"
+	"strings"
+)
+
+// UpdateReason is the outcome of updating a channel input, i.e. why it was
+// or wasn't updated.
+type UpdateReason string
+
+const (
+	// UpdateAdded is when the input wasn't in the lock before.
+	UpdateAdded UpdateReason = "added"
+	// UpdateRefMoved is when the input's version now resolves to a different
+	// URL, e.g. because its branch has a new commit.
+	UpdateRefMoved UpdateReason = "ref-moved"
+	// UpdateHashChanged is when the input resolves to the same URL, but its
+	// contents changed, as told by ChannelLock.HashChanged.
+	UpdateHashChanged UpdateReason = "hash-changed"
+	// UpdatePinned is when the input is pinned to a commit or a tarball hash,
+	// so it never moves.
+	UpdatePinned UpdateReason = "pinned"
+	// UpdateUnchanged is when the input's version still resolves to the same
+	// URL and store hash.
+	UpdateUnchanged UpdateReason = "unchanged"
+)
+
+// Updated returns true if the reason is that the lock of the input changed.
+func (r UpdateReason) Updated() bool {
+	switch r {
+	case UpdateAdded, UpdateRefMoved, UpdateHashChanged:
+		return true
+	default:
+		return false
+	}
+}
+
+type updateReasonCtxKey struct{}
+
+// WithUpdateReasons makes Update and UpdateLocks using the returned context
+// call fn with the outcome of every channel input that they lock. fn is never
+// called concurrently.
+func WithUpdateReasons(ctx context.Context, fn func(ChannelInput, UpdateReason)) context.Context {
+	return context.WithValue(ctx, updateReasonCtxKey{}, fn)
+}
+
+func updateReasonFunc(ctx context.Context) func(ChannelInput, UpdateReason) {
+	fn, _ := ctx.Value(updateReasonCtxKey{}).(func(ChannelInput, UpdateReason))
+	return fn
+}
+
+// classifyUpdate classifies the update of the given input from its old lock,
+// if any, to its new lock, which was locked from the given resolved input.
+func classifyUpdate(input ChannelInput, resolved ResolvedInput, oldLock ChannelLock, hadLock bool, lock ChannelLock) UpdateReason {
+	switch {
+	case !hadLock:
+		return UpdateAdded
+	case input.CanResolve() && oldLock.HashChanged(lock):
+		return UpdateHashChanged
+	case oldLock.URL != lock.URL:
+		return UpdateRefMoved
+	case isPinnedInput(input, resolved):
+		return UpdatePinned
+	default:
+		return UpdateUnchanged
+	}
+}
+
+// isPinnedInput returns true if the input is pinned to an exact tarball hash
+// or to a commit, which is when its version is a prefix of the commit it
+// resolved to without matching any ref.
+func isPinnedInput(input ChannelInput, resolved ResolvedInput) bool {
+	if resolved.SHA256 != "" {
+		return true
+	}
+	return input.Version != "" &&
+		resolved.Ref == "" &&
+		resolved.Rev != "" &&
+		strings.HasPrefix(resolved.Rev, input.Version)
+}
+
+type pinnedInputsCtxKey struct{}
+
+// withPinnedInputs returns ctx with the inputs that are intentionally pinned to
+// a commit. See ChannelRegistry.Pinned.
+func withPinnedInputs(ctx context.Context, pinned map[ChannelInput]bool) context.Context {
+	return context.WithValue(ctx, pinnedInputsCtxKey{}, pinned)
+}
+
+// isAcknowledgedPin returns true if the input is intentionally pinned to a
+// commit, so there's no need to warn that it's never updated.
+func isAcknowledgedPin(ctx context.Context, in ChannelInput) bool {
+	pinned, _ := ctx.Value(pinnedInputsCtxKey{}).(map[ChannelInput]bool)
+	return pinned[in]
+}
@@ -0,0 +1,39 @@
+package bonito
+
+import (
+	"errors"
+	"sort"
+)
+
+// StoreProblem describes a locked channel whose store path cannot be used.
+type StoreProblem struct {
+	Input ChannelInput
+	Err   error
+}
+
+// VerifyStore checks that the store path of every locked channel is still in
+// the Nix store and is the one that was locked. Nothing is fetched or
+// evaluated. It returns the problems found, sorted by input.
+func (s *State) VerifyStore() []StoreProblem {
+	var problems []StoreProblem
+
+	for input, lock := range s.Lock.Channels {
+		if lock.StoreHash == "" {
+			problems = append(problems, StoreProblem{
+				Input: input,
+				Err:   errors.New("channel was never fetched (run bonito lock to fetch it)"),
+			})
+			continue
+		}
+
+		if _, err := locateLockedPath(lock); err != nil {
+			problems = append(problems, StoreProblem{Input: input, Err: err})
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Input.String() < problems[j].Input.String()
+	})
+
+	return problems
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+// completionScripts maps shell names to functions that generate their
+// completion scripts. The scripts ask bonito for completions by running it
+// with --generate-shell-completion appended.
+var completionScripts = map[string]func(cmd *cli.Command) (string, error){
+	"bash": func(cmd *cli.Command) (string, error) { return bashCompletion, nil },
+	"zsh":  func(cmd *cli.Command) (string, error) { return zshCompletion, nil },
+	"fish": func(cmd *cli.Command) (string, error) { return cmd.Root().ToFishCompletion() },
+}
+
+func runCompletion(ctx context.Context, cmd *cli.Command) error {
+	shells := make([]string, 0, len(completionScripts))
+	for shell := range completionScripts {
+		shells = append(shells, shell)
+	}
+	sort.Strings(shells)
+
+	shell := cmd.Args().First()
+
+	script, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("usage: bonito completion <%s>", strings.Join(shells, "|"))
+	}
+
+	s, err := script(cmd)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprint(cmd.Root().Writer, s)
+	return err
+}
+
+// completeChannels completes the names that the channels of the current user,
+// or of --user, go by: the global and the user's channels and aliases, merged
+// like when they are applied, and the Flakes channels. Subcommands and flags
+// are completed too.
+func completeChannels(ctx context.Context, cmd *cli.Command) {
+	cli.DefaultCompleteWithFlags(ctx, cmd)
+
+	// Completions must not print errors, so a broken config completes
+	// nothing.
+	config, err := readConfigFile(configFlag(cmd))
+	if err != nil {
+		return
+	}
+
+	username, err := currentUsername(cmd)
+	if err != nil {
+		return
+	}
+
+	// Users that aren't configured still get the global channels.
+	channels, _ := config.UserChannels(username)
+
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for name := range channels {
+		add(name)
+	}
+	for name := range config.Flakes.Channels {
+		add(name)
+	}
+	for name := range config.Flakes.Aliases {
+		add(name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintln(cmd.Root().Writer, name)
+	}
+}
+
+const bashCompletion = `# bash completion for bonito
+_bonito_completion() {
+  local cur words
+  COMPREPLY=()
+  cur="${COMP_WORDS[COMP_CWORD]}"
+  words=("${COMP_WORDS[@]:0:$COMP_CWORD}")
+  if [[ "$cur" == "-"* ]]; then
+    words+=("$cur")
+  fi
+  local opts
+  opts=$("${words[@]}" --generate-shell-completion 2>/dev/null)
+  COMPREPLY=($(compgen -W "${opts}" -- "${cur}"))
+}
+
+complete -o bashdefault -o default -F _bonito_completion bonito
+`
+
+const zshCompletion = `#compdef bonito
+
+_bonito() {
+  local -a opts
+  local cur
+  cur=${words[-1]}
+  if [[ "$cur" == "-"* ]]; then
+    opts=("${(@f)$(${words[@]:0:#words[@]-1} ${cur} --generate-shell-completion 2>/dev/null)}")
+  else
+    opts=("${(@f)$(${words[@]:0:#words[@]-1} --generate-shell-completion 2>/dev/null)}")
+  fi
+
+  if [[ "${opts[1]}" != "" ]]; then
+    _describe 'values' opts
+  else
+    _files
+  fi
+}
+
+if [ "$funcstack[1]" = "_bonito" ]; then
+  _bonito "$@"
+else
+  compdef _bonito bonito
+fi
+`
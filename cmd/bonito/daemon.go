@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/diamondburned/nix-bonito/bonito"
+	"github.com/lmittmann/tint"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v3"
+)
+
+// daemonStatus is the status that the daemon serves as JSON.
+type daemonStatus struct {
+	// LastRun is when the last run started, if there was one.
+	LastRun *time.Time `json:"last_run,omitempty"`
+	// Duration is how long the last run took.
+	Duration string `json:"duration,omitempty"`
+	// Outcome is "ok" or "error" after the first run.
+	Outcome string `json:"outcome,omitempty"`
+	// Error is the error that the last run failed with, if any.
+	Error string `json:"error,omitempty"`
+	// NextRun is when the next run is scheduled.
+	NextRun time.Time `json:"next_run"`
+	// Pending lists the channels with newer upstream revisions that the last
+	// run did not update, either because it failed or because it only
+	// checked for them.
+	Pending []string `json:"pending"`
+}
+
+// daemon runs bonito on a schedule and keeps the status of the last run.
+type daemon struct {
+	interval time.Duration
+	// run runs bonito once. It returns the channels that are still outdated
+	// afterwards, even if it fails.
+	run func(context.Context) ([]string, error)
+
+	mu     sync.Mutex
+	status daemonStatus
+}
+
+func newDaemon(interval time.Duration, run func(context.Context) ([]string, error)) *daemon {
+	return &daemon{
+		interval: interval,
+		run:      run,
+		status: daemonStatus{
+			NextRun: time.Now(),
+			Pending: []string{},
+		},
+	}
+}
+
+// loop runs bonito right away and then for every tick until ctx is done.
+func (d *daemon) loop(ctx context.Context, ticks <-chan time.Time) {
+	d.tick(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+			d.tick(ctx)
+		}
+	}
+}
+
+// tick runs bonito once and records its status.
+func (d *daemon) tick(ctx context.Context) {
+	start := time.Now()
+	pending, err := d.run(ctx)
+	if pending == nil {
+		pending = []string{}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.status.LastRun = &start
+	d.status.Duration = time.Since(start).Round(time.Millisecond).String()
+	d.status.NextRun = start.Add(d.interval)
+	d.status.Pending = pending
+	d.status.Outcome = "ok"
+	d.status.Error = ""
+
+	if err != nil {
+		d.status.Outcome = "error"
+		d.status.Error = err.Error()
+		slog.Error("daemon run failed", tint.Err(err))
+	}
+}
+
+// ServeHTTP serves the status as JSON at /status, and at /healthz whether the
+// last run succeeded.
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	status := d.status
+	d.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/status":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case "/healthz":
+		if status.Outcome == "error" {
+			http.Error(w, status.Error, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func runDaemon(ctx context.Context, cmd *cli.Command) error {
+	interval := cmd.Duration("interval")
+	if interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+
+	ln, err := net.Listen("tcp", cmd.String("listen"))
+	if err != nil {
+		return errors.Wrap(err, "cannot listen")
+	}
+
+	// Only hold the file lock while running, so that manual runs can happen
+	// in between but never at the same time.
+	if err := flockLock.Unlock(); err != nil {
+		return errors.Wrap(err, "cannot release file lock")
+	}
+
+	ctx = commandContext(ctx, cmd)
+
+	d := newDaemon(interval, func(ctx context.Context) ([]string, error) {
+		if _, err := flockLock.TryLockContext(ctx, time.Second); err != nil {
+			return nil, errors.Wrap(err, "cannot acquire file lock")
+		}
+		defer flockLock.Unlock()
+
+		return daemonRun(ctx, cmd, cmd.Bool("check-only"))
+	})
+
+	srv := &http.Server{Handler: d}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("cannot serve status", tint.Err(err))
+		}
+	}()
+
+	slog.Info(
+		"running as daemon",
+		"interval", interval,
+		"status", "http://"+ln.Addr().String()+"/status")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	d.loop(ctx, ticker.C)
+	return nil
+}
+
+// daemonRun updates the channels that have newer upstream revisions and
+// applies the lock, like bonito -u. If checkOnly is true, it only looks for
+// newer revisions. It returns the channels that are still outdated.
+func daemonRun(ctx context.Context, cmd *cli.Command, checkOnly bool) ([]string, error) {
+	state, err := readState(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := state.CheckRevisions(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot check revisions")
+	}
+
+	names := state.Config.ChannelNames()
+
+	var pending []string
+	for _, rev := range revisions {
+		if rev.Outdated() {
+			pending = append(pending, names[rev.Input]...)
+		}
+	}
+	sort.Strings(pending)
+
+	if checkOnly {
+		return pending, nil
+	}
+
+	newState := bonito.State{
+		Config: state.Config,
+		Lock:   state.Lock,
+	}
+	if err := newState.Update(ctx); err != nil {
+		return pending, errors.Wrap(err, "cannot update inputs to latest versions")
+	}
+	state.Lock = newState.Lock
+
+	if err := state.Apply(ctx); err != nil {
+		return pending, errors.Wrap(err, "cannot apply")
+	}
+
+	if err := saveState(cmd, state); err != nil {
+		return pending, err
+	}
+
+	return nil, nil
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/diamondburned/nix-bonito/bonito"
@@ -27,21 +32,29 @@ var (
 )
 
 func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	newCommand().Run(ctx, os.Args)
+}
+
+func newCommand() *cli.Command {
 	var defaultConfigFile string
 	if hostname, err := os.Hostname(); err == nil {
 		defaultConfigFile = hostname + ".toml"
 	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer cancel()
-
-	cmd := cli.Command{
+	return &cli.Command{
 		Name:      "bonito",
 		Usage:     "Declarative Nix channel manager",
 		Before:    cmdInit,
 		After:     cmdFinish,
 		Action:    cmdRun,
 		ArgsUsage: "[channels...]",
+
+		EnableShellCompletion: true,
+		ShellComplete:         completeChannels,
+
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:    "update",
@@ -52,6 +65,69 @@ func main() {
 				Name:  "update-locks",
 				Usage: "update locks only",
 			},
+			&cli.BoolFlag{
+				Name:  "check",
+				Usage: "exit with an error if --update-locks would change the lock, without changing anything",
+			},
+			&cli.DurationFlag{
+				Name:  "max-age",
+				Usage: "skip updating if the lock file was updated less than this long ago, e.g. 6h, and only apply it",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "print the channel changes without applying them or writing any file",
+			},
+			&cli.BoolFlag{
+				Name:  "preflight",
+				Usage: "check that the preferred user exists and that sudo works for them before touching any channel",
+			},
+			&cli.BoolFlag{
+				Name:    "assume-yes",
+				Aliases: []string{"y"},
+				Usage:   "remove channels for override-channels without asking for confirmation",
+			},
+			&cli.BoolFlag{
+				Name:  "lock-only",
+				Usage: "only update the lock and registry files without touching the users' channels",
+			},
+			&cli.BoolFlag{
+				Name:  "no-lock-write",
+				Usage: "apply the channels without writing the lock, registry or profile file, e.g. on a read-only filesystem",
+			},
+			&cli.BoolFlag{
+				Name:  "transactional",
+				Usage: "restore every user's old channels if applying channels for any user fails",
+			},
+			&cli.BoolFlag{
+				Name:  "sequential",
+				Usage: "apply the channels of one user at a time instead of concurrently, e.g. so that sudo prompts are not interleaved",
+			},
+			&cli.BoolFlag{
+				Name:  "strict-hash",
+				Usage: "fail if any channel has a store hash that is not in the lock, unless updating",
+			},
+			&cli.BoolFlag{
+				Name:  "from-lock",
+				Usage: "apply the named channels in --lock-file for the preferred user without reading the config",
+			},
+			&cli.BoolFlag{
+				Name:  "config-check-only",
+				Usage: "only check that the config is valid, without running anything",
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Usage: "number of times to retry network requests that fail because of network errors",
+				Value: 3,
+			},
+			&cli.IntFlag{
+				Name:  "parallelism",
+				Usage: "maximum number of channel inputs to resolve, or users to apply, at the same time",
+				Value: bonito.DefaultParallelism,
+			},
+			&cli.BoolFlag{
+				Name:  "trace-resolution",
+				Usage: "print how each channel input was resolved as a line of JSON to stderr",
+			},
 			&cli.BoolFlag{
 				Name:    "verbose",
 				Aliases: []string{"v"},
@@ -60,12 +136,28 @@ func main() {
 			&cli.StringFlag{
 				Name:    "config",
 				Aliases: []string{"c"},
-				Usage:   "path to the config file",
+				Usage:   "path to the config file, or to a directory of *.toml config fragments to merge",
 				Value:   defaultConfigFile,
 			},
+			&cli.BoolFlag{
+				Name:  "strict",
+				Usage: "fail instead of warning if a user's or the flakes' channel overrides a global channel with a different input",
+			},
+			&cli.StringFlag{
+				Name:  "config-dir",
+				Usage: "path to a directory of *.toml config fragments to merge in lexical order, overriding --config",
+			},
 			&cli.StringFlag{
 				Name:  "lock-file",
-				Usage: "manual path to the lock file, or {config}.lock.json if empty",
+				Usage: "manual path to the lock file, or {config}.lock.json if empty, or - to write a new lock to stdout",
+			},
+			&cli.StringFlag{
+				Name:  "base-lock",
+				Usage: "path to a lock file shared across hosts that the lock file is layered on top of, which is never written to",
+			},
+			&cli.StringFlag{
+				Name:  "profile-output",
+				Usage: "path to write a Nix expression of the current user's channels to after applying, e.g. channels.nix",
 			},
 			&cli.StringFlag{
 				Name:  "registry-file",
@@ -78,29 +170,175 @@ func main() {
 			},
 		},
 		Commands: []*cli.Command{
+			{
+				Name:      "completion",
+				Usage:     "print the shell completion script for bash, zsh or fish",
+				ArgsUsage: "shell",
+				Action:    runCompletion,
+			},
 			{
 				Name:   "include-flags",
 				Usage:  "generate -I flags for NIX_PATH and Nix CLIs",
 				Action: runIncludeFlags,
 				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "output format, either nix-flags for -I flags or nix-path for a NIX_PATH value",
+						Value: includeFormatNixFlags,
+					},
 					&cli.StringFlag{
 						Name:    "user",
 						Aliases: []string{"u"},
 						Usage:   "generate flags for a specific user, default to current user",
 					},
+					&cli.BoolFlag{
+						Name:  "all-users",
+						Usage: "generate flags for every configured user, one user per line",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the flags of --all-users as a JSON object of usernames to flags",
+					},
 				},
 			},
 			{
-				Name:      "store-path",
-				Usage:     "query the store path of a channel input",
-				ArgsUsage: "channel",
-				Action:    runStorePath,
+				Name:          "store-path",
+				Usage:         "query the store path of a channel input",
+				ArgsUsage:     "channel",
+				Action:        runStorePath,
+				ShellComplete: completeChannels,
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:    "user",
 						Aliases: []string{"u"},
 						Usage:   "generate flags for a specific user, default to current user",
 					},
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "print the name and store path of every channel, as found in the store",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "with --all, print a JSON object of channel names to store paths",
+					},
+				},
+			},
+			{
+				Name:   "list",
+				Usage:  "list all configured channels and their lock status",
+				Action: runList,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the result as JSON",
+					},
+				},
+			},
+			{
+				Name:   "export",
+				Usage:  "print the locked channels as JSON for other tooling, such as CI",
+				Action: runExport,
+			},
+			{
+				Name:   "daemon",
+				Usage:  "update and apply the channels on a schedule and serve the status over HTTP",
+				Action: runDaemon,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "how often to update, e.g. 6h",
+						Value: 24 * time.Hour,
+					},
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "address to serve the status on, at /status and /healthz",
+						Value: "localhost:9531",
+					},
+					&cli.BoolFlag{
+						Name:  "check-only",
+						Usage: "only look for newer upstream revisions and report them as pending",
+					},
+				},
+			},
+			{
+				Name:   "outdated",
+				Usage:  "list Git channels with newer upstream revisions using only git ls-remote",
+				Action: runOutdated,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the result as JSON",
+					},
+				},
+			},
+			{
+				Name:      "resolve",
+				Usage:     "resolve inputs to their latest versions into the lock without fetching them",
+				ArgsUsage: "[channels...]",
+				Action:    runResolve,
+			},
+			{
+				Name:   "lock",
+				Usage:  "fetch the resolved inputs and record their store hashes into the lock",
+				Action: runLock,
+			},
+			{
+				Name:   "apply",
+				Usage:  "apply the locked channels onto the users without resolving or fetching",
+				Action: runApply,
+			},
+			{
+				Name:   "diff",
+				Usage:  "show how freshly fetched locks would differ from the lock file",
+				Action: runDiff,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "against",
+						Usage: "show how the lock file differs from the reference lock at this URL or path instead, without fetching any channel",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the differences as JSON",
+					},
+				},
+			},
+			{
+				Name:   "verify",
+				Usage:  "check that every locked channel is still in the Nix store",
+				Action: runVerify,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "remote",
+						Usage: "check that the locked refs of Git channels still point to the locked revisions upstream instead of checking the Nix store",
+					},
+				},
+			},
+			{
+				Name:   "self-check",
+				Usage:  "check that the config and the lock are consistent with each other and with bonito",
+				Action: runSelfCheck,
+			},
+			{
+				Name:      "remove",
+				Usage:     "remove a channel from the preferred user's channels and from the lock",
+				ArgsUsage: "channel",
+				Action:    runRemove,
+			},
+			{
+				Name:   "gc",
+				Usage:  "remove temporary channels left behind by interrupted runs from every user and the GC roots of local sources that the lock no longer uses",
+				Action: runGC,
+			},
+			{
+				Name:      "bump",
+				Usage:     "change the version of a channel and update its lock",
+				ArgsUsage: "channel version",
+				Action:    runBump,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "resolve the new version and print its lock without writing anything",
+					},
 				},
 			},
 		},
@@ -113,8 +351,6 @@ func main() {
 			os.Exit(1)
 		},
 	}
-
-	cmd.Run(ctx, os.Args)
 }
 
 func cmdInit(ctx context.Context, cmd *cli.Command) error {
@@ -149,6 +385,66 @@ func cmdInit(ctx context.Context, cmd *cli.Command) error {
 	return nil
 }
 
+// commandContext returns ctx with the options from the root flags that affect
+// the bonito package.
+func commandContext(ctx context.Context, cmd *cli.Command) context.Context {
+	if cmd.Bool("verbose") {
+		ctx = bonito.WithVerbose(ctx)
+	}
+	ctx = bonito.WithRetries(ctx, int(cmd.Int("retries")))
+	ctx = bonito.WithParallelism(ctx, int(cmd.Int("parallelism")))
+	if cmd.Bool("preflight") {
+		ctx = bonito.WithPreflight(ctx)
+	}
+	if cmd.Bool("sequential") {
+		ctx = bonito.WithSequential(ctx)
+	}
+	if !cmd.Bool("assume-yes") && isInteractive(cmd) {
+		ctx = bonito.WithRemovalConfirmation(ctx, func(username string, names []string) bool {
+			return confirmRemoval(cmd, username, names)
+		})
+	}
+	if cmd.Bool("trace-resolution") {
+		enc := json.NewEncoder(cmd.Root().ErrWriter)
+		ctx = bonito.WithResolutionTrace(ctx, func(t bonito.ResolutionTrace) {
+			if err := enc.Encode(t); err != nil {
+				slog.Warn("cannot write resolution trace", "err", err)
+			}
+		})
+	}
+	return ctx
+}
+
+// isInteractive returns true if the command reads its input from a terminal,
+// so that it can ask the user for confirmation.
+func isInteractive(cmd *cli.Command) bool {
+	f, ok := cmd.Root().Reader.(*os.File)
+	return ok && isatty.IsTerminal(f.Fd())
+}
+
+// confirmRemoval lists the channels that are about to be removed for the user
+// and asks whether to remove them. Anything but "y" or "yes" keeps them.
+func confirmRemoval(cmd *cli.Command, username string, names []string) bool {
+	w := cmd.Root().ErrWriter
+	fmt.Fprintf(w, "override-channels will remove these channels for user %q:\n", username)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", name)
+	}
+	fmt.Fprint(w, "Remove them? [y/N] ")
+
+	answer, err := bufio.NewReader(cmd.Root().Reader).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
 func cmdFinish(ctx context.Context, cmd *cli.Command) error {
 	if err := flockLock.Unlock(); err != nil {
 		slog.Warn(
@@ -161,8 +457,39 @@ func cmdFinish(ctx context.Context, cmd *cli.Command) error {
 }
 
 func cmdRun(ctx context.Context, cmd *cli.Command) error {
-	if cmd.Bool("verbose") {
-		ctx = bonito.WithVerbose(ctx)
+	if cmd.Bool("config-check-only") {
+		return checkConfig(cmd)
+	}
+
+	ctx = commandContext(ctx, cmd)
+
+	if cmd.Bool("strict-hash") {
+		ctx = bonito.WithStrictHash(ctx)
+	}
+	if cmd.Bool("lock-only") {
+		ctx = bonito.WithLockOnly(ctx)
+	}
+	if cmd.Bool("transactional") {
+		ctx = bonito.WithTransactional(ctx)
+	}
+
+	noLockWrite := cmd.Bool("no-lock-write")
+	if noLockWrite && !cmd.Bool("dry-run") {
+		slog.Warn("--no-lock-write is set, so the lock will not be persisted")
+	}
+
+	var plan *bonito.Plan
+	if cmd.Bool("dry-run") {
+		plan = &bonito.Plan{}
+		ctx = bonito.WithDryRun(ctx, plan)
+	}
+
+	if cmd.Bool("from-lock") {
+		if err := applyFromLock(ctx, cmd); err != nil {
+			return err
+		}
+		printPlan(cmd, plan)
+		return nil
 	}
 
 	state, err := readState(cmd)
@@ -170,7 +497,24 @@ func cmdRun(ctx context.Context, cmd *cli.Command) error {
 		return err
 	}
 
-	if cmd.Bool("update") || cmd.Bool("update-locks") {
+	if cmd.Bool("check") {
+		return checkLock(ctx, cmd, state)
+	}
+
+	lockModTime := state.lockModTime()
+
+	updating := cmd.Bool("update") || cmd.Bool("update-locks")
+	if maxAge := cmd.Duration("max-age"); updating && maxAge > 0 && !lockModTime.IsZero() {
+		if age := time.Since(lockModTime); age < maxAge {
+			slog.Info(
+				"lock file is newer than --max-age, applying it without updating",
+				"age", age.Round(time.Second),
+				"max_age", maxAge)
+			updating = false
+		}
+	}
+
+	if updating {
 		newState := bonito.State{
 			Config: state.Config,
 			Lock:   state.Lock,
@@ -187,17 +531,24 @@ func cmdRun(ctx context.Context, cmd *cli.Command) error {
 			return nil
 		}
 
+		reasons := make(map[bonito.ChannelInput]bonito.UpdateReason)
+		updateCtx := bonito.WithUpdateReasons(ctx, func(input bonito.ChannelInput, reason bonito.UpdateReason) {
+			reasons[input] = reason
+		})
+
 		switch {
 		case cmd.Bool("update"):
-			if err := newState.Update(ctx); err != nil {
+			if err := newState.Update(updateCtx); err != nil {
 				return errors.Wrap(err, "cannot update inputs to latest versions")
 			}
 		case cmd.Bool("update-locks"):
-			if err := newState.UpdateLocks(ctx); err != nil {
+			if err := newState.UpdateLocks(updateCtx); err != nil {
 				return errors.Wrap(err, "cannot update locks")
 			}
 		}
 
+		logUpdateReasons(reasons, cmd.Bool("verbose"))
+
 		// Update the actual lock state.
 		state.Lock = newState.Lock
 	}
@@ -208,19 +559,175 @@ func cmdRun(ctx context.Context, cmd *cli.Command) error {
 		return errors.Wrap(err, "cannot apply")
 	}
 
-	if state.Config.Flakes.Enable {
-		if err := state.saveNixRegistryFile(); err != nil {
-			return errors.Wrap(err, "cannot save nix registry file")
+	if plan != nil {
+		printPlan(cmd, plan)
+		return nil
+	}
+
+	if noLockWrite {
+		return nil
+	}
+
+	if err := saveState(cmd, state); err != nil {
+		return err
+	}
+
+	if !updating && !lockModTime.IsZero() {
+		// The lock was only applied, so keep its modification time at when
+		// it was last updated for --max-age.
+		if err := state.setLockModTime(lockModTime); err != nil {
+			slog.Warn(
+				"cannot keep the modification time of the lock file",
+				"path", state.lockPath,
+				"err", err)
 		}
 	}
 
-	if err := state.saveLockFile(); err != nil {
-		return errors.Wrap(err, "cannot save lock file")
+	return nil
+}
+
+// checkLock prints the channels whose locks --update-locks would change and
+// returns an error if there are any.
+func checkLock(ctx context.Context, cmd *cli.Command, state *stateFiles) error {
+	fresh, err := state.FreshLock(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot update locks")
+	}
+
+	// The listed differences decide, so that an outdated lock never lists
+	// nothing.
+	diffs := bonito.DiffLocks(state.Lock, fresh)
+	if len(diffs) == 0 {
+		slog.Info("lock is up to date")
+		return nil
+	}
+
+	names := state.Config.ChannelNames()
+
+	out := cmd.Root().Writer
+	for _, diff := range diffs {
+		channels := names[diff.Input]
+		if len(channels) == 0 {
+			// Removed inputs are no longer used by any channel.
+			channels = []string{"-"}
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\n", diff.Action, strings.Join(channels, ","), diff.Input)
+	}
+
+	return fmt.Errorf("lock is out of date for %d inputs, run bonito --update-locks", len(diffs))
+}
+
+// applyFromLock applies the channels in the lock file without reading the
+// config, so that only the lock file has to be deployed.
+func applyFromLock(ctx context.Context, cmd *cli.Command) error {
+	lockPath := cmd.String("lock-file")
+	if lockPath == "" || lockPath == stdioPath {
+		return errors.New("--from-lock requires a --lock-file path")
+	}
+
+	f, err := os.Open(lockPath)
+	if err != nil {
+		return errors.Wrap(err, "cannot open lock file")
+	}
+	defer f.Close()
+
+	lock, err := bonito.NewLockFileFromReader(f)
+	if err != nil {
+		return errors.Wrap(err, "cannot read lock file")
+	}
+
+	slog.Info("applying channels from lock file", "path", lockPath)
+
+	state := bonito.State{Lock: lock}
+	if err := state.ApplyLock(ctx); err != nil {
+		return errors.Wrap(err, "cannot apply lock")
+	}
+
+	return nil
+}
+
+// printPlan prints the changes of a dry run. It does nothing if plan is nil.
+func printPlan(cmd *cli.Command, plan *bonito.Plan) {
+	switch {
+	case plan == nil:
+	case len(plan.Changes) == 0:
+		slog.Info("dry run: nothing would change")
+	default:
+		fmt.Fprintln(cmd.Root().Writer, plan)
+	}
+}
+
+// checkConfig parses and validates the config file. It never runs any
+// external commands, so it is cheap enough to use in a pre-commit hook.
+func checkConfig(cmd *cli.Command) error {
+	configPath := configFlag(cmd)
+
+	config, err := readConfigFile(configPath)
+	if err != nil {
+		return errors.Wrap(err, "cannot read config file")
 	}
 
+	if err := config.Validate(); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+
+	for _, conflict := range config.ConflictingVersions() {
+		slog.Warn(
+			"channels use the same URL with different versions, "+
+				"they will be resolved separately",
+			"url", conflict.URL,
+			"versions", conflict.Versions)
+	}
+
+	if err := checkStrict(cmd, config); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+
+	slog.Info("config is valid", "path", configPath)
 	return nil
 }
 
+// checkStrict warns about channels with unknown schemes, which are usually
+// typos such as "gihub:", right after the config is read. It returns an error
+// if --strict is set and the config has such channels or channels that shadow
+// global channels.
+func checkStrict(cmd *cli.Command, config bonito.Config) error {
+	unresolvable := config.UnresolvableChannels()
+	for _, channel := range unresolvable {
+		slog.Warn(
+			"channel has an unknown URL scheme and cannot be resolved",
+			"channel", channel.Name,
+			"scope", channel.Scope,
+			"scheme", channel.Scheme)
+	}
+
+	if !cmd.Bool("strict") {
+		return nil
+	}
+
+	if len(unresolvable) > 0 {
+		descs := make([]string, len(unresolvable))
+		for i, channel := range unresolvable {
+			descs[i] = fmt.Sprintf("%s channel %q has scheme %q",
+				channel.Scope, channel.Name, channel.Scheme)
+		}
+		return fmt.Errorf("channels have unknown schemes (--strict): %s", strings.Join(descs, "; "))
+	}
+
+	shadowed := config.ShadowedChannels()
+	if len(shadowed) == 0 {
+		return nil
+	}
+
+	descs := make([]string, len(shadowed))
+	for i, shadow := range shadowed {
+		descs[i] = fmt.Sprintf("%s channel %q is %q instead of the global %q",
+			shadow.Scope, shadow.Name, shadow.Input, shadow.Global)
+	}
+
+	return fmt.Errorf("channels shadow global channels (--strict): %s", strings.Join(descs, "; "))
+}
+
 func recordChannels(state bonito.State) int {
 	var channelCount int
 
@@ -257,45 +764,100 @@ func recordChannels(state bonito.State) int {
 	return channelCount
 }
 
-func runIncludeFlags(ctx context.Context, cmd *cli.Command) error {
-	state, err := readState(cmd)
-	if err != nil {
-		return err
+// Output formats of the include-flags command.
+const (
+	includeFormatNixFlags = "nix-flags" // -I name=path ...
+	includeFormatNixPath  = "nix-path"  // name=path:...
+)
+
+// logUpdateReasons logs a summary of how many channel inputs were updated and
+// why. If verbose is true, the outcome of every input is logged as well.
+func logUpdateReasons(reasons map[bonito.ChannelInput]bonito.UpdateReason, verbose bool) {
+	if len(reasons) == 0 {
+		return
 	}
 
-	username, err := currentUsername(cmd)
-	if err != nil {
-		return fmt.Errorf("cannot get current user: %w", err)
+	inputs := make([]bonito.ChannelInput, 0, len(reasons))
+	for input := range reasons {
+		inputs = append(inputs, input)
 	}
+	sort.Slice(inputs, func(i, j int) bool {
+		return inputs[i].String() < inputs[j].String()
+	})
 
-	channelInputs, err := state.Config.UserChannels(username)
-	if err != nil {
-		return fmt.Errorf("cannot get channels for user %q: %w", username, err)
+	counts := make(map[bonito.UpdateReason]int)
+	var updated int
+	for _, input := range inputs {
+		reason := reasons[input]
+		counts[reason]++
+		if reason.Updated() {
+			updated++
+		}
+		if verbose {
+			slog.Info(
+				"channel update",
+				"input", input,
+				"reason", reason,
+				"updated", reason.Updated())
+		}
 	}
 
-	values := make([]string, 0, len(channelInputs))
-	for name, input := range channelInputs {
-		lock, ok := state.Lock.Channels[input]
-		if !ok || lock.StorePath == "" {
-			return fmt.Errorf("channel %q has no lock, try running `bonito` again?", name)
+	attrs := []any{"updated", updated}
+	for _, reason := range []bonito.UpdateReason{
+		bonito.UpdateAdded,
+		bonito.UpdateRefMoved,
+		bonito.UpdateHashChanged,
+		bonito.UpdatePinned,
+		bonito.UpdateUnchanged,
+	} {
+		if counts[reason] > 0 {
+			attrs = append(attrs, string(reason), counts[reason])
 		}
-		value := fmt.Sprintf("-I %s=%s", name, lock.StorePath)
-		values = append(values, value)
 	}
 
-	fmt.Println(strings.Join(values, " "))
-	return nil
+	slog.Info("updated channel locks", attrs...)
 }
 
-func runStorePath(ctx context.Context, cmd *cli.Command) error {
+func runIncludeFlags(ctx context.Context, cmd *cli.Command) error {
 	state, err := readState(cmd)
 	if err != nil {
 		return err
 	}
 
-	channel := cmd.Args().First()
-	if channel == "" {
-		return errors.New("channel argument is required")
+	format := cmd.String("format")
+	if format != includeFormatNixFlags && format != includeFormatNixPath {
+		return fmt.Errorf("unknown format %q, must be %s or %s",
+			format, includeFormatNixFlags, includeFormatNixPath)
+	}
+
+	out := cmd.Root().Writer
+
+	if cmd.Bool("all-users") {
+		usernames := make([]string, 0, len(state.Config.Users))
+		for username := range state.Config.Users {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+
+		flags := make(map[string]string, len(usernames))
+		for _, username := range usernames {
+			values, err := includeValues(&state.State, username)
+			if err != nil {
+				return err
+			}
+			flags[username] = formatIncludeValues(format, values)
+		}
+
+		if cmd.Bool("json") {
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			return enc.Encode(flags)
+		}
+
+		for _, username := range usernames {
+			fmt.Fprintf(out, "%s: %s\n", username, flags[username])
+		}
+		return nil
 	}
 
 	username, err := currentUsername(cmd)
@@ -303,15 +865,117 @@ func runStorePath(ctx context.Context, cmd *cli.Command) error {
 		return fmt.Errorf("cannot get current user: %w", err)
 	}
 
-	channelInputs, err := state.Config.UserChannels(username)
+	values, err := includeValues(&state.State, username)
 	if err != nil {
-		return fmt.Errorf("cannot get channels for user %q: %w", username, err)
+		return err
 	}
 
-	channelInput, ok := channelInputs[channel]
-	if !ok {
-		return fmt.Errorf("channel %q not found", channel)
-	}
+	fmt.Fprintln(out, formatIncludeValues(format, values))
+	return nil
+}
+
+// includeValues returns the NIX_PATH entries of the given user's locked
+// channels in the order of their names, followed by the static entries.
+func includeValues(state *bonito.State, username string) ([]string, error) {
+	channelInputs, err := state.Config.UserChannels(username)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get channels for user %q: %w", username, err)
+	}
+
+	names := make([]string, 0, len(channelInputs))
+	for name := range channelInputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make([]string, 0, len(channelInputs))
+	for _, name := range names {
+		lock, ok := state.Lock.Channels[channelInputs[name]]
+		if !ok || lock.StorePath == "" {
+			return nil, fmt.Errorf("channel %q has no lock, try running `bonito` again?", name)
+		}
+		values = append(values, name+"="+lock.StorePath)
+	}
+
+	return appendNixPath(values, state.Config.Global.NixPath), nil
+}
+
+// formatIncludeValues formats the NIX_PATH entries in the given include-flags
+// format.
+func formatIncludeValues(format string, values []string) string {
+	switch format {
+	case includeFormatNixFlags:
+		flags := make([]string, len(values))
+		for i, value := range values {
+			flags[i] = "-I " + value
+		}
+		return strings.Join(flags, " ")
+	default:
+		return strings.Join(values, ":")
+	}
+}
+
+// appendNixPath appends the static NIX_PATH entries to the given entries in
+// order. Entries that are already there are skipped, and so are entries whose
+// name is already taken, since Nix would never look them up.
+func appendNixPath(entries, static []string) []string {
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry] = true
+		if name, _, ok := strings.Cut(entry, "="); ok {
+			seen[name+"="] = true
+		}
+	}
+
+	for _, entry := range static {
+		if seen[entry] {
+			continue
+		}
+		if name, _, ok := strings.Cut(entry, "="); ok {
+			if seen[name+"="] {
+				slog.Warn(
+					"static NIX_PATH entry is shadowed by an earlier entry of the same name, skipping",
+					"entry", entry)
+				continue
+			}
+			seen[name+"="] = true
+		}
+		seen[entry] = true
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func runStorePath(ctx context.Context, cmd *cli.Command) error {
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Bool("all") {
+		return printAllStorePaths(cmd, state)
+	}
+
+	channel := cmd.Args().First()
+	if channel == "" {
+		return errors.New("channel argument is required")
+	}
+
+	username, err := currentUsername(cmd)
+	if err != nil {
+		return fmt.Errorf("cannot get current user: %w", err)
+	}
+
+	channelInputs, err := state.Config.UserChannels(username)
+	if err != nil {
+		return fmt.Errorf("cannot get channels for user %q: %w", username, err)
+	}
+
+	channelInput, ok := channelInputs[channel]
+	if !ok {
+		return fmt.Errorf("channel %q not found", channel)
+	}
 
 	lock, ok := state.Lock.Channels[channelInput]
 	if !ok {
@@ -322,6 +986,43 @@ func runStorePath(ctx context.Context, cmd *cli.Command) error {
 	return nil
 }
 
+// printAllStorePaths prints the store path of every channel of the user.
+func printAllStorePaths(cmd *cli.Command, state *stateFiles) error {
+	if cmd.Args().Present() {
+		return errors.New("--all takes no channel argument")
+	}
+
+	username, err := currentUsername(cmd)
+	if err != nil {
+		return err
+	}
+
+	paths, err := state.LocateStorePaths(username)
+	if err != nil {
+		return err
+	}
+
+	out := cmd.Root().Writer
+
+	if cmd.Bool("json") {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(paths)
+	}
+
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(out, "%s\t%s\n", name, paths[name])
+	}
+
+	return nil
+}
+
 func currentUsername(cmd *cli.Command) (string, error) {
 	username := cmd.String("user")
 	if username == "" {
@@ -333,3 +1034,580 @@ func currentUsername(cmd *cli.Command) (string, error) {
 	}
 	return username, nil
 }
+
+func runBump(ctx context.Context, cmd *cli.Command) error {
+	ctx = commandContext(ctx, cmd)
+
+	if cmd.Args().Len() != 2 {
+		return errors.New("usage: bonito bump <channel> <version>")
+	}
+
+	channel := cmd.Args().Get(0)
+	version := cmd.Args().Get(1)
+
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	config, configDocs, err := bumpConfig(state.configPath, channel, version)
+	if err != nil {
+		return err
+	}
+
+	newState := bonito.State{
+		Config: config.FilterChannels([]string{channel}),
+		Lock:   state.Lock,
+	}
+
+	// The bumped input is resolved but not fetched during a dry run, and the
+	// lock that it would get is printed instead.
+	var plan *bonito.Plan
+	if cmd.Bool("dry-run") {
+		plan = &bonito.Plan{}
+		ctx = bonito.WithDryRun(ctx, plan)
+	}
+
+	recordChannels(newState)
+
+	if err := newState.Update(ctx); err != nil {
+		return errors.Wrap(err, "cannot update bumped channel")
+	}
+
+	if plan != nil {
+		printPlan(cmd, plan)
+		return nil
+	}
+
+	state.Config = config
+	state.Lock = newState.Lock
+	state.SyncLockNames()
+
+	// The lock is saved first, so that a failure never leaves the config
+	// pointing to a version that the lock doesn't have.
+	if err := state.saveLockFile(); err != nil {
+		return errors.Wrap(err, "cannot save lock file")
+	}
+
+	for path, doc := range configDocs {
+		if err := replaceFile(doc, path); err != nil {
+			return errors.Wrapf(err, "cannot save config file %q", path)
+		}
+	}
+
+	return nil
+}
+
+// bumpConfig sets the version of the channel in the config at configPath. It
+// returns the bumped config and the bumped documents keyed by the paths that
+// they must be saved to. If configPath is a directory, then every config
+// fragment that defines the channel is bumped.
+func bumpConfig(configPath, channel, version string) (bonito.Config, map[string][]byte, error) {
+	if !isDir(configPath) {
+		configDoc, err := os.ReadFile(configPath)
+		if err != nil {
+			return bonito.Config{}, nil, errors.Wrap(err, "cannot read config file")
+		}
+
+		configDoc, err = bonito.SetChannelVersion(configDoc, channel, version)
+		if err != nil {
+			return bonito.Config{}, nil, errors.Wrapf(err, "cannot bump channel %q", channel)
+		}
+
+		config, err := bonito.NewConfigFromReader(bytes.NewReader(configDoc))
+		if err != nil {
+			return bonito.Config{}, nil, errors.Wrap(err, "cannot parse bumped config")
+		}
+
+		return config, map[string][]byte{configPath: configDoc}, nil
+	}
+
+	fragments, err := bonito.ReadConfigFragments(configPath)
+	if err != nil {
+		return bonito.Config{}, nil, errors.Wrap(err, "cannot read config directory")
+	}
+
+	bumped := make(map[string][]byte)
+	for path, doc := range fragments {
+		doc, err = bonito.SetChannelVersion(doc, channel, version)
+		if err != nil {
+			if errors.Is(err, bonito.ErrChannelNotFound) {
+				continue
+			}
+			return bonito.Config{}, nil, errors.Wrapf(err, "cannot bump channel %q in %q", channel, path)
+		}
+		fragments[path] = doc
+		bumped[path] = doc
+	}
+
+	if len(bumped) == 0 {
+		return bonito.Config{}, nil, errors.Wrapf(bonito.ErrChannelNotFound, "cannot bump channel %q", channel)
+	}
+
+	config, err := bonito.NewConfigFromFragments(fragments)
+	if err != nil {
+		return bonito.Config{}, nil, errors.Wrap(err, "cannot parse bumped config")
+	}
+
+	return config, bumped, nil
+}
+
+func runResolve(ctx context.Context, cmd *cli.Command) error {
+	ctx = commandContext(ctx, cmd)
+
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	newState := bonito.State{
+		Config: state.Config,
+		Lock:   state.Lock,
+	}
+
+	if channels := cmd.Args().Slice(); len(channels) > 0 {
+		newState.Config = state.Config.FilterChannels(channels)
+	}
+
+	changes, err := newState.Resolve(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot resolve inputs")
+	}
+
+	for _, change := range changes {
+		slog.Info(
+			"resolved input to a new URL",
+			"input", change.Name,
+			"url", change.NewURL)
+	}
+
+	state.Lock = newState.Lock
+	return state.saveLockFile()
+}
+
+func runLock(ctx context.Context, cmd *cli.Command) error {
+	ctx = commandContext(ctx, cmd)
+
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := state.UpdateLocks(ctx); err != nil {
+		return errors.Wrap(err, "cannot update locks")
+	}
+
+	return state.saveLockFile()
+}
+
+func runApply(ctx context.Context, cmd *cli.Command) error {
+	ctx = commandContext(ctx, cmd)
+
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := state.ApplyUsers(ctx); err != nil {
+		return errors.Wrap(err, "cannot apply")
+	}
+
+	if state.Config.Flakes.Enable {
+		if err := state.saveNixRegistryFile(); err != nil {
+			return errors.Wrap(err, "cannot save nix registry file")
+		}
+	}
+
+	if err := saveNixProfileFile(cmd, state); err != nil {
+		return errors.Wrap(err, "cannot save nix profile file")
+	}
+
+	return nil
+}
+
+func runDiff(ctx context.Context, cmd *cli.Command) error {
+	ctx = commandContext(ctx, cmd)
+
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	var diffs []bonito.LockDiff
+	if against := cmd.String("against"); against != "" {
+		ref, err := bonito.FetchLockFile(ctx, against)
+		if err != nil {
+			return errors.Wrap(err, "cannot read reference lock")
+		}
+		diffs = state.DiffAgainst(ref)
+	} else {
+		fresh, err := state.FreshLock(ctx)
+		if err != nil {
+			return errors.Wrap(err, "cannot update locks")
+		}
+		if !fresh.Eq(state.Lock) {
+			diffs = bonito.DiffLocks(state.Lock, fresh)
+		}
+	}
+
+	out := cmd.Root().Writer
+
+	if cmd.Bool("json") {
+		if diffs == nil {
+			diffs = []bonito.LockDiff{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diffs)
+	}
+
+	if len(diffs) == 0 {
+		fmt.Fprintln(out, "no changes")
+		return nil
+	}
+
+	for _, diff := range diffs {
+		switch diff.Action {
+		case bonito.ChangeAdd:
+			fmt.Fprintf(out, "+ %s %s\n", diff.Input, diff.New.URL)
+		case bonito.ChangeRemove:
+			fmt.Fprintf(out, "- %s %s\n", diff.Input, diff.Old.URL)
+		case bonito.ChangeUpdate:
+			fmt.Fprintf(out, "~ %s\n", diff.Input)
+			for _, field := range diff.Fields {
+				var oldValue, newValue any
+				switch field {
+				case "url":
+					oldValue, newValue = diff.Old.URL, diff.New.URL
+				case "store_hash":
+					oldValue, newValue = diff.Old.StoreHash, diff.New.StoreHash
+				case "store_path":
+					oldValue, newValue = diff.Old.StorePath, diff.New.StorePath
+				case "meta":
+					oldValue, newValue = formatLockMeta(diff.Old.Meta), formatLockMeta(diff.New.Meta)
+				}
+				fmt.Fprintf(out, "    %s: %v -> %v\n", field, oldValue, newValue)
+			}
+		}
+	}
+
+	return nil
+}
+
+func formatLockMeta(meta *bonito.ChannelLockMeta) string {
+	if meta == nil {
+		return "(none)"
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Sprint(*meta)
+	}
+	return string(b)
+}
+
+func runVerify(ctx context.Context, cmd *cli.Command) error {
+	// The remote check is for audits, e.g. in CI, where the locked channels
+	// aren't in the store.
+	if cmd.Bool("remote") {
+		return runVerifyRemote(commandContext(ctx, cmd), cmd)
+	}
+
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	problems := state.VerifyStore()
+	for _, problem := range problems {
+		slog.Error(
+			"locked channel is unusable",
+			"input", problem.Input,
+			"err", problem.Err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d of %d locked channels are unusable", len(problems), len(state.Lock.Channels))
+	}
+
+	slog.Info("all locked channels are in the store", "count", len(state.Lock.Channels))
+	return nil
+}
+
+func runVerifyRemote(ctx context.Context, cmd *cli.Command) error {
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	drifts, err := state.CheckLockedRefs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot check locked refs")
+	}
+
+	var moved int
+	for _, drift := range drifts {
+		switch {
+		case drift.Advanced():
+			slog.Info(
+				"locked branch has moved upstream",
+				"input", drift.Input,
+				"ref", drift.Ref,
+				"locked", drift.Locked,
+				"upstream", drift.Upstream)
+			continue
+		case drift.Upstream == "":
+			slog.Warn(
+				"locked ref no longer exists upstream",
+				"input", drift.Input,
+				"ref", drift.Ref,
+				"locked", drift.Locked)
+		default:
+			slog.Warn(
+				"locked ref points to a different revision upstream",
+				"input", drift.Input,
+				"ref", drift.Ref,
+				"locked", drift.Locked,
+				"upstream", drift.Upstream)
+		}
+		moved++
+	}
+
+	if moved > 0 {
+		return fmt.Errorf("%d locked refs no longer point to their locked revisions", moved)
+	}
+
+	slog.Info("no locked tag was moved or deleted upstream")
+	return nil
+}
+
+func runSelfCheck(ctx context.Context, cmd *cli.Command) error {
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	problems := state.SelfCheck()
+	for _, problem := range problems {
+		slog.Error(
+			"self-check failed",
+			"check", problem.Check,
+			"err", problem.Err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d self-check problems found", len(problems))
+	}
+
+	slog.Info("self-check passed")
+	return nil
+}
+
+func runRemove(ctx context.Context, cmd *cli.Command) error {
+	ctx = commandContext(ctx, cmd)
+
+	channel := cmd.Args().First()
+	if channel == "" || cmd.Args().Len() != 1 {
+		return errors.New("usage: bonito remove <channel>")
+	}
+
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := state.RemoveChannel(ctx, channel); err != nil {
+		return errors.Wrapf(err, "cannot remove channel %q", channel)
+	}
+
+	if err := state.saveLockFile(); err != nil {
+		return errors.Wrap(err, "cannot save lock file")
+	}
+
+	return nil
+}
+
+func runGC(ctx context.Context, cmd *cli.Command) error {
+	ctx = commandContext(ctx, cmd)
+
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	removed, err := state.RemoveTempChannels(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Root().Writer, "removed %d temporary channels\n", removed)
+
+	removed, err = state.RemoveStaleGCRoots()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Root().Writer, "removed %d stale GC roots\n", removed)
+	return nil
+}
+
+type listEntry struct {
+	Name      string              `json:"name"`
+	Input     bonito.ChannelInput `json:"input"`
+	Scope     string              `json:"scope"`
+	User      string              `json:"user,omitempty"`
+	Locked    bool                `json:"locked"`
+	StorePath string              `json:"store_path,omitempty"`
+}
+
+func runList(ctx context.Context, cmd *cli.Command) error {
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	var entries []listEntry
+	add := func(scope, user string, channels map[string]bonito.ChannelInput) {
+		names := make([]string, 0, len(channels))
+		for name := range channels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			input := channels[name]
+			lock, locked := state.Lock.Channels[input]
+			entries = append(entries, listEntry{
+				Name:      name,
+				Input:     input,
+				Scope:     scope,
+				User:      user,
+				Locked:    locked && lock.StorePath != "",
+				StorePath: lock.StorePath,
+			})
+		}
+	}
+
+	add("global", "", state.Config.Global.Channels)
+	add("flakes", "", state.Config.Flakes.Channels)
+
+	usernames := make([]string, 0, len(state.Config.Users))
+	for username := range state.Config.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		add("user", username, state.Config.Users[username].Channels)
+	}
+
+	out := cmd.Root().Writer
+
+	if cmd.Bool("json") {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SCOPE\tNAME\tINPUT\tSTORE PATH")
+	for _, entry := range entries {
+		scope := entry.Scope
+		if entry.User != "" {
+			scope += ":" + entry.User
+		}
+
+		storePath := entry.StorePath
+		if !entry.Locked {
+			storePath = "(not locked)"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", scope, entry.Name, entry.Input, storePath)
+	}
+
+	return w.Flush()
+}
+
+func runExport(ctx context.Context, cmd *cli.Command) error {
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	export, err := state.Export()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(cmd.Root().Writer)
+	enc.SetIndent("", "  ")
+	return enc.Encode(export)
+}
+
+func runOutdated(ctx context.Context, cmd *cli.Command) error {
+	ctx = commandContext(ctx, cmd)
+
+	state, err := readState(cmd)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := state.CheckRevisions(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot check revisions")
+	}
+
+	names := state.Config.ChannelNames()
+
+	entries := make([]outdatedEntry, len(revisions))
+	for i, rev := range revisions {
+		entries[i] = outdatedEntry{
+			Channels:  names[rev.Input],
+			Input:     rev.Input,
+			LockedRev: rev.Locked,
+			LatestRev: rev.Latest,
+			Outdated:  rev.Outdated(),
+		}
+	}
+
+	out := cmd.Root().Writer
+
+	if cmd.Bool("json") {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANNEL\tLOCKED\tLATEST\tUPDATE")
+	for _, entry := range entries {
+		locked := shortRev(entry.LockedRev)
+		if locked == "" {
+			locked = "-"
+		}
+
+		update := "no"
+		if entry.Outdated {
+			update = "yes"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			strings.Join(entry.Channels, ","), locked, shortRev(entry.LatestRev), update)
+	}
+
+	return w.Flush()
+}
+
+type outdatedEntry struct {
+	Channels  []string            `json:"channels"`
+	Input     bonito.ChannelInput `json:"input"`
+	LockedRev string              `json:"locked_rev"`
+	LatestRev string              `json:"latest_rev"`
+	Outdated  bool                `json:"outdated"`
+}
+
+func shortRev(rev string) string {
+	if len(rev) > 12 {
+		return rev[:12]
+	}
+	return rev
+}
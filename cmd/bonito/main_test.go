@@ -0,0 +1,1862 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondburned/nix-bonito/bonito"
+	"github.com/diamondburned/nix-bonito/internal/faketest"
+	"github.com/urfave/cli/v3"
+)
+
+// writeTestConfig writes a config made from the given TOML body into a
+// temporary directory. The current user is set as the preferred user, and
+// {{user}} in the body is replaced with its name. A table for the user is
+// added if the body doesn't configure any user. It returns the path to the
+// config file.
+func writeTestConfig(t testing.TB, configBody string) string {
+	t.Helper()
+
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("cannot get current user:", err)
+	}
+
+	t.Setenv("USER", u.Username)
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Cleanup(bonito.SetStoreDir(faketest.DefaultStoreDir))
+
+	configPath := filepath.Join(t.TempDir(), "host.toml")
+	configBody = strings.ReplaceAll(configBody, "{{user}}", u.Username)
+	if !strings.Contains(configBody, "[users.") {
+		configBody += fmt.Sprintf("\n[users.%q]\n", u.Username)
+	}
+	configBody = fmt.Sprintf("[global]\npreferred_user = %q\n\n%s", u.Username, configBody)
+
+	if err := os.WriteFile(configPath, []byte(configBody), 0644); err != nil {
+		t.Fatal("cannot write config:", err)
+	}
+
+	return configPath
+}
+
+// writeTestLock writes the given lock file next to the config.
+func writeTestLock(t *testing.T, configPath string, lock bonito.LockFile) {
+	t.Helper()
+
+	lockPath := trimExt(configPath) + ".lock.json"
+	if err := os.WriteFile(lockPath, []byte(lock.String()), 0644); err != nil {
+		t.Fatal("cannot write lock:", err)
+	}
+}
+
+// runTestCommand runs bonito with the given arguments on the given config. It
+// returns what bonito wrote to stdout.
+func runTestCommand(t testing.TB, sys *faketest.System, configPath string, args ...string) (string, error) {
+	t.Helper()
+
+	ctx := bonito.WithCommandRunner(context.Background(), sys.Run)
+
+	var stdout strings.Builder
+
+	cmd := newCommand()
+	cmd.ExitErrHandler = nil
+	cmd.Writer = &stdout
+	cmd.ErrWriter = io.Discard
+
+	argv := append([]string{"bonito", "--no-color", "-c", configPath}, args...)
+	err := cmd.Run(ctx, argv)
+	return stdout.String(), err
+}
+
+func readTestState(t *testing.T, configPath string) bonito.State {
+	t.Helper()
+
+	config, err := readConfigFile(configPath)
+	if err != nil {
+		t.Fatal("cannot read config:", err)
+	}
+
+	lock, err := tryReadLockFile(trimExt(configPath) + ".lock.json")
+	if err != nil {
+		t.Fatal("cannot read lock:", err)
+	}
+
+	return bonito.State{Config: config, Lock: lock}
+}
+
+func TestBump(t *testing.T) {
+	const config = `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-23.11" # keep me
+`
+
+	refs := map[string]string{
+		"nixos-23.11": strings.Repeat("a", 40),
+		"nixos-24.05": strings.Repeat("b", 40),
+	}
+
+	t.Run("update", func(t *testing.T) {
+		sys := faketest.New(refs)
+
+		configPath := writeTestConfig(t, config)
+		if err := os.Chmod(configPath, 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := runTestCommand(t, sys, configPath, "bump", "nixpkgs", "nixos-24.05"); err != nil {
+			t.Fatal("cannot bump:", err)
+		}
+
+		fi, err := os.Stat(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := fi.Mode().Perm(); mode != 0640 {
+			t.Errorf("config mode = %v, want %v", mode, os.FileMode(0640))
+		}
+
+		configDoc, err := os.ReadFile(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(configDoc), `nixpkgs = "github:NixOS/nixpkgs nixos-24.05" # keep me`) {
+			t.Fatalf("config was not bumped:\n%s", configDoc)
+		}
+
+		state := readTestState(t, configPath)
+
+		input := state.Config.Global.Channels["nixpkgs"]
+		lock, ok := state.Lock.Channels[input]
+		if !ok {
+			t.Fatalf("lock has no entry for %q: %v", input, state.Lock)
+		}
+
+		wantURL := "https://github.com/NixOS/nixpkgs/archive/" + refs["nixos-24.05"] + ".tar.gz"
+		if lock.URL != wantURL {
+			t.Errorf("lock URL = %q, want %q", lock.URL, wantURL)
+		}
+		if lock.StoreHash == "" {
+			t.Error("lock has no store hash")
+		}
+	})
+
+	t.Run("dry-run", func(t *testing.T) {
+		sys := faketest.New(refs)
+
+		configPath := writeTestConfig(t, config)
+		out, err := runTestCommand(t, sys, configPath, "bump", "--dry-run", "nixpkgs", "nixos-24.05")
+		if err != nil {
+			t.Fatal("cannot bump:", err)
+		}
+
+		want := "~ github:NixOS/nixpkgs nixos-24.05 (none) -> https://github.com/NixOS/nixpkgs/archive/" + refs["nixos-24.05"] + ".tar.gz\n"
+		if out != want {
+			t.Errorf("unexpected output %q, want %q", out, want)
+		}
+
+		state := readTestState(t, configPath)
+		if v := state.Config.Global.Channels["nixpkgs"].Version; v != "nixos-23.11" {
+			t.Errorf("config version changed to %q during dry run", v)
+		}
+		if len(state.Lock.Channels) != 0 {
+			t.Errorf("lock written during dry run: %v", state.Lock)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		sys := faketest.New(refs)
+
+		configPath := writeTestConfig(t, config)
+		if _, err := runTestCommand(t, sys, configPath, "bump", "nixos", "nixos-24.05"); err == nil {
+			t.Fatal("bumping an unknown channel succeeded")
+		}
+	})
+}
+
+func TestOutdated(t *testing.T) {
+	// Only Git inputs are checked, so the resolver of mypkgs is never run and
+	// the tarball is never downloaded.
+	const config = `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+home-manager = "github:nix-community/home-manager master"
+mypkgs = "exec:/nonexistent/resolver"
+tarball = "https://example.invalid/nixexprs.tar.xz"
+`
+
+	oldRev := strings.Repeat("a", 40)
+	newRev := strings.Repeat("b", 40)
+	hmRev := strings.Repeat("c", 40)
+
+	lock := bonito.LockFile{
+		Channels: map[bonito.ChannelInput]bonito.ChannelLock{
+			{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}: {
+				URL:       "https://github.com/NixOS/nixpkgs/archive/" + oldRev + ".tar.gz",
+				StoreHash: "4ch3bm9bx98jf68ri8jmx00k479mv8g6",
+				Meta:      &bonito.ChannelLockMeta{Rev: oldRev},
+			},
+			{URL: "github:nix-community/home-manager", Version: "master"}: {
+				URL:       "https://github.com/nix-community/home-manager/archive/" + hmRev + ".tar.gz",
+				StoreHash: "5ch3bm9bx98jf68ri8jmx00k479mv8g6",
+				Meta:      &bonito.ChannelLockMeta{Rev: hmRev},
+			},
+		},
+	}
+
+	refs := map[string]string{
+		"nixos-unstable": newRev,
+		"master":         hmRev,
+	}
+
+	t.Run("table", func(t *testing.T) {
+		configPath := writeTestConfig(t, config)
+		writeTestLock(t, configPath, lock)
+
+		sys := faketest.New(refs)
+
+		out, err := runTestCommand(t, sys, configPath, "outdated")
+		if err != nil {
+			t.Fatal("cannot check outdated channels:", err)
+		}
+
+		const want = "" +
+			"CHANNEL       LOCKED        LATEST        UPDATE\n" +
+			"nixpkgs       aaaaaaaaaaaa  bbbbbbbbbbbb  yes\n" +
+			"home-manager  cccccccccccc  cccccccccccc  no\n"
+		if out != want {
+			t.Errorf("unexpected output:\n%s\nwant:\n%s", out, want)
+		}
+
+		for _, call := range sys.Calls {
+			if call[0] != "git" {
+				t.Errorf("unexpected non-git command %q", call)
+			}
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		configPath := writeTestConfig(t, config)
+		writeTestLock(t, configPath, lock)
+
+		sys := faketest.New(refs)
+
+		out, err := runTestCommand(t, sys, configPath, "outdated", "--json")
+		if err != nil {
+			t.Fatal("cannot check outdated channels:", err)
+		}
+
+		var entries []outdatedEntry
+		if err := json.Unmarshal([]byte(out), &entries); err != nil {
+			t.Fatalf("cannot decode JSON output %q: %v", out, err)
+		}
+
+		outdated := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			outdated[strings.Join(entry.Channels, ",")] = entry.Outdated
+		}
+
+		want := map[string]bool{"nixpkgs": true, "home-manager": false}
+		if !reflect.DeepEqual(outdated, want) {
+			t.Errorf("unexpected outdated channels %v, want %v", outdated, want)
+		}
+	})
+}
+
+func TestConfigCheckOnly(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[global.aliases]
+nixos = "nixpkgs"
+`)
+
+		sys := faketest.New(nil)
+		if _, err := runTestCommand(t, sys, configPath, "--config-check-only"); err != nil {
+			t.Fatal("valid config failed the check:", err)
+		}
+
+		if len(sys.Calls) > 0 {
+			t.Errorf("unexpected commands run: %q", sys.Calls)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		configPath := writeTestConfig(t, `
+[global.aliases]
+nixos = "nixpkgs"
+`)
+
+		sys := faketest.New(nil)
+		if _, err := runTestCommand(t, sys, configPath, "--config-check-only"); err == nil {
+			t.Fatal("config with a dangling alias passed the check")
+		}
+
+		if len(sys.Calls) > 0 {
+			t.Errorf("unexpected commands run: %q", sys.Calls)
+		}
+	})
+
+	t.Run("shadowed", func(t *testing.T) {
+		configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[users.{{user}}.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-24.05"
+`)
+
+		sys := faketest.New(nil)
+		if _, err := runTestCommand(t, sys, configPath, "--config-check-only"); err != nil {
+			t.Fatal("shadowing failed the check without --strict:", err)
+		}
+
+		_, err := runTestCommand(t, sys, configPath, "--strict", "--config-check-only")
+		if err == nil || !strings.Contains(err.Error(), `channel "nixpkgs" is "github:NixOS/nixpkgs nixos-24.05"`) {
+			t.Fatalf("unexpected error with --strict: %v", err)
+		}
+	})
+
+	t.Run("unknown scheme", func(t *testing.T) {
+		configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "gihub:NixOS/nixpkgs nixos-unstable"
+`)
+
+		sys := faketest.New(nil)
+		if _, err := runTestCommand(t, sys, configPath, "--config-check-only"); err != nil {
+			t.Fatal("unknown scheme failed the check without --strict:", err)
+		}
+
+		// A run fails before anything is resolved.
+		_, err := runTestCommand(t, sys, configPath, "--strict", "-u")
+		if err == nil || !strings.Contains(err.Error(), `global channel "nixpkgs" has scheme "gihub"`) {
+			t.Fatalf("unexpected error with --strict: %v", err)
+		}
+		if len(sys.Calls) > 0 {
+			t.Errorf("unexpected commands run: %q", sys.Calls)
+		}
+	})
+}
+
+func BenchmarkConfigCheckOnly(b *testing.B) {
+	sys := faketest.New(nil)
+	configPath := filepath.Join("..", "..", "example", "hackadoll3.toml")
+
+	for i := 0; i < b.N; i++ {
+		if _, err := runTestCommand(b, sys, configPath, "--config-check-only"); err != nil {
+			b.Fatal("example config failed the check:", err)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[users."{{user}}"]
+override-channels = true
+`)
+
+	rev := strings.Repeat("a", 40)
+
+	sys := faketest.New(map[string]string{"nixos-unstable": rev})
+	sys.Channels["old"] = "https://example.com/old.tar.gz"
+
+	out, err := runTestCommand(t, sys, configPath, "--dry-run", "-u")
+	if err != nil {
+		t.Fatal("cannot dry run:", err)
+	}
+
+	for _, call := range sys.Calls {
+		if call[0] == "nix-channel" && call[1] != "--list" {
+			t.Errorf("unexpected channel change %q", call)
+		}
+	}
+
+	u, _ := user.Current()
+	url := "https://github.com/NixOS/nixpkgs/archive/" + rev + ".tar.gz"
+
+	want := strings.Join([]string{
+		"+ " + u.Username + "/nixpkgs " + url,
+		"- " + u.Username + "/old https://example.com/old.tar.gz",
+		"~ github:NixOS/nixpkgs nixos-unstable (none) -> " + url,
+	}, "\n") + "\n"
+	if out != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", out, want)
+	}
+
+	if _, err := os.Stat(trimExt(configPath) + ".lock.json"); !os.IsNotExist(err) {
+		t.Errorf("lock file written during dry run: %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[flakes.channels]
+nur = "github:nix-community/NUR master"
+`)
+
+	nixpkgs := bonito.ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	writeTestLock(t, configPath, bonito.LockFile{
+		Channels: map[bonito.ChannelInput]bonito.ChannelLock{
+			nixpkgs: {
+				URL:       "https://github.com/NixOS/nixpkgs/archive/abc.tar.gz",
+				StoreHash: "4ch3bm9bx98jf68ri8jmx00k479mv8g6",
+				StorePath: "/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source",
+			},
+		},
+	})
+
+	t.Run("table", func(t *testing.T) {
+		out, err := runTestCommand(t, faketest.New(nil), configPath, "list")
+		if err != nil {
+			t.Fatal("cannot list:", err)
+		}
+
+		const want = "" +
+			"SCOPE   NAME     INPUT                                STORE PATH\n" +
+			"global  nixpkgs  github:NixOS/nixpkgs nixos-unstable  /nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source\n" +
+			"flakes  nur      github:nix-community/NUR master      (not locked)\n"
+		if out != want {
+			t.Errorf("unexpected output:\n%s\nwant:\n%s", out, want)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		out, err := runTestCommand(t, faketest.New(nil), configPath, "list", "--json")
+		if err != nil {
+			t.Fatal("cannot list:", err)
+		}
+
+		var entries []listEntry
+		if err := json.Unmarshal([]byte(out), &entries); err != nil {
+			t.Fatalf("cannot decode JSON output %q: %v", out, err)
+		}
+
+		want := []listEntry{
+			{
+				Name:      "nixpkgs",
+				Input:     nixpkgs,
+				Scope:     "global",
+				Locked:    true,
+				StorePath: "/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source",
+			},
+			{
+				Name:  "nur",
+				Input: bonito.ChannelInput{URL: "github:nix-community/NUR", Version: "master"},
+				Scope: "flakes",
+			},
+		}
+		if !reflect.DeepEqual(entries, want) {
+			t.Errorf("unexpected entries %+v, want %+v", entries, want)
+		}
+	})
+}
+
+func TestIncludeFlags(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+home-manager = "github:nix-community/home-manager master"
+`)
+
+	writeTestLock(t, configPath, bonito.LockFile{
+		Channels: map[bonito.ChannelInput]bonito.ChannelLock{
+			{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}: {
+				StorePath: "/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source",
+			},
+			{URL: "github:nix-community/home-manager", Version: "master"}: {
+				StorePath: "/nix/store/0ch3bm9bx98jf68ri8jmx00k479mv8g6-source",
+			},
+		},
+	})
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: "nix-flags",
+			want: "" +
+				"-I home-manager=/nix/store/0ch3bm9bx98jf68ri8jmx00k479mv8g6-source " +
+				"-I nixpkgs=/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source\n",
+		},
+		{
+			format: "nix-path",
+			want: "" +
+				"home-manager=/nix/store/0ch3bm9bx98jf68ri8jmx00k479mv8g6-source:" +
+				"nixpkgs=/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			out, err := runTestCommand(t, faketest.New(nil), configPath, "include-flags", "--format", test.format)
+			if err != nil {
+				t.Fatal("cannot get include flags:", err)
+			}
+			if out != test.want {
+				t.Errorf("unexpected output %q, want %q", out, test.want)
+			}
+		})
+	}
+
+	_, err := runTestCommand(t, faketest.New(nil), configPath, "include-flags", "--format", "json")
+	if err == nil || !strings.Contains(err.Error(), `unknown format "json"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStorePathAll(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+home-manager = "github:nix-community/home-manager master"
+`)
+
+	storeDir := t.TempDir()
+	t.Cleanup(bonito.SetStoreDir(storeDir))
+
+	const nixpkgsHash = "4ch3bm9bx98jf68ri8jmx00k479mv8g6"
+	const hmHash = "0ch3bm9bx98jf68ri8jmx00k479mv8g6"
+
+	for _, hash := range []string{nixpkgsHash, hmHash} {
+		if err := os.Mkdir(filepath.Join(storeDir, hash+"-source"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeTestLock(t, configPath, bonito.LockFile{
+		Channels: map[bonito.ChannelInput]bonito.ChannelLock{
+			{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}: {
+				StoreHash: nixpkgsHash,
+			},
+			{URL: "github:nix-community/home-manager", Version: "master"}: {
+				StoreHash: hmHash,
+			},
+		},
+	})
+
+	nixpkgsPath := filepath.Join(storeDir, nixpkgsHash+"-source")
+	hmPath := filepath.Join(storeDir, hmHash+"-source")
+
+	out, err := runTestCommand(t, faketest.New(nil), configPath, "store-path", "--all")
+	if err != nil {
+		t.Fatal("cannot get store paths:", err)
+	}
+	if want := "home-manager\t" + hmPath + "\nnixpkgs\t" + nixpkgsPath + "\n"; out != want {
+		t.Errorf("unexpected output %q, want %q", out, want)
+	}
+
+	out, err = runTestCommand(t, faketest.New(nil), configPath, "store-path", "--all", "--json")
+	if err != nil {
+		t.Fatal("cannot get store paths as JSON:", err)
+	}
+	var paths map[string]string
+	if err := json.Unmarshal([]byte(out), &paths); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out, err)
+	}
+	if want := map[string]string{"nixpkgs": nixpkgsPath, "home-manager": hmPath}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %v, want %v", paths, want)
+	}
+
+	// A garbage-collected channel is an error rather than a missing line.
+	if err := os.Remove(hmPath); err != nil {
+		t.Fatal(err)
+	}
+	_, err = runTestCommand(t, faketest.New(nil), configPath, "store-path", "--all")
+	if err == nil || !strings.Contains(err.Error(), `channel "home-manager"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestIncludeFlagsNixPath(t *testing.T) {
+	// The body continues the [global] table of writeTestConfig.
+	configPath := writeTestConfig(t, `
+nix_path = [
+	"nixos-config=/etc/nixos/configuration.nix",
+	"/etc/nix/path",
+	"nixos-config=/etc/nixos/configuration.nix",
+	"nixpkgs=/home/user/nixpkgs",
+]
+
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`)
+
+	writeTestLock(t, configPath, bonito.LockFile{
+		Channels: map[bonito.ChannelInput]bonito.ChannelLock{
+			{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}: {
+				StorePath: "/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source",
+			},
+		},
+	})
+
+	out, err := runTestCommand(t, faketest.New(nil), configPath, "include-flags", "--format", "nix-path")
+	if err != nil {
+		t.Fatal("cannot get include flags:", err)
+	}
+
+	const want = "" +
+		"nixpkgs=/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source:" +
+		"nixos-config=/etc/nixos/configuration.nix:" +
+		"/etc/nix/path\n"
+	if out != want {
+		t.Errorf("unexpected output %q, want %q", out, want)
+	}
+}
+
+func TestIncludeFlagsAllUsers(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[users.alice]
+[users.bob.channels]
+home-manager = "github:nix-community/home-manager master"
+`)
+
+	writeTestLock(t, configPath, bonito.LockFile{
+		Channels: map[bonito.ChannelInput]bonito.ChannelLock{
+			{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}: {
+				StorePath: "/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source",
+			},
+			{URL: "github:nix-community/home-manager", Version: "master"}: {
+				StorePath: "/nix/store/0ch3bm9bx98jf68ri8jmx00k479mv8g6-source",
+			},
+		},
+	})
+
+	out, err := runTestCommand(t, faketest.New(nil), configPath, "include-flags", "--all-users")
+	if err != nil {
+		t.Fatal("cannot get include flags:", err)
+	}
+
+	const want = "" +
+		"alice: -I nixpkgs=/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source\n" +
+		"bob: -I home-manager=/nix/store/0ch3bm9bx98jf68ri8jmx00k479mv8g6-source " +
+		"-I nixpkgs=/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source\n"
+	if out != want {
+		t.Errorf("unexpected output %q, want %q", out, want)
+	}
+
+	out, err = runTestCommand(t, faketest.New(nil), configPath,
+		"include-flags", "--all-users", "--json", "--format", "nix-path")
+	if err != nil {
+		t.Fatal("cannot get include flags as JSON:", err)
+	}
+
+	var flags map[string]string
+	if err := json.Unmarshal([]byte(out), &flags); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out)
+	}
+
+	wantFlags := map[string]string{
+		"alice": "nixpkgs=/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source",
+		"bob": "" +
+			"home-manager=/nix/store/0ch3bm9bx98jf68ri8jmx00k479mv8g6-source:" +
+			"nixpkgs=/nix/store/4ch3bm9bx98jf68ri8jmx00k479mv8g6-source",
+	}
+	if !reflect.DeepEqual(flags, wantFlags) {
+		t.Errorf("unexpected flags %q, want %q", flags, wantFlags)
+	}
+}
+
+func TestLockFileStdout(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`)
+
+	rev := strings.Repeat("a", 40)
+	sys := faketest.New(map[string]string{"nixos-unstable": rev})
+
+	out, err := runTestCommand(t, sys, configPath, "--lock-file", "-", "-u")
+	if err != nil {
+		t.Fatal("cannot update:", err)
+	}
+
+	lock, err := bonito.NewLockFileFromReader(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("stdout is not a lock file: %v\n%s", err, out)
+	}
+
+	input := bonito.ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	if lock.Channels[input].Rev() != rev {
+		t.Errorf("unexpected lock written to stdout:\n%s", out)
+	}
+
+	if _, err := os.Stat(trimExt(configPath) + ".lock.json"); !os.IsNotExist(err) {
+		t.Errorf("lock file written next to the config: %v", err)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`)
+	lockPath := trimExt(configPath) + ".lock.json"
+
+	sys := faketest.New(map[string]string{"nixos-unstable": strings.Repeat("a", 40)})
+	if _, err := runTestCommand(t, sys, configPath, "-u"); err != nil {
+		t.Fatal("cannot update:", err)
+	}
+
+	lsRemotes := func() int {
+		var n int
+		for _, call := range sys.Calls {
+			if call[0] == "git" && slices.Contains(call, "ls-remote") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// The lock was just updated, so nothing is fetched.
+	sys.Refs["nixos-unstable"] = strings.Repeat("b", 40)
+	before := lsRemotes()
+	if _, err := runTestCommand(t, sys, configPath, "-u", "--max-age", "1h"); err != nil {
+		t.Fatal("cannot update with a fresh lock:", err)
+	}
+	if n := lsRemotes(); n != before {
+		t.Errorf("fresh lock was updated, %d git ls-remote calls", n-before)
+	}
+	if rev := readTestState(t, configPath).Lock.Channels[bonito.ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}].Rev(); rev != strings.Repeat("a", 40) {
+		t.Errorf("fresh lock was changed to %q", rev)
+	}
+
+	// Applying must not make the lock look fresher than it is.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runTestCommand(t, sys, configPath); err != nil {
+		t.Fatal("cannot apply:", err)
+	}
+	if stat, err := os.Stat(lockPath); err != nil || !stat.ModTime().Equal(old) {
+		t.Errorf("applying changed the lock modification time: %v", err)
+	}
+
+	if _, err := runTestCommand(t, sys, configPath, "-u", "--max-age", "1h"); err != nil {
+		t.Fatal("cannot update with a stale lock:", err)
+	}
+	if rev := readTestState(t, configPath).Lock.Channels[bonito.ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}].Rev(); rev != strings.Repeat("b", 40) {
+		t.Errorf("stale lock was not updated, got %q", rev)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`)
+	lockPath := trimExt(configPath) + ".lock.json"
+
+	sys := faketest.New(map[string]string{
+		"nixos-unstable": strings.Repeat("a", 40),
+		"master":         strings.Repeat("b", 40),
+	})
+
+	if _, err := runTestCommand(t, sys, configPath, "--check"); err == nil {
+		t.Error("--check passed without a lock")
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("--check wrote the lock: %v", err)
+	}
+
+	if _, err := runTestCommand(t, sys, configPath, "-u"); err != nil {
+		t.Fatal("cannot update:", err)
+	}
+	if _, err := runTestCommand(t, sys, configPath, "--check"); err != nil {
+		t.Error("--check failed with a current lock:", err)
+	}
+
+	before, err := os.ReadFile(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = bytes.Replace(config,
+		[]byte("nixpkgs = "), []byte("home-manager = \"github:nix-community/home-manager master\"\nnixpkgs = "), 1)
+	if err := os.WriteFile(configPath, config, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runTestCommand(t, sys, configPath, "--check")
+	if err == nil {
+		t.Error("--check passed with an outdated lock")
+	}
+	if !strings.Contains(out, "add\thome-manager\t") {
+		t.Errorf("--check did not print the new channel:\n%s", out)
+	}
+	if strings.Contains(out, "nixpkgs") {
+		t.Errorf("--check printed an unchanged channel:\n%s", out)
+	}
+
+	if after, err := os.ReadFile(lockPath); err != nil || !bytes.Equal(before, after) {
+		t.Errorf("--check changed the lock: %v", err)
+	}
+}
+
+func TestFromLock(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[users."{{user}}".channels]
+home-manager = "github:nix-community/home-manager master"
+`)
+
+	sys := faketest.New(map[string]string{
+		"nixos-unstable": strings.Repeat("a", 40),
+		"master":         strings.Repeat("b", 40),
+	})
+
+	if _, err := runTestCommand(t, sys, configPath, "-u"); err != nil {
+		t.Fatal("cannot update:", err)
+	}
+
+	// Deploy just the lock file onto a fresh system.
+	lockPath := filepath.Join(t.TempDir(), "deployed.lock.json")
+	if err := os.Rename(trimExt(configPath)+".lock.json", lockPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	deployed := faketest.New(nil)
+	if _, err := runTestCommand(t, deployed, configPath, "--from-lock", "--lock-file", lockPath); err != nil {
+		t.Fatal("cannot apply from lock:", err)
+	}
+
+	want := map[string]string{
+		"nixpkgs":      sys.Channels["nixpkgs"],
+		"home-manager": sys.Channels["home-manager"],
+	}
+	if !reflect.DeepEqual(deployed.Channels, want) {
+		t.Errorf("unexpected channels applied from lock:\ngot  %v\nwant %v", deployed.Channels, want)
+	}
+}
+
+func TestStrictHash(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-24.05"
+`)
+
+	sys := faketest.New(map[string]string{
+		"nixos-23.11": strings.Repeat("a", 40),
+		"nixos-24.05": strings.Repeat("b", 40),
+	})
+
+	// Lock the channel while it still pointed to nixos-23.11. The nixos-24.05
+	// input has to be resolved again, which gives it a new store hash.
+	oldInput := bonito.ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-23.11"}
+	oldURL := "https://github.com/NixOS/nixpkgs/archive/" + strings.Repeat("a", 40) + ".tar.gz"
+	writeTestLock(t, configPath, bonito.LockFile{
+		Channels: map[bonito.ChannelInput]bonito.ChannelLock{
+			oldInput: {URL: oldURL},
+		},
+	})
+
+	_, err := runTestCommand(t, sys, configPath, "--strict-hash")
+	if err == nil || !strings.Contains(err.Error(), "not in the lock") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := sys.Channels["nixpkgs"]; ok {
+		t.Error("channel was applied despite the strict hash failure")
+	}
+
+	if _, err := runTestCommand(t, sys, configPath, "--strict-hash", "--update-locks"); err != nil {
+		t.Fatal("cannot update locks:", err)
+	}
+
+	if _, err := runTestCommand(t, sys, configPath, "--strict-hash"); err != nil {
+		t.Fatal("cannot apply updated locks:", err)
+	}
+}
+
+func TestLockOnly(t *testing.T) {
+	const config = `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`
+
+	refs := map[string]string{"nixos-unstable": strings.Repeat("a", 40)}
+	input := bonito.ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+
+	check := func(t *testing.T, sys *faketest.System, configPath string) {
+		t.Helper()
+
+		if lock := readTestState(t, configPath).Lock.Channels[input]; lock.StoreHash == "" {
+			t.Error("channel was not locked")
+		}
+		for name := range sys.Channels {
+			if !strings.HasPrefix(name, "bonito-") {
+				t.Errorf("channel %q was added to the user", name)
+			}
+		}
+	}
+
+	t.Run("flag", func(t *testing.T) {
+		sys := faketest.New(refs)
+		configPath := writeTestConfig(t, config)
+
+		if _, err := runTestCommand(t, sys, configPath, "--lock-only"); err != nil {
+			t.Fatal("cannot lock:", err)
+		}
+		check(t, sys, configPath)
+	})
+
+	t.Run("config", func(t *testing.T) {
+		sys := faketest.New(refs)
+		// The body continues the [global] table of writeTestConfig.
+		configPath := writeTestConfig(t, "skip_user_channels = true\n"+config)
+
+		if _, err := runTestCommand(t, sys, configPath); err != nil {
+			t.Fatal("cannot lock:", err)
+		}
+		check(t, sys, configPath)
+	})
+}
+
+func TestNoLockWrite(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`)
+
+	sys := faketest.New(map[string]string{"nixos-unstable": strings.Repeat("a", 40)})
+	profilePath := filepath.Join(t.TempDir(), "channels.nix")
+
+	_, err := runTestCommand(t, sys, configPath, "--no-lock-write", "--profile-output", profilePath)
+	if err != nil {
+		t.Fatal("cannot apply:", err)
+	}
+
+	if _, ok := sys.Channels["nixpkgs"]; !ok {
+		t.Error("channel was not applied")
+	}
+
+	for _, path := range []string{trimExt(configPath) + ".lock.json", profilePath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was written (stat error: %v)", path, err)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+home-manager = "github:nix-community/home-manager master"
+`)
+
+	sys := faketest.New(map[string]string{
+		"nixos-unstable": strings.Repeat("a", 40),
+		"master":         strings.Repeat("b", 40),
+	})
+
+	if _, err := runTestCommand(t, sys, configPath, "-u"); err != nil {
+		t.Fatal("cannot update:", err)
+	}
+
+	// Drop home-manager from the config. Without override_channels, applying
+	// keeps it around.
+	configBody, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configBody = bytes.ReplaceAll(configBody, []byte(`home-manager = "github:nix-community/home-manager master"`), nil)
+	if err := os.WriteFile(configPath, configBody, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runTestCommand(t, sys, configPath, "remove", "home-manager"); err != nil {
+		t.Fatal("cannot remove:", err)
+	}
+
+	if _, ok := sys.Channels["home-manager"]; ok {
+		t.Error("channel was not removed")
+	}
+	if _, ok := sys.Channels["nixpkgs"]; !ok {
+		t.Error("other channel was removed")
+	}
+
+	hm := bonito.ChannelInput{URL: "github:nix-community/home-manager", Version: "master"}
+	if _, ok := readTestState(t, configPath).Lock.Channels[hm]; ok {
+		t.Error("channel is still in the lock")
+	}
+
+	_, err = runTestCommand(t, sys, configPath, "remove", "home-manager")
+	if err == nil || !strings.Contains(err.Error(), "neither") {
+		t.Fatalf("unexpected error removing an unknown channel: %v", err)
+	}
+}
+
+func TestGC(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`)
+
+	sys := faketest.New(nil)
+	sys.Channels["nixpkgs"] = "https://example.com/nixpkgs.tar.gz"
+	sys.Channels["bonito-nixpkgs"] = "https://example.com/nixpkgs.tar.gz"
+	sys.Channels["bonito-home-manager"] = "https://example.com/home-manager.tar.gz"
+
+	out, err := runTestCommand(t, sys, configPath, "gc")
+	if err != nil {
+		t.Fatal("cannot gc:", err)
+	}
+
+	if out != "removed 2 temporary channels\nremoved 0 stale GC roots\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	want := map[string]string{"nixpkgs": "https://example.com/nixpkgs.tar.gz"}
+	if !reflect.DeepEqual(sys.Channels, want) {
+		t.Errorf("unexpected channels %v, want %v", sys.Channels, want)
+	}
+}
+
+func TestPhases(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`)
+
+	const rev = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	sys := faketest.New(map[string]string{"nixos-unstable": rev})
+	input := bonito.ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	url := "https://github.com/NixOS/nixpkgs/archive/" + rev + ".tar.gz"
+
+	// commands returns the commands run since the last call.
+	var seen int
+	commands := func() []string {
+		var names []string
+		for _, call := range sys.Calls[seen:] {
+			names = append(names, strings.Join(call[:2], " "))
+		}
+		seen = len(sys.Calls)
+		return names
+	}
+
+	t.Run("apply-unlocked", func(t *testing.T) {
+		_, err := runTestCommand(t, sys, configPath, "apply")
+		if err == nil || !strings.Contains(err.Error(), "not locked yet") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		commands()
+	})
+
+	t.Run("resolve", func(t *testing.T) {
+		if _, err := runTestCommand(t, sys, configPath, "resolve"); err != nil {
+			t.Fatal("cannot resolve:", err)
+		}
+
+		lock := readTestState(t, configPath).Lock.Channels[input]
+		if lock.URL != url || lock.StoreHash != "" {
+			t.Errorf("unexpected resolved lock %+v", lock)
+		}
+
+		for _, command := range commands() {
+			if strings.HasPrefix(command, "nix-channel") {
+				t.Errorf("resolve ran %q", command)
+			}
+		}
+	})
+
+	t.Run("lock", func(t *testing.T) {
+		if _, err := runTestCommand(t, sys, configPath, "lock"); err != nil {
+			t.Fatal("cannot lock:", err)
+		}
+
+		lock := readTestState(t, configPath).Lock.Channels[input]
+		if lock.URL != url || lock.StoreHash == "" || lock.NarHash() != "sha256:"+faketest.SourceHash(url) {
+			t.Errorf("unexpected lock %+v", lock)
+		}
+
+		if _, ok := sys.Channels["nixpkgs"]; ok {
+			t.Error("lock applied the user channel")
+		}
+		for _, command := range commands() {
+			if strings.HasPrefix(command, "git") {
+				t.Errorf("lock ran %q", command)
+			}
+		}
+	})
+
+	t.Run("apply", func(t *testing.T) {
+		if _, err := runTestCommand(t, sys, configPath, "apply"); err != nil {
+			t.Fatal("cannot apply:", err)
+		}
+
+		if sys.Channels["nixpkgs"] != url {
+			t.Errorf("channel was not applied: %v", sys.Channels)
+		}
+		for _, command := range commands() {
+			if strings.HasPrefix(command, "git") {
+				t.Errorf("apply ran %q", command)
+			}
+		}
+	})
+}
+
+func TestPerUserLocks(t *testing.T) {
+	configPath := writeTestConfig(t, `
+per_user_locks = true
+
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[flakes.channels]
+nur = "github:nix-community/NUR master"
+
+[users.{{user}}.channels]
+home-manager = "github:nix-community/home-manager master"
+
+[users.other.channels]
+emacs = "github:nix-community/emacs-overlay master"
+`)
+
+	sys := faketest.New(map[string]string{
+		"nixos-unstable": strings.Repeat("a", 40),
+		"master":         strings.Repeat("b", 40),
+	})
+
+	if _, err := runTestCommand(t, sys, configPath, "lock"); err != nil {
+		t.Fatal("cannot lock:", err)
+	}
+
+	readInputs := func(lockPath string) []string {
+		t.Helper()
+
+		lock, err := tryReadLockFile(lockPath)
+		if err != nil {
+			t.Fatal("cannot read lock:", err)
+		}
+
+		var inputs []string
+		for input := range lock.Channels {
+			inputs = append(inputs, input.String())
+		}
+		sort.Strings(inputs)
+		return inputs
+	}
+
+	lockPath := trimExt(configPath) + ".lock.json"
+	username := os.Getenv("USER")
+
+	tests := map[string][]string{
+		lockPath: {"github:nix-community/NUR master"},
+		userLockPath(lockPath, username): {
+			"github:NixOS/nixpkgs nixos-unstable",
+			"github:nix-community/home-manager master",
+		},
+		userLockPath(lockPath, "other"): {
+			"github:NixOS/nixpkgs nixos-unstable",
+			"github:nix-community/emacs-overlay master",
+		},
+	}
+
+	for path, want := range tests {
+		if got := readInputs(path); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s has inputs %q, want %q", filepath.Base(path), got, want)
+		}
+	}
+
+	// Reading the state merges the lock files back.
+	var state *stateFiles
+	cmd := &cli.Command{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "config", Value: configPath},
+			&cli.StringFlag{Name: "lock-file"},
+			&cli.StringFlag{Name: "registry-file"},
+		},
+		Action: func(ctx context.Context, cmd *cli.Command) (err error) {
+			state, err = readState(cmd)
+			return err
+		},
+	}
+	if err := cmd.Run(context.Background(), []string{"bonito"}); err != nil {
+		t.Fatal("cannot read state:", err)
+	}
+
+	if len(state.Lock.Channels) != 4 {
+		t.Errorf("merged lock has %d channels, want 4: %v", len(state.Lock.Channels), state.Lock)
+	}
+}
+
+func TestLocalDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nixpkgs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "default.nix"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := writeTestConfig(t, fmt.Sprintf(`
+[global.channels]
+local = %q
+`, dir))
+
+	sys := faketest.New(nil)
+	if _, err := runTestCommand(t, sys, configPath, "-u"); err != nil {
+		t.Fatal("cannot apply:", err)
+	}
+
+	// nix-channel gets the tarball of the directory, not the directory.
+	url := sys.Channels["local"]
+	if !strings.HasPrefix(url, "file:///nix/store/") || !strings.HasSuffix(url, "-nixpkgs.tar.gz") {
+		t.Errorf("local channel has URL %q, want a tarball in the store", url)
+	}
+
+	lock := readTestState(t, configPath).Lock
+	for _, channelLock := range lock.Channels {
+		if channelLock.URL != url {
+			t.Errorf("lock has URL %q, want %q", channelLock.URL, url)
+		}
+	}
+
+	// The tarball has a GC root, since only the lock refers to it.
+	rootsDir := filepath.Join(os.Getenv("HOME"), ".local", "state", "bonito", "gcroots")
+	oldPath := strings.TrimPrefix(url, "file://")
+	oldRoot := filepath.Join(rootsDir, filepath.Base(oldPath))
+	if target, err := os.Readlink(oldRoot); err != nil || target != oldPath {
+		t.Errorf("tarball has no GC root: %q, %v", target, err)
+	}
+
+	// Changing the directory gives a new tarball, so the old one's root is
+	// stale.
+	if err := os.WriteFile(filepath.Join(dir, "default.nix"), []byte("{ }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runTestCommand(t, sys, configPath, "-u"); err != nil {
+		t.Fatal("cannot update:", err)
+	}
+	newPath := strings.TrimPrefix(sys.Channels["local"], "file://")
+	if newPath == oldPath {
+		t.Fatal("changing the directory didn't change the tarball")
+	}
+
+	out, err := runTestCommand(t, sys, configPath, "gc")
+	if err != nil {
+		t.Fatal("cannot gc:", err)
+	}
+	if !strings.HasSuffix(out, "removed 1 stale GC roots\n") {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	if _, err := os.Lstat(oldRoot); !os.IsNotExist(err) {
+		t.Errorf("stale GC root was not removed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(rootsDir, filepath.Base(newPath))); err != nil {
+		t.Errorf("GC root of the locked tarball was removed: %v", err)
+	}
+}
+
+func TestBaseLock(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[users.{{user}}.channels]
+home-manager = "github:nix-community/home-manager master"
+`)
+
+	sys := faketest.New(map[string]string{
+		"nixos-unstable": strings.Repeat("a", 40),
+		"master":         strings.Repeat("b", 40),
+	})
+
+	if _, err := runTestCommand(t, sys, configPath, "lock"); err != nil {
+		t.Fatal("cannot lock:", err)
+	}
+
+	// Share only nixpkgs in the base lock.
+	lockPath := trimExt(configPath) + ".lock.json"
+	base, err := tryReadLockFile(lockPath)
+	if err != nil {
+		t.Fatal("cannot read lock:", err)
+	}
+	for input, lock := range base.Channels {
+		if input.String() != "github:NixOS/nixpkgs nixos-unstable" {
+			delete(base.Channels, input)
+			continue
+		}
+		// The host that wrote the base lock names nixpkgs differently.
+		meta := *lock.Meta
+		meta.Names = []string{"nixos"}
+		lock.Meta = &meta
+		base.Channels[input] = lock
+	}
+
+	// The base lock also has an input that this host doesn't configure.
+	stable, err := bonito.ParseChannelInput("github:NixOS/nixpkgs nixos-24.05")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.Channels[stable] = bonito.ChannelLock{
+		URL:       "https://github.com/NixOS/nixpkgs/archive/" + strings.Repeat("c", 40) + ".tar.gz",
+		StoreHash: "cccccccccccccccccccccccccccccccc",
+		Meta:      &bonito.ChannelLockMeta{Names: []string{"stable"}},
+	}
+
+	basePath := filepath.Join(t.TempDir(), "base.lock.json")
+	if err := os.WriteFile(basePath, []byte(base.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(lockPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Applying drops the names of the inputs that this host doesn't
+	// configure.
+	if _, err := runTestCommand(t, sys, configPath, "--base-lock", basePath); err != nil {
+		t.Fatal("cannot apply with a base lock:", err)
+	}
+
+	hostLock, err := tryReadLockFile(lockPath)
+	if err != nil {
+		t.Fatal("cannot read host lock:", err)
+	}
+	var inputs []string
+	for input := range hostLock.Channels {
+		inputs = append(inputs, input.String())
+	}
+	if want := []string{"github:nix-community/home-manager master"}; !reflect.DeepEqual(inputs, want) {
+		t.Errorf("host lock has inputs %q, want %q", inputs, want)
+	}
+
+	if b, err := os.ReadFile(basePath); err != nil {
+		t.Fatal(err)
+	} else if string(b) != base.String() {
+		t.Errorf("base lock was changed:\n%s", b)
+	}
+
+	// Reading the state layers the host lock on top of the base lock.
+	var state *stateFiles
+	cmd := &cli.Command{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "config", Value: configPath},
+			&cli.StringFlag{Name: "lock-file"},
+			&cli.StringFlag{Name: "base-lock", Value: basePath},
+			&cli.StringFlag{Name: "registry-file"},
+		},
+		Action: func(ctx context.Context, cmd *cli.Command) (err error) {
+			state, err = readState(cmd)
+			return err
+		},
+	}
+	if err := cmd.Run(context.Background(), []string{"bonito"}); err != nil {
+		t.Fatal("cannot read state:", err)
+	}
+
+	if len(state.Lock.Channels) != 3 {
+		t.Errorf("layered lock has %d channels, want 3: %v", len(state.Lock.Channels), state.Lock)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`)
+
+	const rev = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	sys := faketest.New(map[string]string{
+		"nixos-unstable": rev,
+		"master":         strings.Repeat("b", 40),
+	})
+
+	if _, err := runTestCommand(t, sys, configPath, "lock"); err != nil {
+		t.Fatal("cannot lock:", err)
+	}
+
+	out, err := runTestCommand(t, sys, configPath, "diff")
+	if err != nil {
+		t.Fatal("cannot diff:", err)
+	}
+	if out != "no changes\n" {
+		t.Errorf("unexpected diff of an unchanged lock:\n%s", out)
+	}
+
+	configBody, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configBody = append(configBody, "\n[flakes.channels]\nnur = \"github:nix-community/NUR master\"\n"...)
+	if err := os.WriteFile(configPath, configBody, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = runTestCommand(t, sys, configPath, "diff")
+	if err != nil {
+		t.Fatal("cannot diff:", err)
+	}
+	const want = "+ github:nix-community/NUR master https://github.com/nix-community/NUR/archive/bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb.tar.gz\n"
+	if out != want {
+		t.Errorf("diff = %q, want %q", out, want)
+	}
+
+	out, err = runTestCommand(t, sys, configPath, "diff", "--json")
+	if err != nil {
+		t.Fatal("cannot diff:", err)
+	}
+
+	var diffs []bonito.LockDiff
+	if err := json.Unmarshal([]byte(out), &diffs); err != nil {
+		t.Fatal("cannot decode JSON diff:", err)
+	}
+	if len(diffs) != 1 || diffs[0].Action != bonito.ChangeAdd {
+		t.Errorf("unexpected JSON diff %+v", diffs)
+	}
+
+	// Diffing must not touch the lock file.
+	if len(readTestState(t, configPath).Lock.Channels) != 1 {
+		t.Error("diff changed the lock file")
+	}
+}
+
+func TestConfigDir(t *testing.T) {
+	refs := map[string]string{
+		"nixos-23.11": strings.Repeat("a", 40),
+		"nixos-24.05": strings.Repeat("b", 40),
+		"master":      strings.Repeat("c", 40),
+	}
+
+	// Split the usual test config into a fragment of its global table and a
+	// fragment of the channels.
+	configPath := writeTestConfig(t, "")
+	base, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(filepath.Dir(configPath), "host.d")
+	fragments := map[string]string{
+		"00-base.toml": string(base),
+		"10-nixpkgs.toml": `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-23.11"
+`,
+		"20-hm.toml": `
+[global.channels]
+home-manager = "github:nix-community/home-manager master"
+`,
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range fragments {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sys := faketest.New(refs)
+	if _, err := runTestCommand(t, sys, configPath, "--config-dir", dir, "bump", "nixpkgs", "nixos-24.05"); err != nil {
+		t.Fatal("cannot bump:", err)
+	}
+
+	for name, want := range map[string]string{
+		"10-nixpkgs.toml": `nixpkgs = "github:NixOS/nixpkgs nixos-24.05"`,
+		"20-hm.toml":      `home-manager = "github:nix-community/home-manager master"`,
+	} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), want) {
+			t.Errorf("fragment %q does not contain %q:\n%s", name, want, b)
+		}
+	}
+
+	state := readTestState(t, dir)
+	if len(state.Config.Global.Channels) != 2 {
+		t.Errorf("merged config has channels %v, want 2", state.Config.Global.Channels)
+	}
+
+	input := state.Config.Global.Channels["nixpkgs"]
+	if _, ok := state.Lock.Channels[input]; !ok {
+		t.Errorf("lock next to the config directory has no entry for %q", input)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+
+[global.aliases]
+unstable = "nixpkgs"
+
+[users.{{user}}.channels]
+home-manager = "github:nix-community/home-manager master"
+
+[users.{{user}}.aliases]
+nixos = "nixpkgs"
+hm = "home-manager"
+
+[users.bonito-someone-else.channels]
+private = "github:corp/private main"
+`)
+
+	t.Run("channels", func(t *testing.T) {
+		for _, args := range [][]string{
+			{"--generate-shell-completion"},
+			{"store-path", "--generate-shell-completion"},
+		} {
+			out, err := runTestCommand(t, faketest.New(nil), configPath, args...)
+			if err != nil {
+				t.Fatalf("cannot complete %q: %v", args, err)
+			}
+
+			lines := strings.Split(out, "\n")
+			for _, name := range []string{"hm", "home-manager", "nixos", "nixpkgs", "unstable"} {
+				if !slices.Contains(lines, name) {
+					t.Errorf("completions of %q are missing channel %q:\n%s", args, name, out)
+				}
+			}
+			// Channels of other users are not the current user's.
+			if slices.Contains(lines, "private") {
+				t.Errorf("completions of %q have another user's channel:\n%s", args, out)
+			}
+		}
+	})
+
+	t.Run("scripts", func(t *testing.T) {
+		for _, shell := range []string{"bash", "zsh", "fish"} {
+			out, err := runTestCommand(t, faketest.New(nil), configPath, "completion", shell)
+			if err != nil {
+				t.Fatalf("cannot generate %s completion: %v", shell, err)
+			}
+			if !strings.Contains(out, "bonito") {
+				t.Errorf("%s completion does not mention bonito:\n%s", shell, out)
+			}
+		}
+
+		if _, err := runTestCommand(t, faketest.New(nil), configPath, "completion", "tcsh"); err == nil {
+			t.Error("generating completion for an unknown shell succeeded")
+		}
+	})
+}
+
+func TestDaemonLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runs := make(chan struct{})
+	d := newDaemon(time.Hour, func(ctx context.Context) ([]string, error) {
+		runs <- struct{}{}
+		return nil, nil
+	})
+
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		d.loop(ctx, ticks)
+		close(done)
+	}()
+
+	// The first run happens right away, then once per tick.
+	<-runs
+	ticks <- time.Now()
+	<-runs
+
+	cancel()
+	<-done
+
+	select {
+	case <-runs:
+		t.Error("ran after being stopped")
+	default:
+	}
+}
+
+func TestDaemonStatus(t *testing.T) {
+	var runErr error
+	d := newDaemon(time.Hour, func(ctx context.Context) ([]string, error) {
+		if runErr != nil {
+			return []string{"nixpkgs"}, runErr
+		}
+		return nil, nil
+	})
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	readStatus := func() daemonStatus {
+		t.Helper()
+		code, body := get("/status")
+		if code != http.StatusOK {
+			t.Fatalf("unexpected status code %d", code)
+		}
+		var status daemonStatus
+		if err := json.Unmarshal([]byte(body), &status); err != nil {
+			t.Fatal("invalid status JSON:", err)
+		}
+		return status
+	}
+
+	if status := readStatus(); status.LastRun != nil || status.Outcome != "" {
+		t.Errorf("unexpected status before the first run: %+v", status)
+	}
+
+	d.tick(context.Background())
+
+	status := readStatus()
+	if status.LastRun == nil || status.Outcome != "ok" || len(status.Pending) != 0 {
+		t.Errorf("unexpected status after a run: %+v", status)
+	}
+	if want := status.LastRun.Add(time.Hour); !status.NextRun.Equal(want) {
+		t.Errorf("next run is %v, want %v", status.NextRun, want)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("unhealthy after a successful run: %d", code)
+	}
+
+	runErr = errors.New("cannot update")
+	d.tick(context.Background())
+
+	status = readStatus()
+	if status.Outcome != "error" || status.Error != "cannot update" || !reflect.DeepEqual(status.Pending, []string{"nixpkgs"}) {
+		t.Errorf("unexpected status after a failed run: %+v", status)
+	}
+	if code, body := get("/healthz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "cannot update") {
+		t.Errorf("unexpected health after a failed run: %d %q", code, body)
+	}
+}
+
+func TestDaemonRun(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`)
+
+	sys := faketest.New(map[string]string{"nixos-unstable": strings.Repeat("a", 40)})
+	if _, err := runTestCommand(t, sys, configPath, "-u"); err != nil {
+		t.Fatal("cannot update:", err)
+	}
+	sys.Refs["nixos-unstable"] = strings.Repeat("b", 40)
+
+	var pending [][]string
+	cmd := newCommand()
+	cmd.ExitErrHandler = nil
+	cmd.Writer = io.Discard
+	cmd.ErrWriter = io.Discard
+	for _, c := range cmd.Commands {
+		if c.Name == "daemon" {
+			c.Action = func(ctx context.Context, cmd *cli.Command) error {
+				for _, checkOnly := range []bool{true, false} {
+					p, err := daemonRun(ctx, cmd, checkOnly)
+					if err != nil {
+						return err
+					}
+					pending = append(pending, p)
+				}
+				return nil
+			}
+		}
+	}
+
+	ctx := bonito.WithCommandRunner(context.Background(), sys.Run)
+	if err := cmd.Run(ctx, []string{"bonito", "--no-color", "-c", configPath, "daemon"}); err != nil {
+		t.Fatal("cannot run daemon:", err)
+	}
+
+	if want := [][]string{{"nixpkgs"}, nil}; !reflect.DeepEqual(pending, want) {
+		t.Errorf("unexpected pending channels %q, want %q", pending, want)
+	}
+
+	input := bonito.ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	if rev := readTestState(t, configPath).Lock.Channels[input].Rev(); rev != strings.Repeat("b", 40) {
+		t.Errorf("daemon did not update the lock, got %q", rev)
+	}
+}
+
+func TestWriteUserFile(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("cannot get current user:", err)
+	}
+
+	dst := filepath.Join(t.TempDir(), ".config", "nix", "registry.json")
+	if err := writeUserFile([]byte("{}"), u.Username, dst); err != nil {
+		t.Fatal("cannot write user file:", err)
+	}
+
+	stat, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := stat.Mode().Perm(); perm != 0644 {
+		t.Errorf("user file has mode %v, want 0644", perm)
+	}
+}
+
+func TestWriteOwnedFile(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+
+	t.Run("symlink destination", func(t *testing.T) {
+		home := t.TempDir()
+
+		secret := filepath.Join(t.TempDir(), "shadow")
+		if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		dir := filepath.Join(home, ".config", "nix")
+		if err := makeUserDirs(home, dir, uid, gid); err != nil {
+			t.Fatal("cannot make directories:", err)
+		}
+		dst := filepath.Join(dir, "registry.json")
+		if err := os.Symlink(secret, dst); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := writeOwnedFile([]byte("{}"), dst, 0644, uid, gid); err != nil {
+			t.Fatal("cannot write file:", err)
+		}
+
+		// The symlink is replaced, and the file it pointed to is untouched.
+		if stat, err := os.Lstat(dst); err != nil || !stat.Mode().IsRegular() || stat.Mode().Perm() != 0644 {
+			t.Errorf("destination is not a 0644 regular file: %v, %v", stat.Mode(), err)
+		}
+		if stat, err := os.Stat(secret); err != nil || stat.Mode().Perm() != 0600 {
+			t.Errorf("symlink target mode changed: %v, %v", stat.Mode(), err)
+		}
+		if b, _ := os.ReadFile(secret); string(b) != "secret" {
+			t.Errorf("symlink target was overwritten with %q", b)
+		}
+	})
+
+	t.Run("symlinked directory", func(t *testing.T) {
+		home := t.TempDir()
+		elsewhere := t.TempDir()
+
+		if err := os.Symlink(elsewhere, filepath.Join(home, ".config")); err != nil {
+			t.Fatal(err)
+		}
+
+		err := makeUserDirs(home, filepath.Join(home, ".config", "nix"), uid, gid)
+		if err == nil || !strings.Contains(err.Error(), "refusing to write through the symlink") {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if entries, _ := os.ReadDir(elsewhere); len(entries) > 0 {
+			t.Errorf("directories were made through the symlink: %v", entries)
+		}
+	})
+}
+
+func TestRotateBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "host.lock.json")
+
+	write := func(content string) {
+		t.Helper()
+		if err := rotateBackups(path, []byte(content), 2); err != nil {
+			t.Fatal("cannot rotate backups:", err)
+		}
+		if err := writeToFile([]byte(content), path); err != nil {
+			t.Fatal("cannot write lock:", err)
+		}
+	}
+
+	for _, content := range []string{"1", "2", "2", "3", "4"} {
+		write(content)
+	}
+
+	want := map[string]string{
+		path:        "4",
+		path + ".1": "3",
+		path + ".2": "2",
+	}
+	for path, content := range want {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("%s has %q, want %q", filepath.Base(path), b, content)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("backup past lock_backups is kept: %v", err)
+	}
+}
+
+func TestVerifyRemote(t *testing.T) {
+	configPath := writeTestConfig(t, `
+[global.channels]
+nixpkgs = "github:NixOS/nixpkgs nixos-unstable"
+`)
+
+	input := bonito.ChannelInput{URL: "github:NixOS/nixpkgs", Version: "nixos-unstable"}
+	locked := strings.Repeat("a", 40)
+
+	// The locked channel isn't in the store, which the remote check doesn't
+	// need.
+	writeTestLock(t, configPath, bonito.LockFile{Channels: map[bonito.ChannelInput]bonito.ChannelLock{
+		input: {
+			URL:       "https://github.com/NixOS/nixpkgs/archive/" + locked + ".tar.gz",
+			StoreHash: "0c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd",
+			StorePath: "/nix/store/0c5ygbzsqvh56fcmyfcz7vbdq1x2mrjd-source",
+			Meta: &bonito.ChannelLockMeta{
+				Ref: "refs/heads/nixos-unstable",
+				Rev: locked,
+			},
+		},
+	}})
+
+	sys := faketest.New(map[string]string{"nixos-unstable": locked})
+	if _, err := runTestCommand(t, sys, configPath, "verify", "--remote"); err != nil {
+		t.Fatal("cannot verify unmoved ref:", err)
+	}
+
+	delete(sys.Refs, "nixos-unstable")
+	_, err := runTestCommand(t, sys, configPath, "verify", "--remote")
+	if err == nil || !strings.Contains(err.Error(), "no longer point to their locked revisions") {
+		t.Fatalf("unexpected error for deleted ref: %v", err)
+	}
+
+	if _, err := runTestCommand(t, sys, configPath, "verify"); err == nil {
+		t.Error("channel missing from the store was verified")
+	}
+}
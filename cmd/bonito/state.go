@@ -1,9 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"os"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/diamondburned/nix-bonito/bonito"
 	"github.com/pkg/errors"
@@ -13,12 +21,26 @@ import (
 type stateFiles struct {
 	bonito.State
 	lockPath     string
+	baseLock     bonito.LockFile
 	configPath   string
 	registryPath string
+	stdout       io.Writer
+}
+
+// stdioPath is the path that means stdout when used as the lock file path.
+const stdioPath = "-"
+
+// configFlag returns the path of the config file or directory given on the
+// command line.
+func configFlag(cmd *cli.Command) string {
+	if dir := cmd.String("config-dir"); dir != "" {
+		return dir
+	}
+	return cmd.String("config")
 }
 
 func readState(cmd *cli.Command) (*stateFiles, error) {
-	configPath := cmd.String("config")
+	configPath := configFlag(cmd)
 
 	// Resolve configPath to an absolute path so that symlinks are resolved.
 	var err error
@@ -30,15 +52,57 @@ func readState(cmd *cli.Command) (*stateFiles, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot read config file")
 	}
+	config.ResolvePatchPaths(configDir(configPath))
+	config.ResolveSecretPaths(configDir(configPath))
+
+	if err := checkStrict(cmd, config); err != nil {
+		return nil, err
+	}
 
 	lockPath := cmd.String("lock-file")
 	if lockPath == "" {
 		lockPath = trimExt(configPath) + ".lock.json"
 	}
 
-	lockFile, err := tryReadLockFile(lockPath)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot read lock file")
+	var baseLock bonito.LockFile
+	if basePath := cmd.String("base-lock"); basePath != "" {
+		baseLock, err = readBaseLockFile(basePath)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read base lock file")
+		}
+	}
+
+	var lockFile bonito.LockFile
+	// Writing the lock to stdout means that we start from an empty lock.
+	if lockPath != stdioPath {
+		lockFile, err = tryReadLockFile(lockPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read lock file")
+		}
+
+		if config.Global.PerUserLocks {
+			usernames := make([]string, 0, len(config.Users))
+			for username := range config.Users {
+				usernames = append(usernames, username)
+			}
+			sort.Strings(usernames)
+
+			for _, username := range usernames {
+				userLock, err := tryReadLockFile(userLockPath(lockPath, username))
+				if err != nil {
+					return nil, errors.Wrapf(err, "cannot read lock file of user %q", username)
+				}
+				lockFile.Merge(userLock)
+			}
+		}
+	}
+
+	if baseLock.Channels != nil {
+		// Layer the host lock on top of a copy of the base lock.
+		merged := bonito.LockFile{Version: lockFile.Version}
+		merged.Update(baseLock)
+		merged.Update(lockFile)
+		lockFile = merged
 	}
 
 	registryPath := cmd.String("registry-file")
@@ -52,8 +116,10 @@ func readState(cmd *cli.Command) (*stateFiles, error) {
 			Lock:   lockFile,
 		},
 		lockPath:     lockPath,
+		baseLock:     baseLock,
 		configPath:   configPath,
 		registryPath: registryPath,
+		stdout:       cmd.Root().Writer,
 	}, nil
 }
 
@@ -77,7 +143,32 @@ func tryReadLockFile(lockPath string) (bonito.LockFile, error) {
 	return bonito.NewLockFileFromReader(f)
 }
 
+// readBaseLockFile reads the --base-lock file. Unlike the lock file, it must
+// exist, since bonito never writes it.
+func readBaseLockFile(path string) (bonito.LockFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return bonito.LockFile{}, err
+	}
+	defer f.Close()
+
+	lock, err := bonito.NewLockFileFromReader(f)
+	if err != nil {
+		return bonito.LockFile{}, err
+	}
+	if lock.Channels == nil {
+		lock.Channels = make(map[bonito.ChannelInput]bonito.ChannelLock)
+	}
+	return lock, nil
+}
+
+// readConfigFile reads the config file at configPath. If configPath is a
+// directory, then the config fragments in it are merged.
 func readConfigFile(configPath string) (bonito.Config, error) {
+	if isDir(configPath) {
+		return bonito.NewConfigFromDir(configPath)
+	}
+
 	f, err := os.Open(configPath)
 	if err != nil {
 		return bonito.Config{}, errors.Wrap(err, "cannot open config file")
@@ -87,17 +178,360 @@ func readConfigFile(configPath string) (bonito.Config, error) {
 	return bonito.NewConfigFromReader(f)
 }
 
+// configDir returns the directory that paths in the config at configPath are
+// relative to.
+func configDir(configPath string) string {
+	if isDir(configPath) {
+		return configPath
+	}
+	return filepath.Dir(configPath)
+}
+
+func isDir(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.IsDir()
+}
+
+// saveLockFile writes the lock file. With --base-lock, only the locks of the
+// configured inputs that differ from the base lock are written.
 func (s stateFiles) saveLockFile() error {
-	return writeToFile([]byte(s.Lock.String()), s.lockPath)
+	lock := s.Lock
+	if s.baseLock.Channels != nil {
+		lock = lock.Overlay(s.baseLock, s.Config)
+	}
+
+	if s.lockPath == stdioPath {
+		_, err := fmt.Fprintln(s.stdout, lock.String())
+		return err
+	}
+	if !s.Config.Global.PerUserLocks {
+		return s.writeLockFile(lock, s.lockPath)
+	}
+
+	rest, users, err := lock.SplitUsers(s.Config)
+	if err != nil {
+		return errors.Wrap(err, "cannot split lock file by user")
+	}
+
+	for username, userLock := range users {
+		if err := s.writeLockFile(userLock, userLockPath(s.lockPath, username)); err != nil {
+			return errors.Wrapf(err, "cannot write lock file of user %q", username)
+		}
+	}
+
+	return s.writeLockFile(rest, s.lockPath)
+}
+
+// writeLockFile writes the lock to the given path, first rotating the lock
+// file that it replaces into the backups if global.lock_backups is set.
+func (s stateFiles) writeLockFile(lock bonito.LockFile, path string) error {
+	b := []byte(lock.String())
+
+	if err := rotateBackups(path, b, s.Config.Global.LockBackups); err != nil {
+		return errors.Wrap(err, "cannot back up lock file")
+	}
+
+	return writeToFile(b, path)
+}
+
+// rotateBackups moves the file at path to path.1, path.1 to path.2 and so on,
+// dropping the oldest backup past n. Nothing is rotated if there is no file
+// yet or it already has the given contents, so that the backups are always
+// different versions.
+func rotateBackups(path string, b []byte, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	old, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if bytes.Equal(old, b) {
+		return nil
+	}
+
+	backupPath := func(i int) string { return path + "." + strconv.Itoa(i) }
+
+	for i := n - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(i), backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Copy instead of renaming, so that the lock file stays in place if
+	// writing the new one fails.
+	return writeToFile(old, backupPath(1))
 }
 
+// saveState writes the files of the applied state: the flakes registry if
+// flakes are enabled, the --profile-output file if given, and the lock file.
+func saveState(cmd *cli.Command, s *stateFiles) error {
+	if s.Config.Flakes.Enable {
+		if err := s.saveNixRegistryFile(); err != nil {
+			return errors.Wrap(err, "cannot save nix registry file")
+		}
+	}
+
+	if err := saveNixProfileFile(cmd, s); err != nil {
+		return errors.Wrap(err, "cannot save nix profile file")
+	}
+
+	if err := s.saveLockFile(); err != nil {
+		return errors.Wrap(err, "cannot save lock file")
+	}
+
+	return nil
+}
+
+// lockModTime returns the modification time of the lock file, or the zero
+// time if there is no lock file yet.
+func (s stateFiles) lockModTime() time.Time {
+	if s.lockPath == stdioPath {
+		return time.Time{}
+	}
+	stat, err := os.Stat(s.lockPath)
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
+
+// setLockModTime sets the modification time of the lock file.
+func (s stateFiles) setLockModTime(t time.Time) error {
+	if s.lockPath == stdioPath {
+		return nil
+	}
+	return os.Chtimes(s.lockPath, time.Time{}, t)
+}
+
+// userLockPath returns the path of the given user's lock file when per-user
+// locks are enabled, e.g. host.alice.lock.json for host.lock.json.
+func userLockPath(lockPath, username string) string {
+	return strings.TrimSuffix(lockPath, ".lock.json") + "." + username + ".lock.json"
+}
+
+// saveNixRegistryFile writes the flakes registry, and if flakes.per_user is
+// set, the user registry of each user.
 func (s stateFiles) saveNixRegistryFile() error {
 	registryJSON, err := s.GenerateNixRegistry()
 	if err != nil {
 		return errors.Wrap(err, "cannot generate flakes registry")
 	}
 
-	return writeToFile(registryJSON, s.registryPath)
+	if err := writeToFile(registryJSON, s.registryPath); err != nil {
+		return err
+	}
+
+	if !s.Config.Flakes.PerUser {
+		return nil
+	}
+
+	usernames := make([]string, 0, len(s.Config.Users))
+	for username := range s.Config.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		if err := s.saveUserNixRegistryFile(username); err != nil {
+			return errors.Wrapf(err, "cannot save registry of user %q", username)
+		}
+	}
+
+	return nil
+}
+
+// saveUserNixRegistryFile writes the user registry of the given user into
+// their ~/.config/nix/registry.json, where Nix reads it from.
+func (s stateFiles) saveUserNixRegistryFile(username string) error {
+	registryJSON, err := s.GenerateUserNixRegistry(username)
+	if err != nil {
+		return errors.Wrap(err, "cannot generate flakes registry")
+	}
+
+	configDir, err := userConfigDir(username)
+	if err != nil {
+		return err
+	}
+
+	return writeUserFile(registryJSON, username, filepath.Join(configDir, "nix", "registry.json"))
+}
+
+// userConfigDir returns the configuration directory of the given user. For
+// the current user, this respects $XDG_CONFIG_HOME like Nix does.
+func userConfigDir(username string) (string, error) {
+	if current, err := user.Current(); err == nil && current.Username == username {
+		return os.UserConfigDir()
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot look up user %q", username)
+	}
+	return filepath.Join(u.HomeDir, ".config"), nil
+}
+
+// writeUserFile writes the file into the given user's home. If they are not
+// the current user, e.g. when bonito runs as root, then the file and the
+// directories that are created for it are given to them. Since the user
+// controls their home, nothing is done through a path that they could have
+// replaced with a symlink.
+func writeUserFile(b []byte, username, dst string) error {
+	current, err := user.Current()
+	if err != nil {
+		return errors.Wrap(err, "cannot get current user")
+	}
+	if current.Username == username {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return errors.Wrap(err, "cannot make directory")
+		}
+		return writeOwnedFile(b, dst, 0644, -1, -1)
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return errors.Wrapf(err, "cannot look up user %q", username)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return errors.Wrapf(err, "invalid uid of user %q", username)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return errors.Wrapf(err, "invalid gid of user %q", username)
+	}
+
+	if err := makeUserDirs(u.HomeDir, filepath.Dir(dst), uid, gid); err != nil {
+		return err
+	}
+	return writeOwnedFile(b, dst, 0644, uid, gid)
+}
+
+// makeUserDirs makes the directories from home down to dir that don't exist
+// yet and gives them to the user. It refuses to go through a symlink below
+// home, since the user could point it anywhere.
+func makeUserDirs(home, dir string, uid, gid int) error {
+	rel, err := filepath.Rel(home, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("%s is not in the home directory %s", dir, home)
+	}
+
+	path := home
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if name == "." {
+			continue
+		}
+		path = filepath.Join(path, name)
+
+		stat, err := os.Lstat(path)
+		switch {
+		case os.IsNotExist(err):
+			// Mkdir fails instead of following a symlink that was made in
+			// the meantime.
+			if err := os.Mkdir(path, 0755); err != nil {
+				return errors.Wrap(err, "cannot make directory")
+			}
+			d, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+			if err != nil {
+				return errors.Wrap(err, "cannot open new directory")
+			}
+			err = d.Chown(uid, gid)
+			d.Close()
+			if err != nil {
+				return errors.Wrapf(err, "cannot give %s to its user", path)
+			}
+		case err != nil:
+			return err
+		case stat.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("refusing to write through the symlink %s", path)
+		case !stat.IsDir():
+			return fmt.Errorf("%s is not a directory", path)
+		}
+	}
+
+	return nil
+}
+
+// writeOwnedFile atomically writes a file with the given mode to dst, owned
+// by the given user unless uid is -1. The mode and owner are set on the
+// temporary file before it replaces dst, and replacing a symlink at dst
+// replaces the symlink itself instead of the file it points to.
+func writeOwnedFile(b []byte, dst string, mode os.FileMode, uid, gid int) error {
+	tmp := filepath.Join(filepath.Dir(dst), fmt.Sprintf(".tmp.bonito.%d.%s", os.Getpid(), filepath.Base(dst)))
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return errors.Wrap(err, "cannot make temporary file")
+	}
+	defer f.Close()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(b); err != nil {
+		return errors.Wrap(err, "cannot write to temporary file")
+	}
+	if err := f.Chmod(mode); err != nil {
+		return errors.Wrap(err, "cannot set the mode of the file")
+	}
+	if uid != -1 {
+		if err := f.Chown(uid, gid); err != nil {
+			return errors.Wrap(err, "cannot give file to its user")
+		}
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "cannot write to temporary file")
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		return errors.Wrap(err, "cannot commit file")
+	}
+
+	return nil
+}
+
+// replaceFile atomically replaces the existing file at dst, which may be a
+// symlink to it, while keeping its mode and owner.
+func replaceFile(b []byte, dst string) error {
+	dst, err := filepath.EvalSymlinks(dst)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+
+	uid, gid := -1, -1
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && (int(st.Uid) != os.Getuid() || int(st.Gid) != os.Getgid()) {
+		uid, gid = int(st.Uid), int(st.Gid)
+	}
+
+	return writeOwnedFile(b, dst, fi.Mode().Perm(), uid, gid)
+}
+
+// saveNixProfileFile writes the Nix expression of the current user's channels
+// to the --profile-output path, if it is given.
+func saveNixProfileFile(cmd *cli.Command, s *stateFiles) error {
+	profilePath := cmd.String("profile-output")
+	if profilePath == "" {
+		return nil
+	}
+
+	username, err := currentUsername(cmd)
+	if err != nil {
+		return err
+	}
+
+	profile, err := s.GenerateNixProfile(username)
+	if err != nil {
+		return errors.Wrap(err, "cannot generate nix profile")
+	}
+
+	return writeToFile(profile, profilePath)
 }
 
 func writeToFile(b []byte, dst string) error {
@@ -0,0 +1,216 @@
+// Package faketest fakes the external commands that bonito runs, so that
+// tests can run without Nix, Git or the network.
+package faketest
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// DefaultStoreDir is the store directory that fake store paths are in if
+// System.StoreDir is empty.
+const DefaultStoreDir = "/nix/store"
+
+// System fakes the external commands that bonito runs: nix-channel,
+// nix-store, nix-hash, readlink, patch and git. Channels are kept in memory
+// and linked into ~/.nix-defexpr on update, and every channel URL maps to a
+// fake but valid store path.
+//
+// The zero value fakes a system without channels or Git refs. Run can be used
+// as a command runner.
+type System struct {
+	// StoreDir is the store directory that fake store paths are in. If it
+	// is empty, then DefaultStoreDir is used.
+	StoreDir string
+	// Channels maps the name of each channel to its URL.
+	Channels map[string]string
+	// Refs maps the Git branches that git ls-remote knows of to their
+	// commits.
+	Refs map[string]string
+	// FailAdds contains the names of the channels that fail to be added.
+	FailAdds map[string]bool
+	// Calls contains the arguments of every command that was run.
+	Calls [][]string
+
+	mu sync.Mutex
+}
+
+// New creates a new System without channels that knows of the given Git refs.
+func New(refs map[string]string) *System {
+	return &System{
+		Channels: make(map[string]string),
+		Refs:     refs,
+	}
+}
+
+// Link links every channel into ~/.nix-defexpr/channels like nix-channel
+// --update does, but without going through Run.
+func (s *System) Link() error {
+	dir := filepath.Join(os.Getenv("HOME"), ".nix-defexpr", "channels")
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, url := range s.Channels {
+		if err := os.Symlink(s.SourcePath(url, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run runs the given command in the fake system.
+func (s *System) Run(cmd *exec.Cmd) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Calls = append(s.Calls, cmd.Args)
+
+	stdout := cmd.Stdout
+	if stdout == nil {
+		stdout = io.Discard
+	}
+
+	args := cmd.Args
+	switch args[0] {
+	case "nix-channel":
+		switch args[1] {
+		case "--list":
+			for name, url := range s.Channels {
+				fmt.Fprintf(stdout, "%s %s\n", name, url)
+			}
+		case "--add":
+			if s.FailAdds[args[3]] {
+				return fmt.Errorf("cannot add channel %q", args[3])
+			}
+			if s.Channels == nil {
+				s.Channels = make(map[string]string)
+			}
+			s.Channels[args[3]] = args[2]
+		case "--remove":
+			delete(s.Channels, args[2])
+		case "--update":
+			// Like nix-channel, link the channels into ~/.nix-defexpr for
+			// the current user. Other users read them using readlink.
+			if err := s.Link(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected nix-channel args %q", args)
+		}
+	case "readlink":
+		name := filepath.Base(args[1])
+		url, ok := s.Channels[name]
+		if !ok {
+			return fmt.Errorf("no channel %q", name)
+		}
+		fmt.Fprintln(stdout, s.SourcePath(url, name))
+	case "patch":
+		// Record the applied patch into the source, like patch(1) would.
+		dir, patch := args[len(args)-3], args[len(args)-1]
+		b, err := os.ReadFile(patch)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(dir, "PATCHES"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+	case "nix-store":
+		switch {
+		case args[1] == "--add":
+			// Like nix-store, name the store path after the added file.
+			b, err := os.ReadFile(args[len(args)-1])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(stdout, s.StorePath(string(b), filepath.Base(args[len(args)-1])))
+		case args[1] == "--realise" && args[3] == "--add-root":
+			// Register the GC root like nix-store --add-root would, which
+			// replaces an existing one.
+			os.Remove(args[4])
+			return os.Symlink(args[2], args[4])
+		default:
+			return fmt.Errorf("unexpected nix-store args %q", args)
+		}
+	case "nix-hash":
+		// Channel sources are named after their channel, and their
+		// contents are those of the channel's URL.
+		name := filepath.Base(args[len(args)-1])
+		url, ok := s.Channels[name]
+		if !ok {
+			return fmt.Errorf("no channel %q", name)
+		}
+		fmt.Fprintln(stdout, SourceHash(url))
+	case "git":
+		// Like git ls-remote, print the branches that match the patterns
+		// after the remote, and nothing for unknown ones.
+		i := slices.Index(args, "ls-remote")
+		if i == -1 {
+			return fmt.Errorf("unexpected git args %q", args)
+		}
+		for i++; i < len(args) && strings.HasPrefix(args[i], "-"); i++ {
+		}
+		for _, pattern := range args[i+1:] {
+			ref := strings.TrimPrefix(pattern, "refs/heads/")
+			if commit, ok := s.Refs[ref]; ok {
+				fmt.Fprintf(stdout, "%s\trefs/heads/%s\n", commit, ref)
+			}
+		}
+	default:
+		return fmt.Errorf("unexpected command %q", args)
+	}
+
+	return nil
+}
+
+// StorePath returns the fake store path of the given contents added to the
+// store under the given name.
+func (s *System) StorePath(contents, name string) string {
+	storeDir := s.StoreDir
+	if storeDir == "" {
+		storeDir = DefaultStoreDir
+	}
+	return filepath.Join(storeDir, StoreHash(contents)+"-"+name)
+}
+
+// SourcePath returns the fake source path of the channel with the given name
+// and URL, which is what its symlink in ~/.nix-defexpr points to. Like
+// nix-channel, the sources are in a directory named after the channel within
+// the store path, so the store path differs between channels of the same URL.
+func (s *System) SourcePath(url, name string) string {
+	return filepath.Join(s.StorePath(url+"\x00"+name, name), name)
+}
+
+// StoreHash deterministically turns the given string into a valid nixbase32
+// store hash.
+func StoreHash(s string) string {
+	const alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+	sum := sha256.Sum256([]byte(s))
+	hash := make([]byte, 32)
+	for i := range hash {
+		hash[i] = alphabet[sum[i]%32]
+	}
+	return string(hash)
+}
+
+// SourceHash returns the fake NAR hash of the sources at the given URL, as
+// nix-hash --type sha256 --base32 prints it.
+func SourceHash(url string) string {
+	hash := StoreHash(url)
+	return hash + hash[:20]
+}